@@ -0,0 +1,887 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avestuk/kubecuttle/pkg/apply"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/version"
+	"sigs.k8s.io/yaml"
+)
+
+// fakeResource is a kind served by fakeAPIServer.
+type fakeResource struct {
+	gvk        schema.GroupVersionKind
+	resource   string
+	namespaced bool
+}
+
+// fakeResources are the kinds fakeAPIServer serves.
+var fakeResources = []fakeResource{
+	{gvk: schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, resource: "namespaces"},
+	{gvk: schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, resource: "pods", namespaced: true},
+	{gvk: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, resource: "configmaps", namespaced: true},
+	{gvk: schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, resource: "secrets", namespaced: true},
+	{gvk: schema.GroupVersionKind{Version: "v1", Kind: "Service"}, resource: "services", namespaced: true},
+	{gvk: schema.GroupVersionKind{Version: "v1", Kind: "ServiceAccount"}, resource: "serviceaccounts", namespaced: true},
+	{gvk: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, resource: "deployments", namespaced: true},
+	{gvk: schema.GroupVersionKind{Group: "coordination.k8s.io", Version: "v1", Kind: "Lease"}, resource: "leases", namespaced: true},
+}
+
+// fakeObjectKey identifies an object stored by fakeAPIServer.
+type fakeObjectKey struct {
+	resource, namespace, name string
+}
+
+// fakeAPIServer is an in-process stand in for a cluster's API server, so
+// tests that apply objects can run offline. It serves discovery and the
+// version, and gets, lists, creates, updates, deletes and server side
+// applies the kinds in fakeResources.
+//
+// Applies are validated against the bundled schemas and record which
+// manager owns each field in managedFields. Lists are atomic and fields are
+// only tracked for applies, which is enough to see conflicts between
+// managers and fields a manager stops applying being removed.
+type fakeAPIServer struct {
+	mu              sync.Mutex
+	validator       *validator
+	objects         map[fakeObjectKey]*unstructured.Unstructured
+	owners          map[fakeObjectKey]map[string]map[string]bool
+	resourceVersion int
+}
+
+// newFakeAPIServer returns a server with the default, kube-system and
+// sre-test namespaces and a couple of pods in kube-system.
+func newFakeAPIServer() *fakeAPIServer {
+	s := &fakeAPIServer{
+		validator: newValidator(bundledSchemaSource()),
+		objects:   map[fakeObjectKey]*unstructured.Unstructured{},
+		owners:    map[fakeObjectKey]map[string]map[string]bool{},
+	}
+
+	for _, ns := range []string{"default", "kube-system", "sre-test"} {
+		s.seed(fakeResources[0], &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata":   map[string]interface{}{"name": ns},
+		}})
+	}
+	for _, name := range []string{"coredns", "kube-proxy"} {
+		s.seed(fakeResources[1], &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "kube-system"},
+			"spec": map[string]interface{}{
+				"containers": []interface{}{map[string]interface{}{"name": name, "image": name}},
+			},
+		}})
+	}
+
+	return s
+}
+
+// startFakeAPIServer starts a fakeAPIServer and points KUBECONFIG at it
+// until the test ends.
+func startFakeAPIServer(t *testing.T) *fakeAPIServer {
+	s := newFakeAPIServer()
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	contents := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: %s
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: fake
+current-context: fake
+users:
+- name: fake
+  user: {}
+`, server.URL)
+	require.NoError(t, ioutil.WriteFile(kubeconfig, []byte(contents), 0o600), "failed to write kubeconfig")
+
+	setEnv(t, "KUBECONFIG", kubeconfig)
+
+	return s
+}
+
+// setEnv sets an environment variable until the test ends.
+func setEnv(t *testing.T, name, value string) {
+	previous, set := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// get returns a copy of a stored object, or nil.
+func (s *fakeAPIServer) get(resource, namespace, name string) *unstructured.Unstructured {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[fakeObjectKey{resource, namespace, name}]
+	if !ok {
+		return nil
+	}
+
+	return obj.DeepCopy()
+}
+
+// seed stores obj as though it had been created.
+func (s *fakeAPIServer) seed(r fakeResource, obj *unstructured.Unstructured) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.create(obj)
+	s.objects[fakeObjectKey{r.resource, obj.GetNamespace(), obj.GetName()}] = obj
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "version":
+		writeJSON(w, http.StatusOK, version.Info{Major: "1", Minor: "22", GitVersion: "v1.22.0"})
+	case path == "api":
+		writeJSON(w, http.StatusOK, metav1.APIVersions{Versions: []string{"v1"}})
+	case path == "apis":
+		writeJSON(w, http.StatusOK, s.groups())
+	default:
+		s.serveResource(w, r, strings.Split(path, "/"))
+	}
+}
+
+// groups returns discovery's list of the named API groups.
+func (s *fakeAPIServer) groups() *metav1.APIGroupList {
+	list := &metav1.APIGroupList{}
+	seen := map[string]bool{}
+	for _, r := range fakeResources {
+		gv := r.gvk.GroupVersion()
+		if gv.Group == "" || seen[gv.String()] {
+			continue
+		}
+		seen[gv.String()] = true
+
+		version := metav1.GroupVersionForDiscovery{GroupVersion: gv.String(), Version: gv.Version}
+		list.Groups = append(list.Groups, metav1.APIGroup{
+			Name:             gv.Group,
+			Versions:         []metav1.GroupVersionForDiscovery{version},
+			PreferredVersion: version,
+		})
+	}
+
+	return list
+}
+
+// serveResource serves paths under /api/v1 and /apis/<group>/<version>.
+func (s *fakeAPIServer) serveResource(w http.ResponseWriter, r *http.Request, segments []string) {
+	var gv schema.GroupVersion
+	switch {
+	case len(segments) >= 2 && segments[0] == "api":
+		gv, segments = schema.GroupVersion{Version: segments[1]}, segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		gv, segments = schema.GroupVersion{Group: segments[1], Version: segments[2]}, segments[3:]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(segments) == 0 {
+		list := &metav1.APIResourceList{GroupVersion: gv.String()}
+		for _, res := range fakeResources {
+			if res.gvk.GroupVersion() == gv {
+				list.APIResources = append(list.APIResources, metav1.APIResource{
+					Name:       res.resource,
+					Namespaced: res.namespaced,
+					Kind:       res.gvk.Kind,
+					Verbs:      metav1.Verbs{"create", "delete", "get", "list", "patch", "update"},
+				})
+			}
+		}
+		if len(list.APIResources) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	// Requests are for [namespaces/<namespace>/]<resource>[/<name>].
+	var namespace, name string
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		namespace, segments = segments[1], segments[2:]
+	}
+	if len(segments) == 2 {
+		name = segments[1]
+	} else if len(segments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var res *fakeResource
+	for i := range fakeResources {
+		if fakeResources[i].gvk.GroupVersion() == gv && fakeResources[i].resource == segments[0] {
+			res = &fakeResources[i]
+		}
+	}
+	if res == nil || (namespace != "" && !res.namespaced) {
+		http.NotFound(w, r)
+		return
+	}
+
+	gr := schema.GroupResource{Group: gv.Group, Resource: res.resource}
+	var obj *unstructured.Unstructured
+	var err error
+	status := http.StatusOK
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, http.StatusOK, s.list(res, namespace, r.URL.Query().Get("labelSelector")))
+		return
+	case r.Method == http.MethodGet:
+		obj, err = s.getObject(gr, fakeObjectKey{res.resource, namespace, name})
+	case r.Method == http.MethodDelete && name != "":
+		err = s.delete(gr, fakeObjectKey{res.resource, namespace, name})
+		if err == nil {
+			writeJSON(w, http.StatusOK, &metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusSuccess})
+			return
+		}
+	case r.Method == http.MethodPost && name == "":
+		obj, err = s.write(r, res, namespace, "")
+		status = http.StatusCreated
+	case r.Method == http.MethodPut && name != "":
+		obj, err = s.write(r, res, namespace, name)
+	case r.Method == http.MethodPatch && name != "":
+		if r.Header.Get("Content-Type") != string(types.ApplyPatchType) {
+			err = apierrors.NewGenericServerResponse(http.StatusUnsupportedMediaType, "patch", gr, name, "only apply patches are supported", 0, false)
+			break
+		}
+		var created bool
+		obj, created, err = s.apply(r, res, namespace, name)
+		if created {
+			status = http.StatusCreated
+		}
+	default:
+		err = apierrors.NewMethodNotSupported(gr, r.Method)
+	}
+
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	writeJSON(w, status, obj)
+}
+
+// list returns the objects of a resource in namespace, or every namespace,
+// matching selector.
+func (s *fakeAPIServer) list(res *fakeResource, namespace, selector string) *unstructured.UnstructuredList {
+	list := &unstructured.UnstructuredList{Object: map[string]interface{}{
+		"apiVersion": res.gvk.GroupVersion().String(),
+		"kind":       res.gvk.Kind + "List",
+		"metadata":   map[string]interface{}{"resourceVersion": strconv.Itoa(s.resourceVersion)},
+	}}
+
+	matches, err := labels.Parse(selector)
+	if err != nil {
+		matches = labels.Nothing()
+	}
+
+	keys := []fakeObjectKey{}
+	for key := range s.objects {
+		if key.resource == res.resource && (namespace == "" || key.namespace == namespace) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].namespace+"/"+keys[i].name < keys[j].namespace+"/"+keys[j].name
+	})
+	for _, key := range keys {
+		obj := s.objects[key]
+		if matches.Matches(labels.Set(obj.GetLabels())) {
+			list.Items = append(list.Items, *obj.DeepCopy())
+		}
+	}
+
+	return list
+}
+
+func (s *fakeAPIServer) getObject(gr schema.GroupResource, key fakeObjectKey) (*unstructured.Unstructured, error) {
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, apierrors.NewNotFound(gr, key.name)
+	}
+
+	return obj, nil
+}
+
+func (s *fakeAPIServer) delete(gr schema.GroupResource, key fakeObjectKey) error {
+	if _, ok := s.objects[key]; !ok {
+		return apierrors.NewNotFound(gr, key.name)
+	}
+	delete(s.objects, key)
+	delete(s.owners, key)
+
+	return nil
+}
+
+// write creates an object, or replaces it when name is set.
+func (s *fakeAPIServer) write(r *http.Request, res *fakeResource, namespace, name string) (*unstructured.Unstructured, error) {
+	obj, err := s.decode(r, res, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkNamespace(res, obj.GetNamespace()); err != nil {
+		return nil, err
+	}
+
+	gr := schema.GroupResource{Group: res.gvk.Group, Resource: res.resource}
+	key := fakeObjectKey{res.resource, obj.GetNamespace(), obj.GetName()}
+	live, exists := s.objects[key]
+	switch {
+	case name == "" && exists:
+		return nil, apierrors.NewAlreadyExists(gr, obj.GetName())
+	case name == "":
+		s.create(obj)
+	case !exists:
+		return nil, apierrors.NewNotFound(gr, name)
+	case obj.GetResourceVersion() != "" && obj.GetResourceVersion() != live.GetResourceVersion():
+		return nil, apierrors.NewConflict(gr, name, fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	default:
+		s.update(live, obj)
+	}
+
+	if !isDryRun(r) {
+		s.objects[key] = obj
+	}
+
+	return obj, nil
+}
+
+// apply server side applies the object in the request body.
+func (s *fakeAPIServer) apply(r *http.Request, res *fakeResource, namespace, name string) (*unstructured.Unstructured, bool, error) {
+	manager := r.URL.Query().Get("fieldManager")
+	if manager == "" {
+		return nil, false, apierrors.NewInvalid(schema.GroupKind{Group: "meta.k8s.io", Kind: "PatchOptions"}, "", field.ErrorList{
+			field.Required(field.NewPath("fieldManager"), "is required for apply patch"),
+		})
+	}
+	force := r.URL.Query().Get("force") == "true"
+
+	config, err := s.decode(r, res, namespace, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.checkNamespace(res, namespace); err != nil {
+		return nil, false, err
+	}
+
+	key := fakeObjectKey{res.resource, namespace, name}
+	live, exists := s.objects[key]
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	if exists {
+		obj = live.DeepCopy()
+	}
+	owners := map[string]map[string]bool{}
+	for m, fields := range s.owners[key] {
+		owners[m] = copyFieldSet(fields)
+	}
+
+	// Fields another manager owns can only be changed by forcing, which
+	// takes them over.
+	applied := leafFields(config.Object, "")
+	causes := []metav1.StatusCause{}
+	for _, path := range sortedFields(applied) {
+		for _, other := range sortedManagers(owners) {
+			if other == manager || !owners[other][path] || reflect.DeepEqual(fieldValue(obj.Object, path), fieldValue(config.Object, path)) {
+				continue
+			}
+			if force {
+				delete(owners[other], path)
+				continue
+			}
+			causes = append(causes, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldManagerConflict,
+				Message: fmt.Sprintf("conflict with %q using %s", other, res.gvk.GroupVersion()),
+				Field:   path,
+			})
+		}
+	}
+	if len(causes) > 0 {
+		return nil, false, apierrors.NewApplyConflict(causes, fmt.Sprintf("Apply failed with %d conflict(s)", len(causes)))
+	}
+
+	// Fields the manager applied last time but not this time are
+	// removed, unless another manager owns them too.
+	for path := range owners[manager] {
+		if applied[path] {
+			continue
+		}
+		shared := false
+		for other, fields := range owners {
+			if other != manager && fields[path] {
+				shared = true
+			}
+		}
+		if !shared {
+			removeField(obj.Object, path)
+		}
+	}
+	mergeFields(obj.Object, config.Object)
+	owners[manager] = applied
+	for m, fields := range owners {
+		if len(fields) == 0 {
+			delete(owners, m)
+		}
+	}
+
+	if exists {
+		s.update(live, obj)
+	} else {
+		s.create(obj)
+	}
+	setManagedFields(obj, owners, res.gvk.GroupVersion().String())
+
+	if !isDryRun(r) {
+		s.objects[key] = obj
+		s.owners[key] = owners
+	}
+
+	return obj, !exists, nil
+}
+
+// decode reads the object in the request body and checks it's valid and
+// belongs at the path it was sent to.
+func (s *fakeAPIServer) decode(r *http.Request, res *fakeResource, namespace, name string) (*unstructured.Unstructured, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	data, err := yaml.YAMLToJSON(body)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(data); err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+
+	switch {
+	case obj.GroupVersionKind() != res.gvk:
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("the API version in the data (%s) does not match the expected API version (%s)", obj.GetAPIVersion(), res.gvk.GroupVersion()))
+	case name != "" && obj.GetName() != name:
+		return nil, apierrors.NewBadRequest("the name of the object does not match the name on the URL")
+	case namespace != "" && obj.GetNamespace() != "" && obj.GetNamespace() != namespace:
+		return nil, apierrors.NewBadRequest("the namespace of the object does not match the namespace on the request")
+	}
+	if res.namespaced {
+		obj.SetNamespace(namespace)
+	}
+
+	errs, _, err := s.validator.validate(obj, res.gvk)
+	if err != nil {
+		return nil, apierrors.NewInternalError(err)
+	}
+	if len(errs) > 0 {
+		list := field.ErrorList{}
+		for _, e := range errs {
+			path := field.NewPath(strings.TrimPrefix(e.Path.String(), "."))
+			switch e.Type {
+			case fieldErrorUnknownField:
+				list = append(list, field.Forbidden(path, "field not declared in schema"))
+			case fieldErrorRequired:
+				list = append(list, field.Required(path, ""))
+			default:
+				list = append(list, field.Invalid(path, pathValue(obj.Object, e.Path), e.Detail))
+			}
+		}
+		return nil, apierrors.NewInvalid(res.gvk.GroupKind(), obj.GetName(), list)
+	}
+
+	return obj, nil
+}
+
+// checkNamespace fails if namespace doesn't exist.
+func (s *fakeAPIServer) checkNamespace(res *fakeResource, namespace string) error {
+	if !res.namespaced {
+		return nil
+	}
+	if _, ok := s.objects[fakeObjectKey{"namespaces", "", namespace}]; !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "namespaces"}, namespace)
+	}
+
+	return nil
+}
+
+// create sets the metadata the server sets on new objects.
+func (s *fakeAPIServer) create(obj *unstructured.Unstructured) {
+	s.resourceVersion++
+	obj.SetUID(types.UID(fmt.Sprintf("00000000-0000-0000-0000-%012d", s.resourceVersion)))
+	obj.SetCreationTimestamp(metav1.NewTime(time.Now().Truncate(time.Second)))
+	obj.SetResourceVersion(strconv.Itoa(s.resourceVersion))
+	obj.SetGeneration(1)
+}
+
+// update carries the server's metadata over from live to obj, bumping the
+// resourceVersion if anything changed and the generation if more than the
+// metadata did.
+func (s *fakeAPIServer) update(live, obj *unstructured.Unstructured) {
+	obj.SetUID(live.GetUID())
+	obj.SetCreationTimestamp(live.GetCreationTimestamp())
+	obj.SetResourceVersion(live.GetResourceVersion())
+	obj.SetGeneration(live.GetGeneration())
+	obj.SetManagedFields(live.GetManagedFields())
+
+	if reflect.DeepEqual(live.Object, obj.Object) {
+		return
+	}
+	s.resourceVersion++
+	obj.SetResourceVersion(strconv.Itoa(s.resourceVersion))
+
+	for k := range obj.Object {
+		if k != "metadata" && !reflect.DeepEqual(obj.Object[k], live.Object[k]) {
+			obj.SetGeneration(live.GetGeneration() + 1)
+			break
+		}
+	}
+}
+
+// isDryRun reports whether r asks for changes not to be persisted.
+func isDryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dryRun") == metav1.DryRunAll
+}
+
+// writeJSON writes body as the JSON response.
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// writeStatus writes err as a Status response, the way the API server
+// reports errors.
+func writeStatus(w http.ResponseWriter, err error) {
+	status := apierrors.NewInternalError(err).ErrStatus
+	if statusErr, ok := err.(apierrors.APIStatus); ok {
+		status = statusErr.Status()
+	}
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+
+	writeJSON(w, int(status.Code), &status)
+}
+
+// identityFields aren't owned by any manager.
+var identityFields = map[string]bool{
+	".apiVersion":         true,
+	".kind":               true,
+	".metadata.name":      true,
+	".metadata.namespace": true,
+}
+
+// leafFields returns the paths, like .spec.replicas, of every field in obj
+// that isn't an object. Lists are treated as a single field.
+func leafFields(obj map[string]interface{}, prefix string) map[string]bool {
+	fields := map[string]bool{}
+	for k, v := range obj {
+		path := prefix + "." + k
+		if identityFields[path] {
+			continue
+		}
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 {
+			for p := range leafFields(child, path) {
+				fields[p] = true
+			}
+			continue
+		}
+		fields[path] = true
+	}
+
+	return fields
+}
+
+// fieldValue returns the value at path in obj, or nil.
+func fieldValue(obj map[string]interface{}, path string) interface{} {
+	var value interface{} = obj
+	for _, name := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+
+	return value
+}
+
+// pathValue returns the value at path in obj, or nil.
+func pathValue(obj interface{}, path fieldPath) interface{} {
+	for _, elem := range path {
+		switch e := elem.(type) {
+		case int:
+			list, ok := obj.([]interface{})
+			if !ok || e >= len(list) {
+				return nil
+			}
+			obj = list[e]
+		default:
+			m, ok := obj.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			obj = m[fmt.Sprint(e)]
+		}
+	}
+
+	return obj
+}
+
+// removeField deletes the field at path from obj, and any objects left
+// empty by doing so.
+func removeField(obj map[string]interface{}, path string) {
+	names := strings.Split(strings.TrimPrefix(path, "."), ".")
+	child, ok := obj[names[0]]
+	if len(names) == 1 || !ok {
+		delete(obj, names[0])
+		return
+	}
+	if m, ok := child.(map[string]interface{}); ok {
+		removeField(m, "."+strings.Join(names[1:], "."))
+		if len(m) == 0 {
+			delete(obj, names[0])
+		}
+	}
+}
+
+// mergeFields sets every field in config on obj, merging objects.
+func mergeFields(obj, config map[string]interface{}) {
+	for k, v := range config {
+		child, isMap := v.(map[string]interface{})
+		existing, existingIsMap := obj[k].(map[string]interface{})
+		if isMap && existingIsMap {
+			mergeFields(existing, child)
+			continue
+		}
+		obj[k] = v
+	}
+}
+
+// setManagedFields records which manager owns which fields on obj, the
+// way the API server does in metadata.managedFields.
+func setManagedFields(obj *unstructured.Unstructured, owners map[string]map[string]bool, apiVersion string) {
+	entries := []metav1.ManagedFieldsEntry{}
+	now := metav1.NewTime(time.Now().Truncate(time.Second))
+	for _, manager := range sortedManagers(owners) {
+		// Managers whose fields were all taken over are dropped.
+		if len(owners[manager]) == 0 {
+			continue
+		}
+		set := map[string]interface{}{}
+		for path := range owners[manager] {
+			node := set
+			for _, name := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+				child, ok := node["f:"+name].(map[string]interface{})
+				if !ok {
+					child = map[string]interface{}{}
+					node["f:"+name] = child
+				}
+				node = child
+			}
+		}
+		raw, _ := json.Marshal(set)
+
+		entries = append(entries, metav1.ManagedFieldsEntry{
+			Manager:    manager,
+			Operation:  metav1.ManagedFieldsOperationApply,
+			APIVersion: apiVersion,
+			Time:       &now,
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: raw},
+		})
+	}
+
+	obj.SetManagedFields(entries)
+}
+
+func copyFieldSet(fields map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(fields))
+	for path := range fields {
+		copied[path] = true
+	}
+
+	return copied
+}
+
+func sortedFields(fields map[string]bool) []string {
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func sortedManagers(owners map[string]map[string]bool) []string {
+	managers := make([]string, 0, len(owners))
+	for manager := range owners {
+		managers = append(managers, manager)
+	}
+	sort.Strings(managers)
+
+	return managers
+}
+
+func TestFakeAPIServer(t *testing.T) {
+	server := startFakeAPIServer(t)
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+
+	applierFor := func(options apply.Options) *apply.Applier {
+		applier, err := apply.NewForConfig(config, options)
+		require.NoError(t, err, "failed to build applier")
+		return applier
+	}
+	decode := func(manifest string) *unstructured.Unstructured {
+		objects, err := apply.Decode(strings.NewReader(manifest))
+		require.NoError(t, err, "failed to decode object")
+		return objects[0]
+	}
+	labelled := func(labels string) string {
+		return `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: sre-test
+  labels: {` + labels + `}
+data:
+  mode: fast
+`
+	}
+	ctx := context.Background()
+
+	cases := []struct {
+		Name     string
+		Options  apply.Options
+		Manifest string
+		Err      string
+		Labels   map[string]string
+		Managers []string
+	}{
+		{
+			Name:     "create",
+			Manifest: labelled("team: sre"),
+			Labels:   map[string]string{"team": "sre"},
+			Managers: []string{"kubecuttle"},
+		},
+		{
+			Name:     "dry runs aren't persisted",
+			Options:  apply.Options{DryRun: true},
+			Manifest: labelled("team: platform"),
+			Labels:   map[string]string{"team": "sre"},
+			Managers: []string{"kubecuttle"},
+		},
+		{
+			Name:     "fields other managers own conflict",
+			Options:  apply.Options{FieldManager: "deployer"},
+			Manifest: labelled("team: platform"),
+			Err:      `Apply failed with 1 conflict(s)`,
+			Labels:   map[string]string{"team": "sre"},
+			Managers: []string{"kubecuttle"},
+		},
+		{
+			Name:     "fields with the same value are shared",
+			Options:  apply.Options{FieldManager: "deployer"},
+			Manifest: labelled("team: sre, tier: web"),
+			Labels:   map[string]string{"team": "sre", "tier": "web"},
+			Managers: []string{"deployer", "kubecuttle"},
+		},
+		{
+			Name:     "forcing takes over fields",
+			Options:  apply.Options{FieldManager: "deployer", Force: true},
+			Manifest: labelled("team: platform, tier: web"),
+			Labels:   map[string]string{"team": "platform", "tier": "web"},
+			Managers: []string{"deployer", "kubecuttle"},
+		},
+		{
+			Name:     "fields no longer applied are removed",
+			Options:  apply.Options{FieldManager: "deployer"},
+			Manifest: labelled("team: platform"),
+			Labels:   map[string]string{"team": "platform"},
+			Managers: []string{"deployer", "kubecuttle"},
+		},
+		{
+			Name: "invalid objects",
+			Manifest: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: sre-test
+data:
+  mode: 1
+should: not be here
+`,
+			Err:      `ConfigMap "settings" is invalid: [data.mode: Invalid value: 1: expected string, got integer, should: Forbidden: field not declared in schema]`,
+			Labels:   map[string]string{"team": "platform"},
+			Managers: []string{"deployer", "kubecuttle"},
+		},
+		{
+			Name:     "missing namespaces",
+			Manifest: strings.Replace(labelled(""), "sre-test", "missing", 1),
+			Err:      `namespaces "missing" not found`,
+			Labels:   map[string]string{"team": "platform"},
+			Managers: []string{"deployer", "kubecuttle"},
+		},
+	}
+
+	for _, tt := range cases {
+		_, err := applierFor(tt.Options).ApplyObject(ctx, decode(tt.Manifest))
+		if tt.Err != "" {
+			require.Error(t, err, "test: %s", tt.Name)
+			require.Contains(t, err.Error(), tt.Err, "test: %s", tt.Name)
+		} else {
+			require.NoError(t, err, "test: %s", tt.Name)
+		}
+
+		live := server.get("configmaps", "sre-test", "settings")
+		require.NotNil(t, live, "test: %s", tt.Name)
+		require.Equal(t, tt.Labels, live.GetLabels(), "test: %s", tt.Name)
+		managers := []string{}
+		for _, entry := range live.GetManagedFields() {
+			managers = append(managers, entry.Manager)
+		}
+		require.Equal(t, tt.Managers, managers, "test: %s", tt.Name)
+	}
+}
@@ -4,30 +4,31 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/avestuk/kubecuttle/pkg/apply"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"k8s.io/apimachinery/pkg/api/meta"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/restmapper"
 
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	serializerYaml "k8s.io/apimachinery/pkg/runtime/serializer/yaml"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
-	fieldManager   string        = "kubecuttle"
+	fieldManager   string        = apply.DefaultFieldManager
 	defaultTimeout time.Duration = 10 * time.Second
 )
 
@@ -38,103 +39,350 @@ var applyCmd = &cobra.Command{
 	Long: `Apply uses ServerSideApply to create or patch a resource, or resources, passed
 to apply. Apply mimics the behaviour of kubectl apply -f.
 
+Before changing anything a plan of what will be created, updated or left
+unchanged is worked out with a dry run and printed. At a terminal you're
+asked to confirm it, even when the objects are read from stdin.
+
+While it runs apply holds a Lease, in the objects' namespace by default, so
+concurrent runs against the same objects go one after the other instead of
+interleaving. Another run holding it fails straight away unless --lock-wait
+is passed.
+
+Pass --audit-log to keep a JSONL record of who applied what, where and when,
+and --audit-events to record it as Events on the objects too.
+
+After applying, the objects are recorded as a revision of a release in a
+Secret, so kubecuttle rollback can go back to them. See kubecuttle history.
+
+Clusters can be marked as protected in the config file. Changing them needs
+--context passed explicitly and the cluster's name typed to confirm, or
+passed with --confirm-cluster.
+
 Examples:
 	# Apply the configuration from stdin to a pod.
 	cat pod.json | kubecuttle apply -f -
 
 	# Apply the configuration from a file to a pod. 
 	kubecuttle apply -f ./pod.yaml
+
+	# Re-apply a file's objects whenever it's saved.
+	kubecuttle apply -f ./pod.yaml --watch
+
+	# Apply without being asked to confirm the plan.
+	kubecuttle apply -f ./pod.yaml --yes
+
+	# Keep a record of every object applied.
+	kubecuttle apply -f ./pod.yaml --audit-log /var/log/kubecuttle/audit.jsonl
+
+	# Wait up to 5 minutes for another run applying to the same namespace.
+	kubecuttle apply -f ./pod.yaml --lock-wait 5m
+
+	# Apply to a cluster marked as protected in the config file.
+	kubecuttle apply -f ./pod.yaml --context prod --confirm-cluster prod-eu-1
+
+	# Set the image tag referenced as ${TAG} in the file.
+	kubecuttle apply -f ./deployment.yaml --var TAG=1.34
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		input, err := cmd.Flags().GetString("file")
+		policy, err := retryPolicyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		mode, err := validationModeFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		cacheDir, err := cacheDirFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		ttl, err := discoveryTTLFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		target, err := targetVersionFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		upgrade, err := cmd.Flags().GetBool("auto-upgrade-api")
+		if err != nil {
+			return fmt.Errorf("could not get value of auto-upgrade-api flag, got err: %s", err)
+		}
+
+		watch, err := cmd.Flags().GetBool("watch")
+		if err != nil {
+			return fmt.Errorf("could not get value of watch flag, got err: %s", err)
+		}
+
+		debounce, err := cmd.Flags().GetDuration("debounce")
+		if err != nil {
+			return fmt.Errorf("could not get value of debounce flag, got err: %s", err)
+		}
+
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			return fmt.Errorf("could not get value of yes flag, got err: %s", err)
+		}
+
+		recordHistory, err := cmd.Flags().GetBool("history")
+		if err != nil {
+			return fmt.Errorf("could not get value of history flag, got err: %s", err)
+		}
+
+		templates, err := templateOptionsFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		rules, err := objectPolicyFromFlags(cmd)
 		if err != nil {
-			return fmt.Errorf("could not get value of file flag, got err: %s", err)
+			return err
 		}
 
-		// Parse input
-		switch input {
-		case "-":
-			input = "/dev/stdin"
-		case "":
-			return fmt.Errorf("no input file passed")
-		default:
+		assertions, err := assertionsFromFlags(cmd)
+		if err != nil {
+			return err
 		}
 
-		fileContents, err := ioutil.ReadFile(input)
+		files, err := readInputFiles(cmd)
 		if err != nil {
-			return fmt.Errorf("failed to read file: %s, got err: %s", input, err)
+			return err
+		}
+		if watch && readsStdin(files) {
+			return fmt.Errorf("can't watch stdin for changes, pass files to --watch")
 		}
 
-		// Attempt to decode input into pods.
-		objects, err := decodeInput(fileContents)
+		// Decode every object before applying any of them so that a
+		// bad object later in the input doesn't leave us half applied.
+		manifests, err := decodeManifests(files)
 		if err != nil {
 			return fmt.Errorf("failed to decode objects, got err: %w", err)
 		}
+		if err := transformManifests(cmd, manifests); err != nil {
+			return err
+		}
+		if err := rewriteImages(cmd, manifests); err != nil {
+			return err
+		}
 
 		// Build clients
-		client, dynamicClient, err := buildK8sClients()
+		config, err := buildConfig()
 		if err != nil {
-			return fmt.Errorf("failed to build clients: %w", err)
+			return fmt.Errorf("failed to build config, got err: %w", err)
 		}
 
-		// Fetch K8s group resources, essentially a list of resources
-		// and their mapping to a Kubernetes Kind. Essentially equates
-		// to kubectl api-resources.
-		gr, err := restmapper.GetAPIGroupResources(client.Discovery())
+		// Protected clusters have to be picked deliberately, and only
+		// changed when and from where the config allows.
+		protected, err := checkProtection(cmd, viper.GetViper(), config, files, time.Now())
 		if err != nil {
-			return fmt.Errorf("failed to get API group resources, got err: %w", err)
+			return err
 		}
-		mapper := restmapper.NewDiscoveryRESTMapper(gr)
 
-		// Create a serializer that can decode
-		decodingSerializer := serializerYaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
+		dynamicClient, err := dynamicClientInit(config)
+		if err != nil {
+			return fmt.Errorf("failed to build clients: %w", err)
+		}
 
-		for _, object := range objects {
-			obj := &unstructured.Unstructured{}
+		// Discover the K8s group resources, essentially a list of
+		// resources and their mapping to a Kubernetes Kind. Essentially
+		// equates to kubectl api-resources. The result is cached on
+		// disk as it's slow to fetch from clusters with many CRDs.
+		discoveryClient, mapper, err := buildCachedDiscovery(config, cacheDir, ttl)
+		if err != nil {
+			return err
+		}
 
-			// Decode the object into a k8s runtime Object. This also
-			// returns the GroupValueKind for the object. GVK identifies a
-			// kind. A kind is the implementation of a K8s API resource.
-			// For instance, a pod is a resource and it's v1/Pod
-			// implementation is its kind.
-			runtimeObj, gvk, err := decodeRawObjects(decodingSerializer, object.Raw, obj)
+		if target == nil {
+			target, err = serverVersion(discoveryClient)
 			if err != nil {
-				return fmt.Errorf("failed to decode object, got err: %w", err)
+				return err
 			}
+		}
 
-			// Find the resource mapping for the GVK extracted from the
-			// object. A resource type is uniquely identified by a Group,
-			// Version, Resource tuple where a kind is identified by a
-			// Group, Version, Kind tuple. You can see these mappings using
-			// kubectl api-resources.
-			gvr, err := getResourceMapping(mapper, gvk)
+		var schemas schemaSource
+		if mode != validationIgnore {
+			schemas, err = schemaSourceFromFlags(cmd, discoveryClient.RESTClient(), policy, openAPICacheDir(cacheDir, config.Host))
 			if err != nil {
-				return fmt.Errorf("failed to get gvr, got err: %w", err)
+				return err
+			}
+		}
+
+		// prepare converts, checks, validates and enforces policy and
+		// assertions on objects before any of them are sent.
+		prepare := func(manifests []manifestObject) error {
+			// Check for APIs the cluster no longer serves, or soon
+			// won't, converting them to their replacements if asked
+			// to.
+			if upgrade {
+				report := func(format string, args ...interface{}) {
+					fmt.Fprintf(os.Stderr, format, args...)
+				}
+				if err := upgradeManifests(manifests, target, report); err != nil {
+					return err
+				}
+			}
+			if err := checkDeprecations(manifests, target); err != nil {
+				return err
 			}
 
-			// Establish a REST mapping for the GVR. For instance
-			// for a Pod the endpoint we need is: GET /apis/v1/namespaces/{namespace}/pods/{name}
-			// As some objects are not namespaced (e.g. PVs) a namespace may not be required.
-			dr := getRESTMapping(dynamicClient, gvr.Scope.Name(), obj.GetNamespace(), gvr.Resource)
+			// Validate the objects against the cluster's OpenAPI
+			// schemas, or those passed on the command line.
+			if mode != validationIgnore {
+				// CRDs in the input won't be known to the cluster
+				// yet, so use them to validate any custom resources
+				// alongside them.
+				crds, err := crdSchemaSourceFromManifests(manifests)
+				if err != nil {
+					return err
+				}
+
+				if err := validateObjects(newValidator(layeredSchemaSource{schemas, crds}), manifests, mode); err != nil {
+					return fmt.Errorf("%w, pass --validate=warn to apply them anyway", err)
+				}
+			}
 
-			// Marshall our runtime object into json. All json is
-			// valid yaml but not all yaml is valid json. The
-			// APIServer works on json.
-			data, err := marshallRuntimeObj(runtimeObj)
-			if err != nil {
-				return fmt.Errorf("failed to marshal json to runtime obj, got err: %w", err)
+			// Enforce the policy, even on clusters without admission
+			// controllers to do it.
+			if err := checkObjectPolicy(rules, manifests); err != nil {
+				return err
+			}
+
+			return checkAssertions(assertions, manifests)
+		}
+
+		if err := prepare(manifests); err != nil {
+			return err
+		}
+
+		// Hold the lock from planning until we're done, so another run
+		// can't change the same objects in between.
+		client, err := typedClientInit(config)
+		if err != nil {
+			return err
+		}
+		lock, err := applyLockFromFlags(cmd, client.CoordinationV1(), manifests)
+		if err != nil {
+			return err
+		}
+		if lock != nil {
+			if err := lock.acquire(context.Background()); err != nil {
+				return err
+			}
+			defer func() {
+				if err := lock.release(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}()
+		}
+
+		audit, err := auditLogFromFlags(cmd, config, dynamicClient, client.CoreV1())
+		if err != nil {
+			return err
+		}
+		defer audit.close()
+
+		// Show what's about to change and, when there's someone at a
+		// terminal, check it's what they want.
+		p, err := planManifests(dynamicClient, mapper, discoveryClient, manifests, policy)
+		if err != nil {
+			return err
+		}
+		printPlan(os.Stdout, p)
+		// Changes to protected clusters always need their name
+		// confirming, --yes isn't enough. Watching is confirmed up
+		// front as whatever changes later is applied unasked.
+		if protected != nil && (p.changeCount() > 0 || watch) {
+			if err := protected.confirm(cmd, readsStdin(files), os.Stdout); err != nil {
+				return err
+			}
+		} else if !yes && p.changeCount() > 0 {
+			if in := confirmationInput(readsStdin(files)); in != nil {
+				ok, err := confirm(in, os.Stdout, p.changeCount())
+				if in != os.Stdin {
+					in.Close()
+				}
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return errApplyCancelled
+				}
 			}
+		}
 
-			// Attempt to ServerSideApply the provided object.
-			k8sObj, err := applyObjects(dr, obj, data)
+		applier := newManifestApplier(dynamicClient, mapper, discoveryClient, policy)
+		for _, manifest := range manifests {
+			k8sObj, err := applyAndRecord(applier, manifest, lock, audit, p.hash(manifest.obj))
 			if err != nil {
-				return fmt.Errorf("failed to apply obj, got err: %w", err)
+				return err
 			}
 
 			fmt.Printf("\n%s %s/%s updated\n", k8sObj.GetKind(), k8sObj.GetNamespace(), k8sObj.GetName())
 		}
 
-		return nil
+		// Record what was applied so it can be rolled back to. The
+		// history goes where the lock does unless told otherwise.
+		if recordHistory {
+			history, err := revisionHistoryFromFlags(cmd, client.CoreV1(), manifests, true)
+			if err != nil {
+				return err
+			}
+			if err := recordApplied(context.Background(), history, newRevision(files), manifests, os.Stdout, os.Stderr); err != nil {
+				return err
+			}
+		}
+
+		if !watch {
+			return nil
+		}
+
+		// Keep applying whatever changes until interrupted, or the lock
+		// is lost.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			select {
+			case <-lock.done():
+				stop()
+			case <-ctx.Done():
+			}
+		}()
+
+		applyOne := func(manifest manifestObject) error {
+			_, err := planAndApply(applier, manifest, lock, audit)
+			return err
+		}
+		// Changed files are rendered and transformed again with the
+		// variables and flags we started with.
+		load := func(paths []string) ([]manifestObject, error) {
+			files, err := readPaths(paths)
+			if err != nil {
+				return nil, err
+			}
+			if files, err = templates.render(files); err != nil {
+				return nil, err
+			}
+			manifests, err := decodeManifests(files)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode objects, got err: %w", err)
+			}
+			if err := transformManifests(cmd, manifests); err != nil {
+				return nil, err
+			}
+			if err := rewriteImages(cmd, manifests); err != nil {
+				return nil, err
+			}
+			return manifests, nil
+		}
+		if err := watchAndApply(ctx, files, manifests, debounce, load, prepare, applyOne, os.Stdout); err != nil {
+			return err
+		}
+		return lock.err()
 	},
 }
 
@@ -146,7 +394,26 @@ func init() {
 	// Cobra supports Persistent Flags which will work for this command
 	// and all subcommands, e.g.:
 	// ApplyCmd.PersistentFlags().String("foo", "", "A help for foo")
-	applyCmd.PersistentFlags().StringP("file", "f", "", "pass a file path or pass - to apply yaml configuration from STDIN")
+	applyCmd.PersistentFlags().StringSliceP("file", "f", nil, "pass a file path or pass - to apply yaml configuration from STDIN")
+	applyCmd.PersistentFlags().Duration("timeout", defaultObjectTimeout, "time allowed to apply each object, including retries. Zero means no limit")
+	applyCmd.PersistentFlags().Duration("request-timeout", defaultTimeout, "time allowed for a single request to the API server")
+	applyCmd.PersistentFlags().String("validate", string(validationStrict), "validate objects against their OpenAPI schema before applying them. One of strict, warn or ignore")
+	applyCmd.PersistentFlags().StringSlice("openapi-file", nil, "read OpenAPI v3 documents from these files or directories instead of the cluster")
+	applyCmd.PersistentFlags().String("target-version", "", "check for deprecated and removed APIs against this Kubernetes version instead of the cluster's, e.g. v1.25")
+	applyCmd.PersistentFlags().Bool("watch", false, "keep running and re-apply objects whose documents change in the input files")
+	applyCmd.PersistentFlags().Duration("debounce", defaultDebounce, "time to wait for input files to stop changing before re-applying them in watch mode")
+	applyCmd.PersistentFlags().Bool("yes", false, "apply without asking to confirm the plan. Only asked at a terminal")
+	addProtectionFlags(applyCmd.PersistentFlags())
+	addLockFlags(applyCmd.PersistentFlags())
+	applyCmd.PersistentFlags().Bool("history", true, "record what was applied as a revision that can be rolled back to")
+	addHistoryFlags(applyCmd.PersistentFlags(), true)
+	addAuditFlags(applyCmd.PersistentFlags())
+	applyCmd.PersistentFlags().Bool("auto-upgrade-api", false, "convert objects using APIs deprecated or removed in the target version to their replacements before applying them")
+	addTemplateFlags(applyCmd.PersistentFlags())
+	addTransformFlags(applyCmd.PersistentFlags())
+	addImageFlags(applyCmd.PersistentFlags())
+	addPolicyFlags(applyCmd.PersistentFlags())
+	addAssertFlags(applyCmd.PersistentFlags())
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
@@ -193,18 +460,64 @@ func dynamicClientInit(config *rest.Config) (dynamic.Interface, error) {
 	return dynamicClient, nil
 }
 
-// buildConfig builds a Kubernetes client config.
+// buildConfig builds a Kubernetes client config. When KUBECONFIG isn't set
+// and we're running in a pod, the pod's service account is used.
 func buildConfig() (*rest.Config, error) {
+	// Requests can be recorded to a cassette and replayed from it
+	// later without a cluster.
+	mode, cassettePath, err := cassetteFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if mode == cassetteReplay {
+		return replayConfig(cassettePath)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if mode == cassetteRecord {
+		recordConfig(config, cassettePath)
+	}
+
+	return config, nil
+}
+
+// kubeconfigLoader loads the kubeconfig at path, using the context passed
+// with --context rather than its current context if there was one.
+func kubeconfigLoader(path string) clientcmd.ClientConfig {
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: path},
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	)
+}
+
+// loadConfig reads the kubeconfig KUBECONFIG points at, falling back to the
+// pod's service account when it's not set.
+func loadConfig() (*rest.Config, error) {
 	kubeconfigPath := os.Getenv("KUBECONFIG")
 	if kubeconfigPath == "" {
-		return nil, fmt.Errorf("KUBECONFIG was empty")
+		if kubeContext != "" {
+			return nil, fmt.Errorf("KUBECONFIG was empty, it must be set to use --context")
+		}
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("KUBECONFIG was empty")
+		}
+		config.WarningHandler = rest.NewWarningWriter(os.Stderr, rest.WarningWriterOptions{Deduplicate: true})
+		return config, nil
 	}
 
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	config, err := kubeconfigLoader(kubeconfigPath).ClientConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read kubeconfig from file: %s", kubeconfigPath)
+		return nil, fmt.Errorf("failed to read kubeconfig from file: %s, got err: %s", kubeconfigPath, err)
 	}
 
+	// Print the API server's Warning headers, such as those for
+	// deprecated APIs, once each.
+	config.WarningHandler = rest.NewWarningWriter(os.Stderr, rest.WarningWriterOptions{Deduplicate: true})
+
 	return config, nil
 }
 
@@ -259,11 +572,137 @@ func marshallRuntimeObj(obj runtime.Object) ([]byte, error) {
 	return data, nil
 }
 
-// applyObject uses the Patch API endpoint with Apply patch to create or update an object.
-func applyObjects(dr dynamic.ResourceInterface, obj *unstructured.Unstructured, data []byte) (*unstructured.Unstructured, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
-	defer cancel()
-	return dr.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
-		FieldManager: fieldManager,
-	})
+// retryPolicyFromFlags builds a retryPolicy from the timeout flags.
+func retryPolicyFromFlags(cmd *cobra.Command) (retryPolicy, error) {
+	policy := defaultRetryPolicy()
+
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return policy, fmt.Errorf("could not get value of timeout flag, got err: %s", err)
+	}
+	if timeout < 0 {
+		return policy, fmt.Errorf("timeout must not be negative, got: %s", timeout)
+	}
+
+	requestTimeout, err := cmd.Flags().GetDuration("request-timeout")
+	if err != nil {
+		return policy, fmt.Errorf("could not get value of request-timeout flag, got err: %s", err)
+	}
+	if requestTimeout < 0 {
+		return policy, fmt.Errorf("request-timeout must not be negative, got: %s", requestTimeout)
+	}
+
+	policy.timeout = timeout
+	policy.requestTimeout = requestTimeout
+
+	return policy, nil
+}
+
+// validationModeFromFlags reads the validate flag.
+func validationModeFromFlags(cmd *cobra.Command) (validationMode, error) {
+	value, err := cmd.Flags().GetString("validate")
+	if err != nil {
+		return "", fmt.Errorf("could not get value of validate flag, got err: %s", err)
+	}
+
+	return parseValidationMode(value)
+}
+
+// schemaSourceFromFlags returns where OpenAPI schemas should be read from.
+// Files passed with --openapi-file take precedence over the cluster. Schemas
+// fetched from the cluster are cached in cacheDir.
+func schemaSourceFromFlags(cmd *cobra.Command, client rest.Interface, policy retryPolicy, cacheDir string) (schemaSource, error) {
+	files, err := cmd.Flags().GetStringSlice("openapi-file")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of openapi-file flag, got err: %s", err)
+	}
+
+	if len(files) > 0 {
+		source, err := loadOpenAPIFiles(files)
+		if err != nil {
+			return nil, err
+		}
+		return source, nil
+	}
+
+	return newClusterSchemaSource(client, policy, cacheDir), nil
+}
+
+// manifestApplier server side applies decoded objects. One is built for a
+// run and shared by every object in it.
+type manifestApplier struct {
+	applier *apply.Applier
+	// discovery explains objects whose kind the cluster doesn't serve.
+	discovery discovery.DiscoveryInterface
+	// dynamicClient, mapper and policy dry run objects that weren't
+	// planned before being applied.
+	dynamicClient dynamic.Interface
+	mapper        meta.RESTMapper
+	policy        retryPolicy
+}
+
+// newManifestApplier returns a manifestApplier that applies objects with
+// dynamicClient, retrying as policy says.
+func newManifestApplier(dynamicClient dynamic.Interface, mapper meta.RESTMapper, discoveryClient discovery.DiscoveryInterface, policy retryPolicy) *manifestApplier {
+	return &manifestApplier{
+		applier: apply.New(dynamicClient, mapper, apply.Options{
+			FieldManager: fieldManager,
+			Retry:        policy.doContext,
+		}),
+		discovery:     discoveryClient,
+		dynamicClient: dynamicClient,
+		mapper:        mapper,
+		policy:        policy,
+	}
+}
+
+// apply server side applies a single decoded object.
+func (a *manifestApplier) apply(manifest manifestObject) (*unstructured.Unstructured, error) {
+	k8sObj, err := a.applier.ApplyObject(context.Background(), manifest.obj)
+	var mappingErr *apply.MappingError
+	if errors.As(err, &mappingErr) {
+		err = explainMappingError(mappingErr.Err, *manifest.gvk, a.discovery)
+		return nil, fmt.Errorf("failed to get gvr for %s, got err: %w", manifest.source.locate(manifest.index, nil), err)
+	}
+
+	return k8sObj, err
+}
+
+// applyAndRecord applies manifest and records the outcome in audit, along
+// with hash, the diff hash of the change planned for it. Nothing is applied
+// once lock has been lost.
+func applyAndRecord(applier *manifestApplier, manifest manifestObject, lock *applyLock, audit *auditLog, hash string) (*unstructured.Unstructured, error) {
+	if err := lock.err(); err != nil {
+		return nil, err
+	}
+	k8sObj, err := applier.apply(manifest)
+	if err != nil {
+		if auditErr := audit.record(manifest.obj, nil, auditFailed, hash, err); auditErr != nil {
+			fmt.Fprintln(os.Stderr, auditErr)
+		}
+		return nil, err
+	}
+	if err := audit.record(manifest.obj, k8sObj, auditApplied, hash, nil); err != nil {
+		return nil, err
+	}
+
+	return k8sObj, nil
+}
+
+// planAndApply applies a manifest that wasn't planned with the others, such
+// as one re-applied in watch mode, dry running it first so audit records
+// the diff hash of its change like the rest.
+func planAndApply(applier *manifestApplier, manifest manifestObject, lock *applyLock, audit *auditLog) (*unstructured.Unstructured, error) {
+	if err := lock.err(); err != nil {
+		return nil, err
+	}
+	p, err := planManifests(applier.dynamicClient, applier.mapper, applier.discovery, []manifestObject{manifest}, applier.policy)
+	if err != nil {
+		if auditErr := audit.record(manifest.obj, nil, auditFailed, "", err); auditErr != nil {
+			fmt.Fprintln(os.Stderr, auditErr)
+		}
+		return nil, err
+	}
+
+	return applyAndRecord(applier, manifest, lock, audit, p.hash(manifest.obj))
 }
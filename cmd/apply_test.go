@@ -2,18 +2,16 @@ package cmd
 
 import (
 	"context"
-	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/avestuk/kubecuttle/pkg/apply"
 	"github.com/stretchr/testify/require"
-	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	serializerYaml "k8s.io/apimachinery/pkg/runtime/serializer/yaml"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/restmapper"
 )
 
@@ -204,50 +202,19 @@ func TestDecode(t *testing.T) {
 }
 
 func TestIncorrectSpec(t *testing.T) {
-	// Build required k8s clients
-	client, dynamicClient, err := buildK8sClients()
-	require.NoError(t, err, "failed to build client")
+	applier, cleanup := testApplier(t)
 
-	// Return GroupMappings for K8s API resources.
-	gr, err := restmapper.GetAPIGroupResources(client.Discovery())
-	require.NoError(t, err, "failed to get API group resources")
-	mapper := restmapper.NewDiscoveryRESTMapper(gr)
+	objects, err := apply.Decode(strings.NewReader(incorrectSpec))
+	require.NoError(t, err, "got error from Decode")
+	defer cleanup(objects)
 
-	// Build decoder
-	objects, err := decodeInput([]byte(incorrectSpec))
-	require.NoError(t, err, "got error from DecodePods")
-
-	decodingSerializer := serializerYaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
-	obj := &unstructured.Unstructured{}
-	runtimeObj, gvk, err := decodeRawObjects(decodingSerializer, objects[0].Raw, obj)
-	require.NoError(t, err, "failed to decode raw objects")
-
-	gvr, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
-	require.NoError(t, err, "failed to get gvr")
-
-	// Obtain the REST interface for the GVR and set a namespace if the K8s
-	// kind is namespaced. E.g. pod vs PV
-	var dr dynamic.ResourceInterface
-	if gvr.Scope.Name() == meta.RESTScopeNameNamespace {
-		dr = dynamicClient.Resource(gvr.Resource).Namespace(obj.GetNamespace())
-	} else {
-		dr = dynamicClient.Resource(gvr.Resource)
-	}
-
-	// Marshal Object into JSON
-	data, err := json.Marshal(runtimeObj)
-	require.NoError(t, err, "failed to marshal json to runtime obj")
-
-	// Apply the thing
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	obj, err = dr.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
-		FieldManager: "kubecuttle",
-	})
+	obj, err := applier.ApplyObject(context.Background(), objects[0])
 	require.Error(t, err, "expected error applying incorrect object spec, got obj:\n%v", obj)
 }
 
 func TestBuildClients(t *testing.T) {
+	startFakeAPIServer(t)
+
 	client, dClient, err := buildK8sClients()
 	require.NoError(t, err, "failed to build k8s clients")
 
@@ -294,67 +261,20 @@ func TestApply(t *testing.T) {
 	}
 
 	for _, tt := range cases {
-		// Build required k8s clients
-		client, dynamicClient, err := buildK8sClients()
-		require.NoError(t, err, "failed to build client")
-
-		// Return GroupMappings for K8s API resources.
-		gr, err := restmapper.GetAPIGroupResources(client.Discovery())
-		require.NoError(t, err, "failed to get API group resources")
-		mapper := restmapper.NewDiscoveryRESTMapper(gr)
+		applier, cleanup := testApplier(t)
 
-		// Build decoder
-		objects, err := decodeInput([]byte(tt.Input))
+		objects, err := apply.Decode(strings.NewReader(tt.Input))
 		require.NoError(t, err, "failed to decode test input, %s", tt.Name)
-
-		// Create a serializer that can decode
-		decodingSerializer := serializerYaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
-
-		for _, object := range objects {
-			obj := &unstructured.Unstructured{}
-
-			// Decode the object into a k8s runtime Object. This also
-			// returns the GroupValueKind for the object. GVK identifies a
-			// kind. A kind is the implementation of a K8s API resource.
-			// For instance, a pod is a resource and it's v1/Pod
-			// implementation is its kind.
-			runtimeObj, gvk, err := decodeRawObjects(decodingSerializer, object.Raw, obj)
-			require.NoError(t, err, "failed to decode object")
-
-			// Find the resource mapping for the GVK extracted from the
-			// object. A resource type is uniquely identified by a Group,
-			// Version, Resource tuple where a kind is identified by a
-			// Group, Version, Kind tuple. You can see these mappings using
-			// kubectl api-resources.
-			gvr, err := getResourceMapping(mapper, gvk)
-			require.NoError(t, err, "failed to get GroupVersionResource from GroupVersionKind")
-
-			// Establish a REST mapping for the GVR. For instance
-			// for a Pod the endpoint we need is: GET /apis/v1/namespaces/{namespace}/pods/{name}
-			// As some objects are not namespaced (e.g. PVs) a namespace may not be required.
-			dr := getRESTMapping(dynamicClient, gvr.Scope.Name(), obj.GetNamespace(), gvr.Resource)
-
-			// Marshall our runtime object into json. All json is
-			// valid yaml but not all yaml is valid json. The
-			// APIServer works on json.
-			data, err := marshallRuntimeObj(runtimeObj)
-			require.NoError(t, err, "failed to marshal json to runtime obj")
-
-			// Attempt to ServerSideApply the provided object.
-			defer func() {
-				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-				defer cancel()
-				dr.Delete(ctx, obj.GetName(), *metav1.NewDeleteOptions(0))
-			}()
-
-			_, err = applyObjects(dr, obj, data)
-			switch {
-			case tt.ApplySuccess:
-				require.NoError(t, err, "failed to patch object, test: %s", tt.Name)
-			case !tt.ApplySuccess:
-				require.Error(t, err, "expected failure to patch object but got none, test: %s", tt.Name)
-			}
+		defer cleanup(objects)
+
+		report, err := applier.Apply(context.Background(), objects)
+		switch {
+		case tt.ApplySuccess:
+			require.NoError(t, err, "failed to patch object, test: %s", tt.Name)
+		case !tt.ApplySuccess:
+			require.Error(t, err, "expected failure to patch object but got none, test: %s", tt.Name)
 		}
+		require.Len(t, report.Results, len(objects), "test: %s", tt.Name)
 	}
 }
 
@@ -382,60 +302,14 @@ func TestUpdate(t *testing.T) {
 	}
 
 	for i, tt := range cases {
-		// Build required k8s clients
-		client, dynamicClient, err := buildK8sClients()
-		require.NoError(t, err, "failed to build client")
+		applier, cleanup := testApplier(t)
 
-		// Return GroupMappings for K8s API resources.
-		gr, err := restmapper.GetAPIGroupResources(client.Discovery())
-		require.NoError(t, err, "failed to get API group resources")
-		mapper := restmapper.NewDiscoveryRESTMapper(gr)
-
-		// Build decoder
-		objects, err := decodeInput([]byte(tt.Input))
+		objects, err := apply.Decode(strings.NewReader(tt.Input))
 		require.NoError(t, err, "failed to decode test input, %s", tt.Name)
+		defer cleanup(objects)
 
-		// Create a serializer that can decode
-		decodingSerializer := serializerYaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
-
-		for _, object := range objects {
-			obj := &unstructured.Unstructured{}
-
-			// Decode the object into a k8s runtime Object. This also
-			// returns the GroupValueKind for the object. GVK identifies a
-			// kind. A kind is the implementation of a K8s API resource.
-			// For instance, a pod is a resource and it's v1/Pod
-			// implementation is its kind.
-			runtimeObj, gvk, err := decodeRawObjects(decodingSerializer, object.Raw, obj)
-			require.NoError(t, err, "failed to decode object")
-
-			// Find the resource mapping for the GVK extracted from the
-			// object. A resource type is uniquely identified by a Group,
-			// Version, Resource tuple where a kind is identified by a
-			// Group, Version, Kind tuple. You can see these mappings using
-			// kubectl api-resources.
-			gvr, err := getResourceMapping(mapper, gvk)
-			require.NoError(t, err, "failed to get GroupVersionResource from GroupVersionKind")
-
-			// Establish a REST mapping for the GVR. For instance
-			// for a Pod the endpoint we need is: GET /apis/v1/namespaces/{namespace}/pods/{name}
-			// As some objects are not namespaced (e.g. PVs) a namespace may not be required.
-			dr := getRESTMapping(dynamicClient, gvr.Scope.Name(), obj.GetNamespace(), gvr.Resource)
-
-			// Marshall our runtime object into json. All json is
-			// valid yaml but not all yaml is valid json. The
-			// APIServer works on json.
-			data, err := marshallRuntimeObj(runtimeObj)
-			require.NoError(t, err, "failed to marshal json to runtime obj")
-
-			// Attempt to ServerSideApply the provided object.
-			defer func() {
-				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-				defer cancel()
-				dr.Delete(ctx, obj.GetName(), *metav1.NewDeleteOptions(0))
-			}()
-
-			_, err = applyObjects(dr, obj, data)
+		for _, obj := range objects {
+			_, err = applier.ApplyObject(context.Background(), obj)
 			switch i {
 			// First object will be apply creation
 			case 0:
@@ -451,3 +325,39 @@ func TestUpdate(t *testing.T) {
 		}
 	}
 }
+
+// testApplier starts a fake API server and returns an Applier for it and a
+// func that deletes the objects passed to it.
+func testApplier(t *testing.T) (*apply.Applier, func(objects []*unstructured.Unstructured)) {
+	startFakeAPIServer(t)
+
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+
+	applier, err := apply.NewForConfig(config, apply.Options{Retry: defaultRetryPolicy().doContext})
+	require.NoError(t, err, "failed to build applier")
+
+	client, dynamicClient, err := buildK8sClients()
+	require.NoError(t, err, "failed to build client")
+
+	// Return GroupMappings for K8s API resources.
+	gr, err := restmapper.GetAPIGroupResources(client.Discovery())
+	require.NoError(t, err, "failed to get API group resources")
+	mapper := restmapper.NewDiscoveryRESTMapper(gr)
+
+	cleanup := func(objects []*unstructured.Unstructured) {
+		for _, obj := range objects {
+			gvk := obj.GroupVersionKind()
+			mapping, err := getResourceMapping(mapper, &gvk)
+			if err != nil {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			getRESTMapping(dynamicClient, mapping.Scope.Name(), obj.GetNamespace(), mapping.Resource).Delete(ctx, obj.GetName(), *metav1.NewDeleteOptions(0))
+			cancel()
+		}
+	}
+
+	return applier, cleanup
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// assertion is a CEL expression every object must satisfy.
+type assertion struct {
+	expression *celExpression
+	// message replaces what's reported when the assertion fails.
+	message string
+}
+
+// assertionFile is the format of the files passed with --assert-file.
+type assertionFile struct {
+	Assertions []struct {
+		Expression string `json:"expression"`
+		Message    string `json:"message,omitempty"`
+	} `json:"assertions"`
+}
+
+// addAssertFlags adds the flags that pass assertions to flags.
+func addAssertFlags(flags *pflag.FlagSet) {
+	flags.StringArray("assert", nil, "a CEL expression every object, as object, must satisfy, e.g. 'object.kind != \"Pod\" || has(object.spec.securityContext)'")
+	flags.StringSlice("assert-file", nil, "read assertions every object must satisfy from these files")
+}
+
+// assertionsFromFlags compiles the assertions passed with the assert flags.
+func assertionsFromFlags(cmd *cobra.Command) ([]assertion, error) {
+	assertions := []assertion{}
+
+	paths, err := cmd.Flags().GetStringSlice("assert-file")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of assert-file flag, got err: %s", err)
+	}
+	for _, path := range paths {
+		loaded, err := loadAssertions(path)
+		if err != nil {
+			return nil, err
+		}
+		assertions = append(assertions, loaded...)
+	}
+
+	expressions, err := cmd.Flags().GetStringArray("assert")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of assert flag, got err: %s", err)
+	}
+	for _, expression := range expressions {
+		compiled, err := compileCEL(expression)
+		if err != nil {
+			return nil, err
+		}
+		assertions = append(assertions, assertion{expression: compiled})
+	}
+
+	return assertions, nil
+}
+
+// loadAssertions reads and compiles the assertions in a file.
+func loadAssertions(path string) ([]assertion, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read assertions file: %s, got err: %s", path, err)
+	}
+
+	file := assertionFile{}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse assertions file: %s, got err: %w", path, err)
+	}
+
+	assertions := make([]assertion, 0, len(file.Assertions))
+	for _, a := range file.Assertions {
+		compiled, err := compileCEL(a.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid assertion in %s, got err: %w", path, err)
+		}
+		assertions = append(assertions, assertion{expression: compiled, message: a.Message})
+	}
+
+	return assertions, nil
+}
+
+// checkAssertions evaluates every assertion against every object, reporting
+// each that fails. An assertion that can't be evaluated, for instance
+// because it reads a field the object doesn't have, fails.
+func checkAssertions(assertions []assertion, objects []manifestObject) error {
+	failed := 0
+	for _, o := range objects {
+		objectFailed := false
+		for _, a := range assertions {
+			failures, err := a.expression.failures(o.obj)
+			if err != nil {
+				failures = []string{err.Error()}
+			} else if len(failures) > 0 && a.message != "" {
+				failures = []string{a.message}
+			}
+
+			for _, failure := range failures {
+				fmt.Fprintf(os.Stderr, "%s: %s: assertion failed: %s\n", o.source.locate(o.index, nil), describeObject(o.obj), failure)
+			}
+			if len(failures) > 0 {
+				objectFailed = true
+			}
+		}
+		if objectFailed {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d object(s) failed assertions", failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAssertions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"assertions.yaml": `
+assertions:
+- expression: object.metadata.namespace == "sre-test"
+- expression: object.metadata.name.startsWith("busybox-")
+  message: names must start with busybox-
+`,
+		"broken.yaml": `
+assertions:
+- expression: object.kind ==
+`,
+	})
+	manifests, err := decodeManifests([]inputFile{{source: "pods.yaml", contents: []byte(twoPods)}})
+	require.NoError(t, err, "failed to decode pods")
+
+	cases := []struct {
+		Name string
+		Args []string
+		Err  string
+	}{
+		{
+			Name: "no assertions",
+		},
+		{
+			Name: "passing assertions",
+			Args: []string{"--assert", `object.kind == "Pod"`, "--assert-file", filepath.Join(dir, "assertions.yaml")},
+		},
+		{
+			Name: "failing assertion",
+			Args: []string{"--assert", `object.spec.containers[0].args[1] == "1000000"`},
+			Err:  "1 object(s) failed assertions",
+		},
+		{
+			Name: "assertions reading missing fields fail",
+			Args: []string{"--assert", `object.spec.securityContext.runAsNonRoot`},
+			Err:  "2 object(s) failed assertions",
+		},
+		{
+			Name: "assertions must compile",
+			Args: []string{"--assert-file", filepath.Join(dir, "broken.yaml")},
+			Err:  "invalid assertion in " + filepath.Join(dir, "broken.yaml"),
+		},
+	}
+
+	for _, tt := range cases {
+		cmd := &cobra.Command{}
+		addAssertFlags(cmd.Flags())
+		require.NoError(t, cmd.ParseFlags(tt.Args), "test: %s", tt.Name)
+
+		assertions, err := assertionsFromFlags(cmd)
+		if err == nil {
+			err = checkAssertions(assertions, manifests)
+		}
+		if tt.Err != "" {
+			require.Error(t, err, "test: %s", tt.Name)
+			require.Contains(t, err.Error(), tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+	}
+}
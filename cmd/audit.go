@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// auditOutcome is what happened to an object.
+type auditOutcome string
+
+const (
+	auditApplied auditOutcome = "applied"
+	auditFailed  auditOutcome = "failed"
+	auditPruned  auditOutcome = "pruned"
+)
+
+// selfSubjectReviewVersions are the authentication.k8s.io versions that
+// serve SelfSubjectReview, newest first. Older clusters serve neither.
+var selfSubjectReviewVersions = []string{"v1", "v1beta1", "v1alpha1"}
+
+// addAuditFlags adds the flags that configure the audit log to flags.
+func addAuditFlags(flags *pflag.FlagSet) {
+	flags.String("audit-log", "", "append a JSON line recording who changed what, where and when to this file for every object applied")
+	flags.Bool("audit-events", false, "also record every object applied as a Kubernetes Event on it")
+}
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// User is who the cluster knows us as, or failing that the
+	// kubeconfig user.
+	User         string       `json:"user"`
+	Cluster      string       `json:"cluster"`
+	Server       string       `json:"server"`
+	FieldManager string       `json:"fieldManager"`
+	Object       objectRef    `json:"object"`
+	Outcome      auditOutcome `json:"outcome"`
+	Error        string       `json:"error,omitempty"`
+	// DiffHash identifies the change planned for the object, see
+	// diffHash. Objects re-applied in watch mode are dry run for one. It's
+	// empty for prunes.
+	DiffHash string `json:"diffHash,omitempty"`
+}
+
+// auditLog records every change made to a cluster in an append only JSONL
+// file and, optionally, as Events on the objects changed, so there's a
+// record of who changed what and when that outlives the CI log.
+type auditLog struct {
+	mu   sync.Mutex
+	file io.WriteCloser
+	// events are where Events are created, if they're wanted.
+	events corev1client.EventsGetter
+	// identity is filled in on every entry.
+	user    string
+	cluster string
+	server  string
+}
+
+// auditLogFromFlags returns the audit log configured by cmd's flags, or nil
+// if it's disabled.
+func auditLogFromFlags(cmd *cobra.Command, config *rest.Config, dynamicClient dynamic.Interface, events corev1client.EventsGetter) (*auditLog, error) {
+	path, err := cmd.Flags().GetString("audit-log")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of audit-log flag, got err: %s", err)
+	}
+	emitEvents, err := cmd.Flags().GetBool("audit-events")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of audit-events flag, got err: %s", err)
+	}
+	if path == "" && !emitEvents {
+		return nil, nil
+	}
+
+	target, err := currentTarget(config)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &auditLog{
+		user:    auditUser(dynamicClient, target),
+		cluster: target.cluster,
+		server:  target.server,
+	}
+	if emitEvents {
+		a.events = events
+	}
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create audit log directory, got err: %w", err)
+		}
+		// Entries are only ever appended, each in a single write.
+		a.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %s, got err: %s", path, err)
+		}
+	}
+
+	return a, nil
+}
+
+// auditUser returns who the cluster authenticates us as, asking it with a
+// SelfSubjectReview. Clusters too old to answer get the kubeconfig user of
+// the current context, or the local user outside of a kubeconfig.
+func auditUser(dynamicClient dynamic.Interface, target clusterTarget) string {
+	for _, version := range selfSubjectReviewVersions {
+		gvr := schema.GroupVersionResource{Group: "authentication.k8s.io", Version: version, Resource: "selfsubjectreviews"}
+		review := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": gvr.GroupVersion().String(),
+			"kind":       "SelfSubjectReview",
+		}}
+
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		result, err := dynamicClient.Resource(gvr).Create(ctx, review, metav1.CreateOptions{})
+		cancel()
+		if err != nil {
+			continue
+		}
+		if username, _, _ := unstructured.NestedString(result.Object, "status", "userInfo", "username"); username != "" {
+			return username
+		}
+	}
+
+	if target.user != "" {
+		return target.user
+	}
+
+	return currentUser()
+}
+
+// record logs what happened to obj. applied is the object returned by the
+// server, if it was applied, and hash the diff hash of the change planned
+// for it, if there was a plan.
+func (a *auditLog) record(obj, applied *unstructured.Unstructured, outcome auditOutcome, hash string, applyErr error) error {
+	if a == nil {
+		return nil
+	}
+
+	ref := refFor(obj)
+	entry := auditEntry{
+		Time:         time.Now().UTC(),
+		User:         a.user,
+		Cluster:      a.cluster,
+		Server:       a.server,
+		FieldManager: fieldManager,
+		Object:       ref,
+		Outcome:      outcome,
+		DiffHash:     hash,
+	}
+	if applyErr != nil {
+		entry.Error = applyErr.Error()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit entry, got err: %w", err)
+		}
+		if _, err := a.file.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to write audit log, got err: %w", err)
+		}
+	}
+
+	if a.events != nil {
+		if applied == nil {
+			applied = obj
+		}
+		if err := a.event(applied, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// event records entry as an Event on obj.
+func (a *auditLog) event(obj *unstructured.Unstructured, entry auditEntry) error {
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	eventType, reason := corev1.EventTypeNormal, "Applied"
+	message := fmt.Sprintf("%s by %s with %s", entry.Outcome, entry.User, fieldManager)
+	switch entry.Outcome {
+	case auditFailed:
+		eventType, reason = corev1.EventTypeWarning, "ApplyFailed"
+		message = fmt.Sprintf("apply by %s with %s failed: %s", entry.User, fieldManager, entry.Error)
+	case auditPruned:
+		reason = "Pruned"
+	}
+
+	now := metav1.NewTime(entry.Time)
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// Named the way kubectl and the controllers name theirs.
+			Name:      fmt.Sprintf("%s.%x", obj.GetName(), entry.Time.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      obj.GetAPIVersion(),
+			Kind:            obj.GetKind(),
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: fieldManager},
+		ReportingController: fieldManager,
+		ReportingInstance:   entry.User,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	if _, err := a.events.Events(namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create audit event for %s, got err: %w", describeObject(obj), err)
+	}
+
+	return nil
+}
+
+// close closes the audit log file.
+func (a *auditLog) close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+
+	return a.file.Close()
+}
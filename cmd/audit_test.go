@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	startFakeAPIServer(t)
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+	dynamicClient, err := dynamicClientInit(config)
+	require.NoError(t, err, "failed to build dynamic client")
+
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	cmd := &cobra.Command{}
+	addAuditFlags(cmd.Flags())
+
+	// Nothing is recorded unless asked for.
+	audit, err := auditLogFromFlags(cmd, config, dynamicClient, nil)
+	require.NoError(t, err, "failed to build disabled audit log")
+	require.Nil(t, audit)
+	require.NoError(t, audit.record(&unstructured.Unstructured{}, nil, auditApplied, "", nil), "expected a nil audit log to record nothing")
+
+	require.NoError(t, cmd.Flags().Set("audit-log", path), "failed to set audit-log flag")
+	require.NoError(t, cmd.Flags().Set("audit-events", "true"), "failed to set audit-events flag")
+	events := fake.NewSimpleClientset()
+	audit, err = auditLogFromFlags(cmd, config, dynamicClient, events.CoreV1())
+	require.NoError(t, err, "failed to build audit log")
+
+	manifests, err := decodeManifests([]inputFile{{source: "test.yaml", contents: []byte(onePod + "---" + configMapB)}})
+	require.NoError(t, err, "failed to decode objects")
+	pod, configMap := manifests[0].obj, manifests[1].obj
+
+	applied := pod.DeepCopy()
+	applied.SetUID("1234")
+	require.NoError(t, audit.record(pod, applied, auditApplied, "sha256:pod", nil), "failed to record applied pod")
+	require.NoError(t, audit.record(configMap, nil, auditFailed, "", errors.New("rejected")), "failed to record failed ConfigMap")
+	require.NoError(t, audit.close(), "failed to close audit log")
+
+	// Entries are appended across runs.
+	audit, err = auditLogFromFlags(cmd, config, dynamicClient, events.CoreV1())
+	require.NoError(t, err, "failed to reopen audit log")
+	require.NoError(t, audit.record(configMap, nil, auditPruned, "", nil), "failed to record pruned ConfigMap")
+	require.NoError(t, audit.close(), "failed to close audit log")
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "failed to read audit log")
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+
+	entries := make([]auditEntry, len(lines))
+	for i, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &entries[i]), "failed to decode entry %d", i)
+		// The fake server doesn't serve SelfSubjectReview.
+		require.Equal(t, "fake", entries[i].User)
+		require.Equal(t, "fake", entries[i].Cluster)
+		require.Equal(t, config.Host, entries[i].Server)
+		require.Equal(t, fieldManager, entries[i].FieldManager)
+		require.False(t, entries[i].Time.IsZero(), "expected entry %d to have a time", i)
+	}
+	require.Equal(t, objectRef{Version: "v1", Kind: "Pod", Namespace: "sre-test", Name: "busybox-sleep"}, entries[0].Object)
+	require.Equal(t, auditApplied, entries[0].Outcome)
+	require.Equal(t, "sha256:pod", entries[0].DiffHash)
+	require.Equal(t, auditFailed, entries[1].Outcome)
+	require.Equal(t, "rejected", entries[1].Error)
+	require.Empty(t, entries[1].DiffHash)
+	require.Equal(t, auditPruned, entries[2].Outcome)
+
+	list, err := events.CoreV1().Events("sre-test").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err, "failed to list events")
+	require.Len(t, list.Items, 3)
+	reasons := map[string]corev1.Event{}
+	for _, event := range list.Items {
+		reasons[event.Reason] = event
+	}
+	require.Equal(t, corev1.EventTypeNormal, reasons["Applied"].Type)
+	require.Equal(t, "applied by fake with kubecuttle", reasons["Applied"].Message)
+	require.Equal(t, "1234", string(reasons["Applied"].InvolvedObject.UID))
+	require.Equal(t, corev1.EventTypeWarning, reasons["ApplyFailed"].Type)
+	require.Equal(t, "apply by fake with kubecuttle failed: rejected", reasons["ApplyFailed"].Message)
+	require.Equal(t, "ConfigMap", reasons["Pruned"].InvolvedObject.Kind)
+}
+
+func TestAuditLogWatch(t *testing.T) {
+	startFakeAPIServer(t)
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+	dynamicClient, err := dynamicClientInit(config)
+	require.NoError(t, err, "failed to build dynamic client")
+	discoveryClient, mapper, err := buildCachedDiscovery(config, "", 0)
+	require.NoError(t, err, "failed to build discovery")
+	policy := defaultRetryPolicy()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	cmd := &cobra.Command{}
+	addAuditFlags(cmd.Flags())
+	require.NoError(t, cmd.Flags().Set("audit-log", path), "failed to set audit-log flag")
+	audit, err := auditLogFromFlags(cmd, config, dynamicClient, nil)
+	require.NoError(t, err, "failed to build audit log")
+
+	// The initial apply is planned.
+	writeFiles(t, dir, map[string]string{"cm.yaml": configMapB})
+	manifests, err := decodeManifests([]inputFile{{source: filepath.Join(dir, "cm.yaml"), contents: []byte(configMapB)}})
+	require.NoError(t, err, "failed to decode ConfigMap")
+	p, err := planManifests(dynamicClient, mapper, discoveryClient, manifests, policy)
+	require.NoError(t, err, "failed to plan")
+	applier := newManifestApplier(dynamicClient, mapper, discoveryClient, policy)
+	_, err = applyAndRecord(applier, manifests[0], nil, audit, p.hash(manifests[0].obj))
+	require.NoError(t, err, "failed to apply ConfigMap")
+	applied, err := hashManifests(manifests)
+	require.NoError(t, err, "failed to hash ConfigMap")
+
+	// Re-applying the changed file in watch mode dry runs it first.
+	writeFiles(t, dir, map[string]string{"cm.yaml": strings.Replace(configMapB, "value", "changed", 1)})
+	load := func(paths []string) ([]manifestObject, error) {
+		files, err := readPaths(paths)
+		if err != nil {
+			return nil, err
+		}
+		return decodeManifests(files)
+	}
+	prepare := func([]manifestObject) error { return nil }
+	applyOne := func(manifest manifestObject) error {
+		_, err := planAndApply(applier, manifest, nil, audit)
+		return err
+	}
+	out := &bytes.Buffer{}
+	reapplyChanged([]string{filepath.Join(dir, "cm.yaml")}, applied, load, prepare, applyOne, out)
+	require.Contains(t, out.String(), "ConfigMap sre-test/b applied")
+	require.NoError(t, audit.close(), "failed to close audit log")
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "failed to read audit log")
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	entries := make([]auditEntry, len(lines))
+	for i, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &entries[i]), "failed to decode entry %d", i)
+		require.Equal(t, auditApplied, entries[i].Outcome)
+	}
+	require.Equal(t, p.hash(manifests[0].obj), entries[0].DiffHash)
+	require.NotEmpty(t, entries[0].DiffHash)
+	require.NotEmpty(t, entries[1].DiffHash, "expected the watch mode re-apply to have a diff hash")
+	require.NotEqual(t, entries[0].DiffHash, entries[1].DiffHash, "expected the changed ConfigMap to hash differently")
+}
+
+func TestAuditUser(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	client.PrependReactor("create", "selfsubjectreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+		if review.GroupVersionKind().Version != "v1beta1" {
+			return true, nil, errors.New("the server could not find the requested resource")
+		}
+		require.NoError(t, unstructured.SetNestedField(review.Object, "alice@example.com", "status", "userInfo", "username"))
+		return true, review, nil
+	})
+	require.Equal(t, "alice@example.com", auditUser(client, clusterTarget{user: "admin"}), "expected the user the cluster knows us as")
+
+	unanswered := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	unanswered.PrependReactor("create", "selfsubjectreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("the server could not find the requested resource")
+	})
+	require.Equal(t, "admin", auditUser(unanswered, clusterTarget{user: "admin"}), "expected the kubeconfig user")
+}
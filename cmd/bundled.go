@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+var (
+	bundledOnce   sync.Once
+	bundledSource *staticSchemaSource
+
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// bundledSchemaSource returns schemas for every built in kind client-go
+// knows about. They're generated from the Go types compiled into kubecuttle
+// so they're always available, even without a cluster. Unlike the schemas
+// served by an API server they don't know which fields are required.
+func bundledSchemaSource() *staticSchemaSource {
+	bundledOnce.Do(func() {
+		schemas := newOpenAPISchemas()
+		g := &schemaGenerator{seen: map[reflect.Type]*openAPISchema{}}
+		for gvk, t := range scheme.Scheme.AllKnownTypes() {
+			if gvk.Version == runtime.APIVersionInternal {
+				continue
+			}
+			schemas.kinds[gvk] = g.schemaFor(t)
+		}
+
+		bundledSource = &staticSchemaSource{schemas: schemas}
+	})
+
+	return bundledSource
+}
+
+// schemaGenerator builds OpenAPI schemas from Go types using their json
+// tags, the same way the API server's schemas are generated.
+type schemaGenerator struct {
+	// seen holds schemas already generated, which also stops recursive
+	// types recursing forever.
+	seen map[reflect.Type]*openAPISchema
+}
+
+// schemaFor returns the schema for values of type t.
+func (g *schemaGenerator) schemaFor(t reflect.Type) *openAPISchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if s, ok := g.seen[t]; ok {
+		return s
+	}
+
+	s := &openAPISchema{}
+	g.seen[t] = s
+
+	switch t {
+	case reflect.TypeOf(metav1.Time{}), reflect.TypeOf(metav1.MicroTime{}), reflect.TypeOf(metav1.Duration{}):
+		s.Type = "string"
+		return s
+	case reflect.TypeOf(resource.Quantity{}), reflect.TypeOf(intstr.IntOrString{}):
+		s.IntOrString = true
+		return s
+	case reflect.TypeOf(runtime.RawExtension{}):
+		s.PreserveUnknownFields = true
+		return s
+	}
+
+	// Any other type that marshals itself may look like anything.
+	if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) {
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		s.Type = "string"
+	case reflect.Bool:
+		s.Type = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s.Type = "integer"
+	case reflect.Float32, reflect.Float64:
+		s.Type = "number"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte is base64 encoded.
+			s.Type = "string"
+			break
+		}
+		s.Type = "array"
+		s.Items = g.schemaFor(t.Elem())
+	case reflect.Map:
+		s.Type = "object"
+		s.AdditionalProperties = &schemaOrBool{Allows: true, Schema: g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		s.Type = "object"
+		s.Properties = map[string]*openAPISchema{}
+		g.addProperties(s, t)
+	}
+
+	return s
+}
+
+// addProperties adds a property to s for each serialised field of struct t.
+// Inlined structs, such as TypeMeta, have their fields added directly.
+func (g *schemaGenerator) addProperties(s *openAPISchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			// Unexported fields aren't serialised.
+			continue
+		}
+
+		name, inline := jsonFieldName(field)
+		switch {
+		case name == "-":
+			continue
+		case inline:
+			embedded := field.Type
+			for embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				g.addProperties(s, embedded)
+			}
+			continue
+		}
+
+		s.Properties[name] = g.schemaFor(field.Type)
+	}
+}
+
+// jsonFieldName returns the name a struct field is serialised as, and
+// whether its fields are inlined into its parent.
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	name := strings.Split(tag, ",")[0]
+
+	if strings.Contains(tag, ",inline") || (field.Anonymous && name == "") {
+		return "", true
+	}
+	if name == "" {
+		name = field.Name
+	}
+
+	return name, false
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// overlyCautiousIllegalFileCharacters matches characters that may not be
+// safe to use in a directory name on every platform.
+var overlyCautiousIllegalFileCharacters = regexp.MustCompile(`[^(\w/.)]`)
+
+// defaultCacheDir returns the directory kubecuttle caches data in unless
+// told otherwise. It's shared with kubectl.
+func defaultCacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".kube", "cache")
+}
+
+// cacheDirFromFlags reads the cache-dir flag. An empty value disables
+// caching.
+func cacheDirFromFlags(cmd *cobra.Command) (string, error) {
+	cacheDir, err := cmd.Flags().GetString("cache-dir")
+	if err != nil {
+		return "", fmt.Errorf("could not get value of cache-dir flag, got err: %s", err)
+	}
+
+	return cacheDir, nil
+}
+
+// hostCacheDir returns a directory under parent for data that belongs to the
+// API server at host, e.g. ~/.kube/cache/discovery/example.com_6443.
+func hostCacheDir(parent, host string) string {
+	// Strip the scheme and make the host safe to use as a directory name.
+	schemelessHost := strings.Replace(strings.Replace(host, "https://", "", 1), "http://", "", 1)
+	safeHost := overlyCautiousIllegalFileCharacters.ReplaceAllString(schemelessHost, "_")
+
+	return filepath.Join(parent, safeHost)
+}
+
+// openAPICacheDir returns the directory OpenAPI documents fetched from the
+// API server at host are cached in.
+func openAPICacheDir(cacheDir, host string) string {
+	return hostCacheDir(filepath.Join(cacheDir, "kubecuttle", "openapi"), host)
+}
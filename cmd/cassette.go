@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// cassetteEnv names the file requests to the API server are
+	// recorded to or replayed from.
+	cassetteEnv = "KUBECUTTLE_CASSETTE"
+	// cassetteModeEnv is record or replay.
+	cassetteModeEnv = "KUBECUTTLE_CASSETTE_MODE"
+)
+
+// cassetteMode is whether a cassette is being recorded or replayed.
+type cassetteMode string
+
+const (
+	cassetteRecord cassetteMode = "record"
+	cassetteReplay cassetteMode = "replay"
+)
+
+// cassette holds the requests made to an API server and its responses, so
+// they can be replayed without it.
+type cassette struct {
+	// Host is the API server the cassette was recorded against.
+	Host         string        `json:"host"`
+	Interactions []interaction `json:"interactions"`
+}
+
+// interaction is a request and the response it got.
+type interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+// recordedRequest is what's matched against when replaying. The URL is the
+// path and query, so a cassette can be replayed against any host.
+type recordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+type recordedResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// recordedHeaders are the response headers kept in cassettes. Anything that
+// might be sensitive, or only describes the connection, is left out.
+var recordedHeaders = []string{"Content-Type", "Retry-After", "Warning"}
+
+// cassetteFromEnv returns the cassette mode and file set in the environment,
+// or an empty mode if there isn't one.
+func cassetteFromEnv() (cassetteMode, string, error) {
+	path := os.Getenv(cassetteEnv)
+	mode := cassetteMode(os.Getenv(cassetteModeEnv))
+	if path == "" {
+		if mode != "" {
+			return "", "", fmt.Errorf("%s is set but %s isn't, set it to the cassette file", cassetteModeEnv, cassetteEnv)
+		}
+		return "", "", nil
+	}
+
+	switch mode {
+	case "":
+		return cassetteReplay, path, nil
+	case cassetteRecord, cassetteReplay:
+		return mode, path, nil
+	default:
+		return "", "", fmt.Errorf("invalid value for %s: %q, expected one of record or replay", cassetteModeEnv, mode)
+	}
+}
+
+// recordConfig makes config record every request and response to the
+// cassette at path, replacing anything already in it.
+func recordConfig(config *rest.Config, path string) {
+	// Each client built from config gets its own transport, all
+	// recording to the same cassette.
+	recording := &cassetteRecording{path: path, cassette: cassette{Host: config.Host}}
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &cassetteRecorder{recording: recording, next: rt}
+	})
+}
+
+// replayConfig returns a config for the host the cassette at path was
+// recorded against, which answers requests from the cassette instead.
+func replayConfig(path string) (*rest.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %s, got err: %s", path, err)
+	}
+
+	replayer := &cassetteReplayer{path: path}
+	if err := yaml.Unmarshal(data, &replayer.cassette); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette: %s, got err: %w", path, err)
+	}
+	replayer.used = make([]bool, len(replayer.cassette.Interactions))
+
+	config := &rest.Config{Host: replayer.cassette.Host}
+	config.WarningHandler = rest.NewWarningWriter(os.Stderr, rest.WarningWriterOptions{Deduplicate: true})
+	config.Wrap(func(http.RoundTripper) http.RoundTripper {
+		return replayer
+	})
+
+	return config, nil
+}
+
+// cassetteRecording is a cassette being recorded to a file.
+type cassetteRecording struct {
+	mu       sync.Mutex
+	path     string
+	cassette cassette
+}
+
+// add appends an interaction to the cassette and saves it, so the file is
+// complete however the program ends.
+func (c *cassetteRecording) add(i interaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cassette.Interactions = append(c.cassette.Interactions, i)
+	data, err := yaml.Marshal(&c.cassette)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cassette, got err: %w", err)
+	}
+	if err := ioutil.WriteFile(c.path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cassette: %s, got err: %s", c.path, err)
+	}
+
+	return nil
+}
+
+// cassetteRecorder is a transport that records to a cassette.
+type cassetteRecorder struct {
+	recording *cassetteRecording
+	next      http.RoundTripper
+}
+
+func (r *cassetteRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	request, err := recordRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	response := recordedResponse{Status: resp.StatusCode, Body: string(body)}
+	for _, name := range recordedHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			if response.Headers == nil {
+				response.Headers = map[string]string{}
+			}
+			response.Headers[name] = value
+		}
+	}
+
+	if err := r.recording.add(interaction{Request: request, Response: response}); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// cassetteReplayer is a transport that answers requests from a cassette.
+type cassetteReplayer struct {
+	mu       sync.Mutex
+	path     string
+	cassette cassette
+	// used marks interactions that have been replayed.
+	used []bool
+}
+
+// RoundTrip answers req with the first recorded response to the same
+// request that hasn't been replayed yet, so the same request can get
+// different answers, as it would when an object is applied and then
+// updated. Once all have been replayed the last one is repeated. Requests
+// whose bodies change from run to run are matched by method and URL alone,
+// see volatileRequest.
+func (r *cassetteReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	request, err := recordRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	volatile := volatileRequest(request)
+	match := -1
+	for i, recorded := range r.cassette.Interactions {
+		if recorded.Request.Method != request.Method || recorded.Request.URL != request.URL {
+			continue
+		}
+		if !volatile && recorded.Request.Body != request.Body {
+			continue
+		}
+		match = i
+		if !r.used[i] {
+			break
+		}
+	}
+	if match < 0 {
+		return nil, fmt.Errorf("no response to %s %s recorded in cassette: %s", request.Method, request.URL, r.path)
+	}
+	r.used[match] = true
+
+	response := r.cassette.Interactions[match].Response
+	header := http.Header{}
+	for name, value := range response.Headers {
+		header.Set(name, value)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", response.Status, http.StatusText(response.Status)),
+		StatusCode:    response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(response.Body))),
+		ContentLength: int64(len(response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// volatileRequest reports whether request creates or replaces an object
+// we write with a body that's different every run: a revision's Secret,
+// which records when it was applied, or an audit Event.
+func volatileRequest(request recordedRequest) bool {
+	if request.Method != http.MethodPost && request.Method != http.MethodPut {
+		return false
+	}
+
+	var obj struct {
+		Kind string `json:"kind"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal([]byte(request.Body), &obj); err != nil {
+		return false
+	}
+
+	switch obj.Kind {
+	case "Secret":
+		return obj.Type == string(revisionSecretType)
+	case "Event":
+		return true
+	default:
+		return false
+	}
+}
+
+// recordRequest returns what's recorded of req, leaving its body to be
+// read again.
+func recordRequest(req *http.Request) (recordedRequest, error) {
+	request := recordedRequest{Method: req.Method, URL: req.URL.RequestURI()}
+	if req.Body == nil {
+		return request, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return request, fmt.Errorf("failed to read request body, got err: %w", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request.Body = string(body)
+
+	return request, nil
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/avestuk/kubecuttle/pkg/apply"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// applyScenario creates a pod, updates it and then tries to apply an
+// invalid one, returning what happened to each.
+func applyScenario(t *testing.T) []string {
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+	applier, err := apply.NewForConfig(config, apply.Options{})
+	require.NoError(t, err, "failed to build applier")
+
+	objects, err := apply.Decode(strings.NewReader(onePodSpecUpdate + "---" + incorrectSpec))
+	require.NoError(t, err, "failed to decode objects")
+
+	outcomes := []string{}
+	for _, obj := range objects {
+		applied, err := applier.ApplyObject(context.Background(), obj)
+		if err != nil {
+			outcomes = append(outcomes, err.Error())
+			continue
+		}
+		containers, _, _ := unstructured.NestedSlice(applied.Object, "spec", "containers")
+		outcomes = append(outcomes, fmt.Sprintf("%s %v", applied.GetResourceVersion(), containers[0].(map[string]interface{})["image"]))
+	}
+
+	return outcomes
+}
+
+func TestCassette(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.yaml")
+
+	// Record the scenario against a server.
+	startFakeAPIServer(t)
+	setEnv(t, cassetteEnv, path)
+	setEnv(t, cassetteModeEnv, string(cassetteRecord))
+	recorded := applyScenario(t)
+	require.Len(t, recorded, 3, "expected an outcome per object")
+	require.Contains(t, recorded[1], "busybox:stable", "expected the update to be applied")
+	require.Contains(t, recorded[2], `Pod "busybox-wrong" is invalid`, "expected the invalid pod to be rejected")
+
+	// Replaying it needs no server, and gives the same results.
+	setEnv(t, "KUBECONFIG", "")
+	setEnv(t, cassetteModeEnv, string(cassetteReplay))
+	require.Equal(t, recorded, applyScenario(t), "expected replaying to give the recorded results")
+
+	// Requests that weren't recorded fail.
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+	applier, err := apply.NewForConfig(config, apply.Options{FieldManager: "someone-else"})
+	require.NoError(t, err, "failed to build applier")
+	objects, err := apply.Decode(strings.NewReader(onePod))
+	require.NoError(t, err, "failed to decode pod")
+	_, err = applier.ApplyObject(context.Background(), objects[0])
+	require.Error(t, err, "expected unrecorded requests to fail")
+	require.Contains(t, err.Error(), "no response to PATCH /api/v1/namespaces/sre-test/pods/busybox-sleep?fieldManager=someone-else recorded in cassette: "+path)
+}
+
+func TestCassetteApplyCmd(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cassette.yaml")
+	writeFiles(t, dir, map[string]string{"pod.yaml": onePod})
+	rootCmd.SetArgs([]string{"apply", "-f", filepath.Join(dir, "pod.yaml"), "--yes", "--validate", "ignore", "--cache-dir", ""})
+	t.Cleanup(func() { rootCmd.SetArgs(nil) })
+
+	// Record a run that takes the lock and records a revision.
+	server := startFakeAPIServer(t)
+	setEnv(t, cassetteEnv, path)
+	setEnv(t, cassetteModeEnv, string(cassetteRecord))
+	require.NoError(t, rootCmd.Execute(), "failed to record apply")
+	require.NotNil(t, server.get("leases", "sre-test", defaultLockName), "expected the lock to be taken")
+	require.NotNil(t, server.get("secrets", "sre-test", "kubecuttle.v1"), "expected a revision to be recorded")
+
+	// The revision and the lock's holder differ from the recording, but
+	// it still replays.
+	setEnv(t, "KUBECONFIG", "")
+	setEnv(t, cassetteModeEnv, string(cassetteReplay))
+	require.NoError(t, rootCmd.Execute(), "failed to replay apply")
+}
+
+func TestVolatileRequest(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Request  recordedRequest
+		Volatile bool
+	}{
+		{
+			Name:     "revision",
+			Request:  recordedRequest{Method: "POST", URL: "/api/v1/namespaces/sre-test/secrets", Body: `{"kind":"Secret","type":"kubecuttle.io/revision"}`},
+			Volatile: true,
+		},
+		{
+			Name:     "audit event",
+			Request:  recordedRequest{Method: "POST", URL: "/api/v1/namespaces/sre-test/events", Body: `{"kind":"Event"}`},
+			Volatile: true,
+		},
+		{
+			Name:    "other secret",
+			Request: recordedRequest{Method: "POST", URL: "/api/v1/namespaces/sre-test/secrets", Body: `{"kind":"Secret","type":"Opaque"}`},
+		},
+		{
+			Name:    "apply",
+			Request: recordedRequest{Method: "PATCH", URL: "/api/v1/namespaces/sre-test/secrets/kubecuttle.v1", Body: `{"kind":"Secret","type":"kubecuttle.io/revision"}`},
+		},
+	}
+
+	for _, tt := range cases {
+		require.Equal(t, tt.Volatile, volatileRequest(tt.Request), "test: %s", tt.Name)
+	}
+}
+
+func TestCassetteFromEnv(t *testing.T) {
+	cases := []struct {
+		Name string
+		Path string
+		Mode string
+		Want cassetteMode
+		Err  string
+	}{
+		{
+			Name: "no cassette",
+		},
+		{
+			Name: "replay by default",
+			Path: "cassette.yaml",
+			Want: cassetteReplay,
+		},
+		{
+			Name: "record",
+			Path: "cassette.yaml",
+			Mode: "record",
+			Want: cassetteRecord,
+		},
+		{
+			Name: "invalid mode",
+			Path: "cassette.yaml",
+			Mode: "rewind",
+			Err:  `invalid value for KUBECUTTLE_CASSETTE_MODE: "rewind", expected one of record or replay`,
+		},
+		{
+			Name: "mode without a cassette",
+			Mode: "record",
+			Err:  "KUBECUTTLE_CASSETTE_MODE is set but KUBECUTTLE_CASSETTE isn't, set it to the cassette file",
+		},
+	}
+
+	for _, tt := range cases {
+		setEnv(t, cassetteEnv, tt.Path)
+		setEnv(t, cassetteModeEnv, tt.Mode)
+
+		mode, path, err := cassetteFromEnv()
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Want, mode, "test: %s", tt.Name)
+		if tt.Want != "" {
+			require.Equal(t, tt.Path, path, "test: %s", tt.Name)
+		}
+	}
+}
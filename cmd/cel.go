@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// celEnv is the environment CEL expressions about objects are compiled in.
+// The object being checked is the variable object.
+var celEnv = mustCELEnv()
+
+func mustCELEnv() *cel.Env {
+	env, err := cel.NewEnv(cel.Variable("object", cel.DynType))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create CEL environment, got err: %s", err))
+	}
+
+	return env
+}
+
+// stringSliceType is what lists returned by expressions are converted to.
+var stringSliceType = reflect.TypeOf([]string{})
+
+// celExpression is a compiled CEL expression about an object.
+type celExpression struct {
+	source  string
+	program cel.Program
+}
+
+// compileCEL compiles a CEL expression about an object.
+func compileCEL(expression string) (*celExpression, error) {
+	ast, issues := celEnv.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile %q, got err: %w", expression, issues.Err())
+	}
+
+	program, err := celEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile %q, got err: %w", expression, err)
+	}
+
+	return &celExpression{source: expression, program: program}, nil
+}
+
+// eval evaluates the expression against obj.
+func (e *celExpression) eval(obj *unstructured.Unstructured) (ref.Val, error) {
+	out, _, err := e.program.Eval(map[string]interface{}{"object": obj.Object})
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate %q, got err: %w", e.source, err)
+	}
+
+	return out, nil
+}
+
+// failures evaluates the expression against obj and returns why it failed,
+// if it did. Expressions pass by returning true or an empty string or list
+// and fail by returning false, or strings describing what's wrong.
+func (e *celExpression) failures(obj *unstructured.Unstructured) ([]string, error) {
+	out, err := e.eval(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	switch out.Type() {
+	case types.BoolType:
+		if out == types.True {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s is false", e.source)}, nil
+
+	case types.StringType:
+		if s := out.Value().(string); s != "" {
+			return []string{s}, nil
+		}
+		return nil, nil
+
+	case types.ListType:
+		value, err := out.ConvertToNative(stringSliceType)
+		if err != nil {
+			return nil, fmt.Errorf("%q must return a list of strings, got err: %w", e.source, err)
+		}
+		return value.([]string), nil
+
+	default:
+		return nil, fmt.Errorf("%q must return a bool, string or list of strings, got: %s", e.source, out.Type().TypeName())
+	}
+}
@@ -0,0 +1,503 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// conversion rewrites the fields of an object whose schema changed between a
+// deprecated API and its replacement. The apiVersion is set by the caller.
+type conversion func(obj map[string]interface{}) error
+
+// conversions lists the conversions needed for deprecated APIs, keyed by the
+// API being converted from. APIs whose replacement has the same schema only
+// need their apiVersion changed and aren't listed.
+var conversions = map[schema.GroupVersionKind]conversion{
+	{Group: "extensions", Version: "v1beta1", Kind: "Deployment"}:                                       convertExtensionsWorkload,
+	{Group: "extensions", Version: "v1beta1", Kind: "DaemonSet"}:                                        convertExtensionsWorkload,
+	{Group: "extensions", Version: "v1beta1", Kind: "ReplicaSet"}:                                       convertBetaWorkload,
+	{Group: "apps", Version: "v1beta1", Kind: "Deployment"}:                                             convertExtensionsWorkload,
+	{Group: "apps", Version: "v1beta1", Kind: "StatefulSet"}:                                            convertBetaWorkload,
+	{Group: "apps", Version: "v1beta2", Kind: "Deployment"}:                                             convertBetaWorkload,
+	{Group: "apps", Version: "v1beta2", Kind: "StatefulSet"}:                                            convertBetaWorkload,
+	{Group: "apps", Version: "v1beta2", Kind: "DaemonSet"}:                                              convertBetaWorkload,
+	{Group: "apps", Version: "v1beta2", Kind: "ReplicaSet"}:                                             convertBetaWorkload,
+	{Group: "networking.k8s.io", Version: "v1beta1", Kind: "Ingress"}:                                   convertIngress,
+	{Group: "apiextensions.k8s.io", Version: "v1beta1", Kind: "CustomResourceDefinition"}:               convertCRD,
+	{Group: "admissionregistration.k8s.io", Version: "v1beta1", Kind: "MutatingWebhookConfiguration"}:   convertWebhookConfiguration,
+	{Group: "admissionregistration.k8s.io", Version: "v1beta1", Kind: "ValidatingWebhookConfiguration"}: convertWebhookConfiguration,
+	{Group: "authorization.k8s.io", Version: "v1beta1", Kind: "SubjectAccessReview"}:                    convertSubjectAccessReview,
+	{Group: "authorization.k8s.io", Version: "v1beta1", Kind: "LocalSubjectAccessReview"}:               convertSubjectAccessReview,
+	{Group: "certificates.k8s.io", Version: "v1beta1", Kind: "CertificateSigningRequest"}:               convertCSR,
+	{Group: "discovery.k8s.io", Version: "v1beta1", Kind: "EndpointSlice"}:                              convertEndpointSlice,
+	{Group: "autoscaling", Version: "v2beta1", Kind: "HorizontalPodAutoscaler"}:                         convertHPA,
+	{Group: "policy", Version: "v1beta1", Kind: "PodDisruptionBudget"}:                                  convertPDB,
+	{Group: "flowcontrol.apiserver.k8s.io", Version: "v1beta2", Kind: "PriorityLevelConfiguration"}:     convertPriorityLevelConfiguration,
+}
+
+// upgradeAPI rewrites obj from a deprecated API to its current replacement,
+// following replacements that have since been deprecated themselves. If
+// target is set, only APIs deprecated or removed in that Kubernetes version
+// are converted, and only to replacements it serves, otherwise every
+// deprecated API is. It returns the API the object was converted from, or an
+// empty GVK if it wasn't converted.
+func upgradeAPI(obj *unstructured.Unstructured, target *version.Version) (schema.GroupVersionKind, error) {
+	original := obj.GroupVersionKind()
+
+	for {
+		gvk := obj.GroupVersionKind()
+		lifecycle, ok := apiLifecycles[gvk]
+		if !ok {
+			break
+		}
+		if target != nil && !lifecycle.deprecatedAt(target) && !lifecycle.removedAt(target) {
+			break
+		}
+		if lifecycle.replacement.Kind == "" {
+			if target != nil && lifecycle.removedAt(target) {
+				return schema.GroupVersionKind{}, fmt.Errorf("%s has no replacement to convert to", lifecycle)
+			}
+			break
+		}
+		if target != nil && !lifecycle.replacementServedAt(target) {
+			break
+		}
+
+		if convert, ok := conversions[gvk]; ok {
+			if err := convert(obj.Object); err != nil {
+				return schema.GroupVersionKind{}, fmt.Errorf("failed to convert %s to %s, got err: %w", gvk.GroupVersion(), lifecycle.replacement.GroupVersion(), err)
+			}
+		}
+		obj.SetGroupVersionKind(lifecycle.replacement)
+	}
+
+	if obj.GroupVersionKind() == original {
+		return schema.GroupVersionKind{}, nil
+	}
+
+	return original, nil
+}
+
+// upgradeManifests converts every object in manifests using upgradeAPI,
+// reporting each conversion on stderr.
+func upgradeManifests(manifests []manifestObject, target *version.Version, report func(format string, args ...interface{})) error {
+	for i := range manifests {
+		m := &manifests[i]
+		from, err := upgradeAPI(m.obj, target)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", m.source.locate(m.index, nil), describeObject(m.obj), err)
+		}
+		if from.Empty() {
+			continue
+		}
+
+		gvk := m.obj.GroupVersionKind()
+		m.gvk = &gvk
+		report("%s: converted %s from %s to %s\n", m.source.locate(m.index, nil), describeObject(m.obj), from.GroupVersion(), gvk.GroupVersion())
+	}
+
+	return nil
+}
+
+// convertBetaWorkload converts apps/v1beta2 and older workloads to apps/v1,
+// which requires a selector. Beta versions defaulted it to the pod
+// template's labels.
+func convertBetaWorkload(obj map[string]interface{}) error {
+	if _, found, _ := unstructured.NestedFieldNoCopy(obj, "spec", "selector"); found {
+		return nil
+	}
+
+	labels, found, err := unstructured.NestedMap(obj, "spec", "template", "metadata", "labels")
+	if err != nil {
+		return err
+	}
+	if !found || len(labels) == 0 {
+		return fmt.Errorf("spec.selector is required and can't be defaulted as spec.template.metadata.labels is empty")
+	}
+
+	return unstructured.SetNestedMap(obj, map[string]interface{}{"matchLabels": labels}, "spec", "selector")
+}
+
+// convertExtensionsWorkload converts extensions/v1beta1 and apps/v1beta1
+// workloads, which also had fields apps/v1 dropped.
+func convertExtensionsWorkload(obj map[string]interface{}) error {
+	unstructured.RemoveNestedField(obj, "spec", "rollbackTo")
+	unstructured.RemoveNestedField(obj, "spec", "templateGeneration")
+
+	return convertBetaWorkload(obj)
+}
+
+// convertIngress converts networking.k8s.io/v1beta1 Ingresses, and so
+// extensions/v1beta1 ones which share their schema, to networking.k8s.io/v1. Backends reference services by a
+// nested service instead of serviceName and servicePort, the default
+// backend was renamed and paths must have a pathType.
+func convertIngress(obj map[string]interface{}) error {
+	spec, found, err := unstructured.NestedMap(obj, "spec")
+	if err != nil || !found {
+		return err
+	}
+
+	if backend, ok := spec["backend"].(map[string]interface{}); ok {
+		spec["defaultBackend"] = convertIngressBackend(backend)
+		delete(spec, "backend")
+	}
+
+	rules, _ := spec["rules"].([]interface{})
+	for _, rule := range rules {
+		rule, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		paths, _, _ := unstructured.NestedSlice(rule, "http", "paths")
+		for i, path := range paths {
+			path, ok := path.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if backend, ok := path["backend"].(map[string]interface{}); ok {
+				path["backend"] = convertIngressBackend(backend)
+			}
+			// The beta APIs treated paths without a type the way
+			// the ingress controller chose to.
+			if _, ok := path["pathType"]; !ok {
+				path["pathType"] = "ImplementationSpecific"
+			}
+			paths[i] = path
+		}
+		if len(paths) > 0 {
+			if err := unstructured.SetNestedSlice(rule, paths, "http", "paths"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return unstructured.SetNestedMap(obj, spec, "spec")
+}
+
+// convertIngressBackend converts a beta Ingress backend. Resource backends
+// are unchanged.
+func convertIngressBackend(backend map[string]interface{}) map[string]interface{} {
+	name, hasName := backend["serviceName"]
+	port, hasPort := backend["servicePort"]
+	if !hasName && !hasPort {
+		return backend
+	}
+
+	service := map[string]interface{}{}
+	if hasName {
+		service["name"] = name
+	}
+	if hasPort {
+		// servicePort was an IntOrString, v1 splits it in two.
+		if portName, ok := port.(string); ok {
+			service["port"] = map[string]interface{}{"name": portName}
+		} else {
+			service["port"] = map[string]interface{}{"number": port}
+		}
+	}
+
+	converted := map[string]interface{}{}
+	for k, v := range backend {
+		if k != "serviceName" && k != "servicePort" {
+			converted[k] = v
+		}
+	}
+	converted["service"] = service
+
+	return converted
+}
+
+// convertCRD converts an apiextensions.k8s.io/v1beta1
+// CustomResourceDefinition to v1, where the schema, subresources and
+// printer columns are set per version and every version needs a schema.
+func convertCRD(obj map[string]interface{}) error {
+	spec, found, err := unstructured.NestedMap(obj, "spec")
+	if err != nil || !found {
+		return err
+	}
+
+	versions, _ := spec["versions"].([]interface{})
+	if len(versions) == 0 {
+		name, ok := spec["version"].(string)
+		if !ok || name == "" {
+			return fmt.Errorf("spec.versions or spec.version is required")
+		}
+		versions = []interface{}{map[string]interface{}{"name": name, "served": true, "storage": true}}
+	}
+	delete(spec, "version")
+
+	preserve := spec["preserveUnknownFields"] != false
+
+	// Fields set for the whole CRD in v1beta1 move onto each version,
+	// unless the version overrides them.
+	shared := map[string]interface{}{}
+	if validation, ok := spec["validation"]; ok {
+		shared["schema"] = validation
+		delete(spec, "validation")
+	}
+	if subresources, ok := spec["subresources"]; ok {
+		shared["subresources"] = subresources
+		delete(spec, "subresources")
+	}
+	if columns, ok := spec["additionalPrinterColumns"]; ok {
+		shared["additionalPrinterColumns"] = columns
+		delete(spec, "additionalPrinterColumns")
+	}
+
+	for i, v := range versions {
+		v, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, value := range shared {
+			if _, ok := v[key]; !ok {
+				v[key] = runtime.DeepCopyJSONValue(value)
+			}
+		}
+
+		if columns, ok := v["additionalPrinterColumns"].([]interface{}); ok {
+			for _, column := range columns {
+				if column, ok := column.(map[string]interface{}); ok {
+					if path, ok := column["JSONPath"]; ok {
+						column["jsonPath"] = path
+						delete(column, "JSONPath")
+					}
+				}
+			}
+		}
+
+		// v1 requires a structural schema for every version. Without
+		// one v1beta1 accepted any fields, so keep doing that.
+		if _, ok := v["schema"]; !ok {
+			v["schema"] = map[string]interface{}{
+				"openAPIV3Schema": map[string]interface{}{
+					"type": "object",
+				},
+			}
+		}
+		// v1beta1 kept unknown fields unless preserveUnknownFields was
+		// false. v1 only allows it to be false, and keeps them when the
+		// schema says so instead.
+		if preserve {
+			if schema := childMap(v, "schema", "openAPIV3Schema"); schema != nil {
+				if _, ok := schema["x-kubernetes-preserve-unknown-fields"]; !ok {
+					schema["x-kubernetes-preserve-unknown-fields"] = true
+				}
+			}
+		}
+		versions[i] = v
+	}
+	spec["versions"] = versions
+	delete(spec, "preserveUnknownFields")
+
+	return unstructured.SetNestedMap(obj, spec, "spec")
+}
+
+// convertWebhookConfiguration converts admissionregistration.k8s.io/v1beta1
+// webhook configurations to v1. v1 changed several defaults, so the old ones
+// are set explicitly to keep the webhooks behaving the same, and requires
+// sideEffects to be None or NoneOnDryRun.
+func convertWebhookConfiguration(obj map[string]interface{}) error {
+	webhooks, _, err := unstructured.NestedSlice(obj, "webhooks")
+	if err != nil {
+		return err
+	}
+
+	defaults := map[string]interface{}{
+		"failurePolicy":           "Ignore",
+		"matchPolicy":             "Exact",
+		"timeoutSeconds":          int64(30),
+		"admissionReviewVersions": []interface{}{"v1beta1"},
+	}
+	for i, webhook := range webhooks {
+		webhook, ok := webhook.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, value := range defaults {
+			if _, ok := webhook[key]; !ok {
+				webhook[key] = runtime.DeepCopyJSONValue(value)
+			}
+		}
+
+		switch webhook["sideEffects"] {
+		case "None", "NoneOnDryRun":
+		default:
+			return fmt.Errorf("webhooks[%d].sideEffects must be None or NoneOnDryRun in v1, check what the webhook does and set it", i)
+		}
+		webhooks[i] = webhook
+	}
+
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	return unstructured.SetNestedSlice(obj, webhooks, "webhooks")
+}
+
+// convertSubjectAccessReview converts authorization.k8s.io/v1beta1 access
+// reviews to v1, which renamed spec.group to spec.groups.
+func convertSubjectAccessReview(obj map[string]interface{}) error {
+	return renameField(obj, []string{"spec", "group"}, "groups")
+}
+
+// convertCSR converts a certificates.k8s.io/v1beta1
+// CertificateSigningRequest to v1, which requires a signerName.
+func convertCSR(obj map[string]interface{}) error {
+	signer, _, _ := unstructured.NestedString(obj, "spec", "signerName")
+	if signer == "" {
+		return fmt.Errorf("spec.signerName is required in v1 and can't be defaulted, set it to the signer that should sign the request")
+	}
+
+	return nil
+}
+
+// convertEndpointSlice converts a discovery.k8s.io/v1beta1 EndpointSlice to
+// v1, where the well known topology labels became fields and the rest of
+// the topology map was deprecated.
+func convertEndpointSlice(obj map[string]interface{}) error {
+	endpoints, found, err := unstructured.NestedSlice(obj, "endpoints")
+	if err != nil || !found {
+		return err
+	}
+
+	for i, endpoint := range endpoints {
+		endpoint, ok := endpoint.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		topology, ok := endpoint["topology"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		delete(endpoint, "topology")
+
+		if node, ok := topology["kubernetes.io/hostname"]; ok {
+			endpoint["nodeName"] = node
+			delete(topology, "kubernetes.io/hostname")
+		}
+		if zone, ok := topology["topology.kubernetes.io/zone"]; ok {
+			endpoint["zone"] = zone
+			delete(topology, "topology.kubernetes.io/zone")
+		}
+		if len(topology) > 0 {
+			endpoint["deprecatedTopology"] = topology
+		}
+		endpoints[i] = endpoint
+	}
+
+	return unstructured.SetNestedSlice(obj, endpoints, "endpoints")
+}
+
+// convertHPA converts an autoscaling/v2beta1 HorizontalPodAutoscaler to
+// v2beta2, whose schema v2 kept, where each metric's target is described by
+// a MetricTarget and metrics are identified by a MetricIdentifier.
+func convertHPA(obj map[string]interface{}) error {
+	metrics, found, err := unstructured.NestedSlice(obj, "spec", "metrics")
+	if err != nil || !found {
+		return err
+	}
+
+	for i, metric := range metrics {
+		metric, ok := metric.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, source := range []string{"resource", "containerResource", "pods", "object", "external"} {
+			m, ok := metric[source].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			metric[source] = convertHPAMetricSource(m)
+		}
+		metrics[i] = metric
+	}
+
+	return unstructured.SetNestedSlice(obj, metrics, "spec", "metrics")
+}
+
+// convertHPAMetricSource converts a single autoscaling/v2beta1 metric
+// source.
+func convertHPAMetricSource(source map[string]interface{}) map[string]interface{} {
+	converted := map[string]interface{}{}
+	target := map[string]interface{}{}
+	metric := map[string]interface{}{}
+
+	for key, value := range source {
+		switch key {
+		case "targetAverageUtilization":
+			target["type"] = "Utilization"
+			target["averageUtilization"] = value
+		case "targetAverageValue", "averageValue":
+			target["type"] = "AverageValue"
+			target["averageValue"] = value
+		case "targetValue":
+			target["type"] = "Value"
+			target["value"] = value
+		case "metricName":
+			metric["name"] = value
+		case "selector", "metricSelector":
+			metric["selector"] = value
+		case "target":
+			// Object metrics named the object they describe
+			// target.
+			converted["describedObject"] = value
+		default:
+			converted[key] = value
+		}
+	}
+
+	if len(target) > 0 {
+		converted["target"] = target
+	}
+	if len(metric) > 0 {
+		converted["metric"] = metric
+	}
+
+	return converted
+}
+
+// convertPDB converts a policy/v1beta1 PodDisruptionBudget to v1. An empty
+// selector matched no pods in v1beta1 but matches every pod in the
+// namespace in v1, so it can't be converted silently.
+func convertPDB(obj map[string]interface{}) error {
+	selector, found, err := unstructured.NestedMap(obj, "spec", "selector")
+	if err != nil {
+		return err
+	}
+	if found && len(selector) == 0 {
+		return fmt.Errorf("an empty spec.selector matches no pods in policy/v1beta1 but every pod in the namespace in policy/v1, remove it or set a selector")
+	}
+
+	return nil
+}
+
+// convertPriorityLevelConfiguration converts flowcontrol.apiserver.k8s.io
+// v1beta2 PriorityLevelConfigurations, and so v1beta1 ones which share their
+// schema, to v1beta3, where assuredConcurrencyShares was renamed to
+// nominalConcurrencyShares.
+func convertPriorityLevelConfiguration(obj map[string]interface{}) error {
+	return renameField(obj, []string{"spec", "limited", "assuredConcurrencyShares"}, "nominalConcurrencyShares")
+}
+
+// renameField moves the field at path to a sibling called to, if it's set.
+func renameField(obj map[string]interface{}, path []string, to string) error {
+	value, found, err := unstructured.NestedFieldNoCopy(obj, path...)
+	if err != nil || !found {
+		return err
+	}
+
+	parent := path[:len(path)-1]
+	if err := unstructured.SetNestedField(obj, runtime.DeepCopyJSONValue(value), append(append([]string{}, parent...), to)...); err != nil {
+		return fmt.Errorf("failed to set %s, got err: %w", strings.Join(append(append([]string{}, parent...), to), "."), err)
+	}
+	unstructured.RemoveNestedField(obj, path...)
+
+	return nil
+}
@@ -0,0 +1,360 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+var betaIngress = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  backend:
+    serviceName: default
+    servicePort: 80
+  rules:
+  - host: example.com
+    http:
+      paths:
+      - path: /
+        backend:
+          serviceName: web
+          servicePort: http
+`
+
+var convertedIngress = `
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  defaultBackend:
+    service:
+      name: default
+      port:
+        number: 80
+  rules:
+  - host: example.com
+    http:
+      paths:
+      - path: /
+        pathType: ImplementationSpecific
+        backend:
+          service:
+            name: web
+            port:
+              name: http
+`
+
+var betaDeployment = `
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: nginx
+  namespace: sre-test
+spec:
+  rollbackTo:
+    revision: 2
+  template:
+    metadata:
+      labels:
+        app: nginx
+    spec:
+      containers:
+      - name: nginx
+        image: nginx
+`
+
+var convertedDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+  namespace: sre-test
+spec:
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      labels:
+        app: nginx
+    spec:
+      containers:
+      - name: nginx
+        image: nginx
+`
+
+var betaCRD = `
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  version: v1
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  subresources:
+    status: {}
+  additionalPrinterColumns:
+  - name: Size
+    type: integer
+    JSONPath: .spec.size
+  validation:
+    openAPIV3Schema:
+      type: object
+`
+
+var convertedCRD = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    subresources:
+      status: {}
+    additionalPrinterColumns:
+    - name: Size
+      type: integer
+      jsonPath: .spec.size
+    schema:
+      openAPIV3Schema:
+        type: object
+        x-kubernetes-preserve-unknown-fields: true
+`
+
+var betaHPA = `
+apiVersion: autoscaling/v2beta1
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: web
+  maxReplicas: 10
+  metrics:
+  - type: Resource
+    resource:
+      name: cpu
+      targetAverageUtilization: 80
+  - type: External
+    external:
+      metricName: queue_length
+      metricSelector:
+        matchLabels:
+          queue: jobs
+      targetValue: 30
+`
+
+var convertedHPA = `
+apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: web
+  maxReplicas: 10
+  metrics:
+  - type: Resource
+    resource:
+      name: cpu
+      target:
+        type: Utilization
+        averageUtilization: 80
+  - type: External
+    external:
+      metric:
+        name: queue_length
+        selector:
+          matchLabels:
+            queue: jobs
+      target:
+        type: Value
+        value: 30
+`
+
+var betaPriorityLevel = `
+apiVersion: flowcontrol.apiserver.k8s.io/v1beta1
+kind: PriorityLevelConfiguration
+metadata:
+  name: batch
+spec:
+  type: Limited
+  limited:
+    assuredConcurrencyShares: 10
+    limitResponse:
+      type: Reject
+`
+
+var convertedPriorityLevel = `
+apiVersion: flowcontrol.apiserver.k8s.io/v1
+kind: PriorityLevelConfiguration
+metadata:
+  name: batch
+spec:
+  type: Limited
+  limited:
+    nominalConcurrencyShares: 10
+    limitResponse:
+      type: Reject
+`
+
+var betaPDB = `
+apiVersion: policy/v1beta1
+kind: PodDisruptionBudget
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  minAvailable: 1
+  selector:
+    matchLabels:
+      app: web
+`
+
+var convertedPDB = `
+apiVersion: policy/v1
+kind: PodDisruptionBudget
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  minAvailable: 1
+  selector:
+    matchLabels:
+      app: web
+`
+
+var betaWebhook = `
+apiVersion: admissionregistration.k8s.io/v1beta1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: policy
+webhooks:
+- name: policy.example.com
+  clientConfig:
+    service:
+      name: policy
+      namespace: sre-test
+`
+
+var betaPSP = `
+apiVersion: policy/v1beta1
+kind: PodSecurityPolicy
+metadata:
+  name: restricted
+spec:
+  privileged: false
+`
+
+// upgradeInput decodes input and converts it for target, returning the
+// converted objects.
+func upgradeInput(t *testing.T, input string, target *version.Version) ([]manifestObject, error) {
+	manifests, err := decodeManifests([]inputFile{{source: "input.yaml", contents: []byte(input)}})
+	require.NoError(t, err, "failed to decode objects")
+
+	err = upgradeManifests(manifests, target, t.Logf)
+	return manifests, err
+}
+
+func TestUpgradeAPI(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Input    string
+		Target   string
+		Expected string
+		Err      string
+	}{
+		{Name: "ingress", Input: betaIngress, Expected: convertedIngress},
+		{Name: "deployment", Input: betaDeployment, Expected: convertedDeployment},
+		{Name: "crd", Input: betaCRD, Expected: convertedCRD},
+		{Name: "crd pruning unknown fields", Input: betaCRD + "  preserveUnknownFields: false\n", Expected: strings.Replace(convertedCRD, "        x-kubernetes-preserve-unknown-fields: true\n", "", 1)},
+		{Name: "hpa", Input: betaHPA, Expected: convertedHPA},
+		{Name: "hpa before autoscaling v2", Input: betaHPA, Target: "v1.22.0", Expected: strings.Replace(convertedHPA, "autoscaling/v2\n", "autoscaling/v2beta2\n", 1)},
+		{Name: "hpa with autoscaling v2", Input: betaHPA, Target: "v1.25.0", Expected: convertedHPA},
+		{Name: "ingress before networking v1", Input: betaIngress, Target: "v1.16.0", Expected: strings.Replace(betaIngress, "extensions/v1beta1", "networking.k8s.io/v1beta1", 1)},
+		{Name: "ingress with networking v1", Input: betaIngress, Target: "v1.19.0", Expected: convertedIngress},
+		{Name: "priority level", Input: betaPriorityLevel, Expected: convertedPriorityLevel},
+		{Name: "priority level before v1beta3", Input: betaPriorityLevel, Target: "v1.23.0", Expected: strings.Replace(betaPriorityLevel, "/v1beta1", "/v1beta2", 1)},
+		{Name: "priority level before v1", Input: betaPriorityLevel, Target: "v1.28.0", Expected: strings.Replace(convertedPriorityLevel, "/v1\n", "/v1beta3\n", 1)},
+		{Name: "pdb", Input: betaPDB, Expected: convertedPDB},
+		{Name: "pdb deprecated in target", Input: betaPDB, Target: "v1.21.0", Expected: convertedPDB},
+		{Name: "pdb served in target", Input: betaPDB, Target: "v1.20.0", Expected: betaPDB},
+		{Name: "current api", Input: onePod, Expected: onePod},
+		{Name: "psp", Input: betaPSP, Expected: betaPSP},
+		{Name: "psp removed in target", Input: betaPSP, Target: "v1.25.0", Err: "input.yaml:2: PodSecurityPolicy restricted: policy/v1beta1 PodSecurityPolicy is deprecated in v1.21+, unavailable in v1.25+ has no replacement to convert to"},
+		{Name: "webhook side effects", Input: betaWebhook, Err: "input.yaml:2: ValidatingWebhookConfiguration policy: failed to convert admissionregistration.k8s.io/v1beta1 to admissionregistration.k8s.io/v1, got err: webhooks[0].sideEffects must be None or NoneOnDryRun in v1, check what the webhook does and set it"},
+	}
+
+	for _, tt := range cases {
+		var target *version.Version
+		if tt.Target != "" {
+			target = version.MustParseGeneric(tt.Target)
+		}
+
+		converted, err := upgradeInput(t, tt.Input, target)
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+
+		expected, err := decodeManifests([]inputFile{{source: "expected.yaml", contents: []byte(tt.Expected)}})
+		require.NoError(t, err, "test: %s: failed to decode expected objects", tt.Name)
+		require.Equal(t, expected[0].obj.Object, converted[0].obj.Object, "test: %s", tt.Name)
+		require.Equal(t, expected[0].obj.GroupVersionKind(), *converted[0].gvk, "test: %s", tt.Name)
+	}
+}
+
+func TestConvertedWebhookKeepsDefaults(t *testing.T) {
+	input := betaWebhook + "  sideEffects: None\n"
+	converted, err := upgradeInput(t, input, nil)
+	require.NoError(t, err, "failed to convert webhook")
+
+	webhook := converted[0].obj.Object["webhooks"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "Ignore", webhook["failurePolicy"])
+	require.Equal(t, "Exact", webhook["matchPolicy"])
+	require.Equal(t, int64(30), webhook["timeoutSeconds"])
+	require.Equal(t, []interface{}{"v1beta1"}, webhook["admissionReviewVersions"])
+}
+
+func TestEncodeManifests(t *testing.T) {
+	converted, err := upgradeInput(t, betaPDB+"---"+onePod, nil)
+	require.NoError(t, err, "failed to convert objects")
+
+	data, err := encodeManifests(converted, "yaml")
+	require.NoError(t, err, "failed to encode objects")
+
+	// The output decodes back to the same objects.
+	decoded, err := decodeManifests([]inputFile{{source: "output.yaml", contents: data}})
+	require.NoError(t, err, "failed to decode output")
+	require.Len(t, decoded, 2)
+	require.Equal(t, converted[0].obj.Object, decoded[0].obj.Object)
+	require.Equal(t, converted[1].obj.Object, decoded[1].obj.Object)
+}
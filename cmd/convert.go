@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// convertCmd represents the convert command
+var convertCmd = &cobra.Command{
+	Use:   "convert",
+	Short: "Convert configuration files from deprecated API versions",
+	Long: `Convert rewrites the resources passed to it from deprecated API versions to
+their current replacements, for instance policy/v1beta1 PodDisruptionBudget to
+policy/v1, and prints them to stdout. Fields whose schema changed between the
+versions are rewritten too. Conversions that can't be done safely, such as a
+webhook with unknown side effects, fail with an explanation.
+
+Every deprecated API is converted unless --target-version is passed, in which
+case only those deprecated or removed in that Kubernetes version are. Comments
+and formatting in the input are not preserved.
+
+Examples:
+	# Convert a manifest in place.
+	kubecuttle convert -f ingress.yaml > ingress.new.yaml && mv ingress.new.yaml ingress.yaml
+
+	# Only convert what needs to change before upgrading to v1.25.
+	kubecuttle convert -f ./manifests.yaml --target-version v1.25
+`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("could not get value of output flag, got err: %s", err)
+		}
+		if output != "yaml" && output != "json" {
+			return fmt.Errorf("output must be one of yaml or json, got: %s", output)
+		}
+
+		target, err := targetVersionFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		files, err := readInputFiles(cmd)
+		if err != nil {
+			return err
+		}
+
+		manifests, err := decodeManifests(files)
+		if err != nil {
+			return fmt.Errorf("failed to decode objects, got err: %w", err)
+		}
+		if err := transformManifests(cmd, manifests); err != nil {
+			return err
+		}
+
+		report := func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format, args...)
+		}
+		if err := upgradeManifests(manifests, target, report); err != nil {
+			return err
+		}
+
+		data, err := encodeManifests(manifests, output)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stdout.Write(data)
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(convertCmd)
+
+	convertCmd.PersistentFlags().StringSliceP("file", "f", nil, "pass a file path or pass - to convert yaml configuration from STDIN")
+	convertCmd.PersistentFlags().String("target-version", "", "only convert APIs deprecated or removed in this Kubernetes version, e.g. v1.25")
+	convertCmd.PersistentFlags().StringP("output", "o", "yaml", "output format. One of yaml or json")
+	addTemplateFlags(convertCmd.PersistentFlags())
+	addTransformFlags(convertCmd.PersistentFlags())
+}
+
+// encodeManifests renders manifests as a YAML stream, or as a JSON List if
+// output is json.
+func encodeManifests(manifests []manifestObject, output string) ([]byte, error) {
+	if output == "json" {
+		items := make([]interface{}, 0, len(manifests))
+		for _, m := range manifests {
+			items = append(items, m.obj.Object)
+		}
+		list := map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": items}
+
+		data, err := json.MarshalIndent(list, "", "    ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode objects as json, got err: %w", err)
+		}
+		return append(data, '\n'), nil
+	}
+
+	var b bytes.Buffer
+	for i, m := range manifests {
+		data, err := yaml.Marshal(m.obj.Object)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s as yaml, got err: %w", describeObject(m.obj), err)
+		}
+		if i > 0 {
+			b.WriteString("---\n")
+		}
+		b.Write(data)
+	}
+
+	return b.Bytes(), nil
+}
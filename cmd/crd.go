@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	serializerYaml "k8s.io/apimachinery/pkg/runtime/serializer/yaml"
+)
+
+const crdGroup = "apiextensions.k8s.io"
+
+// isCRD reports whether gvk is a CustomResourceDefinition.
+func isCRD(gvk schema.GroupVersionKind) bool {
+	return gvk.Group == crdGroup && gvk.Kind == "CustomResourceDefinition"
+}
+
+// loadCRDFiles reads the schemas for custom resources from files, or
+// directories of files, containing CustomResourceDefinitions. Any other
+// objects in the files are ignored.
+func loadCRDFiles(paths []string) (*staticSchemaSource, error) {
+	schemas := newOpenAPISchemas()
+	decodingSerializer := serializerYaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
+
+	for _, path := range paths {
+		files, err := expandSchemaPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CRD file: %s, got err: %w", file, err)
+			}
+
+			objects, err := decodeInput(contents)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode CRD file: %s, got err: %w", file, err)
+			}
+
+			for _, object := range objects {
+				obj := &unstructured.Unstructured{}
+				_, gvk, err := decodeRawObjects(decodingSerializer, object.Raw, obj)
+				if err != nil {
+					return nil, fmt.Errorf("failed to decode object in CRD file: %s, got err: %w", file, err)
+				}
+				if !isCRD(*gvk) {
+					continue
+				}
+
+				if err := addCRDSchemas(schemas, obj); err != nil {
+					return nil, fmt.Errorf("failed to read schema from CRD %s in %s, got err: %w", obj.GetName(), file, err)
+				}
+			}
+		}
+	}
+
+	return &staticSchemaSource{schemas: schemas}, nil
+}
+
+// crdSchemaSourceFromManifests returns the schemas for the custom resources
+// defined by any CustomResourceDefinitions among manifests, so custom
+// resources can be validated alongside the CRDs that define them.
+func crdSchemaSourceFromManifests(manifests []manifestObject) (*staticSchemaSource, error) {
+	schemas := newOpenAPISchemas()
+	for _, manifest := range manifests {
+		if !isCRD(*manifest.gvk) {
+			continue
+		}
+
+		if err := addCRDSchemas(schemas, manifest.obj); err != nil {
+			return nil, fmt.Errorf("failed to read schema from CRD %s in %s, got err: %w", manifest.obj.GetName(), manifest.source.locate(manifest.index, nil), err)
+		}
+	}
+
+	return &staticSchemaSource{schemas: schemas}, nil
+}
+
+// addCRDSchemas adds the schema for each version a CustomResourceDefinition
+// serves. Both apiextensions.k8s.io/v1 and v1beta1 CRDs are understood.
+func addCRDSchemas(schemas *openAPISchemas, crd *unstructured.Unstructured) error {
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	kind, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+	if group == "" || kind == "" {
+		return fmt.Errorf("spec.group and spec.names.kind must be set")
+	}
+
+	// v1beta1 CRDs may have one schema for all versions.
+	shared, _, _ := unstructured.NestedMap(crd.Object, "spec", "validation", "openAPIV3Schema")
+
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	if len(versions) == 0 {
+		// Older v1beta1 CRDs only have a single version.
+		version, _, _ := unstructured.NestedString(crd.Object, "spec", "version")
+		versions = []interface{}{map[string]interface{}{"name": version}}
+	}
+
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, _, _ := unstructured.NestedString(version, "name")
+		raw, found, _ := unstructured.NestedMap(version, "schema", "openAPIV3Schema")
+		if !found {
+			raw = shared
+		}
+		if name == "" || raw == nil {
+			continue
+		}
+
+		definition, err := crdSchema(raw)
+		if err != nil {
+			return err
+		}
+		schemas.kinds[schema.GroupVersionKind{Group: group, Version: name, Kind: kind}] = definition
+	}
+
+	return nil
+}
+
+// crdSchema converts a CRD's openAPIV3Schema into an openAPISchema. The API
+// server always allows apiVersion, kind and metadata on custom resources.
+func crdSchema(raw map[string]interface{}) (*openAPISchema, error) {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	definition := &openAPISchema{}
+	if err := json.Unmarshal(data, definition); err != nil {
+		return nil, err
+	}
+	definition.EmbeddedResource = true
+
+	return definition, nil
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+// deletePollInterval is how often an object is checked for when waiting for
+// it to be deleted.
+const deletePollInterval time.Duration = time.Second
+
+// deleteCmd represents the delete command
+var deleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete the resources in a configuration via a file or stdin",
+	Long: `Delete removes the resources passed to it from the cluster, mimicking the
+behaviour of kubectl delete -f. Objects are deleted in the reverse of the
+order they'd be created in, so custom resources go before their CRDs and
+namespaces go last.
+
+Examples:
+	# Delete the pods in a file and wait for them to be gone.
+	kubecuttle delete -f ./pod.yaml --wait
+
+	# Delete a deployment but leave its pods running.
+	kubecuttle delete -f ./deployment.yaml --cascade=orphan
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		policy, err := retryPolicyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		options, err := deleteOptionsFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		cacheDir, err := cacheDirFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		ttl, err := discoveryTTLFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		files, err := readInputFiles(cmd)
+		if err != nil {
+			return err
+		}
+
+		manifests, err := decodeManifests(files)
+		if err != nil {
+			return fmt.Errorf("failed to decode objects, got err: %w", err)
+		}
+		if err := transformManifests(cmd, manifests); err != nil {
+			return err
+		}
+
+		config, err := buildConfig()
+		if err != nil {
+			return fmt.Errorf("failed to build config, got err: %w", err)
+		}
+
+		// Deleting from a protected cluster always needs its name
+		// confirming.
+		protected, err := checkProtection(cmd, viper.GetViper(), config, files, time.Now())
+		if err != nil {
+			return err
+		}
+		if protected != nil {
+			if err := protected.confirm(cmd, readsStdin(files), os.Stdout); err != nil {
+				return err
+			}
+		}
+
+		dynamicClient, err := dynamicClientInit(config)
+		if err != nil {
+			return fmt.Errorf("failed to build clients: %w", err)
+		}
+
+		discoveryClient, mapper, err := buildCachedDiscovery(config, cacheDir, ttl)
+		if err != nil {
+			return err
+		}
+
+		for _, manifest := range sortForDelete(manifests) {
+			obj, gvk := manifest.obj, manifest.gvk
+
+			gvr, err := getResourceMapping(mapper, gvk)
+			if err != nil {
+				err = explainMappingError(err, *gvk, discoveryClient)
+				return fmt.Errorf("failed to get gvr for %s, got err: %w", manifest.source.locate(manifest.index, nil), err)
+			}
+
+			dr := getRESTMapping(dynamicClient, gvr.Scope.Name(), obj.GetNamespace(), gvr.Resource)
+
+			deleted, err := deleteObject(dr, obj, options, policy)
+			if err != nil {
+				return fmt.Errorf("failed to delete obj, got err: %w", err)
+			}
+			if !deleted {
+				continue
+			}
+
+			fmt.Printf("\n%s %s/%s deleted\n", gvk.Kind, obj.GetNamespace(), obj.GetName())
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(deleteCmd)
+
+	deleteCmd.PersistentFlags().StringSliceP("file", "f", nil, "pass a file path or pass - to delete the resources in yaml configuration from STDIN")
+	deleteCmd.PersistentFlags().Duration("timeout", defaultObjectTimeout, "time allowed to delete each object, including retries and waiting for it to be gone. Zero means no limit")
+	deleteCmd.PersistentFlags().Duration("request-timeout", defaultTimeout, "time allowed for a single request to the API server")
+	deleteCmd.PersistentFlags().String("cascade", string(metav1.DeletePropagationBackground), "how dependents such as a deployment's pods are deleted. One of background, foreground or orphan")
+	deleteCmd.PersistentFlags().Int64("grace-period", -1, "seconds given to the resource to terminate gracefully. A negative value uses the resource's default")
+	deleteCmd.PersistentFlags().Bool("wait", false, "wait for each object to be gone before deleting the next")
+	addProtectionFlags(deleteCmd.PersistentFlags())
+	deleteCmd.PersistentFlags().Bool("ignore-not-found", false, "treat objects that don't exist as successfully deleted")
+	addTemplateFlags(deleteCmd.PersistentFlags())
+	addTransformFlags(deleteCmd.PersistentFlags())
+}
+
+// deleteOptions controls how objects are deleted.
+type deleteOptions struct {
+	propagation    metav1.DeletionPropagation
+	gracePeriod    *int64
+	wait           bool
+	ignoreNotFound bool
+}
+
+// deleteOptionsFromFlags reads the delete command's flags.
+func deleteOptionsFromFlags(cmd *cobra.Command) (deleteOptions, error) {
+	options := deleteOptions{}
+
+	cascade, err := cmd.Flags().GetString("cascade")
+	if err != nil {
+		return options, fmt.Errorf("could not get value of cascade flag, got err: %s", err)
+	}
+	switch cascade {
+	case "background":
+		options.propagation = metav1.DeletePropagationBackground
+	case "foreground":
+		options.propagation = metav1.DeletePropagationForeground
+	case "orphan":
+		options.propagation = metav1.DeletePropagationOrphan
+	default:
+		return options, fmt.Errorf("cascade must be one of background, foreground or orphan, got: %s", cascade)
+	}
+
+	gracePeriod, err := cmd.Flags().GetInt64("grace-period")
+	if err != nil {
+		return options, fmt.Errorf("could not get value of grace-period flag, got err: %s", err)
+	}
+	if gracePeriod >= 0 {
+		options.gracePeriod = &gracePeriod
+	}
+
+	options.wait, err = cmd.Flags().GetBool("wait")
+	if err != nil {
+		return options, fmt.Errorf("could not get value of wait flag, got err: %s", err)
+	}
+
+	options.ignoreNotFound, err = cmd.Flags().GetBool("ignore-not-found")
+	if err != nil {
+		return options, fmt.Errorf("could not get value of ignore-not-found flag, got err: %s", err)
+	}
+
+	return options, nil
+}
+
+// deleteObject deletes obj and, if asked to, waits for it to be gone. It
+// returns false if the object didn't exist and options allow that.
+func deleteObject(dr dynamic.ResourceInterface, obj *unstructured.Unstructured, options deleteOptions, policy retryPolicy) (bool, error) {
+	ctx := context.Background()
+	if policy.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.timeout)
+		defer cancel()
+	}
+
+	// Remember which object we deleted so that waiting isn't fooled by
+	// one recreated with the same name.
+	var uid string
+	err := policy.do(func(ctx context.Context) error {
+		existing, err := dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		uid = string(existing.GetUID())
+
+		return dr.Delete(ctx, obj.GetName(), metav1.DeleteOptions{
+			PropagationPolicy:  &options.propagation,
+			GracePeriodSeconds: options.gracePeriod,
+		})
+	})
+	if apierrors.IsNotFound(err) {
+		if options.ignoreNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	if err != nil || !options.wait {
+		return err == nil, err
+	}
+
+	err = wait.PollImmediateUntil(deletePollInterval, func() (bool, error) {
+		var existing *unstructured.Unstructured
+		err := policy.do(func(ctx context.Context) error {
+			var err error
+			existing, err = dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			return err
+		})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return string(existing.GetUID()) != uid, nil
+	}, ctx.Done())
+	if err == wait.ErrWaitTimeout {
+		return false, fmt.Errorf("timed out waiting for %s to be deleted", describeObject(obj))
+	}
+
+	return err == nil, err
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestSortForDelete(t *testing.T) {
+	input := `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: sre-test
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+  namespace: sre-test
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: sre-test
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: my-widget
+  namespace: sre-test
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: second
+  namespace: sre-test
+`
+	manifests, err := decodeManifests([]inputFile{{source: "input.yaml", contents: []byte(input)}})
+	require.NoError(t, err, "failed to decode objects")
+
+	names := []string{}
+	for _, m := range sortForDelete(manifests) {
+		names = append(names, m.obj.GetName())
+	}
+	require.Equal(t, []string{"my-widget", "web", "widgets.example.com", "second", "first", "sre-test"}, names)
+}
+
+func TestDeleteObject(t *testing.T) {
+	manifests, err := decodeManifests([]inputFile{{source: "input.yaml", contents: []byte(onePod)}})
+	require.NoError(t, err, "failed to decode objects")
+	pod := manifests[0].obj
+
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), pod.DeepCopy())
+	dr := client.Resource(podsResource.WithVersion("v1")).Namespace(pod.GetNamespace())
+	options := deleteOptions{propagation: metav1.DeletePropagationBackground, wait: true}
+
+	deleted, err := deleteObject(dr, pod, options, testRetryPolicy())
+	require.NoError(t, err, "failed to delete pod")
+	require.True(t, deleted, "expected pod to be deleted")
+
+	_, err = dr.Get(context.Background(), pod.GetName(), metav1.GetOptions{})
+	require.True(t, apierrors.IsNotFound(err), "expected pod to be gone, got err: %v", err)
+
+	// Deleting it again fails unless not found is ignored.
+	_, err = deleteObject(dr, pod, options, testRetryPolicy())
+	require.True(t, apierrors.IsNotFound(err), "expected not found, got err: %v", err)
+
+	options.ignoreNotFound = true
+	deleted, err = deleteObject(dr, pod, options, testRetryPolicy())
+	require.NoError(t, err, "expected not found to be ignored")
+	require.False(t, deleted, "expected nothing to be deleted")
+}
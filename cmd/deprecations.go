@@ -0,0 +1,259 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+)
+
+// apiLifecycle records when a group version of a built in kind was
+// deprecated, and when it was or will be removed.
+type apiLifecycle struct {
+	gvk schema.GroupVersionKind
+	// deprecatedIn is the Kubernetes minor version the API was deprecated
+	// in.
+	deprecatedIn *version.Version
+	// removedIn is the Kubernetes minor version the API was removed in.
+	removedIn *version.Version
+	// replacement is the API to use instead. It's empty if the kind was
+	// removed without a replacement. It may be deprecated itself, in
+	// which case it has a lifecycle of its own.
+	replacement schema.GroupVersionKind
+	// replacementIn is the Kubernetes minor version the replacement was
+	// first served in.
+	replacementIn *version.Version
+}
+
+// deprecatedAt reports whether the API is deprecated, but still served, by
+// Kubernetes at version v.
+func (l apiLifecycle) deprecatedAt(v *version.Version) bool {
+	return atLeastMinor(v, l.deprecatedIn) && !l.removedAt(v)
+}
+
+// removedAt reports whether the API has been removed from Kubernetes at
+// version v.
+func (l apiLifecycle) removedAt(v *version.Version) bool {
+	return l.removedIn != nil && atLeastMinor(v, l.removedIn)
+}
+
+// replacementServedAt reports whether the API's replacement is served by
+// Kubernetes at version v.
+func (l apiLifecycle) replacementServedAt(v *version.Version) bool {
+	return l.replacement.Kind != "" && (l.replacementIn == nil || atLeastMinor(v, l.replacementIn))
+}
+
+// replacements returns the API's replacement followed by theirs, in turn,
+// ending with the current one.
+func (l apiLifecycle) replacements() []apiLifecycle {
+	chain := []apiLifecycle{}
+	for l.replacement.Kind != "" {
+		chain = append(chain, l)
+		next, ok := apiLifecycles[l.replacement]
+		if !ok {
+			break
+		}
+		l = next
+	}
+
+	return chain
+}
+
+// replacementAt returns the newest replacement for the API served by
+// Kubernetes at version v, or the current one if v is nil. It's empty if
+// there's none.
+func (l apiLifecycle) replacementAt(v *version.Version) schema.GroupVersionKind {
+	replacement := schema.GroupVersionKind{}
+	for _, step := range l.replacements() {
+		if v != nil && !step.replacementServedAt(v) {
+			break
+		}
+		replacement = step.replacement
+	}
+
+	return replacement
+}
+
+// String describes the API's lifecycle the same way the API server's
+// deprecation warnings do.
+func (l apiLifecycle) String() string {
+	return l.describeAt(nil)
+}
+
+// describeAt describes the API's lifecycle like String, suggesting the
+// newest replacement served by Kubernetes at version v.
+func (l apiLifecycle) describeAt(v *version.Version) string {
+	msg := fmt.Sprintf("%s %s is deprecated in v%d.%d+", l.gvk.GroupVersion(), l.gvk.Kind, l.deprecatedIn.Major(), l.deprecatedIn.Minor())
+	if l.removedIn != nil {
+		msg += fmt.Sprintf(", unavailable in v%d.%d+", l.removedIn.Major(), l.removedIn.Minor())
+	}
+	if replacement := l.replacementAt(v); replacement.Kind != "" {
+		msg += fmt.Sprintf("; use %s %s", replacement.GroupVersion(), replacement.Kind)
+	}
+
+	return msg
+}
+
+// apiLifecycles lists the deprecated built in APIs, see
+// https://kubernetes.io/docs/reference/using-api/deprecation-guide/
+var apiLifecycles = buildAPILifecycles()
+
+// buildAPILifecycles builds apiLifecycles from a more compact description.
+// Each API is replaced by the next one that was served by the time it was
+// deprecated, so converting for an older target stops at an API that target
+// serves.
+func buildAPILifecycles() map[schema.GroupVersionKind]apiLifecycle {
+	lifecycles := map[schema.GroupVersionKind]apiLifecycle{}
+	// add records that from was deprecated and removed in the given
+	// versions, replaced by to, which was first served in toIn.
+	add := func(deprecatedIn, removedIn, from, to, toIn string, kinds ...string) {
+		fromGV, _ := schema.ParseGroupVersion(from)
+		toGV, _ := schema.ParseGroupVersion(to)
+		for _, kind := range kinds {
+			lifecycle := apiLifecycle{
+				gvk:          fromGV.WithKind(kind),
+				deprecatedIn: version.MustParseGeneric(deprecatedIn),
+			}
+			if removedIn != "" {
+				lifecycle.removedIn = version.MustParseGeneric(removedIn)
+			}
+			if to != "" {
+				lifecycle.replacement = toGV.WithKind(kind)
+				lifecycle.replacementIn = version.MustParseGeneric(toIn)
+			}
+			lifecycles[lifecycle.gvk] = lifecycle
+		}
+	}
+
+	// v1.16
+	add("1.8", "1.16", "extensions/v1beta1", "apps/v1", "1.9", "Deployment", "DaemonSet", "ReplicaSet")
+	add("1.9", "1.16", "extensions/v1beta1", "networking.k8s.io/v1", "1.7", "NetworkPolicy")
+	add("1.11", "1.16", "extensions/v1beta1", "policy/v1beta1", "1.10", "PodSecurityPolicy")
+	add("1.8", "1.16", "apps/v1beta1", "apps/v1", "1.9", "Deployment", "StatefulSet", "ControllerRevision")
+	add("1.9", "1.16", "apps/v1beta2", "apps/v1", "1.9", "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ControllerRevision")
+
+	// v1.22
+	add("1.14", "1.22", "extensions/v1beta1", "networking.k8s.io/v1beta1", "1.14", "Ingress")
+	add("1.19", "1.22", "networking.k8s.io/v1beta1", "networking.k8s.io/v1", "1.19", "Ingress", "IngressClass")
+	add("1.16", "1.22", "apiextensions.k8s.io/v1beta1", "apiextensions.k8s.io/v1", "1.16", "CustomResourceDefinition")
+	add("1.19", "1.22", "apiregistration.k8s.io/v1beta1", "apiregistration.k8s.io/v1", "1.10", "APIService")
+	add("1.19", "1.22", "authentication.k8s.io/v1beta1", "authentication.k8s.io/v1", "1.6", "TokenReview")
+	add("1.19", "1.22", "authorization.k8s.io/v1beta1", "authorization.k8s.io/v1", "1.6", "SubjectAccessReview", "LocalSubjectAccessReview", "SelfSubjectAccessReview", "SelfSubjectRulesReview")
+	add("1.19", "1.22", "certificates.k8s.io/v1beta1", "certificates.k8s.io/v1", "1.19", "CertificateSigningRequest")
+	add("1.19", "1.22", "coordination.k8s.io/v1beta1", "coordination.k8s.io/v1", "1.14", "Lease")
+	add("1.16", "1.22", "admissionregistration.k8s.io/v1beta1", "admissionregistration.k8s.io/v1", "1.16", "MutatingWebhookConfiguration", "ValidatingWebhookConfiguration")
+	add("1.17", "1.22", "rbac.authorization.k8s.io/v1beta1", "rbac.authorization.k8s.io/v1", "1.8", "ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding")
+	add("1.14", "1.22", "scheduling.k8s.io/v1beta1", "scheduling.k8s.io/v1", "1.14", "PriorityClass")
+	add("1.19", "1.22", "storage.k8s.io/v1beta1", "storage.k8s.io/v1", "1.18", "CSIDriver")
+	add("1.19", "1.22", "storage.k8s.io/v1beta1", "storage.k8s.io/v1", "1.17", "CSINode")
+	add("1.19", "1.22", "storage.k8s.io/v1beta1", "storage.k8s.io/v1", "1.6", "StorageClass")
+	add("1.19", "1.22", "storage.k8s.io/v1beta1", "storage.k8s.io/v1", "1.13", "VolumeAttachment")
+
+	// v1.25
+	add("1.21", "1.25", "batch/v1beta1", "batch/v1", "1.21", "CronJob")
+	add("1.21", "1.25", "discovery.k8s.io/v1beta1", "discovery.k8s.io/v1", "1.21", "EndpointSlice")
+	add("1.19", "1.25", "events.k8s.io/v1beta1", "events.k8s.io/v1", "1.19", "Event")
+	add("1.22", "1.25", "autoscaling/v2beta1", "autoscaling/v2beta2", "1.12", "HorizontalPodAutoscaler")
+	add("1.21", "1.25", "policy/v1beta1", "policy/v1", "1.21", "PodDisruptionBudget")
+	add("1.21", "1.25", "policy/v1beta1", "", "", "PodSecurityPolicy")
+	add("1.20", "1.25", "node.k8s.io/v1beta1", "node.k8s.io/v1", "1.20", "RuntimeClass")
+
+	// v1.26
+	add("1.23", "1.26", "autoscaling/v2beta2", "autoscaling/v2", "1.23", "HorizontalPodAutoscaler")
+	add("1.23", "1.26", "flowcontrol.apiserver.k8s.io/v1beta1", "flowcontrol.apiserver.k8s.io/v1beta2", "1.23", "FlowSchema", "PriorityLevelConfiguration")
+
+	// v1.27
+	add("1.24", "1.27", "storage.k8s.io/v1beta1", "storage.k8s.io/v1", "1.24", "CSIStorageCapacity")
+
+	// v1.29
+	add("1.26", "1.29", "flowcontrol.apiserver.k8s.io/v1beta2", "flowcontrol.apiserver.k8s.io/v1beta3", "1.26", "FlowSchema", "PriorityLevelConfiguration")
+
+	// v1.32
+	add("1.29", "1.32", "flowcontrol.apiserver.k8s.io/v1beta3", "flowcontrol.apiserver.k8s.io/v1", "1.29", "FlowSchema", "PriorityLevelConfiguration")
+
+	return lifecycles
+}
+
+// atLeastMinor reports whether v is at least the same minor version as min,
+// ignoring patch versions.
+func atLeastMinor(v, min *version.Version) bool {
+	if v.Major() != min.Major() {
+		return v.Major() > min.Major()
+	}
+
+	return v.Minor() >= min.Minor()
+}
+
+// targetVersionFromFlags reads the target-version flag. It returns nil if
+// the flag wasn't set.
+func targetVersionFromFlags(cmd *cobra.Command) (*version.Version, error) {
+	target, err := cmd.Flags().GetString("target-version")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of target-version flag, got err: %s", err)
+	}
+	if target == "" {
+		return nil, nil
+	}
+
+	v, err := version.ParseGeneric(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target-version %q, expected a Kubernetes version such as v1.25, got err: %w", target, err)
+	}
+
+	return v, nil
+}
+
+// serverVersion returns the Kubernetes version the API server reports.
+func serverVersion(client discovery.ServerVersionInterface) (*version.Version, error) {
+	info, err := client.ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server version, got err: %w", err)
+	}
+
+	if v, err := version.ParseGeneric(info.GitVersion); err == nil {
+		return v, nil
+	}
+
+	// Some managed clusters report versions like 1.25+ in their
+	// major and minor fields.
+	v, err := version.ParseGeneric(fmt.Sprintf("%s.%s", strings.TrimSuffix(info.Major, "+"), strings.TrimSuffix(info.Minor, "+")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server version %q, got err: %w", info.GitVersion, err)
+	}
+
+	return v, nil
+}
+
+// checkDeprecations looks for objects using APIs that are deprecated or
+// removed in Kubernetes at version target. Deprecated APIs are reported as
+// warnings, removed ones are an error as the API server would reject them
+// anyway, so failing before anything is sent avoids a half applied input.
+func checkDeprecations(objects []manifestObject, target *version.Version) error {
+	removed := 0
+	for _, o := range objects {
+		lifecycle, ok := apiLifecycles[*o.gvk]
+		if !ok {
+			continue
+		}
+
+		location := o.source.locate(o.index, nil)
+		switch {
+		case lifecycle.removedAt(target):
+			removed++
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", location, describeObject(o.obj), lifecycle.describeAt(target))
+		case lifecycle.deprecatedAt(target):
+			fmt.Fprintf(os.Stderr, "Warning: %s: %s: %s\n", location, describeObject(o.obj), lifecycle.describeAt(target))
+		}
+	}
+
+	if removed > 0 {
+		return fmt.Errorf("%d object(s) use APIs removed in Kubernetes v%d.%d", removed, target.Major(), target.Minor())
+	}
+
+	return nil
+}
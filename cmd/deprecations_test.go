@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var betaCronJob = `
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: backup
+  namespace: sre-test
+spec:
+  schedule: "0 * * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          restartPolicy: OnFailure
+          containers:
+          - name: backup
+            image: busybox
+`
+
+func TestAPILifecycle(t *testing.T) {
+	cronJob := apiLifecycles[schema.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "CronJob"}]
+	psp := apiLifecycles[schema.GroupVersionKind{Group: "policy", Version: "v1beta1", Kind: "PodSecurityPolicy"}]
+
+	cases := []struct {
+		Name       string
+		Lifecycle  apiLifecycle
+		Version    string
+		Deprecated bool
+		Removed    bool
+	}{
+		{"before deprecation", cronJob, "1.20.4", false, false},
+		{"deprecated", cronJob, "v1.21.0", true, false},
+		{"deprecated patch release", cronJob, "1.24.17", true, false},
+		{"removed", cronJob, "1.25.0", false, true},
+		{"removed in later release", cronJob, "1.30", false, true},
+		{"removed without replacement", psp, "1.25.0", false, true},
+	}
+
+	for _, tt := range cases {
+		v := utilversion.MustParseGeneric(tt.Version)
+		require.Equal(t, tt.Deprecated, tt.Lifecycle.deprecatedAt(v), "test: %s", tt.Name)
+		require.Equal(t, tt.Removed, tt.Lifecycle.removedAt(v), "test: %s", tt.Name)
+	}
+
+	require.Equal(t, "batch/v1beta1 CronJob is deprecated in v1.21+, unavailable in v1.25+; use batch/v1 CronJob", cronJob.String())
+	require.Equal(t, "policy/v1beta1 PodSecurityPolicy is deprecated in v1.21+, unavailable in v1.25+", psp.String())
+}
+
+func TestAPILifecycleReplacementAt(t *testing.T) {
+	ingress := apiLifecycles[schema.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "Ingress"}]
+	hpa := apiLifecycles[schema.GroupVersionKind{Group: "autoscaling", Version: "v2beta1", Kind: "HorizontalPodAutoscaler"}]
+	priorityLevel := apiLifecycles[schema.GroupVersionKind{Group: "flowcontrol.apiserver.k8s.io", Version: "v1beta1", Kind: "PriorityLevelConfiguration"}]
+
+	cases := []struct {
+		Name      string
+		Lifecycle apiLifecycle
+		Version   string
+		Expected  string
+	}{
+		{"ingress before networking v1", ingress, "1.14.0", "networking.k8s.io/v1beta1"},
+		{"ingress last release without networking v1", ingress, "1.18.3", "networking.k8s.io/v1beta1"},
+		{"ingress with networking v1", ingress, "1.19.0", "networking.k8s.io/v1"},
+		{"hpa before autoscaling v2", hpa, "1.22.0", "autoscaling/v2beta2"},
+		{"hpa with autoscaling v2", hpa, "1.23.0", "autoscaling/v2"},
+		{"priority level before v1beta3", priorityLevel, "1.23.0", "flowcontrol.apiserver.k8s.io/v1beta2"},
+		{"priority level before v1", priorityLevel, "1.28.0", "flowcontrol.apiserver.k8s.io/v1beta3"},
+		{"priority level with v1", priorityLevel, "1.29.0", "flowcontrol.apiserver.k8s.io/v1"},
+	}
+
+	for _, tt := range cases {
+		v := utilversion.MustParseGeneric(tt.Version)
+		require.Equal(t, tt.Expected, tt.Lifecycle.replacementAt(v).GroupVersion().String(), "test: %s", tt.Name)
+	}
+
+	require.Equal(t, "autoscaling/v2beta1 HorizontalPodAutoscaler is deprecated in v1.22+, unavailable in v1.25+; use autoscaling/v2beta2 HorizontalPodAutoscaler", hpa.describeAt(utilversion.MustParseGeneric("1.22.0")))
+	require.Equal(t, "autoscaling/v2beta1 HorizontalPodAutoscaler is deprecated in v1.22+, unavailable in v1.25+; use autoscaling/v2 HorizontalPodAutoscaler", hpa.String())
+}
+
+func TestCheckDeprecations(t *testing.T) {
+	manifests, err := decodeManifests([]inputFile{{source: "input.yaml", contents: []byte(betaCronJob + "---" + onePod)}})
+	require.NoError(t, err, "failed to decode objects")
+
+	cases := []struct {
+		Name    string
+		Version string
+		Err     string
+	}{
+		{"served", "v1.20.0", ""},
+		{"deprecated", "v1.24.0", ""},
+		{"removed", "v1.25.0", "1 object(s) use APIs removed in Kubernetes v1.25"},
+	}
+
+	for _, tt := range cases {
+		err := checkDeprecations(manifests, utilversion.MustParseGeneric(tt.Version))
+		if tt.Err == "" {
+			require.NoError(t, err, "test: %s", tt.Name)
+			continue
+		}
+		require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Info    version.Info
+		Version string
+	}{
+		{"release", version.Info{Major: "1", Minor: "22", GitVersion: "v1.22.1"}, "1.22.1"},
+		{"managed cluster", version.Info{Major: "1", Minor: "21+", GitVersion: "v1.21.2-eks-0389ca3"}, "1.21.2"},
+		{"unparseable git version", version.Info{Major: "1", Minor: "23+", GitVersion: "unknown"}, "1.23"},
+	}
+
+	for _, tt := range cases {
+		info := tt.Info
+		client := &fake.FakeDiscovery{Fake: &clienttesting.Fake{}, FakedServerVersion: &info}
+		v, err := serverVersion(client)
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Version, v.String(), "test: %s", tt.Name)
+	}
+}
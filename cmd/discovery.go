@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/disk"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// defaultDiscoveryTTL is how long discovery data cached on disk is trusted
+// for before it's fetched again.
+const defaultDiscoveryTTL time.Duration = 10 * time.Minute
+
+// discoveryTTLFromFlags reads the discovery-ttl flag.
+func discoveryTTLFromFlags(cmd *cobra.Command) (time.Duration, error) {
+	ttl, err := cmd.Flags().GetDuration("discovery-ttl")
+	if err != nil {
+		return 0, fmt.Errorf("could not get value of discovery-ttl flag, got err: %s", err)
+	}
+
+	return ttl, nil
+}
+
+// buildCachedDiscovery returns a discovery client that caches what it
+// fetches under cacheDir, and a RESTMapper built on top of it.
+//
+// Discovery is a round trip per group version, which adds up on clusters
+// with a lot of CRDs, so results are cached on disk for ttl. The RESTMapper
+// only runs discovery the first time it's asked for a mapping. If the
+// cached data doesn't know about a kind, for instance because its CRD was
+// installed since, the cache is invalidated and discovery run again before
+// giving up. Passing an empty cacheDir keeps the cache in memory only.
+func buildCachedDiscovery(config *rest.Config, cacheDir string, ttl time.Duration) (discovery.CachedDiscoveryInterface, meta.RESTMapper, error) {
+	var client discovery.CachedDiscoveryInterface
+	if cacheDir == "" {
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to build discovery client, got err: %w", err)
+		}
+		client = memory.NewMemCacheClient(discoveryClient)
+	} else {
+		// Share kubectl's layout so both tools benefit from each
+		// other's cache.
+		discoveryCacheDir := hostCacheDir(filepath.Join(cacheDir, "discovery"), config.Host)
+		httpCacheDir := filepath.Join(cacheDir, "http")
+
+		cachedClient, err := disk.NewCachedDiscoveryClientForConfig(config, discoveryCacheDir, httpCacheDir, ttl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to build cached discovery client, got err: %w", err)
+		}
+		client = cachedClient
+	}
+
+	// The deferred mapper resets itself, invalidating the cache, and
+	// retries when a lookup fails against stale data. The shortcut
+	// expander lets resources be referred to by their short names.
+	mapper := restmapper.NewShortcutExpander(restmapper.NewDeferredDiscoveryRESTMapper(client), client)
+
+	return client, mapper, nil
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+)
+
+// discoveryServer serves the discovery endpoints of an API server with core
+// v1 pods and, once installed, an example.com/v1 Widget CRD.
+type discoveryServer struct {
+	mu        sync.Mutex
+	requests  int
+	hasWidget bool
+}
+
+func (d *discoveryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests++
+
+	var body interface{}
+	switch r.URL.Path {
+	case "/api":
+		body = &metav1.APIVersions{Versions: []string{"v1"}}
+	case "/api/v1":
+		body = &metav1.APIResourceList{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Namespaced: true, Kind: "Pod", ShortNames: []string{"po"}, Verbs: metav1.Verbs{"get", "patch"}},
+			},
+		}
+	case "/apis":
+		groups := &metav1.APIGroupList{}
+		if d.hasWidget {
+			version := metav1.GroupVersionForDiscovery{GroupVersion: "example.com/v1", Version: "v1"}
+			groups.Groups = append(groups.Groups, metav1.APIGroup{
+				Name:             "example.com",
+				Versions:         []metav1.GroupVersionForDiscovery{version},
+				PreferredVersion: version,
+			})
+		}
+		body = groups
+	case "/apis/example.com/v1":
+		if !d.hasWidget {
+			http.NotFound(w, r)
+			return
+		}
+		body = &metav1.APIResourceList{
+			GroupVersion: "example.com/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "widgets", Namespaced: true, Kind: "Widget", Verbs: metav1.Verbs{"get", "patch"}},
+			},
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (d *discoveryServer) requestCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.requests
+}
+
+func (d *discoveryServer) installWidget() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hasWidget = true
+}
+
+func TestCachedDiscovery(t *testing.T) {
+	handler := &discoveryServer{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL}
+	cacheDir := t.TempDir()
+	pod := schema.GroupKind{Kind: "Pod"}
+
+	// The first run has to ask the server.
+	_, mapper, err := buildCachedDiscovery(config, cacheDir, time.Hour)
+	require.NoError(t, err, "failed to build discovery")
+	mapping, err := mapper.RESTMapping(pod, "v1")
+	require.NoError(t, err, "failed to map pod")
+	require.Equal(t, "pods", mapping.Resource.Resource)
+	require.NotZero(t, handler.requestCount(), "expected discovery to hit the server")
+
+	// Later runs are served from disk.
+	requests := handler.requestCount()
+	_, mapper, err = buildCachedDiscovery(config, cacheDir, time.Hour)
+	require.NoError(t, err, "failed to build discovery")
+	_, err = mapper.RESTMapping(pod, "v1")
+	require.NoError(t, err, "failed to map pod from the cache")
+	require.Equal(t, requests, handler.requestCount(), "expected discovery to be served from the cache")
+
+	// Kinds the cache doesn't know about cause it to be refreshed.
+	handler.installWidget()
+	_, mapper, err = buildCachedDiscovery(config, cacheDir, time.Hour)
+	require.NoError(t, err, "failed to build discovery")
+	mapping, err = mapper.RESTMapping(schema.GroupKind{Group: "example.com", Kind: "Widget"}, "v1")
+	require.NoError(t, err, "expected stale cache to be refreshed")
+	require.Equal(t, "widgets", mapping.Resource.Resource)
+
+	// Short names are expanded.
+	gvr, err := mapper.ResourceFor(schema.GroupVersionResource{Resource: "po"})
+	require.NoError(t, err, "failed to expand short name")
+	require.Equal(t, "pods", gvr.Resource)
+
+	// Without a cache directory nothing is written to disk.
+	_, mapper, err = buildCachedDiscovery(config, "", time.Hour)
+	require.NoError(t, err, "failed to build discovery")
+	_, err = mapper.RESTMapping(pod, "v1")
+	require.NoError(t, err, "failed to map pod without a cache")
+}
+
+func TestHostCacheDir(t *testing.T) {
+	require.Equal(t, "/cache/example.com_6443", hostCacheDir("/cache", "https://example.com:6443"))
+	require.Equal(t, "/cache/127.0.0.1_8080/prefix", hostCacheDir("/cache", "http://127.0.0.1:8080/prefix"))
+}
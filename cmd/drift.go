@@ -0,0 +1,410 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/structured-merge-diff/v4/fieldpath"
+	"sigs.k8s.io/structured-merge-diff/v4/value"
+)
+
+// driftCmd represents the drift command
+var driftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Report where the cluster has drifted from a configuration",
+	Long: `Drift compares the live state of the resources passed to it with the
+configuration and reports fields that were changed or taken over by another
+field manager, such as kubectl edit or a controller, fields that were removed
+and objects that were deleted. It exits with a non-zero status if anything
+has drifted, making it suitable for scheduled compliance checks.
+
+Which fields kubecuttle should own is worked out by the API server with a
+dry run apply, so nothing is changed.
+
+Examples:
+	# Check whether anyone has changed what we applied.
+	kubecuttle drift -f ./manifests.yaml
+`,
+	// Drift is reported as it's found, the usage message would only bury
+	// it.
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		policy, err := retryPolicyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		cacheDir, err := cacheDirFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		ttl, err := discoveryTTLFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		files, err := readInputFiles(cmd)
+		if err != nil {
+			return err
+		}
+
+		manifests, err := decodeManifests(files)
+		if err != nil {
+			return fmt.Errorf("failed to decode objects, got err: %w", err)
+		}
+		if err := transformManifests(cmd, manifests); err != nil {
+			return err
+		}
+		if err := rewriteImages(cmd, manifests); err != nil {
+			return err
+		}
+
+		config, err := buildConfig()
+		if err != nil {
+			return fmt.Errorf("failed to build config, got err: %w", err)
+		}
+
+		dynamicClient, err := dynamicClientInit(config)
+		if err != nil {
+			return fmt.Errorf("failed to build clients: %w", err)
+		}
+
+		discoveryClient, mapper, err := buildCachedDiscovery(config, cacheDir, ttl)
+		if err != nil {
+			return err
+		}
+
+		drifted := 0
+		for _, manifest := range manifests {
+			obj, gvk := manifest.obj, manifest.gvk
+
+			gvr, err := getResourceMapping(mapper, gvk)
+			if err != nil {
+				err = explainMappingError(err, *gvk, discoveryClient)
+				return fmt.Errorf("failed to get gvr for %s, got err: %w", manifest.source.locate(manifest.index, nil), err)
+			}
+
+			dr := getRESTMapping(dynamicClient, gvr.Scope.Name(), obj.GetNamespace(), gvr.Resource)
+
+			data, err := marshallRuntimeObj(manifest.runtimeObj)
+			if err != nil {
+				return fmt.Errorf("failed to marshal json to runtime obj, got err: %w", err)
+			}
+
+			report, err := checkDrift(dr, obj, data, policy)
+			if err != nil {
+				return fmt.Errorf("failed to check %s for drift, got err: %w", describeObject(obj), err)
+			}
+			if report.drifted() {
+				drifted++
+			}
+			printDriftReport(os.Stdout, report)
+		}
+
+		if drifted > 0 {
+			return fmt.Errorf("%d of %d object(s) have drifted", drifted, len(manifests))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(driftCmd)
+
+	driftCmd.PersistentFlags().StringSliceP("file", "f", nil, "pass a file path or pass - to check yaml configuration from STDIN")
+	driftCmd.PersistentFlags().Duration("timeout", defaultObjectTimeout, "time allowed to check each object, including retries. Zero means no limit")
+	driftCmd.PersistentFlags().Duration("request-timeout", defaultTimeout, "time allowed for a single request to the API server")
+	addTemplateFlags(driftCmd.PersistentFlags())
+	addTransformFlags(driftCmd.PersistentFlags())
+	addImageFlags(driftCmd.PersistentFlags())
+}
+
+// driftedField is a field kubecuttle should own that no longer matches the
+// configuration.
+type driftedField struct {
+	path string
+	// owned reports whether kubecuttle still owns the field.
+	owned bool
+	// managers are the other field managers that own the field now, if
+	// any.
+	managers []string
+	// live and desired are the field's values, nil if it isn't set.
+	live, desired interface{}
+}
+
+// driftReport describes how a live object differs from its configuration.
+type driftReport struct {
+	obj     *unstructured.Unstructured
+	deleted bool
+	fields  []driftedField
+}
+
+// drifted reports whether anything has drifted.
+func (r driftReport) drifted() bool {
+	return r.deleted || len(r.fields) > 0
+}
+
+// checkDrift compares the live counterpart of obj, whose JSON encoding is
+// data, with what applying data would make it.
+func checkDrift(dr dynamic.ResourceInterface, obj *unstructured.Unstructured, data []byte, policy retryPolicy) (driftReport, error) {
+	report := driftReport{obj: obj}
+
+	var live *unstructured.Unstructured
+	err := policy.do(func(ctx context.Context) error {
+		var err error
+		live, err = dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		report.deleted = true
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+
+	// Forcing the dry run means conflicts with other managers don't stop
+	// it, the result is the object kubecuttle would own everything in
+	// the configuration of.
+	force := true
+	var desired *unstructured.Unstructured
+	err = policy.do(func(ctx context.Context) error {
+		var err error
+		desired, err = dr.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+			FieldManager: fieldManager,
+			Force:        &force,
+			DryRun:       []string{metav1.DryRunAll},
+		})
+		return err
+	})
+	if err != nil {
+		return report, fmt.Errorf("dry run apply failed, got err: %w", err)
+	}
+
+	report.fields, err = compareManagedFields(live, desired)
+	return report, err
+}
+
+// compareManagedFields returns the fields kubecuttle owns in desired, the
+// result of applying the configuration to live, that it doesn't own in live
+// or whose value differs.
+func compareManagedFields(live, desired *unstructured.Unstructured) ([]driftedField, error) {
+	desiredSet, err := appliedFieldSet(desired)
+	if err != nil {
+		return nil, err
+	}
+	liveSet, err := appliedFieldSet(live)
+	if err != nil {
+		return nil, err
+	}
+	otherSets, err := otherManagerFieldSets(live)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []driftedField{}
+	desiredSet.Leaves().Iterate(func(path fieldpath.Path) {
+		liveValue, _ := valueAtPath(live.Object, path)
+		desiredValue, _ := valueAtPath(desired.Object, path)
+
+		owned := liveSet.Has(path)
+		if owned && value.Equals(value.NewValueInterface(liveValue), value.NewValueInterface(desiredValue)) {
+			return
+		}
+
+		field := driftedField{path: path.String(), owned: owned, live: liveValue, desired: desiredValue}
+		if !owned {
+			for manager, set := range otherSets {
+				if set.Has(path) {
+					field.managers = append(field.managers, manager)
+				}
+			}
+			sort.Strings(field.managers)
+		}
+		fields = append(fields, field)
+	})
+
+	return fields, nil
+}
+
+// appliedFieldSet returns the fields kubecuttle owns in obj through apply.
+func appliedFieldSet(obj *unstructured.Unstructured) (*fieldpath.Set, error) {
+	set := &fieldpath.Set{}
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Manager != fieldManager || entry.Operation != metav1.ManagedFieldsOperationApply || entry.Subresource != "" {
+			continue
+		}
+		entrySet, err := decodeFieldSet(entry)
+		if err != nil {
+			return nil, err
+		}
+		set = set.Union(entrySet)
+	}
+
+	return set, nil
+}
+
+// otherManagerFieldSets returns the fields owned by every manager except
+// kubecuttle's apply, keyed by manager name.
+func otherManagerFieldSets(obj *unstructured.Unstructured) (map[string]*fieldpath.Set, error) {
+	sets := map[string]*fieldpath.Set{}
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Manager == fieldManager && entry.Operation == metav1.ManagedFieldsOperationApply {
+			continue
+		}
+
+		set, err := decodeFieldSet(entry)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := sets[entry.Manager]; ok {
+			set = existing.Union(set)
+		}
+		sets[entry.Manager] = set
+	}
+
+	return sets, nil
+}
+
+// decodeFieldSet decodes the fields owned by a managedFields entry.
+func decodeFieldSet(entry metav1.ManagedFieldsEntry) (*fieldpath.Set, error) {
+	set := &fieldpath.Set{}
+	if entry.FieldsV1 == nil {
+		return set, nil
+	}
+	if entry.FieldsType != "FieldsV1" {
+		return nil, fmt.Errorf("unsupported managed fields type %q for manager %s", entry.FieldsType, entry.Manager)
+	}
+
+	if err := set.FromJSON(bytes.NewReader(entry.FieldsV1.Raw)); err != nil {
+		return nil, fmt.Errorf("failed to decode managed fields of %s, got err: %w", entry.Manager, err)
+	}
+
+	return set, nil
+}
+
+// valueAtPath returns the value at path in obj.
+func valueAtPath(obj interface{}, path fieldpath.Path) (interface{}, bool) {
+	current := obj
+	for _, element := range path {
+		switch {
+		case element.FieldName != nil:
+			m, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			current, ok = m[*element.FieldName]
+			if !ok {
+				return nil, false
+			}
+		case element.Key != nil:
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			current, ok = findListItem(list, func(item interface{}) bool {
+				m, ok := item.(map[string]interface{})
+				if !ok {
+					return false
+				}
+				for _, field := range *element.Key {
+					if !value.Equals(value.NewValueInterface(m[field.Name]), field.Value) {
+						return false
+					}
+				}
+				return true
+			})
+			if !ok {
+				return nil, false
+			}
+		case element.Value != nil:
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			current, ok = findListItem(list, func(item interface{}) bool {
+				return value.Equals(value.NewValueInterface(item), *element.Value)
+			})
+			if !ok {
+				return nil, false
+			}
+		case element.Index != nil:
+			list, ok := current.([]interface{})
+			if !ok || *element.Index >= len(list) {
+				return nil, false
+			}
+			current = list[*element.Index]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// findListItem returns the first item in list matching match.
+func findListItem(list []interface{}, match func(interface{}) bool) (interface{}, bool) {
+	for _, item := range list {
+		if match(item) {
+			return item, true
+		}
+	}
+
+	return nil, false
+}
+
+// printDriftReport writes a human readable report to out.
+func printDriftReport(out io.Writer, report driftReport) {
+	name := describeObject(report.obj)
+	switch {
+	case report.deleted:
+		fmt.Fprintf(out, "%s: deleted\n", name)
+		return
+	case !report.drifted():
+		fmt.Fprintf(out, "%s: in sync\n", name)
+		return
+	}
+
+	fmt.Fprintf(out, "%s: drifted\n", name)
+	for _, field := range report.fields {
+		var reason string
+		switch {
+		case field.owned:
+			reason = "differs from the configuration"
+		case len(field.managers) > 0:
+			reason = fmt.Sprintf("taken over by %s", strings.Join(field.managers, ", "))
+		case field.live == nil:
+			reason = "removed"
+		default:
+			reason = "not managed by kubecuttle"
+		}
+
+		fmt.Fprintf(out, "\t%s: %s", field.path, reason)
+		if field.live != nil && !value.Equals(value.NewValueInterface(field.live), value.NewValueInterface(field.desired)) {
+			fmt.Fprintf(out, ", %s != %s", formatDriftValue(field.live), formatDriftValue(field.desired))
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+// formatDriftValue renders a field's value compactly.
+func formatDriftValue(v interface{}) string {
+	if v == nil {
+		return "<unset>"
+	}
+
+	return value.ToString(value.NewValueInterface(v))
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// livePod is a pod kubecuttle applied after which kubectl edit changed its
+// image and someone removed its team label.
+var livePod = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-sleep
+  namespace: sre-test
+  labels:
+    foo: bar
+  managedFields:
+  - manager: kubecuttle
+    operation: Apply
+    apiVersion: v1
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:metadata:
+        f:labels:
+          f:foo: {}
+      f:spec:
+        f:containers:
+          k:{"name":"busybox"}:
+            .: {}
+            f:args: {}
+            f:name: {}
+  - manager: kubectl-edit
+    operation: Update
+    apiVersion: v1
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:spec:
+        f:containers:
+          k:{"name":"busybox"}:
+            f:image: {}
+spec:
+  containers:
+  - name: busybox
+    image: busybox:1.33
+    args:
+    - sleep
+    - "1000000"
+`
+
+// desiredPod is livePod after a dry run apply of its configuration.
+var desiredPod = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-sleep
+  namespace: sre-test
+  labels:
+    foo: bar
+    team: sre
+  managedFields:
+  - manager: kubecuttle
+    operation: Apply
+    apiVersion: v1
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:metadata:
+        f:labels:
+          f:foo: {}
+          f:team: {}
+      f:spec:
+        f:containers:
+          k:{"name":"busybox"}:
+            .: {}
+            f:args: {}
+            f:image: {}
+            f:name: {}
+spec:
+  containers:
+  - name: busybox
+    image: busybox
+    args:
+    - sleep
+    - "1000000"
+`
+
+func TestCompareManagedFields(t *testing.T) {
+	live := liveObject(t, livePod)
+	desired := liveObject(t, desiredPod)
+
+	fields, err := compareManagedFields(live, desired)
+	require.NoError(t, err, "failed to compare managed fields")
+	require.Equal(t, []driftedField{
+		{path: ".metadata.labels.team", desired: "sre"},
+		{path: `.spec.containers[name="busybox"].image`, managers: []string{"kubectl-edit"}, live: "busybox:1.33", desired: "busybox"},
+	}, fields)
+
+	// Comparing an object with itself finds nothing.
+	fields, err = compareManagedFields(live, live)
+	require.NoError(t, err, "failed to compare managed fields")
+	require.Empty(t, fields)
+}
+
+func TestPrintDriftReport(t *testing.T) {
+	live := liveObject(t, livePod)
+	desired := liveObject(t, desiredPod)
+	fields, err := compareManagedFields(live, desired)
+	require.NoError(t, err, "failed to compare managed fields")
+
+	cases := []struct {
+		Name     string
+		Report   driftReport
+		Expected string
+	}{
+		{
+			"drifted",
+			driftReport{obj: live, fields: fields},
+			"Pod sre-test/busybox-sleep: drifted\n" +
+				"\t.metadata.labels.team: removed\n" +
+				"\t.spec.containers[name=\"busybox\"].image: taken over by kubectl-edit, \"busybox:1.33\" != \"busybox\"\n",
+		},
+		{
+			"deleted",
+			driftReport{obj: live, deleted: true},
+			"Pod sre-test/busybox-sleep: deleted\n",
+		},
+		{
+			"in sync",
+			driftReport{obj: live},
+			"Pod sre-test/busybox-sleep: in sync\n",
+		},
+	}
+
+	for _, tt := range cases {
+		var b bytes.Buffer
+		printDriftReport(&b, tt.Report)
+		require.Equal(t, tt.Expected, b.String(), "test: %s", tt.Name)
+	}
+}
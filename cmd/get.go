@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+// getCmd represents the get command
+var getCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Show the live state of the resources in a configuration",
+	Long: `Get looks up the live object for every resource passed to it and prints a
+table of their kind, namespace, name, age and status, or the objects
+themselves with -o yaml or -o json.
+
+Examples:
+	# Show the state of everything in a file.
+	kubecuttle get -f ./manifests.yaml
+
+	# Print the live objects.
+	kubecuttle get -f ./pod.yaml -o yaml
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("could not get value of output flag, got err: %s", err)
+		}
+		if output != "table" && output != "yaml" && output != "json" {
+			return fmt.Errorf("output must be one of table, yaml or json, got: %s", output)
+		}
+
+		policy, err := retryPolicyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		cacheDir, err := cacheDirFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		ttl, err := discoveryTTLFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		files, err := readInputFiles(cmd)
+		if err != nil {
+			return err
+		}
+
+		manifests, err := decodeManifests(files)
+		if err != nil {
+			return fmt.Errorf("failed to decode objects, got err: %w", err)
+		}
+		if err := transformManifests(cmd, manifests); err != nil {
+			return err
+		}
+
+		config, err := buildConfig()
+		if err != nil {
+			return fmt.Errorf("failed to build config, got err: %w", err)
+		}
+
+		dynamicClient, err := dynamicClientInit(config)
+		if err != nil {
+			return fmt.Errorf("failed to build clients: %w", err)
+		}
+
+		discoveryClient, mapper, err := buildCachedDiscovery(config, cacheDir, ttl)
+		if err != nil {
+			return err
+		}
+
+		rows := []getRow{}
+		live := []manifestObject{}
+		for _, manifest := range manifests {
+			obj, gvk := manifest.obj, manifest.gvk
+
+			gvr, err := getResourceMapping(mapper, gvk)
+			if err != nil {
+				err = explainMappingError(err, *gvk, discoveryClient)
+				return fmt.Errorf("failed to get gvr for %s, got err: %w", manifest.source.locate(manifest.index, nil), err)
+			}
+
+			dr := getRESTMapping(dynamicClient, gvr.Scope.Name(), obj.GetNamespace(), gvr.Resource)
+
+			var existing *unstructured.Unstructured
+			err = policy.do(func(ctx context.Context) error {
+				var err error
+				existing, err = dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+				return err
+			})
+			if apierrors.IsNotFound(err) {
+				// Missing objects are part of the state we're
+				// asked about, not a failure.
+				rows = append(rows, getRow{kind: gvk.Kind, namespace: obj.GetNamespace(), name: obj.GetName(), age: "<none>", status: "NotFound"})
+				if output != "table" {
+					fmt.Fprintf(os.Stderr, "%s: %s not found\n", manifest.source.locate(manifest.index, nil), describeObject(obj))
+				}
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to get obj, got err: %w", err)
+			}
+
+			rows = append(rows, newGetRow(existing, time.Now()))
+
+			// Like kubectl, leave out managed fields, they're
+			// rarely what's being looked for and are very long.
+			existing.SetManagedFields(nil)
+			live = append(live, manifestObject{obj: existing})
+		}
+
+		if output == "table" {
+			return printGetTable(os.Stdout, rows)
+		}
+
+		data, err := encodeManifests(live, output)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stdout.Write(data)
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(getCmd)
+
+	getCmd.PersistentFlags().StringSliceP("file", "f", nil, "pass a file path or pass - to get the resources in yaml configuration from STDIN")
+	getCmd.PersistentFlags().StringP("output", "o", "table", "output format. One of table, yaml or json")
+	getCmd.PersistentFlags().Duration("timeout", defaultObjectTimeout, "time allowed to get each object, including retries. Zero means no limit")
+	getCmd.PersistentFlags().Duration("request-timeout", defaultTimeout, "time allowed for a single request to the API server")
+	addTemplateFlags(getCmd.PersistentFlags())
+	addTransformFlags(getCmd.PersistentFlags())
+}
+
+// getRow is a row of the get command's table.
+type getRow struct {
+	kind      string
+	namespace string
+	name      string
+	age       string
+	status    string
+}
+
+// newGetRow describes a live object as of now.
+func newGetRow(obj *unstructured.Unstructured, now time.Time) getRow {
+	age := "<unknown>"
+	if created := obj.GetCreationTimestamp(); !created.IsZero() {
+		age = duration.HumanDuration(now.Sub(created.Time))
+	}
+
+	return getRow{
+		kind:      obj.GetKind(),
+		namespace: obj.GetNamespace(),
+		name:      obj.GetName(),
+		age:       age,
+		status:    liveStatus(obj),
+	}
+}
+
+// printGetTable writes rows as a table aligned the way kubectl does.
+func printGetTable(out io.Writer, rows []getRow) error {
+	w := tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME\tAGE\tSTATUS")
+	for _, row := range rows {
+		namespace := row.namespace
+		if namespace == "" {
+			namespace = "<none>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.kind, namespace, row.name, row.age, row.status)
+	}
+
+	return w.Flush()
+}
+
+// liveStatus summarises the status of a live object in a few words. Built in
+// workloads report their ready replicas out of those wanted, everything else
+// its phase or conditions.
+func liveStatus(obj *unstructured.Unstructured) string {
+	if obj.GetDeletionTimestamp() != nil {
+		return "Terminating"
+	}
+
+	status, _, _ := unstructured.NestedMap(obj.Object, "status")
+	replicas := func(ready, desired string) string {
+		r, _, _ := unstructured.NestedInt64(status, ready)
+		d, _, _ := unstructured.NestedInt64(status, desired)
+		return fmt.Sprintf("%d/%d ready", r, d)
+	}
+
+	switch obj.GetKind() {
+	case "Pod":
+		phase, _ := status["phase"].(string)
+		if phase == "Running" && conditionStatus(status, "Ready") != "True" {
+			return "Running, not ready"
+		}
+		if phase != "" {
+			return phase
+		}
+	case "Deployment", "StatefulSet", "ReplicaSet", "ReplicationController":
+		// status.replicas counts old pods too while rolling out, so
+		// compare with how many are wanted.
+		ready, _, _ := unstructured.NestedInt64(status, "readyReplicas")
+		desired, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+		if !found {
+			desired = 1
+		}
+		return fmt.Sprintf("%d/%d ready", ready, desired)
+	case "DaemonSet":
+		return replicas("numberReady", "desiredNumberScheduled")
+	case "Job":
+		succeeded, _, _ := unstructured.NestedInt64(status, "succeeded")
+		completions, found, _ := unstructured.NestedInt64(obj.Object, "spec", "completions")
+		if !found {
+			completions = 1
+		}
+		if failed := conditionStatus(status, "Failed"); failed == "True" {
+			return "Failed"
+		}
+		return fmt.Sprintf("%d/%d succeeded", succeeded, completions)
+	}
+
+	// Conventional conditions, most meaningful first.
+	for _, condition := range []string{"Ready", "Available", "Established"} {
+		switch conditionStatus(status, condition) {
+		case "True":
+			return condition
+		case "False", "Unknown":
+			return "Not" + condition
+		}
+	}
+
+	if phase, ok := status["phase"].(string); ok && phase != "" {
+		return phase
+	}
+
+	return "<none>"
+}
+
+// conditionStatus returns the status of the condition called conditionType,
+// or an empty string if there isn't one.
+func conditionStatus(status map[string]interface{}, conditionType string) string {
+	conditions, _, _ := unstructured.NestedSlice(status, "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if t, _ := condition["type"].(string); strings.EqualFold(t, conditionType) {
+			s, _ := condition["status"].(string)
+			return s
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+)
+
+// liveObject decodes a YAML object as it would be returned by the API
+// server.
+func liveObject(t *testing.T, input string) *unstructured.Unstructured {
+	data, err := yaml.YAMLToJSON([]byte(input))
+	require.NoError(t, err, "failed to convert object to json")
+
+	// Decode numbers as int64 like the dynamic client does.
+	obj := &unstructured.Unstructured{}
+	require.NoError(t, utiljson.Unmarshal(data, &obj.Object), "failed to decode object")
+	return obj
+}
+
+func TestLiveStatus(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Object string
+		Status string
+	}{
+		{
+			"running pod",
+			"kind: Pod\nstatus:\n  phase: Running\n  conditions:\n  - type: Ready\n    status: \"True\"\n",
+			"Running",
+		},
+		{
+			"pod not ready",
+			"kind: Pod\nstatus:\n  phase: Running\n  conditions:\n  - type: Ready\n    status: \"False\"\n",
+			"Running, not ready",
+		},
+		{
+			"completed pod",
+			"kind: Pod\nstatus:\n  phase: Succeeded\n",
+			"Succeeded",
+		},
+		{
+			"terminating",
+			"kind: Pod\nmetadata:\n  deletionTimestamp: \"2021-08-01T00:00:00Z\"\nstatus:\n  phase: Running\n",
+			"Terminating",
+		},
+		{
+			"deployment",
+			"kind: Deployment\nspec:\n  replicas: 3\nstatus:\n  replicas: 3\n  readyReplicas: 2\n",
+			"2/3 ready",
+		},
+		{
+			"deployment rolling out",
+			"kind: Deployment\nspec:\n  replicas: 3\nstatus:\n  replicas: 4\n  readyReplicas: 3\n",
+			"3/3 ready",
+		},
+		{
+			"statefulset with default replicas",
+			"kind: StatefulSet\nstatus:\n  replicas: 1\n",
+			"0/1 ready",
+		},
+		{
+			"daemonset",
+			"kind: DaemonSet\nstatus:\n  desiredNumberScheduled: 4\n  numberReady: 4\n",
+			"4/4 ready",
+		},
+		{
+			"job",
+			"kind: Job\nspec:\n  completions: 3\nstatus:\n  succeeded: 1\n",
+			"1/3 succeeded",
+		},
+		{
+			"failed job",
+			"kind: Job\nstatus:\n  conditions:\n  - type: Failed\n    status: \"True\"\n",
+			"Failed",
+		},
+		{
+			"custom resource condition",
+			"kind: Certificate\nstatus:\n  conditions:\n  - type: Ready\n    status: \"False\"\n",
+			"NotReady",
+		},
+		{
+			"phase",
+			"kind: Namespace\nstatus:\n  phase: Active\n",
+			"Active",
+		},
+		{
+			"no status",
+			"kind: ConfigMap\n",
+			"<none>",
+		},
+	}
+
+	for _, tt := range cases {
+		require.Equal(t, tt.Status, liveStatus(liveObject(t, tt.Object)), "test: %s", tt.Name)
+	}
+}
+
+func TestPrintGetTable(t *testing.T) {
+	now := time.Date(2021, 8, 2, 12, 0, 0, 0, time.UTC)
+	pod := liveObject(t, `
+kind: Pod
+metadata:
+  name: busybox-sleep
+  namespace: sre-test
+  creationTimestamp: "2021-08-02T09:00:00Z"
+status:
+  phase: Pending
+`)
+	namespace := liveObject(t, `
+kind: Namespace
+metadata:
+  name: sre-test
+  creationTimestamp: "2021-07-30T12:00:00Z"
+status:
+  phase: Active
+`)
+
+	rows := []getRow{
+		newGetRow(namespace, now),
+		newGetRow(pod, now),
+		{kind: "Pod", namespace: "sre-test", name: "busybox-sleep-less", age: "<none>", status: "NotFound"},
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, printGetTable(&b, rows), "failed to print table")
+	require.Equal(t, `KIND        NAMESPACE   NAME                 AGE      STATUS
+Namespace   <none>      sre-test             3d       Active
+Pod         sre-test    busybox-sleep        3h       Pending
+Pod         sre-test    busybox-sleep-less   <none>   NotFound
+`, b.String())
+}
@@ -0,0 +1,365 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultRelease    string = "kubecuttle"
+	defaultHistoryMax int    = 10
+	// revisionSecretType marks Secrets holding revisions.
+	revisionSecretType corev1.SecretType = "kubecuttle.io/revision"
+	// releaseLabel and revisionLabel identify a revision's Secret.
+	releaseLabel  string = "kubecuttle.io/release"
+	revisionLabel string = "kubecuttle.io/revision"
+	// revisionManifestsKey holds the gzipped manifests of a revision.
+	revisionManifestsKey string = "manifests"
+	// revisionMetadataKey holds a revision's metadata as JSON.
+	revisionMetadataKey string = "metadata"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the revisions of a release that can be rolled back to",
+	Long: `History lists the revisions recorded by apply, and rollback, for a release:
+when each was made, by whom, from which git commit and how many objects it
+holds.
+
+Examples:
+	# Show what's been applied to the sre-test namespace.
+	kubecuttle history --release-namespace sre-test
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := buildConfig()
+		if err != nil {
+			return fmt.Errorf("failed to build config, got err: %w", err)
+		}
+
+		client, err := typedClientInit(config)
+		if err != nil {
+			return err
+		}
+
+		history, err := revisionHistoryFromFlags(cmd, client.CoreV1(), nil, false)
+		if err != nil {
+			return err
+		}
+
+		revisions, err := history.list(context.Background())
+		if err != nil {
+			return err
+		}
+		if len(revisions) == 0 {
+			return fmt.Errorf("no revisions of release %s found in namespace %s", history.release, history.namespace)
+		}
+
+		return printHistory(os.Stdout, revisions)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+
+	addHistoryFlags(historyCmd.PersistentFlags(), false)
+}
+
+// addHistoryFlags adds the flags that say where revisions are kept to
+// flags, and for commands recording revisions how many are kept.
+func addHistoryFlags(flags *pflag.FlagSet, recording bool) {
+	flags.String("release", defaultRelease, "name of the release whose revisions are recorded, for keeping the history of several sets of objects in one namespace")
+	flags.String("release-namespace", "", "namespace of the Secrets revisions are recorded in. apply defaults to the namespace of the objects if they're all in one that already exists, or default, everything else needs it passed")
+	if recording {
+		flags.Int("history-max", defaultHistoryMax, "number of revisions to keep, older ones are deleted when a new one is recorded. Zero keeps them all")
+	}
+}
+
+// revision is a snapshot of the objects applied to a release.
+type revision struct {
+	Number int       `json:"revision"`
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	// GitSHA is the commit the manifests were applied from, if they
+	// were in a git checkout.
+	GitSHA  string      `json:"gitSHA,omitempty"`
+	Objects []objectRef `json:"objects"`
+	// RollbackTo is the revision this one rolled back to, if it was
+	// recorded by rollback.
+	RollbackTo int `json:"rollbackTo,omitempty"`
+
+	// manifests are the objects applied as YAML documents. They're only
+	// loaded by get.
+	manifests []byte
+}
+
+// description says how the revision was made.
+func (r revision) description() string {
+	if r.RollbackTo > 0 {
+		return fmt.Sprintf("rollback to %d", r.RollbackTo)
+	}
+
+	return "apply"
+}
+
+// revisionHistory keeps the revisions of a release in Secrets named after
+// it, e.g. kubecuttle.v3, the way Helm keeps its releases.
+type revisionHistory struct {
+	client    corev1client.SecretsGetter
+	namespace string
+	release   string
+	// max is how many revisions to keep. Zero keeps them all.
+	max int
+}
+
+// revisionHistoryFromFlags returns the history configured by cmd's flags.
+// Unless --release-namespace was passed it's kept where the lock for
+// manifests is, the way apply records it, so commands without manifests
+// need it passed. recording is whether cmd records revisions, and so has
+// the history-max flag.
+func revisionHistoryFromFlags(cmd *cobra.Command, client corev1client.SecretsGetter, manifests []manifestObject, recording bool) (revisionHistory, error) {
+	history := revisionHistory{client: client}
+	flags := cmd.Flags()
+
+	var err error
+	if history.release, err = flags.GetString("release"); err != nil {
+		return history, fmt.Errorf("could not get value of release flag, got err: %s", err)
+	}
+	if history.namespace, err = flags.GetString("release-namespace"); err != nil {
+		return history, fmt.Errorf("could not get value of release-namespace flag, got err: %s", err)
+	}
+	if history.namespace == "" {
+		if manifests == nil {
+			return history, fmt.Errorf("pass --release-namespace with the namespace %s's revisions are in, apply records them in the namespace of the objects applied, or default if they're in several", history.release)
+		}
+		history.namespace = lockNamespace(manifests)
+	}
+	if recording {
+		if history.max, err = flags.GetInt("history-max"); err != nil {
+			return history, fmt.Errorf("could not get value of history-max flag, got err: %s", err)
+		}
+	}
+
+	return history, nil
+}
+
+// recordApplied records what apply applied as a new revision of history,
+// telling out where. Not being allowed to keep revisions only warns on
+// errOut, as what was asked for has been applied, and users such as CI
+// pipelines may not be allowed to create Secrets in the namespace chosen,
+// especially when it's default.
+func recordApplied(ctx context.Context, history revisionHistory, r revision, manifests []manifestObject, out, errOut io.Writer) error {
+	r, err := history.record(ctx, r, manifests)
+	if apierrors.IsForbidden(err) {
+		fmt.Fprintf(errOut, "\nWarning: no revision of %s recorded, got err: %s\nPass --release-namespace with a namespace you can create Secrets in, or --history=false\n", history.release, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("applied, but %w", err)
+	}
+	fmt.Fprintf(out, "\nRecorded revision %d of %s in namespace %s\n", r.Number, history.release, history.namespace)
+
+	return nil
+}
+
+// secretName returns the name of the Secret holding revision n.
+func (h revisionHistory) secretName(n int) string {
+	return fmt.Sprintf("%s.v%d", h.release, n)
+}
+
+// list returns the revisions recorded, oldest first, without their
+// manifests.
+func (h revisionHistory) list(ctx context.Context) ([]revision, error) {
+	secrets, err := h.client.Secrets(h.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", releaseLabel, h.release),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revisions of %s in %s, got err: %w", h.release, h.namespace, err)
+	}
+
+	revisions := []revision{}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if secret.Type != revisionSecretType {
+			continue
+		}
+		r, err := decodeRevisionMetadata(secret)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	sort.Slice(revisions, func(a, b int) bool {
+		return revisions[a].Number < revisions[b].Number
+	})
+
+	return revisions, nil
+}
+
+// get returns revision n with its manifests.
+func (h revisionHistory) get(ctx context.Context, n int) (revision, error) {
+	secret, err := h.client.Secrets(h.namespace).Get(ctx, h.secretName(n), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return revision{}, fmt.Errorf("revision %d of %s not found in %s", n, h.release, h.namespace)
+	}
+	if err != nil {
+		return revision{}, fmt.Errorf("failed to get revision %d of %s, got err: %w", n, h.release, err)
+	}
+
+	r, err := decodeRevisionMetadata(secret)
+	if err != nil {
+		return r, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(secret.Data[revisionManifestsKey]))
+	if err != nil {
+		return r, fmt.Errorf("failed to decompress revision %d of %s, got err: %w", n, h.release, err)
+	}
+	if r.manifests, err = ioutil.ReadAll(gz); err != nil {
+		return r, fmt.Errorf("failed to decompress revision %d of %s, got err: %w", n, h.release, err)
+	}
+
+	return r, nil
+}
+
+// record saves manifests as the next revision, filling in its number, and
+// deletes the oldest revisions beyond h.max.
+func (h revisionHistory) record(ctx context.Context, r revision, manifests []manifestObject) (revision, error) {
+	revisions, err := h.list(ctx)
+	if err != nil {
+		return r, err
+	}
+	r.Number = 1
+	if len(revisions) > 0 {
+		r.Number = revisions[len(revisions)-1].Number + 1
+	}
+
+	r.Objects = make([]objectRef, 0, len(manifests))
+	var buf bytes.Buffer
+	for _, manifest := range manifests {
+		r.Objects = append(r.Objects, refFor(manifest.obj))
+
+		data, err := yaml.Marshal(manifest.obj.Object)
+		if err != nil {
+			return r, fmt.Errorf("failed to marshal %s, got err: %w", describeObject(manifest.obj), err)
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	r.manifests = buf.Bytes()
+
+	metadata, err := json.Marshal(r)
+	if err != nil {
+		return r, fmt.Errorf("failed to encode revision, got err: %w", err)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(r.manifests); err != nil {
+		return r, fmt.Errorf("failed to compress revision, got err: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return r, fmt.Errorf("failed to compress revision, got err: %w", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      h.secretName(r.Number),
+			Namespace: h.namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": fieldManager,
+				releaseLabel:                   h.release,
+				revisionLabel:                  strconv.Itoa(r.Number),
+			},
+		},
+		Type: revisionSecretType,
+		Data: map[string][]byte{
+			revisionMetadataKey:  metadata,
+			revisionManifestsKey: compressed.Bytes(),
+		},
+	}
+	if _, err := h.client.Secrets(h.namespace).Create(ctx, secret, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		return r, fmt.Errorf("failed to record revision %d of %s, got err: %w", r.Number, h.release, err)
+	}
+
+	// Forget the oldest revisions, keeping the one just recorded.
+	if h.max > 0 && len(revisions)+1 > h.max {
+		for _, old := range revisions[:len(revisions)+1-h.max] {
+			err := h.client.Secrets(h.namespace).Delete(ctx, h.secretName(old.Number), metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return r, fmt.Errorf("failed to delete revision %d of %s, got err: %w", old.Number, h.release, err)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// decodeRevisionMetadata reads the metadata of the revision in secret.
+func decodeRevisionMetadata(secret *corev1.Secret) (revision, error) {
+	r := revision{}
+	if err := json.Unmarshal(secret.Data[revisionMetadataKey], &r); err != nil {
+		return r, fmt.Errorf("failed to decode revision %s/%s, got err: %w", secret.Namespace, secret.Name, err)
+	}
+
+	return r, nil
+}
+
+// newRevision returns a revision made now by the current user from files.
+func newRevision(files []inputFile) revision {
+	r := revision{Time: time.Now().UTC(), User: currentUser()}
+	if sha, err := git(checkoutDir(files), "rev-parse", "HEAD"); err == nil {
+		r.GitSHA = sha
+	}
+
+	return r
+}
+
+// currentUser returns the name of the user we're running as.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+
+	return "unknown"
+}
+
+// printHistory writes revisions as a table.
+func printHistory(out io.Writer, revisions []revision) error {
+	w := tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tTIME\tUSER\tGIT SHA\tOBJECTS\tDESCRIPTION")
+	for _, r := range revisions {
+		sha := r.GitSHA
+		if len(sha) > 7 {
+			sha = sha[:7]
+		}
+		if sha == "" {
+			sha = "<none>"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\n", r.Number, r.Time.Format(time.RFC3339), r.User, sha, len(r.Objects), r.description())
+	}
+
+	return w.Flush()
+}
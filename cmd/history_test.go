@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var configMapB = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: sre-test
+data:
+  key: value
+`
+
+func TestHistoryAndRollback(t *testing.T) {
+	ctx := context.Background()
+	server := startFakeAPIServer(t)
+
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+	client, err := typedClientInit(config)
+	require.NoError(t, err, "failed to build client")
+	dynamicClient, err := dynamicClientInit(config)
+	require.NoError(t, err, "failed to build dynamic client")
+	discoveryClient, mapper, err := buildCachedDiscovery(config, "", 0)
+	require.NoError(t, err, "failed to build discovery")
+	policy := defaultRetryPolicy()
+	applier := newManifestApplier(dynamicClient, mapper, discoveryClient, policy)
+
+	history := revisionHistory{client: client.CoreV1(), namespace: "sre-test", release: "web", max: 2}
+
+	// Apply the pod, then the pod and a ConfigMap, recording each.
+	for i, contents := range []string{onePod, onePod + "---" + configMapB} {
+		manifests, err := decodeManifests([]inputFile{{source: "test.yaml", contents: []byte(contents)}})
+		require.NoError(t, err, "failed to decode revision %d", i+1)
+		for _, manifest := range manifests {
+			_, err := applier.apply(manifest)
+			require.NoError(t, err, "failed to apply revision %d", i+1)
+		}
+
+		r, err := history.record(ctx, revision{User: "test", GitSHA: "0123456789abcdef"}, manifests)
+		require.NoError(t, err, "failed to record revision %d", i+1)
+		require.Equal(t, i+1, r.Number)
+	}
+	require.NotNil(t, server.get("configmaps", "sre-test", "b"), "expected the ConfigMap to be applied")
+
+	revisions, err := history.list(ctx)
+	require.NoError(t, err, "failed to list revisions")
+	require.Len(t, revisions, 2)
+	require.Len(t, revisions[1].Objects, 2)
+
+	// Revisions are kept compressed with their metadata alongside.
+	secret := server.get("secrets", "sre-test", "web.v1")
+	require.NotNil(t, secret, "expected revision 1 to be kept in a Secret")
+	require.Equal(t, string(revisionSecretType), secret.Object["type"])
+	require.Equal(t, "1", secret.GetLabels()[revisionLabel])
+
+	target, err := history.get(ctx, 1)
+	require.NoError(t, err, "failed to get revision 1")
+	require.Contains(t, string(target.manifests), "name: busybox-sleep")
+	manifests, err := decodeManifests([]inputFile{{source: "revision 1", contents: target.manifests}})
+	require.NoError(t, err, "failed to decode revision 1")
+	require.Len(t, manifests, 1)
+
+	prune := rollbackPrunes(revisions, target)
+	require.Equal(t, []objectRef{{Version: "v1", Kind: "ConfigMap", Namespace: "sre-test", Name: "b"}}, prune)
+
+	p, err := planManifests(dynamicClient, mapper, discoveryClient, manifests, policy)
+	require.NoError(t, err, "failed to plan rollback")
+	p.addPrunes(prune)
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	cmd := &cobra.Command{}
+	addAuditFlags(cmd.Flags())
+	require.NoError(t, cmd.Flags().Set("audit-log", auditPath), "failed to set audit-log flag")
+	audit, err := auditLogFromFlags(cmd, config, dynamicClient, nil)
+	require.NoError(t, err, "failed to build audit log")
+
+	out := &bytes.Buffer{}
+	r, err := rollbackTo(ctx, history, target, manifests, prune, p, applier, dynamicClient, mapper, policy, nil, audit, out)
+	require.NoError(t, err, "failed to roll back")
+	require.NoError(t, audit.close(), "failed to close audit log")
+	require.Equal(t, "Pod sre-test/busybox-sleep applied\nConfigMap sre-test/b pruned\n", out.String())
+	require.Nil(t, server.get("configmaps", "sre-test", "b"), "expected the newer ConfigMap to be pruned")
+	require.Equal(t, 3, r.Number)
+	require.Equal(t, 1, r.RollbackTo)
+
+	// The rollback's applies are audited with their planned changes.
+	data, err := ioutil.ReadFile(auditPath)
+	require.NoError(t, err, "failed to read audit log")
+	entry := auditEntry{}
+	require.NoError(t, json.Unmarshal([]byte(strings.SplitN(string(data), "\n", 2)[0]), &entry), "failed to decode audit entry")
+	require.Equal(t, auditApplied, entry.Outcome)
+	require.NotEmpty(t, entry.DiffHash)
+	require.Equal(t, p.hash(manifests[0].obj), entry.DiffHash)
+
+	// Only the last two revisions are kept.
+	revisions, err = history.list(ctx)
+	require.NoError(t, err, "failed to list revisions")
+	require.Len(t, revisions, 2)
+	require.Equal(t, 2, revisions[0].Number)
+
+	out.Reset()
+	require.NoError(t, printHistory(out, revisions), "failed to print history")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Regexp(t, `^REVISION\s+TIME\s+USER\s+GIT SHA\s+OBJECTS\s+DESCRIPTION$`, lines[0])
+	require.Regexp(t, `^2\s+\S+\s+test\s+0123456\s+2\s+apply$`, lines[1])
+	require.Regexp(t, `^3\s+\S+\s+\S+\s+0123456\s+1\s+rollback to 1$`, lines[2])
+
+	_, err = history.get(ctx, 1)
+	require.EqualError(t, err, "revision 1 of web not found in sre-test")
+}
+
+func TestRecordApplied(t *testing.T) {
+	manifests, err := decodeManifests([]inputFile{{source: "test.yaml", contents: []byte(onePod)}})
+	require.NoError(t, err, "failed to decode objects")
+
+	cases := []struct {
+		Name    string
+		Err     error
+		Out     string
+		Warning string
+		Failed  string
+	}{
+		{
+			Name: "recorded",
+			Out:  "Recorded revision 1 of kubecuttle in namespace default",
+		},
+		{
+			Name:    "forbidden",
+			Err:     apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", errors.New("no RBAC policy matched")),
+			Warning: "Pass --release-namespace with a namespace you can create Secrets in, or --history=false",
+		},
+		{
+			Name:   "failed",
+			Err:    errors.New("connection refused"),
+			Failed: "applied, but failed to list revisions of kubecuttle in default, got err: connection refused",
+		},
+	}
+
+	for _, tt := range cases {
+		client := fake.NewSimpleClientset()
+		if tt.Err != nil {
+			client.PrependReactor("*", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, tt.Err
+			})
+		}
+		history := revisionHistory{client: client.CoreV1(), namespace: metav1.NamespaceDefault, release: defaultRelease}
+
+		out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+		err := recordApplied(context.Background(), history, revision{}, manifests, out, errOut)
+		if tt.Failed != "" {
+			require.EqualError(t, err, tt.Failed, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Contains(t, out.String(), tt.Out, "test: %s", tt.Name)
+		require.Contains(t, errOut.String(), tt.Warning, "test: %s", tt.Name)
+	}
+}
+
+func TestRevisionHistoryFromFlags(t *testing.T) {
+	manifests, err := decodeManifests([]inputFile{{source: "test.yaml", contents: []byte(onePod + "---" + configMapB)}})
+	require.NoError(t, err, "failed to decode objects")
+
+	cases := []struct {
+		Name      string
+		Flags     map[string]string
+		Manifests []manifestObject
+		Recording bool
+		Namespace string
+		Max       int
+		Err       string
+	}{
+		{
+			Name:      "apply records revisions next to the objects",
+			Manifests: manifests,
+			Recording: true,
+			Namespace: "sre-test",
+			Max:       defaultHistoryMax,
+		},
+		{
+			Name:      "the release namespace wins",
+			Flags:     map[string]string{"release-namespace": "kube-system", "history-max": "3"},
+			Manifests: manifests,
+			Recording: true,
+			Namespace: "kube-system",
+			Max:       3,
+		},
+		{
+			Name:      "history looks in the release namespace",
+			Flags:     map[string]string{"release-namespace": "sre-test"},
+			Namespace: "sre-test",
+		},
+		{
+			Name: "history without a release namespace fails",
+			Err:  "pass --release-namespace with the namespace kubecuttle's revisions are in, apply records them in the namespace of the objects applied, or default if they're in several",
+		},
+	}
+
+	for _, tt := range cases {
+		cmd := &cobra.Command{}
+		addHistoryFlags(cmd.Flags(), tt.Recording)
+		for name, value := range tt.Flags {
+			require.NoError(t, cmd.Flags().Set(name, value), "test: %s", tt.Name)
+		}
+
+		history, err := revisionHistoryFromFlags(cmd, nil, tt.Manifests, tt.Recording)
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Namespace, history.namespace, "test: %s", tt.Name)
+		require.Equal(t, tt.Max, history.max, "test: %s", tt.Name)
+	}
+}
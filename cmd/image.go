@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// dockerHubDomain is the registry images without a domain come from.
+	dockerHubDomain string = "docker.io"
+	// defaultTag is the tag of images that don't give one.
+	defaultTag string = "latest"
+)
+
+// imageReference is a parsed container image reference, such as
+// busybox:1.34 or ghcr.io/org/app@sha256:....
+type imageReference struct {
+	// domain is the registry's host, and port if any.
+	domain string
+	// repository is the path of the image in the registry.
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseImage parses image the way docker does. Images without a domain are
+// on Docker Hub, and those on Docker Hub without a path are in library/.
+// The tag defaults to latest if there's no digest either.
+func parseImage(image string) (imageReference, error) {
+	ref := imageReference{}
+	if image == "" {
+		return ref, fmt.Errorf("image must not be empty")
+	}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.digest = name[:i], name[i+1:]
+		if !strings.Contains(ref.digest, ":") {
+			return ref, fmt.Errorf("invalid digest in image %s", image)
+		}
+	}
+	// A colon after the last slash starts the tag, one before it is the
+	// registry's port.
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.tag = name[:i], name[i+1:]
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = defaultTag
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.domain, ref.repository = parts[0], parts[1]
+	} else {
+		ref.domain, ref.repository = dockerHubDomain, name
+	}
+	if ref.domain == dockerHubDomain && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+	if ref.repository == "" || strings.ToLower(ref.repository) != ref.repository {
+		return ref, fmt.Errorf("invalid repository in image %s, it must be lowercase", image)
+	}
+
+	return ref, nil
+}
+
+// name returns the image without its tag or digest, in full.
+func (r imageReference) name() string {
+	return r.domain + "/" + r.repository
+}
+
+// imageOptions are the changes made to the images of every container.
+type imageOptions struct {
+	// images maps the full names of images to what they're replaced with.
+	images map[string]string
+	// pin resolves tags to digests with resolver.
+	pin      bool
+	resolver *registryResolver
+}
+
+// addImageFlags adds the flags that change container images to flags.
+func addImageFlags(flags *pflag.FlagSet) {
+	flags.StringArray("set-image", nil, "replace an image in every container, as name=image, e.g. busybox=busybox:1.34. Names match with or without their tag")
+	flags.Bool("pin-digests", false, "resolve every container image's tag to a digest from its registry and pin it, e.g. busybox:1.34@sha256:...")
+}
+
+// imageOptionsFromFlags reads the image flags.
+func imageOptionsFromFlags(cmd *cobra.Command) (*imageOptions, error) {
+	options := &imageOptions{images: map[string]string{}}
+	flags := cmd.Flags()
+
+	images, err := flags.GetStringArray("set-image")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of set-image flag, got err: %s", err)
+	}
+	for _, image := range images {
+		parts := strings.SplitN(image, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("images must be set as name=image, got: %s", image)
+		}
+		from, err := parseImage(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseImage(parts[1]); err != nil {
+			return nil, err
+		}
+		options.images[from.name()] = parts[1]
+	}
+
+	if options.pin, err = flags.GetBool("pin-digests"); err != nil {
+		return nil, fmt.Errorf("could not get value of pin-digests flag, got err: %s", err)
+	}
+	if options.pin {
+		options.resolver = newRegistryResolver()
+	}
+
+	return options, nil
+}
+
+// rewriteImages reads the image flags and rewrites the images in manifests
+// as they ask.
+func rewriteImages(cmd *cobra.Command, manifests []manifestObject) error {
+	options, err := imageOptionsFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+
+	return options.rewrite(manifests)
+}
+
+// rewrite replaces the images of the containers in manifests, then pins
+// them to digests if asked to. Images that already have a digest aren't
+// resolved again.
+func (o *imageOptions) rewrite(manifests []manifestObject) error {
+	if o == nil || (len(o.images) == 0 && !o.pin) {
+		return nil
+	}
+
+	for _, m := range manifests {
+		for _, spec := range podSpecs(m.obj.GetKind(), m.obj.Object) {
+			for _, field := range []string{"initContainers", "containers", "ephemeralContainers"} {
+				for _, container := range childMaps(spec, field) {
+					image, ok := container["image"].(string)
+					if !ok {
+						continue
+					}
+
+					image, err := o.rewriteImage(image)
+					if err != nil {
+						return fmt.Errorf("failed to set image of container %s in %s, got err: %w", container["name"], describeObject(m.obj), err)
+					}
+					container["image"] = image
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// rewriteImage returns what image should be replaced with.
+func (o *imageOptions) rewriteImage(image string) (string, error) {
+	ref, err := parseImage(image)
+	if err != nil {
+		return "", err
+	}
+	if replacement, ok := o.images[ref.name()]; ok {
+		image = replacement
+		if ref, err = parseImage(image); err != nil {
+			return "", err
+		}
+	}
+
+	if !o.pin || ref.digest != "" {
+		return image, nil
+	}
+
+	digest, err := o.resolver.resolve(ref)
+	if err != nil {
+		return "", err
+	}
+
+	// Keep the tag so people can still tell which version it is.
+	return image + "@" + digest, nil
+}
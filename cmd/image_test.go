@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+func TestParseImage(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Image    string
+		Expected imageReference
+		Err      string
+	}{
+		{
+			Name:     "docker hub official image",
+			Image:    "busybox",
+			Expected: imageReference{domain: "docker.io", repository: "library/busybox", tag: "latest"},
+		},
+		{
+			Name:     "docker hub user image",
+			Image:    "avestuk/app:v1",
+			Expected: imageReference{domain: "docker.io", repository: "avestuk/app", tag: "v1"},
+		},
+		{
+			Name:     "registry with a port",
+			Image:    "localhost:5000/team/app:1.2.3",
+			Expected: imageReference{domain: "localhost:5000", repository: "team/app", tag: "1.2.3"},
+		},
+		{
+			Name:     "tag and digest",
+			Image:    "ghcr.io/org/app:1.0@sha256:abc",
+			Expected: imageReference{domain: "ghcr.io", repository: "org/app", tag: "1.0", digest: "sha256:abc"},
+		},
+		{
+			Name:     "digest only",
+			Image:    "ghcr.io/org/app@sha256:abc",
+			Expected: imageReference{domain: "ghcr.io", repository: "org/app", digest: "sha256:abc"},
+		},
+		{
+			Name:  "uppercase repository",
+			Image: "Busybox",
+			Err:   "invalid repository in image Busybox, it must be lowercase",
+		},
+	}
+
+	for _, tt := range cases {
+		ref, err := parseImage(tt.Image)
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Expected, ref, "test: %s", tt.Name)
+	}
+}
+
+// fakeRegistry serves manifests for tags, requiring a bearer token from its
+// /token endpoint as Docker Hub does. It doesn't send digests in response to
+// HEAD requests for repositories listed in noHeadDigest.
+type fakeRegistry struct {
+	manifests    map[string]string
+	noHeadDigest map[string]bool
+	// credentials, if set, must be presented to get a token.
+	credentials string
+	requests    int
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests++
+	if r.URL.Path == "/token" {
+		if f.credentials != "" && r.Header.Get("Authorization") != "Basic "+f.credentials {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": "token-for-%s"}`, r.URL.Query().Get("scope"))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	parts := strings.SplitN(path, "/manifests/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	repository := parts[0]
+
+	if r.Header.Get("Authorization") != "Bearer token-for-repository:"+repository+":pull" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake"`, r.Host))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	manifest, ok := f.manifests[path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+		http.Error(w, "unsupported manifest type", http.StatusNotAcceptable)
+		return
+	}
+
+	if r.Method == http.MethodHead && f.noHeadDigest[repository] {
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", digestOf(manifest))
+	w.Write([]byte(manifest))
+}
+
+// digestOf returns the sha256 digest of manifest.
+func digestOf(manifest string) string {
+	sum := sha256.Sum256([]byte(manifest))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+var imagesInput = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-sleep
+  namespace: sre-test
+spec:
+  initContainers:
+  - name: init
+    image: REGISTRY/team/init:1.0
+  containers:
+  - name: busybox
+    image: busybox:1.33
+  - name: pinned
+    image: REGISTRY/team/app:2.0@sha256:abc
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: nightly
+  namespace: sre-test
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          restartPolicy: Never
+          containers:
+          - name: app
+            image: REGISTRY/team/app:2.0
+`
+
+func TestRewriteImages(t *testing.T) {
+	registry := &fakeRegistry{
+		manifests: map[string]string{
+			"team/init/manifests/1.0":     `{"schemaVersion": 2, "name": "init"}`,
+			"team/app/manifests/2.0":      `{"schemaVersion": 2, "name": "app"}`,
+			"team/app/manifests/2.1":      `{"schemaVersion": 2, "name": "app", "tag": "2.1"}`,
+			"team/busybox/manifests/1.34": `{"schemaVersion": 2, "name": "busybox"}`,
+		},
+		noHeadDigest: map[string]bool{"team/init": true},
+		credentials:  base64.StdEncoding.EncodeToString([]byte("user:password")),
+	}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	manifests, err := decodeManifests([]inputFile{{source: "pods.yaml", contents: []byte(strings.ReplaceAll(imagesInput, "REGISTRY", host))}})
+	require.NoError(t, err, "failed to decode input")
+
+	resolver := newRegistryResolver()
+	resolver.credentials = map[string]string{host: registry.credentials}
+	options := &imageOptions{
+		images: map[string]string{
+			"docker.io/library/busybox": host + "/team/busybox:1.34",
+			host + "/team/app":          host + "/team/app:2.1",
+		},
+		pin:      true,
+		resolver: resolver,
+	}
+	require.NoError(t, options.rewrite(manifests), "failed to rewrite images")
+
+	images := func(m manifestObject) []string {
+		images := []string{}
+		for _, spec := range podSpecs(m.obj.GetKind(), m.obj.Object) {
+			for _, field := range []string{"initContainers", "containers"} {
+				for _, container := range childMaps(spec, field) {
+					images = append(images, container["image"].(string))
+				}
+			}
+		}
+		return images
+	}
+	require.Equal(t, []string{
+		host + "/team/init:1.0@" + digestOf(registry.manifests["team/init/manifests/1.0"]),
+		host + "/team/busybox:1.34@" + digestOf(registry.manifests["team/busybox/manifests/1.34"]),
+		// Images are replaced even if they're pinned.
+		host + "/team/app:2.1@" + digestOf(registry.manifests["team/app/manifests/2.1"]),
+	}, images(manifests[0]))
+	require.Equal(t, []string{
+		host + "/team/app:2.1@" + digestOf(registry.manifests["team/app/manifests/2.1"]),
+	}, images(manifests[1]))
+
+	// Resolved digests are reused.
+	requests := registry.requests
+	require.NoError(t, options.rewrite(manifests[1:]), "failed to rewrite pinned images")
+	require.Equal(t, requests, registry.requests, "expected pinned images not to be resolved again")
+
+	// Tags that don't exist fail.
+	_, err = options.rewriteImage(host + "/team/init:missing")
+	require.Error(t, err, "expected a missing tag to fail")
+
+	// So do registries we can't authenticate to.
+	resolver.credentials = nil
+	_, err = options.rewriteImage(host + "/team/init:2.0")
+	require.Error(t, err, "expected missing credentials to fail")
+	require.Contains(t, err.Error(), "failed to get token")
+
+	out, err := yaml.Marshal(manifests[1].obj.Object)
+	require.NoError(t, err)
+	require.Contains(t, string(out), "@sha256:")
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"`)
+	require.Equal(t, "Bearer", scheme)
+	require.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/busybox:pull",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	require.Equal(t, "Basic", scheme)
+	require.Equal(t, map[string]string{"realm": "registry"}, params)
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	serializerYaml "k8s.io/apimachinery/pkg/runtime/serializer/yaml"
+)
+
+// stdinSource names stdin in messages.
+const stdinSource string = "<stdin>"
+
+// inputFile is a file, or stdin, passed with -f.
+type inputFile struct {
+	// source names the file in messages.
+	source   string
+	contents []byte
+}
+
+// manifestObject is an object decoded from an input file.
+type manifestObject struct {
+	obj        *unstructured.Unstructured
+	runtimeObj runtime.Object
+	gvk        *schema.GroupVersionKind
+	// source maps the object back to the file it came from.
+	source *sourceMap
+	// index is the position of the object's document in its file.
+	index int
+}
+
+// readInputFiles reads every file passed with the file flag, rendering them
+// as the templating flags ask. Passing - reads from stdin.
+func readInputFiles(cmd *cobra.Command) ([]inputFile, error) {
+	paths, err := cmd.Flags().GetStringSlice("file")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of file flag, got err: %s", err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no input file passed")
+	}
+
+	files, err := readPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := templateOptionsFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return templates.render(files)
+}
+
+// readPaths reads the files at paths. Passing - reads from stdin.
+func readPaths(paths []string) ([]inputFile, error) {
+	files := make([]inputFile, 0, len(paths))
+	for _, path := range paths {
+		// Parse input
+		source := path
+		switch path {
+		case "-":
+			path = "/dev/stdin"
+			source = stdinSource
+		case "":
+			return nil, fmt.Errorf("no input file passed")
+		default:
+		}
+
+		fileContents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %s, got err: %s", path, err)
+		}
+
+		files = append(files, inputFile{source: source, contents: fileContents})
+	}
+
+	return files, nil
+}
+
+// readsStdin reports whether any of files was read from stdin.
+func readsStdin(files []inputFile) bool {
+	for _, file := range files {
+		if file.source == stdinSource {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeManifests decodes every object in files. Nothing is sent to the API
+// server.
+func decodeManifests(files []inputFile) ([]manifestObject, error) {
+	// Create a serializer that can decode
+	decodingSerializer := serializerYaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
+
+	manifests := []manifestObject{}
+	for _, file := range files {
+		objects, err := decodeInput(file.contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode objects in %s, got err: %w", file.source, err)
+		}
+
+		sources := newSourceMap(file.source, file.contents)
+		for i, object := range objects {
+			obj := &unstructured.Unstructured{}
+
+			// Decode the object into a k8s runtime Object. This also
+			// returns the GroupValueKind for the object. GVK identifies a
+			// kind. A kind is the implementation of a K8s API resource.
+			// For instance, a pod is a resource and it's v1/Pod
+			// implementation is its kind.
+			runtimeObj, gvk, err := decodeRawObjects(decodingSerializer, object.Raw, obj)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode object in %s, got err: %w", sources.locate(i, nil), err)
+			}
+
+			manifests = append(manifests, manifestObject{
+				obj:        obj,
+				runtimeObj: runtimeObj,
+				gvk:        gvk,
+				source:     sources,
+				index:      i,
+			})
+		}
+	}
+
+	return manifests, nil
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// inventoryKey is the key of the inventory ConfigMap holding the list of
+// objects.
+const inventoryKey string = "objects"
+
+// objectRef identifies an object kubecuttle applied.
+type objectRef struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// refFor returns the objectRef for obj.
+func refFor(obj *unstructured.Unstructured) objectRef {
+	gvk := obj.GroupVersionKind()
+	return objectRef{
+		Group:     gvk.Group,
+		Version:   gvk.Version,
+		Kind:      gvk.Kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+}
+
+// key identifies the object regardless of the API version it was applied
+// with, so that converting a manifest to a new API doesn't prune it.
+func (r objectRef) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s", r.Group, r.Kind, r.Namespace, r.Name)
+}
+
+// gvk returns the object's GroupVersionKind.
+func (r objectRef) gvk() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: r.Group, Version: r.Version, Kind: r.Kind}
+}
+
+// object returns an unstructured object holding just enough to identify
+// the referenced object.
+func (r objectRef) object() *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(r.gvk())
+	obj.SetNamespace(r.Namespace)
+	obj.SetName(r.Name)
+	return obj
+}
+
+// pruneCandidates returns the objects in previous that aren't in current.
+func pruneCandidates(previous, current []objectRef) []objectRef {
+	keep := map[string]bool{}
+	for _, ref := range current {
+		keep[ref.key()] = true
+	}
+
+	prune := []objectRef{}
+	for _, ref := range previous {
+		if !keep[ref.key()] {
+			prune = append(prune, ref)
+		}
+	}
+
+	return prune
+}
+
+// inventory records the objects kubecuttle applied in a ConfigMap so that
+// those removed from the configuration can be pruned, even by another
+// replica or after a restart.
+type inventory struct {
+	client    corev1client.ConfigMapsGetter
+	namespace string
+	name      string
+}
+
+// load returns the objects recorded in the inventory. It returns nothing if
+// the inventory doesn't exist yet.
+func (i inventory) load(ctx context.Context) ([]objectRef, error) {
+	cm, err := i.client.ConfigMaps(i.namespace).Get(ctx, i.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inventory %s/%s, got err: %w", i.namespace, i.name, err)
+	}
+
+	refs := []objectRef{}
+	if data, ok := cm.Data[inventoryKey]; ok {
+		if err := json.Unmarshal([]byte(data), &refs); err != nil {
+			return nil, fmt.Errorf("failed to decode inventory %s/%s, got err: %w", i.namespace, i.name, err)
+		}
+	}
+
+	return refs, nil
+}
+
+// save replaces the objects recorded in the inventory with refs.
+func (i inventory) save(ctx context.Context, refs []objectRef) error {
+	sorted := append([]objectRef{}, refs...)
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].key() < sorted[b].key()
+	})
+
+	data, err := json.Marshal(sorted)
+	if err != nil {
+		return fmt.Errorf("failed to encode inventory, got err: %w", err)
+	}
+
+	configMaps := i.client.ConfigMaps(i.namespace)
+	cm, err := configMaps.Get(ctx, i.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      i.name,
+				Namespace: i.namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": fieldManager},
+			},
+			Data: map[string]string{inventoryKey: string(data)},
+		}
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{FieldManager: fieldManager})
+	} else if err == nil {
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[inventoryKey] = string(data)
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{FieldManager: fieldManager})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save inventory %s/%s, got err: %w", i.namespace, i.name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// unknownKindError wraps a failure to map a kind to a resource with hints on
+// how to fix the object.
+type unknownKindError struct {
+	err   error
+	hints []string
+}
+
+// Error implements error.
+func (e *unknownKindError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.err.Error())
+	for _, hint := range e.hints {
+		b.WriteString("\n\t")
+		b.WriteString(hint)
+	}
+
+	return b.String()
+}
+
+// Unwrap returns the original mapping error.
+func (e *unknownKindError) Unwrap() error {
+	return e.err
+}
+
+// explainMappingError adds hints to a RESTMapper's "no matches for kind"
+// error explaining why the kind isn't known and what to use instead. Other
+// errors are returned unchanged.
+func explainMappingError(err error, gvk schema.GroupVersionKind, client discovery.DiscoveryInterface) error {
+	if !meta.IsNoMatchError(err) {
+		return err
+	}
+
+	served, discoveryErr := servedKinds(client)
+	if discoveryErr != nil {
+		// Hints are best effort, the original error matters more.
+		served = nil
+	}
+
+	hints := suggestKinds(gvk, served)
+	if len(hints) == 0 {
+		return err
+	}
+
+	return &unknownKindError{err: err, hints: hints}
+}
+
+// servedKinds lists every kind the API server serves.
+func servedKinds(client discovery.DiscoveryInterface) ([]schema.GroupVersionKind, error) {
+	_, lists, err := client.ServerGroupsAndResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	}
+
+	kinds := []schema.GroupVersionKind{}
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+
+		for _, resource := range list.APIResources {
+			// Subresources such as pods/status share their
+			// parent's kind.
+			if strings.Contains(resource.Name, "/") {
+				continue
+			}
+			kinds = append(kinds, gv.WithKind(resource.Kind))
+		}
+	}
+
+	return kinds, nil
+}
+
+// servedReplacement returns the newest replacement for an API that's in
+// served, or the current one if none are.
+func servedReplacement(lifecycle apiLifecycle, served []schema.GroupVersionKind) schema.GroupVersionKind {
+	replacements := lifecycle.replacements()
+	for i := len(replacements) - 1; i >= 0; i-- {
+		for _, s := range served {
+			if s == replacements[i].replacement {
+				return s
+			}
+		}
+	}
+
+	return lifecycle.replacementAt(nil)
+}
+
+// suggestKinds returns hints for an object whose kind, gvk, the API server
+// doesn't serve, given the kinds it does.
+func suggestKinds(gvk schema.GroupVersionKind, served []schema.GroupVersionKind) []string {
+	hints := []string{}
+
+	// Built in APIs that have been removed.
+	removal, removed := apiLifecycles[gvk]
+	removed = removed && removal.removedIn != nil
+	if removed {
+		hint := fmt.Sprintf("%s %s was removed in Kubernetes v%d.%d", gvk.GroupVersion(), gvk.Kind, removal.removedIn.Major(), removal.removedIn.Minor())
+		if replacement := servedReplacement(removal, served); replacement.Kind != "" {
+			hint += fmt.Sprintf(", use apiVersion: %s instead", replacement.GroupVersion())
+		} else {
+			hint += " and has no replacement"
+		}
+		hints = append(hints, hint)
+	}
+
+	// The kind exists, just under a different group or version.
+	versions := []string{}
+	groupServed := false
+	for _, s := range served {
+		if s.Kind == gvk.Kind && s.GroupVersion() != gvk.GroupVersion() {
+			versions = append(versions, s.GroupVersion().String())
+		}
+		if s.Group == gvk.Group {
+			groupServed = true
+		}
+	}
+	if len(versions) > 0 {
+		sort.Strings(versions)
+		versions = dedupe(versions)
+		if !removed {
+			hints = append(hints, fmt.Sprintf("kind %s is served as apiVersion: %s", gvk.Kind, strings.Join(versions, ", ")))
+		}
+		return hints
+	}
+
+	// The kind is misspelled.
+	if matches := closeKinds(gvk, served); len(matches) > 0 {
+		hints = append(hints, fmt.Sprintf("did you mean kind %s?", strings.Join(matches, " or ")))
+		return hints
+	}
+
+	// The kind belongs to a custom resource whose CRD isn't installed.
+	if !groupServed && !isBuiltInGroup(gvk.Group) {
+		plural, _ := meta.UnsafeGuessKindToResource(gvk)
+		hints = append(hints, fmt.Sprintf("no CustomResourceDefinition for %s is installed, install the CRD that defines %s %s first", schema.GroupResource{Group: gvk.Group, Resource: plural.Resource}, gvk.GroupVersion(), gvk.Kind))
+	}
+
+	return hints
+}
+
+// closeKinds returns the served kinds whose names are within a small edit
+// distance of gvk's, preferring kinds in the same group.
+func closeKinds(gvk schema.GroupVersionKind, served []schema.GroupVersionKind) []string {
+	want := strings.ToLower(gvk.Kind)
+	maxDistance := len(want) / 4
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+	if maxDistance > 3 {
+		maxDistance = 3
+	}
+
+	best := maxDistance + 1
+	sameGroup := false
+	matches := []string{}
+	for _, s := range served {
+		distance := editDistance(want, strings.ToLower(s.Kind))
+		if distance > maxDistance {
+			continue
+		}
+
+		// Prefer the closest kinds, then those in the same group.
+		inGroup := s.Group == gvk.Group
+		switch {
+		case distance < best, distance == best && inGroup && !sameGroup:
+			best, sameGroup = distance, inGroup
+			matches = []string{describeGVK(s)}
+		case distance == best && inGroup == sameGroup:
+			matches = append(matches, describeGVK(s))
+		}
+	}
+
+	sort.Strings(matches)
+	return dedupe(matches)
+}
+
+// describeGVK renders a kind for hints, e.g. Deployment (apps/v1).
+func describeGVK(gvk schema.GroupVersionKind) string {
+	return fmt.Sprintf("%s (%s)", gvk.Kind, gvk.GroupVersion())
+}
+
+// isBuiltInGroup reports whether group is one of Kubernetes' own API groups.
+// Custom resources must use a group with a dot in it.
+func isBuiltInGroup(group string) bool {
+	return !strings.Contains(group, ".") || strings.HasSuffix(group, ".k8s.io")
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+// min3 returns the smallest of three ints.
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+
+	return a
+}
+
+// dedupe removes adjacent duplicates from a sorted slice.
+func dedupe(values []string) []string {
+	out := []string{}
+	for _, v := range values {
+		if len(out) == 0 || v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
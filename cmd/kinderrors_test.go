@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var servedTestKinds = []schema.GroupVersionKind{
+	{Version: "v1", Kind: "Pod"},
+	{Version: "v1", Kind: "Service"},
+	{Version: "v1", Kind: "ConfigMap"},
+	{Group: "apps", Version: "v1", Kind: "Deployment"},
+	{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+	{Group: "batch", Version: "v1", Kind: "CronJob"},
+	{Group: "autoscaling", Version: "v2beta2", Kind: "HorizontalPodAutoscaler"},
+	{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"},
+	{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"},
+}
+
+func TestSuggestKinds(t *testing.T) {
+	cases := []struct {
+		Name  string
+		GVK   schema.GroupVersionKind
+		Hints []string
+	}{
+		{
+			"removed API",
+			schema.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "Deployment"},
+			[]string{"extensions/v1beta1 Deployment was removed in Kubernetes v1.16, use apiVersion: apps/v1 instead"},
+		},
+		{
+			"removed API replaced twice",
+			schema.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "Ingress"},
+			[]string{"extensions/v1beta1 Ingress was removed in Kubernetes v1.22, use apiVersion: networking.k8s.io/v1 instead"},
+		},
+		{
+			"removed API with newest replacement not served",
+			schema.GroupVersionKind{Group: "autoscaling", Version: "v2beta1", Kind: "HorizontalPodAutoscaler"},
+			[]string{"autoscaling/v2beta1 HorizontalPodAutoscaler was removed in Kubernetes v1.25, use apiVersion: autoscaling/v2beta2 instead"},
+		},
+		{
+			"removed API without replacement",
+			schema.GroupVersionKind{Group: "policy", Version: "v1beta1", Kind: "PodSecurityPolicy"},
+			[]string{"policy/v1beta1 PodSecurityPolicy was removed in Kubernetes v1.25 and has no replacement"},
+		},
+		{
+			"wrong apiVersion",
+			schema.GroupVersionKind{Version: "v1", Kind: "Deployment"},
+			[]string{"kind Deployment is served as apiVersion: apps/v1"},
+		},
+		{
+			"typo",
+			schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deploymnet"},
+			[]string{"did you mean kind Deployment (apps/v1)?"},
+		},
+		{
+			"wrong case",
+			schema.GroupVersionKind{Version: "v1", Kind: "configmap"},
+			[]string{"did you mean kind ConfigMap (v1)?"},
+		},
+		{
+			"missing CRD",
+			schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"},
+			[]string{"no CustomResourceDefinition for widgets.example.com is installed, install the CRD that defines example.com/v1 Widget first"},
+		},
+		{
+			"missing CRD version",
+			schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1alpha2", Kind: "Certificate"},
+			[]string{"kind Certificate is served as apiVersion: cert-manager.io/v1"},
+		},
+		{
+			"no idea",
+			schema.GroupVersionKind{Version: "v1", Kind: "Spaceship"},
+			[]string{},
+		},
+	}
+
+	for _, tt := range cases {
+		require.Equal(t, tt.Hints, suggestKinds(tt.GVK, servedTestKinds), "test: %s", tt.Name)
+	}
+}
+
+func TestUnknownKindError(t *testing.T) {
+	noMatch := &meta.NoKindMatchError{GroupKind: schema.GroupKind{Group: "apps", Kind: "Deploymnet"}, SearchedVersions: []string{"v1"}}
+	err := &unknownKindError{err: noMatch, hints: []string{"did you mean kind Deployment (apps/v1)?"}}
+
+	require.Equal(t, "no matches for kind \"Deploymnet\" in version \"apps/v1\"\n\tdid you mean kind Deployment (apps/v1)?", err.Error())
+	require.ErrorIs(t, err, noMatch)
+}
+
+func TestEditDistance(t *testing.T) {
+	require.Equal(t, 0, editDistance("pod", "pod"))
+	require.Equal(t, 2, editDistance("deploymnet", "deployment"))
+	require.Equal(t, 3, editDistance("kitten", "sitting"))
+	require.Equal(t, 3, editDistance("", "pod"))
+}
@@ -0,0 +1,412 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+const (
+	defaultLockName string = "kubecuttle-apply"
+	// defaultLockDuration is how long a lock lasts without being renewed,
+	// so one left by a killed run doesn't block others for long.
+	defaultLockDuration time.Duration = 30 * time.Second
+	// defaultLockRetryPeriod is how often a held lock is checked for
+	// while waiting for it.
+	defaultLockRetryPeriod time.Duration = 2 * time.Second
+	// lockCommandAnnotation records the command line of the lock's
+	// holder.
+	lockCommandAnnotation string = "kubecuttle.io/command"
+)
+
+// addLockFlags adds the flags that configure the apply lock to flags.
+func addLockFlags(flags *pflag.FlagSet) {
+	flags.Bool("lock", true, "hold a Lease while applying so concurrent runs against the same namespace don't interleave")
+	flags.String("lock-name", defaultLockName, "name of the lock Lease, to let runs applying different sets of objects to one namespace go ahead together")
+	flags.String("lock-namespace", "", "namespace of the lock Lease. Defaults to the namespace of the objects if they're all in one that already exists, otherwise default")
+	flags.Duration("lock-wait", 0, "time to wait for another run holding the lock to finish. Zero fails straight away")
+}
+
+// applyLock is a coordination.k8s.io/v1 Lease held while applying, so that
+// two runs against the same objects, say from racing CI pipelines, go one
+// after the other. The Lease records who holds it, since when and the
+// command they're running, and is renewed until it's released so a long
+// apply keeps it.
+type applyLock struct {
+	client    coordinationv1client.LeasesGetter
+	namespace string
+	name      string
+	// holder identifies us to other runs.
+	holder string
+	// command is the command line recorded on the Lease.
+	command string
+	// duration is how long the Lease lasts without being renewed.
+	duration time.Duration
+	// wait is how long to wait for another holder to finish. Zero fails
+	// straight away.
+	wait time.Duration
+	// retryPeriod is how often a held Lease is checked for while
+	// waiting.
+	retryPeriod time.Duration
+	// out is told when we start waiting.
+	out io.Writer
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+	// lost is closed, with lostErr set, if the lock couldn't be renewed
+	// and another run may have taken it.
+	lost    chan struct{}
+	lostErr error
+	// renewed is when the Lease was taken.
+	renewed time.Time
+}
+
+// lockHeldError is returned when another run holds the lock.
+type lockHeldError struct {
+	namespace string
+	name      string
+	holder    string
+	since     time.Time
+	command   string
+}
+
+func (e *lockHeldError) Error() string {
+	msg := fmt.Sprintf("lock %s/%s is held by %s", e.namespace, e.name, e.holder)
+	if !e.since.IsZero() {
+		msg += fmt.Sprintf(" since %s", e.since.Format(time.RFC3339))
+	}
+	if e.command != "" {
+		msg += fmt.Sprintf(" running %q", e.command)
+	}
+
+	return msg
+}
+
+// applyLockFromFlags returns the lock configured by cmd's flags, or nil if
+// --lock=false was passed. Unless --lock-namespace was passed the Lease goes
+// in the namespace of manifests, if they share one that isn't created by
+// them, so runs applying to different namespaces don't wait for each other.
+func applyLockFromFlags(cmd *cobra.Command, client coordinationv1client.LeasesGetter, manifests []manifestObject) (*applyLock, error) {
+	flags := cmd.Flags()
+
+	enabled, err := flags.GetBool("lock")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of lock flag, got err: %s", err)
+	}
+	if !enabled {
+		return nil, nil
+	}
+	// A replayed run doesn't reach a cluster, so there's no one to
+	// hold it against, and the recorded Lease names the recording run
+	// as its holder.
+	if mode, _, err := cassetteFromEnv(); err != nil || mode == cassetteReplay {
+		return nil, err
+	}
+
+	l := &applyLock{
+		client:      client,
+		holder:      lockHolder(),
+		command:     strings.Join(os.Args, " "),
+		duration:    defaultLockDuration,
+		retryPeriod: defaultLockRetryPeriod,
+		out:         os.Stderr,
+	}
+	if l.name, err = flags.GetString("lock-name"); err != nil {
+		return nil, fmt.Errorf("could not get value of lock-name flag, got err: %s", err)
+	}
+	if l.namespace, err = flags.GetString("lock-namespace"); err != nil {
+		return nil, fmt.Errorf("could not get value of lock-namespace flag, got err: %s", err)
+	}
+	if l.namespace == "" {
+		l.namespace = lockNamespace(manifests)
+	}
+	if l.wait, err = flags.GetDuration("lock-wait"); err != nil {
+		return nil, fmt.Errorf("could not get value of lock-wait flag, got err: %s", err)
+	}
+
+	return l, nil
+}
+
+// lockNamespace returns the namespace every namespaced object in manifests
+// is in, or default if they're in several or their namespace is created
+// by manifests, as the Lease can't be created in it before it exists.
+func lockNamespace(manifests []manifestObject) string {
+	namespace := ""
+	created := map[string]bool{}
+	for _, manifest := range manifests {
+		obj := manifest.obj
+		if obj.GetKind() == "Namespace" && obj.GroupVersionKind().Group == "" {
+			created[obj.GetName()] = true
+		}
+		if obj.GetNamespace() == "" {
+			continue
+		}
+		if namespace != "" && namespace != obj.GetNamespace() {
+			return metav1.NamespaceDefault
+		}
+		namespace = obj.GetNamespace()
+	}
+
+	if namespace == "" || created[namespace] {
+		return metav1.NamespaceDefault
+	}
+
+	return namespace
+}
+
+// lockHolder identifies this run, e.g. alice@ci-runner-3 (pid 4242).
+func lockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s@%s (pid %d)", currentUser(), hostname, os.Getpid())
+}
+
+// acquire takes the lock, waiting for up to l.wait for another holder to
+// finish, and keeps renewing it until release is called.
+func (l *applyLock) acquire(ctx context.Context) error {
+	var deadline time.Time
+	if l.wait > 0 {
+		deadline = time.Now().Add(l.wait)
+	}
+
+	waiting := false
+	for {
+		held, err := l.tryAcquire(ctx)
+		if err != nil {
+			return err
+		}
+		if held == nil {
+			break
+		}
+
+		if l.wait <= 0 {
+			return fmt.Errorf("%w, pass --lock-wait to wait for it", held)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w, gave up waiting after %s", held, l.wait)
+		}
+		if !waiting {
+			fmt.Fprintf(l.out, "Waiting for %s\n", held)
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.retryPeriod):
+		}
+	}
+
+	l.stop = make(chan struct{})
+	l.lost = make(chan struct{})
+	l.stopped.Add(1)
+	go l.renew()
+
+	return nil
+}
+
+// tryAcquire takes the lock if it's free, or held by someone who stopped
+// renewing it. Otherwise it returns who holds it.
+func (l *applyLock) tryAcquire(ctx context.Context) (*lockHeldError, error) {
+	leases := l.client.Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(l.duration / time.Second)
+
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        l.name,
+				Namespace:   l.namespace,
+				Labels:      map[string]string{"app.kubernetes.io/managed-by": fieldManager},
+				Annotations: map[string]string{lockCommandAnnotation: l.command},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.holder,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{FieldManager: fieldManager})
+		if apierrors.IsAlreadyExists(err) {
+			// Someone else created it first, see who.
+			return l.tryAcquire(ctx)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create lock %s/%s, got err: %w", l.namespace, l.name, err)
+		}
+		l.renewed = now.Time
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lock %s/%s, got err: %w", l.namespace, l.name, err)
+	}
+
+	if holder := leaseHolder(lease); holder != "" && holder != l.holder && !leaseExpired(lease, now.Time) {
+		held := &lockHeldError{namespace: l.namespace, name: l.name, holder: holder, command: lease.Annotations[lockCommandAnnotation]}
+		if lease.Spec.AcquireTime != nil {
+			held.since = lease.Spec.AcquireTime.Time
+		}
+		return held, nil
+	}
+
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[lockCommandAnnotation] = l.command
+	lease.Spec.HolderIdentity = &l.holder
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{FieldManager: fieldManager})
+	if apierrors.IsConflict(err) {
+		// Someone else took it first, see who.
+		return l.tryAcquire(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to take lock %s/%s, got err: %w", l.namespace, l.name, err)
+	}
+	l.renewed = now.Time
+
+	return nil, nil
+}
+
+// renew keeps the Lease from expiring until release is called. If it's
+// taken by someone else, or the next attempt to renew it would come after it
+// expires, the lock is lost and renewing stops, so nothing is applied once
+// another run could have taken it.
+func (l *applyLock) renew() {
+	defer l.stopped.Done()
+
+	renewed := l.renewed
+	period := l.duration / 3
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		err := l.update(func(lease *coordinationv1.Lease) {
+			renewTime := metav1.NewMicroTime(now)
+			lease.Spec.RenewTime = &renewTime
+		})
+		if err == nil {
+			renewed = now
+			continue
+		}
+
+		held := &lockHeldError{}
+		switch {
+		case errors.As(err, &held):
+			l.lostErr = fmt.Errorf("lost lock %s/%s, it was taken by %s", l.namespace, l.name, held.holder)
+		case !now.Add(period).Before(renewed.Add(l.duration)):
+			l.lostErr = fmt.Errorf("lost lock %s/%s, failed to renew it for %s, got err: %w", l.namespace, l.name, now.Sub(renewed).Round(time.Millisecond), err)
+		default:
+			fmt.Fprintf(l.out, "failed to renew lock %s/%s, got err: %s\n", l.namespace, l.name, err)
+			continue
+		}
+		close(l.lost)
+		return
+	}
+}
+
+// done returns a channel that's closed if the lock is lost. It's never
+// closed for a nil lock.
+func (l *applyLock) done() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+
+	return l.lost
+}
+
+// err returns why the lock was lost, or nil while it's held, so changes can
+// stop before another run starts making its own.
+func (l *applyLock) err() error {
+	select {
+	case <-l.done():
+		return l.lostErr
+	default:
+		return nil
+	}
+}
+
+// release stops renewing the Lease and frees it for the next run.
+func (l *applyLock) release() error {
+	if l.stop != nil {
+		close(l.stop)
+		l.stopped.Wait()
+		l.stop = nil
+	}
+
+	err := l.update(func(lease *coordinationv1.Lease) {
+		lease.Spec.HolderIdentity = nil
+		lease.Spec.AcquireTime = nil
+		lease.Spec.RenewTime = nil
+		delete(lease.Annotations, lockCommandAnnotation)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release lock %s/%s, got err: %w", l.namespace, l.name, err)
+	}
+
+	return nil
+}
+
+// update changes the Lease with change, as long as we still hold it.
+func (l *applyLock) update(change func(*coordinationv1.Lease)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	leases := l.client.Leases(l.namespace)
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if holder := leaseHolder(lease); holder != l.holder {
+		return &lockHeldError{namespace: l.namespace, name: l.name, holder: holder}
+	}
+
+	change(lease)
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{FieldManager: fieldManager})
+
+	return err
+}
+
+// leaseHolder returns who holds lease, or nothing if it's free.
+func leaseHolder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+
+	return *lease.Spec.HolderIdentity
+}
+
+// leaseExpired reports whether lease's holder stopped renewing it.
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expires := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+
+	return now.After(expires)
+}
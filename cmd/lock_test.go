@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testLock returns a lock on sre-test/kubecuttle-apply held as holder.
+func testLock(client *fake.Clientset, holder string, wait time.Duration) *applyLock {
+	return &applyLock{
+		client:      client.CoordinationV1(),
+		namespace:   "sre-test",
+		name:        defaultLockName,
+		holder:      holder,
+		command:     "kubecuttle apply -f " + holder + ".yaml",
+		duration:    defaultLockDuration,
+		wait:        wait,
+		retryPeriod: 10 * time.Millisecond,
+		out:         &bytes.Buffer{},
+	}
+}
+
+// getLease returns the lock's Lease.
+func getLease(t *testing.T, client *fake.Clientset) *coordinationv1.Lease {
+	lease, err := client.CoordinationV1().Leases("sre-test").Get(context.Background(), defaultLockName, metav1.GetOptions{})
+	require.NoError(t, err, "failed to get lease")
+
+	return lease
+}
+
+func TestApplyLock(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+
+	first := testLock(client, "first", 0)
+	require.NoError(t, first.acquire(ctx), "failed to acquire free lock")
+
+	lease := getLease(t, client)
+	require.Equal(t, "first", leaseHolder(lease))
+	require.Equal(t, "kubecuttle apply -f first.yaml", lease.Annotations[lockCommandAnnotation])
+	require.NotNil(t, lease.Spec.AcquireTime, "expected the start time to be recorded")
+
+	// Another run fails fast, naming who holds the lock.
+	second := testLock(client, "second", 0)
+	err := second.acquire(ctx)
+	held := &lockHeldError{}
+	require.ErrorAs(t, err, &held, "expected held lock to fail")
+	require.Equal(t, "first", held.holder)
+	require.True(t, strings.HasPrefix(err.Error(), "lock sre-test/kubecuttle-apply is held by first since "), err.Error())
+	require.True(t, strings.HasSuffix(err.Error(), ` running "kubecuttle apply -f first.yaml", pass --lock-wait to wait for it`), err.Error())
+
+	// Waiting gives up eventually.
+	second.wait = 50 * time.Millisecond
+	err = second.acquire(ctx)
+	require.ErrorAs(t, err, &held, "expected waiting for held lock to time out")
+	require.Contains(t, err.Error(), "gave up waiting after 50ms")
+
+	// Or gets the lock once it's released.
+	second.wait = time.Minute
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.release()
+	}()
+	require.NoError(t, second.acquire(ctx), "failed to acquire released lock")
+	require.Contains(t, second.out.(*bytes.Buffer).String(), "Waiting for lock sre-test/kubecuttle-apply is held by first")
+	require.Equal(t, "second", leaseHolder(getLease(t, client)))
+
+	require.NoError(t, second.release(), "failed to release lock")
+	lease = getLease(t, client)
+	require.Nil(t, lease.Spec.HolderIdentity, "expected the lock to be free")
+	require.NotContains(t, lease.Annotations, lockCommandAnnotation)
+}
+
+func TestApplyLockExpired(t *testing.T) {
+	// A run that was killed leaves a lock it stopped renewing.
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	holder := "killed"
+	seconds := int32(30)
+	client := fake.NewSimpleClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: defaultLockName, Namespace: "sre-test"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &seconds,
+			AcquireTime:          &renewed,
+			RenewTime:            &renewed,
+		},
+	})
+
+	lock := testLock(client, "next", 0)
+	require.NoError(t, lock.acquire(context.Background()), "failed to take expired lock")
+	require.Equal(t, "next", leaseHolder(getLease(t, client)))
+	require.NoError(t, lock.release(), "failed to release lock")
+}
+
+func TestApplyLockRenew(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	lock := testLock(client, "slow", 0)
+	lock.duration = 30 * time.Millisecond
+
+	require.NoError(t, lock.acquire(context.Background()), "failed to acquire lock")
+	acquired := getLease(t, client).Spec.RenewTime.Time
+
+	time.Sleep(50 * time.Millisecond)
+	require.True(t, getLease(t, client).Spec.RenewTime.After(acquired), "expected the lock to be renewed")
+	require.NoError(t, lock.release(), "failed to release lock")
+}
+
+func TestApplyLockLost(t *testing.T) {
+	cases := []struct {
+		Name string
+		// Taken has another run take the lock, otherwise renewing it
+		// fails.
+		Taken bool
+		Err   string
+	}{
+		{
+			Name:  "taken by another run",
+			Taken: true,
+			Err:   "lost lock sre-test/kubecuttle-apply, it was taken by other",
+		},
+		{
+			Name: "renewal failing for longer than the lease lasts",
+			Err:  "failed to renew it for",
+		},
+	}
+
+	for _, tt := range cases {
+		client := fake.NewSimpleClientset()
+		// Reactors can't be added once the lock is being renewed.
+		var failing int32
+		client.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if atomic.LoadInt32(&failing) == 1 {
+				return true, nil, errors.New("connection refused")
+			}
+			return false, nil, nil
+		})
+		lock := testLock(client, "slow", 0)
+		lock.duration = 30 * time.Millisecond
+		require.NoError(t, lock.acquire(context.Background()), "test: %s", tt.Name)
+		require.NoError(t, lock.err(), "test: %s", tt.Name)
+
+		if tt.Taken {
+			lease := getLease(t, client)
+			other := "other"
+			lease.Spec.HolderIdentity = &other
+			_, err := client.CoordinationV1().Leases("sre-test").Update(context.Background(), lease, metav1.UpdateOptions{})
+			require.NoError(t, err, "test: %s", tt.Name)
+		} else {
+			atomic.StoreInt32(&failing, 1)
+		}
+		select {
+		case <-lock.done():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("test: %s: timed out waiting for the lock to be lost", tt.Name)
+		}
+		require.Error(t, lock.err(), "test: %s", tt.Name)
+		require.Contains(t, lock.err().Error(), tt.Err, "test: %s", tt.Name)
+
+		// Nothing more is applied.
+		_, err := applyAndRecord(nil, manifestObject{}, lock, nil, "")
+		require.Equal(t, lock.err(), err, "test: %s", tt.Name)
+		require.Error(t, lock.release(), "test: %s", tt.Name)
+	}
+
+	// Nil locks, from --lock=false, are never lost.
+	var disabled *applyLock
+	require.NoError(t, disabled.err())
+}
+
+func TestApplyLockLostBeforeExpiry(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var failing int32
+	client.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+	// Leases last whole seconds.
+	lock := testLock(client, "slow", 0)
+	lock.duration = 3 * time.Second
+	require.NoError(t, lock.acquire(context.Background()))
+	atomic.StoreInt32(&failing, 1)
+
+	lease := getLease(t, client)
+	expires := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	select {
+	case <-lock.done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the lock to be lost")
+	}
+	require.True(t, time.Now().Before(expires), "lock was lost after the lease expired at %s", expires)
+	require.Contains(t, lock.err().Error(), "failed to renew it for")
+}
+
+func TestLockNamespace(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Manifests string
+		Namespace string
+	}{
+		{
+			Name:      "one namespace",
+			Manifests: onePod,
+			Namespace: "sre-test",
+		},
+		{
+			Name:      "created namespace",
+			Manifests: "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: sre-test\n---\n" + onePod,
+			Namespace: "default",
+		},
+		{
+			Name:      "several namespaces",
+			Manifests: onePod + "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n  namespace: other\n",
+			Namespace: "default",
+		},
+		{
+			Name:      "cluster scoped",
+			Manifests: "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: sre-test\n",
+			Namespace: "default",
+		},
+	}
+
+	for _, tt := range cases {
+		manifests, err := decodeManifests([]inputFile{{source: "test.yaml", contents: []byte(tt.Manifests)}})
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Namespace, lockNamespace(manifests), "test: %s", tt.Name)
+	}
+}
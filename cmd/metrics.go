@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reconcileResult summarises a single reconcile.
+type reconcileResult struct {
+	// revision is the git revision of the sources, if they're in git.
+	revision string
+	applied  int
+	pruned   int
+	failed   int
+	duration time.Duration
+}
+
+// reconcileMetrics tracks the reconcile loop for the metrics and health
+// endpoints. The metrics are written in the Prometheus text format.
+type reconcileMetrics struct {
+	mu sync.Mutex
+	// started is when the loop started.
+	started time.Time
+	// staleAfter is how long after the last successful reconcile the loop
+	// is considered unhealthy.
+	staleAfter  time.Duration
+	leader      bool
+	successes   int64
+	failures    int64
+	prunedTotal int64
+	last        reconcileResult
+	lastErr     error
+	lastRun     time.Time
+	lastSuccess time.Time
+}
+
+// newReconcileMetrics returns metrics for a loop that reconciles every
+// interval.
+func newReconcileMetrics(interval time.Duration) *reconcileMetrics {
+	return &reconcileMetrics{
+		started: time.Now(),
+		// Allow a couple of slow or failed runs before giving up.
+		staleAfter: 3*interval + time.Minute,
+	}
+}
+
+// record records the outcome of a reconcile.
+func (m *reconcileMetrics) record(result reconcileResult, err error, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.last = result
+	m.lastErr = err
+	m.lastRun = now
+	m.prunedTotal += int64(result.pruned)
+	if err != nil {
+		m.failures++
+		return
+	}
+	m.successes++
+	m.lastSuccess = now
+}
+
+// setLeader records whether this replica is the leader.
+func (m *reconcileMetrics) setLeader(leader bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leader = leader
+}
+
+// healthy reports whether the loop is making progress. Replicas that aren't
+// leading are healthy, they're waiting their turn.
+func (m *reconcileMetrics) healthy(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.leader {
+		return nil
+	}
+
+	since := m.lastSuccess
+	if since.IsZero() {
+		since = m.started
+	}
+	if now.Sub(since) <= m.staleAfter {
+		return nil
+	}
+	if m.lastErr != nil {
+		return fmt.Errorf("no successful reconcile since %s, last error: %s", since.Format(time.RFC3339), m.lastErr)
+	}
+
+	return fmt.Errorf("no successful reconcile since %s", since.Format(time.RFC3339))
+}
+
+// ServeHTTP writes the metrics.
+func (m *reconcileMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	leader := 0
+	if m.leader {
+		leader = 1
+	}
+	lastSuccess := 0.0
+	if !m.lastSuccess.IsZero() {
+		lastSuccess = float64(m.lastSuccess.UnixNano()) / 1e9
+	}
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("kubecuttle_reconcile_total", "counter", "Reconciles run, by result.")
+	fmt.Fprintf(w, "kubecuttle_reconcile_total{result=\"success\"} %d\n", m.successes)
+	fmt.Fprintf(w, "kubecuttle_reconcile_total{result=\"failure\"} %d\n", m.failures)
+	metric("kubecuttle_reconcile_last_success_timestamp_seconds", "gauge", "When the last successful reconcile finished.")
+	fmt.Fprintf(w, "kubecuttle_reconcile_last_success_timestamp_seconds %g\n", lastSuccess)
+	metric("kubecuttle_reconcile_duration_seconds", "gauge", "How long the last reconcile took.")
+	fmt.Fprintf(w, "kubecuttle_reconcile_duration_seconds %g\n", m.last.duration.Seconds())
+	metric("kubecuttle_reconcile_objects", "gauge", "Objects handled by the last reconcile, by outcome.")
+	fmt.Fprintf(w, "kubecuttle_reconcile_objects{outcome=\"applied\"} %d\n", m.last.applied)
+	fmt.Fprintf(w, "kubecuttle_reconcile_objects{outcome=\"failed\"} %d\n", m.last.failed)
+	fmt.Fprintf(w, "kubecuttle_reconcile_objects{outcome=\"pruned\"} %d\n", m.last.pruned)
+	metric("kubecuttle_reconcile_pruned_total", "counter", "Objects pruned since starting.")
+	fmt.Fprintf(w, "kubecuttle_reconcile_pruned_total %d\n", m.prunedTotal)
+	metric("kubecuttle_leader", "gauge", "Whether this replica is the leader.")
+	fmt.Fprintf(w, "kubecuttle_leader %d\n", leader)
+	if m.last.revision != "" {
+		metric("kubecuttle_reconcile_revision_info", "gauge", "The git revision last reconciled.")
+		fmt.Fprintf(w, "kubecuttle_reconcile_revision_info{revision=%q} 1\n", m.last.revision)
+	}
+}
+
+// newStatusMux serves the metrics on /metrics and whether the loop is making
+// progress on /healthz.
+func newStatusMux(m *reconcileMetrics) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.healthy(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	return mux
+}
@@ -0,0 +1,393 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/rest"
+)
+
+// errOpenAPIUnavailable is returned when the API server does not serve
+// OpenAPI v3 documents. Clusters older than v1.24 don't serve them by default.
+var errOpenAPIUnavailable = errors.New("the API server does not serve OpenAPI v3 documents")
+
+// openAPISchema is the subset of an OpenAPI v3 schema object needed to
+// validate Kubernetes objects.
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	AdditionalProperties *schemaOrBool             `json:"additionalProperties,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty"`
+	AnyOf                []*openAPISchema          `json:"anyOf,omitempty"`
+	OneOf                []*openAPISchema          `json:"oneOf,omitempty"`
+	Enum                 []interface{}             `json:"enum,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+
+	// Kubernetes extensions to OpenAPI.
+	PreserveUnknownFields bool           `json:"x-kubernetes-preserve-unknown-fields,omitempty"`
+	IntOrString           bool           `json:"x-kubernetes-int-or-string,omitempty"`
+	EmbeddedResource      bool           `json:"x-kubernetes-embedded-resource,omitempty"`
+	GroupVersionKinds     []gvkExtension `json:"x-kubernetes-group-version-kind,omitempty"`
+}
+
+// schemaOrBool holds the value of additionalProperties, which may either be
+// a boolean or a schema that every additional property must match.
+type schemaOrBool struct {
+	Allows bool
+	Schema *openAPISchema
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *schemaOrBool) UnmarshalJSON(data []byte) error {
+	switch string(bytes.TrimSpace(data)) {
+	case "true":
+		s.Allows = true
+		return nil
+	case "false":
+		s.Allows = false
+		return nil
+	}
+
+	s.Allows = true
+	s.Schema = &openAPISchema{}
+	return json.Unmarshal(data, s.Schema)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s schemaOrBool) MarshalJSON() ([]byte, error) {
+	if s.Schema != nil {
+		return json.Marshal(s.Schema)
+	}
+
+	return json.Marshal(s.Allows)
+}
+
+// gvkExtension is an entry in the x-kubernetes-group-version-kind extension
+// which ties a schema to the kinds it describes.
+type gvkExtension struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+// openAPIDocument is the subset of an OpenAPI v3 document that holds
+// schemas.
+type openAPIDocument struct {
+	Components struct {
+		Schemas map[string]*openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+// openAPISchemas holds the schemas read from one or more OpenAPI documents.
+type openAPISchemas struct {
+	// definitions holds every schema by its component name, which is
+	// what $ref values point at.
+	definitions map[string]*openAPISchema
+	// kinds holds the top level schema for each kind.
+	kinds map[schema.GroupVersionKind]*openAPISchema
+}
+
+// newOpenAPISchemas returns an empty set of schemas.
+func newOpenAPISchemas() *openAPISchemas {
+	return &openAPISchemas{
+		definitions: map[string]*openAPISchema{},
+		kinds:       map[schema.GroupVersionKind]*openAPISchema{},
+	}
+}
+
+// addDocument adds every schema in doc to the set.
+func (s *openAPISchemas) addDocument(doc *openAPIDocument) {
+	for name, definition := range doc.Components.Schemas {
+		s.definitions[name] = definition
+		for _, gvk := range definition.GroupVersionKinds {
+			s.kinds[schema.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}] = definition
+		}
+	}
+}
+
+// lookup returns the schema for a kind.
+func (s *openAPISchemas) lookup(gvk schema.GroupVersionKind) (*openAPISchema, bool) {
+	definition, ok := s.kinds[gvk]
+	return definition, ok
+}
+
+// resolve follows a $ref to the schema it points at.
+func (s *openAPISchemas) resolve(ref string) (*openAPISchema, bool) {
+	definition, ok := s.definitions[strings.TrimPrefix(ref, "#/components/schemas/")]
+	return definition, ok
+}
+
+// schemaSource finds the OpenAPI schema for a kind. A nil schema and nil
+// error means the source has no schema for the kind.
+type schemaSource interface {
+	schemaFor(gvk schema.GroupVersionKind) (*openAPISchema, *openAPISchemas, error)
+}
+
+// staticSchemaSource serves schemas that were all loaded up front, for
+// instance from files.
+type staticSchemaSource struct {
+	schemas *openAPISchemas
+}
+
+// schemaFor implements schemaSource.
+func (s *staticSchemaSource) schemaFor(gvk schema.GroupVersionKind) (*openAPISchema, *openAPISchemas, error) {
+	definition, ok := s.schemas.lookup(gvk)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	return definition, s.schemas, nil
+}
+
+// layeredSchemaSource asks each of its sources for a schema in turn,
+// returning the first one found.
+type layeredSchemaSource []schemaSource
+
+// schemaFor implements schemaSource.
+func (l layeredSchemaSource) schemaFor(gvk schema.GroupVersionKind) (*openAPISchema, *openAPISchemas, error) {
+	for _, source := range l {
+		definition, schemas, err := source.schemaFor(gvk)
+		if err != nil || definition != nil {
+			return definition, schemas, err
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// loadOpenAPIFiles reads OpenAPI v3 documents from files, or from every
+// .json, .yaml and .yml file in a directory.
+func loadOpenAPIFiles(paths []string) (*staticSchemaSource, error) {
+	schemas := newOpenAPISchemas()
+
+	for _, path := range paths {
+		files, err := expandSchemaPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read OpenAPI document: %s, got err: %w", file, err)
+			}
+
+			doc, err := parseOpenAPIDocument(contents)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse OpenAPI document: %s, got err: %w", file, err)
+			}
+			schemas.addDocument(doc)
+		}
+	}
+
+	return &staticSchemaSource{schemas: schemas}, nil
+}
+
+// expandSchemaPath returns path if it is a file, or the schema files inside
+// it if it is a directory.
+func expandSchemaPath(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI path: %s, got err: %w", path, err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI directory: %s, got err: %w", path, err)
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".json", ".yaml", ".yml":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// parseOpenAPIDocument parses a JSON or YAML OpenAPI v3 document.
+func parseOpenAPIDocument(contents []byte) (*openAPIDocument, error) {
+	data, err := yaml.ToJSON(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &openAPIDocument{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// clusterSchemaSource fetches OpenAPI v3 documents from the API server as
+// they are needed. The server publishes one document per group version.
+type clusterSchemaSource struct {
+	client rest.Interface
+	policy retryPolicy
+	// cacheDir is where fetched documents are saved for offline use. An
+	// empty value disables caching.
+	cacheDir string
+
+	// paths maps a group version path, such as apis/apps/v1, to the URL
+	// of its document. It is nil until the index has been fetched.
+	paths   map[string]string
+	fetched map[string]bool
+	schemas *openAPISchemas
+}
+
+// newClusterSchemaSource returns a schemaSource backed by the API server
+// that client talks to. Documents it fetches are saved to cacheDir.
+func newClusterSchemaSource(client rest.Interface, policy retryPolicy, cacheDir string) *clusterSchemaSource {
+	return &clusterSchemaSource{
+		client:   client,
+		policy:   policy,
+		cacheDir: cacheDir,
+		fetched:  map[string]bool{},
+		schemas:  newOpenAPISchemas(),
+	}
+}
+
+// schemaFor implements schemaSource.
+func (s *clusterSchemaSource) schemaFor(gvk schema.GroupVersionKind) (*openAPISchema, *openAPISchemas, error) {
+	if err := s.fetchGroupVersion(gvk.GroupVersion()); err != nil {
+		return nil, nil, err
+	}
+
+	definition, ok := s.schemas.lookup(gvk)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	return definition, s.schemas, nil
+}
+
+// fetchGroupVersion fetches the OpenAPI document for a group version unless
+// it has already been fetched.
+func (s *clusterSchemaSource) fetchGroupVersion(gv schema.GroupVersion) error {
+	path := openAPIPath(gv)
+	if s.fetched[path] {
+		return nil
+	}
+
+	if s.paths == nil {
+		paths, err := s.fetchIndex()
+		if err != nil {
+			return err
+		}
+		s.paths = paths
+	}
+
+	url, ok := s.paths[path]
+	if !ok {
+		// The server has no document for this group version.
+		s.fetched[path] = true
+		return nil
+	}
+
+	data, err := s.get(func() *rest.Request {
+		return s.client.Get().RequestURI(url)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch OpenAPI document for %s, got err: %w", gv, err)
+	}
+
+	doc := &openAPIDocument{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return fmt.Errorf("failed to parse OpenAPI document for %s, got err: %w", gv, err)
+	}
+
+	s.schemas.addDocument(doc)
+	s.fetched[path] = true
+	s.cache(path, data)
+
+	return nil
+}
+
+// cache saves a document so it can be used to validate objects without
+// access to the cluster. Caching is best effort, failures are ignored.
+func (s *clusterSchemaSource) cache(path string, data []byte) {
+	if s.cacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(s.cacheDir, 0750); err != nil {
+		return
+	}
+
+	name := strings.ReplaceAll(path, "/", "_") + ".json"
+	_ = ioutil.WriteFile(filepath.Join(s.cacheDir, name), data, 0640)
+}
+
+// fetchIndex fetches the list of documents the server publishes.
+func (s *clusterSchemaSource) fetchIndex() (map[string]string, error) {
+	data, err := s.get(func() *rest.Request {
+		return s.client.Get().AbsPath("/openapi/v3")
+	})
+	if apierrors.IsNotFound(err) {
+		return nil, errOpenAPIUnavailable
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OpenAPI index, got err: %w", err)
+	}
+
+	index := struct {
+		Paths map[string]struct {
+			ServerRelativeURL string `json:"serverRelativeURL"`
+		} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI index, got err: %w", err)
+	}
+
+	paths := map[string]string{}
+	for path, entry := range index.Paths {
+		paths[path] = entry.ServerRelativeURL
+	}
+
+	return paths, nil
+}
+
+// get makes a GET request, retrying transient failures.
+func (s *clusterSchemaSource) get(request func() *rest.Request) ([]byte, error) {
+	var data []byte
+	err := s.policy.do(func(ctx context.Context) error {
+		var err error
+		data, err = request().Do(ctx).Raw()
+		return err
+	})
+
+	return data, err
+}
+
+// openAPIPath returns the path the API server publishes a group version's
+// OpenAPI document under.
+func openAPIPath(gv schema.GroupVersion) string {
+	if gv.Group == "" {
+		return "api/" + gv.Version
+	}
+
+	return "apis/" + gv.Group + "/" + gv.Version
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"sort"
+)
+
+// kindOrder lists built in kinds in the order they should be created so
+// that anything an object depends on exists before it does. Objects are
+// deleted in the reverse order. Kinds not listed, such as custom resources,
+// come after every listed kind.
+var kindOrder = []string{
+	"Namespace",
+	"NetworkPolicy",
+	"ResourceQuota",
+	"LimitRange",
+	"PodSecurityPolicy",
+	"PodDisruptionBudget",
+	"ServiceAccount",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"CustomResourceDefinition",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"PriorityClass",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"HorizontalPodAutoscaler",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"IngressClass",
+	"Ingress",
+	"APIService",
+	"MutatingWebhookConfiguration",
+	"ValidatingWebhookConfiguration",
+}
+
+// kindRanks maps each kind in kindOrder to its position.
+var kindRanks = func() map[string]int {
+	ranks := make(map[string]int, len(kindOrder))
+	for i, kind := range kindOrder {
+		ranks[kind] = i
+	}
+	return ranks
+}()
+
+// kindRank returns the position of kind in kindOrder.
+func kindRank(kind string) int {
+	if rank, ok := kindRanks[kind]; ok {
+		return rank
+	}
+
+	return len(kindOrder)
+}
+
+// sortForDelete returns manifests in the order they should be deleted in,
+// the reverse of the order they'd be created in. Objects of the same kind
+// are deleted in the reverse of the order they were passed in.
+func sortForDelete(manifests []manifestObject) []manifestObject {
+	sorted := make([]manifestObject, len(manifests))
+	for i, m := range manifests {
+		sorted[len(manifests)-1-i] = m
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return kindRank(sorted[i].gvk.Kind) > kindRank(sorted[j].gvk.Kind)
+	})
+
+	return sorted
+}
@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/avestuk/kubecuttle/pkg/apply"
+	"golang.org/x/term"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+// planAction is what applying will do to an object.
+type planAction string
+
+const (
+	planCreate    planAction = "create"
+	planUpdate    planAction = "update"
+	planUnchanged planAction = "unchanged"
+	planPrune     planAction = "prune"
+)
+
+// planActions lists actions in the order plans are printed in, with the
+// symbol that marks their objects.
+var planActions = []struct {
+	action planAction
+	title  string
+	symbol string
+}{
+	{planCreate, "Create", "+"},
+	{planUpdate, "Update", "~"},
+	{planUnchanged, "Unchanged", "="},
+	{planPrune, "Prune", "-"},
+}
+
+// plannedChange is what applying will do to a single object.
+type plannedChange struct {
+	action planAction
+	object *unstructured.Unstructured
+	// fields lists the fields an update changes.
+	fields []string
+	// hash identifies the change, see diffHash.
+	hash string
+}
+
+// plan is what applying a set of objects will do, worked out with a dry
+// run.
+type plan struct {
+	changes []plannedChange
+}
+
+// hash returns the diff hash of the change planned for obj, or "" if it
+// wasn't planned.
+func (p plan) hash(obj *unstructured.Unstructured) string {
+	key := refFor(obj).key()
+	for _, c := range p.changes {
+		if refFor(c.object).key() == key {
+			return c.hash
+		}
+	}
+
+	return ""
+}
+
+// count returns the number of objects action will be taken on.
+func (p plan) count(action planAction) int {
+	n := 0
+	for _, c := range p.changes {
+		if c.action == action {
+			n++
+		}
+	}
+
+	return n
+}
+
+// addPrunes adds the objects in refs to p as ones that will be pruned.
+func (p *plan) addPrunes(refs []objectRef) {
+	for _, ref := range refs {
+		p.changes = append(p.changes, plannedChange{action: planPrune, object: ref.object()})
+	}
+}
+
+// changeCount returns the number of objects that will be changed.
+func (p plan) changeCount() int {
+	return len(p.changes) - p.count(planUnchanged)
+}
+
+// printPlan writes p grouped by action, e.g.
+//
+//	Create:
+//	  + Pod sre-test/busybox
+//	Update:
+//	  ~ Deployment sre-test/web (spec.replicas)
+//
+//	Plan: 1 to create, 1 to update, 0 unchanged, 0 to prune.
+func printPlan(out io.Writer, p plan) {
+	for _, a := range planActions {
+		if p.count(a.action) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "%s:\n", a.title)
+		for _, c := range p.changes {
+			if c.action != a.action {
+				continue
+			}
+			if len(c.fields) > 0 {
+				fmt.Fprintf(out, "  %s %s (%s)\n", a.symbol, describeObject(c.object), strings.Join(c.fields, ", "))
+				continue
+			}
+			fmt.Fprintf(out, "  %s %s\n", a.symbol, describeObject(c.object))
+		}
+	}
+
+	fmt.Fprintf(out, "\nPlan: %d to create, %d to update, %d unchanged, %d to prune.\n",
+		p.count(planCreate), p.count(planUpdate), p.count(planUnchanged), p.count(planPrune))
+}
+
+// planManifests works out what applying manifests would do by comparing
+// what's live with the result of a dry run apply of each object.
+func planManifests(dynamicClient dynamic.Interface, mapper meta.RESTMapper, discoveryClient discovery.DiscoveryInterface, manifests []manifestObject, policy retryPolicy) (plan, error) {
+	dryRun := apply.New(dynamicClient, mapper, apply.Options{
+		FieldManager: fieldManager,
+		DryRun:       true,
+		Retry:        policy.doContext,
+	})
+
+	p := plan{}
+	for _, manifest := range manifests {
+		obj := manifest.obj
+
+		// Objects whose namespace or kind is created by the same
+		// apply can't be dry run, but are certainly new.
+		if createdByManifests(obj, p) {
+			p.changes = append(p.changes, plannedChange{action: planCreate, object: obj, hash: diffHash(nil, obj)})
+			continue
+		}
+
+		mapping, err := getResourceMapping(mapper, manifest.gvk)
+		if err != nil {
+			err = explainMappingError(err, *manifest.gvk, discoveryClient)
+			return p, fmt.Errorf("failed to get gvr for %s, got err: %w", manifest.source.locate(manifest.index, nil), err)
+		}
+		dr := getRESTMapping(dynamicClient, mapping.Scope.Name(), obj.GetNamespace(), mapping.Resource)
+
+		var live *unstructured.Unstructured
+		err = policy.do(func(ctx context.Context) error {
+			var err error
+			live, err = dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			return err
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return p, fmt.Errorf("failed to get %s, got err: %w", describeObject(obj), err)
+		}
+
+		planned, err := dryRun.ApplyObject(context.Background(), obj)
+		if err != nil {
+			return p, fmt.Errorf("dry run of %s failed, got err: %w", manifest.source.locate(manifest.index, nil), err)
+		}
+
+		hash := diffHash(live, planned)
+		switch fields := changedFields(live, planned); {
+		case live == nil:
+			p.changes = append(p.changes, plannedChange{action: planCreate, object: obj, hash: hash})
+		case len(fields) == 0:
+			p.changes = append(p.changes, plannedChange{action: planUnchanged, object: obj, hash: hash})
+		default:
+			p.changes = append(p.changes, plannedChange{action: planUpdate, object: obj, fields: fields, hash: hash})
+		}
+	}
+
+	return p, nil
+}
+
+// createdByManifests reports whether obj's namespace, or the CRD defining
+// its kind, is planned to be created.
+func createdByManifests(obj *unstructured.Unstructured, p plan) bool {
+	gvk := obj.GroupVersionKind()
+	for _, c := range p.changes {
+		if c.action != planCreate {
+			continue
+		}
+
+		created := c.object.GroupVersionKind()
+		switch {
+		case created.GroupKind() == (schema.GroupKind{Kind: "Namespace"}) && c.object.GetName() == obj.GetNamespace():
+			return true
+		case isCRD(created):
+			group, _, _ := unstructured.NestedString(c.object.Object, "spec", "group")
+			kind, _, _ := unstructured.NestedString(c.object.Object, "spec", "names", "kind")
+			if group == gvk.Group && kind == gvk.Kind {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ignoredPlanFields are set by the server and change without the object
+// being changed.
+var ignoredPlanFields = map[string]bool{
+	"status":                     true,
+	"metadata.managedFields":     true,
+	"metadata.resourceVersion":   true,
+	"metadata.generation":        true,
+	"metadata.creationTimestamp": true,
+	"metadata.uid":               true,
+	"metadata.selfLink":          true,
+}
+
+// changedFields returns the paths of the fields that differ between live
+// and planned, ignoring those the server manages. Lists are compared as a
+// whole.
+func changedFields(live, planned *unstructured.Unstructured) []string {
+	if live == nil || planned == nil {
+		return nil
+	}
+
+	diff := map[string][]interface{}{}
+	diffFields(live.Object, planned.Object, "", diff)
+	fields := make([]string, 0, len(diff))
+	for path := range diff {
+		fields = append(fields, path)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+// diffHash returns a hash of the changes from live to planned, which
+// identifies the change without holding the values changed. Objects that
+// don't exist yet are compared with an empty one.
+func diffHash(live, planned *unstructured.Unstructured) string {
+	before := map[string]interface{}{}
+	if live != nil {
+		before = live.Object
+	}
+
+	diff := map[string][]interface{}{}
+	diffFields(before, planned.Object, "", diff)
+	// Maps are marshalled with their keys sorted, so the same change
+	// always hashes the same.
+	data, _ := json.Marshal(diff)
+	sum := sha256.Sum256(data)
+
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// diffFields records the fields that differ between live and planned in
+// diff, keyed by path, with their live and planned values.
+func diffFields(live, planned map[string]interface{}, prefix string, diff map[string][]interface{}) {
+	keys := map[string]bool{}
+	for k := range live {
+		keys[k] = true
+	}
+	for k := range planned {
+		keys[k] = true
+	}
+
+	for k := range keys {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if ignoredPlanFields[path] {
+			continue
+		}
+
+		liveChild, liveIsMap := live[k].(map[string]interface{})
+		plannedChild, plannedIsMap := planned[k].(map[string]interface{})
+		if liveIsMap && plannedIsMap {
+			diffFields(liveChild, plannedChild, path, diff)
+			continue
+		}
+		if !reflect.DeepEqual(live[k], planned[k]) {
+			diff[path] = []interface{}{live[k], planned[k]}
+		}
+	}
+}
+
+// errApplyCancelled is returned when the plan isn't confirmed.
+var errApplyCancelled = errors.New("apply cancelled")
+
+// confirmationInput returns where to read the answer to the confirmation
+// prompt from, or nil if there's no terminal to ask on. When the objects
+// are read from stdin the answer is read from the terminal directly.
+func confirmationInput(readsStdin bool) *os.File {
+	if readsStdin {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return nil
+		}
+		return tty
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil
+	}
+
+	return os.Stdin
+}
+
+// confirm asks whether to go ahead with changes, reading the answer from
+// in. Only y or yes goes ahead.
+func confirm(in io.Reader, out io.Writer, changes int) (bool, error) {
+	fmt.Fprintf(out, "\nApply these %d changes? [y/N] ", changes)
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read answer, got err: %w", err)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var plannedObjects = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-sleep
+  namespace: sre-test
+spec:
+  containers:
+  - name: busybox
+    image: busybox
+    args:
+    - sleep
+    - "1000000"
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-sleep-less
+  namespace: sre-test
+  labels:
+    foo: bar
+spec:
+  containers:
+  - name: busybox
+    image: busybox:stable
+    args:
+    - sleep
+    - "1000"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: sre-test
+data:
+  mode: fast
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team-a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: team-a
+data:
+  mode: fast
+`
+
+func TestPlanManifests(t *testing.T) {
+	server := startFakeAPIServer(t)
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+	dynamicClient, err := dynamicClientInit(config)
+	require.NoError(t, err, "failed to build dynamic client")
+	discoveryClient, mapper, err := buildCachedDiscovery(config, "", time.Hour)
+	require.NoError(t, err, "failed to build discovery")
+
+	existing, err := decodeManifests([]inputFile{{source: "pods.yaml", contents: []byte(twoPods)}})
+	require.NoError(t, err, "failed to decode pods")
+	applier := newManifestApplier(dynamicClient, mapper, discoveryClient, defaultRetryPolicy())
+	for _, manifest := range existing {
+		_, err := applier.apply(manifest)
+		require.NoError(t, err, "failed to apply %s", describeObject(manifest.obj))
+	}
+
+	manifests, err := decodeManifests([]inputFile{{source: "planned.yaml", contents: []byte(plannedObjects)}})
+	require.NoError(t, err, "failed to decode planned objects")
+	p, err := planManifests(dynamicClient, mapper, discoveryClient, manifests, defaultRetryPolicy())
+	require.NoError(t, err, "failed to plan")
+
+	actions := []string{}
+	for _, c := range p.changes {
+		actions = append(actions, string(c.action)+" "+describeObject(c.object))
+	}
+	require.Equal(t, []string{
+		"unchanged Pod sre-test/busybox-sleep",
+		"update Pod sre-test/busybox-sleep-less",
+		"create ConfigMap sre-test/settings",
+		"create Namespace team-a",
+		"create ConfigMap team-a/settings",
+	}, actions)
+	require.Equal(t, []string{"metadata.labels", "spec.containers"}, p.changes[1].fields)
+	require.Equal(t, 4, p.changeCount())
+	require.Nil(t, server.get("configmaps", "sre-test", "settings"), "expected planning not to create anything")
+
+	out := &bytes.Buffer{}
+	printPlan(out, p)
+	require.Equal(t, `Create:
+  + ConfigMap sre-test/settings
+  + Namespace team-a
+  + ConfigMap team-a/settings
+Update:
+  ~ Pod sre-test/busybox-sleep-less (metadata.labels, spec.containers)
+Unchanged:
+  = Pod sre-test/busybox-sleep
+
+Plan: 3 to create, 1 to update, 1 unchanged, 0 to prune.
+`, out.String())
+
+	// Objects being pruned are planned alongside.
+	p.addPrunes([]objectRef{{Version: "v1", Kind: "ConfigMap", Namespace: "sre-test", Name: "old"}})
+	require.Equal(t, 5, p.changeCount())
+	out.Reset()
+	printPlan(out, p)
+	require.Contains(t, out.String(), `Prune:
+  - ConfigMap sre-test/old
+
+Plan: 3 to create, 1 to update, 1 unchanged, 1 to prune.
+`)
+
+	// Objects the dry run rejects fail the plan.
+	invalid, err := decodeManifests([]inputFile{{source: "invalid.yaml", contents: []byte(incorrectSpec)}})
+	require.NoError(t, err, "failed to decode invalid pod")
+	_, err = planManifests(dynamicClient, mapper, discoveryClient, invalid, defaultRetryPolicy())
+	require.Error(t, err, "expected invalid objects to fail the plan")
+	require.Contains(t, err.Error(), "dry run of invalid.yaml:2 failed")
+}
+
+func TestDiffHash(t *testing.T) {
+	object := func(image, resourceVersion string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "web", "resourceVersion": resourceVersion},
+			"spec":     map[string]interface{}{"image": image},
+		}}
+	}
+
+	update := diffHash(object("nginx:1.20", "1"), object("nginx:1.21", "2"))
+	require.True(t, strings.HasPrefix(update, "sha256:"), update)
+	require.Equal(t, update, diffHash(object("nginx:1.20", "5"), object("nginx:1.21", "6")), "expected fields the server manages to be ignored")
+	require.NotEqual(t, update, diffHash(object("nginx:1.19", "1"), object("nginx:1.21", "2")), "expected a different change to hash differently")
+	require.NotEqual(t, update, diffHash(nil, object("nginx:1.21", "2")), "expected a create to hash differently")
+	require.Equal(t, diffHash(object("nginx:1.21", "1"), object("nginx:1.21", "2")), diffHash(object("nginx:1.20", "1"), object("nginx:1.20", "2")), "expected no change to always hash the same")
+}
+
+func TestConfirm(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Answer string
+		Want   bool
+	}{
+		{Name: "y", Answer: "y\n", Want: true},
+		{Name: "yes", Answer: "Yes\n", Want: true},
+		{Name: "yes without a newline", Answer: "yes", Want: true},
+		{Name: "no", Answer: "n\n"},
+		{Name: "default", Answer: "\n"},
+		{Name: "no answer", Answer: ""},
+		{Name: "anything else", Answer: "sure\n"},
+	}
+
+	for _, tt := range cases {
+		out := &bytes.Buffer{}
+		ok, err := confirm(strings.NewReader(tt.Answer), out, 3)
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Want, ok, "test: %s", tt.Name)
+		require.Equal(t, "\nApply these 3 changes? [y/N] ", out.String(), "test: %s", tt.Name)
+	}
+}
@@ -0,0 +1,428 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// severity decides what happens when an object breaks a policy rule.
+type severity string
+
+const (
+	// severityWarn reports the violation but applies the object anyway.
+	severityWarn severity = "warn"
+	// severityBlock stops anything being applied.
+	severityBlock severity = "block"
+)
+
+// violation is one way an object breaks a rule.
+type violation struct {
+	// path is the field at fault, if there's one in particular.
+	path    fieldPath
+	message string
+}
+
+// policyCheck checks an object against a rule.
+type policyCheck func(obj *unstructured.Unstructured) ([]violation, error)
+
+// policyRuleConfig configures a rule in a policy file. Built in rules are
+// chosen by name, any rule with an expression is a custom CEL rule.
+type policyRuleConfig struct {
+	Name     string   `json:"name"`
+	Severity severity `json:"severity"`
+	// Kinds limits the rule to objects of these kinds.
+	Kinds []string `json:"kinds,omitempty"`
+	// Labels are the labels the required-labels rule requires.
+	Labels []string `json:"labels,omitempty"`
+	// Resources are the requests and limits the require-resources rule
+	// requires, e.g. limits.memory. Defaults to cpu and memory requests
+	// and limits.
+	Resources []string `json:"resources,omitempty"`
+	// Expression is a CEL expression about object, which passes by
+	// returning true or an empty string or list, and fails by returning
+	// false or strings saying what's wrong.
+	Expression string `json:"expression,omitempty"`
+	// Message replaces what's reported when Expression fails.
+	Message string `json:"message,omitempty"`
+}
+
+// policyFile is the format of the files passed with --policy.
+type policyFile struct {
+	Rules []policyRuleConfig `json:"rules"`
+}
+
+// builtinPolicies builds the built in rules from their configuration, by
+// name.
+var builtinPolicies = map[string]func(config policyRuleConfig) (policyCheck, error){
+	"no-latest-tag":     func(policyRuleConfig) (policyCheck, error) { return checkNoLatestTag, nil },
+	"require-resources": newRequireResources,
+	"no-privileged":     func(policyRuleConfig) (policyCheck, error) { return checkNoPrivileged, nil },
+	"no-host-path":      func(policyRuleConfig) (policyCheck, error) { return checkNoHostPath, nil },
+	"required-labels":   newRequiredLabels,
+}
+
+// defaultResources are the requests and limits required by default.
+var defaultResources = []string{"requests.cpu", "requests.memory", "limits.cpu", "limits.memory"}
+
+// policyRule is a rule ready to check objects.
+type policyRule struct {
+	name     string
+	severity severity
+	kinds    map[string]bool
+	check    policyCheck
+}
+
+// objectPolicy is the set of rules objects are checked against before
+// they're applied.
+type objectPolicy struct {
+	rules []policyRule
+}
+
+// addPolicyFlags adds the flags that choose policy rules to flags.
+func addPolicyFlags(flags *pflag.FlagSet) {
+	flags.StringSlice("policy", nil, "check objects against the rules in these policy files before applying them")
+	flags.String("builtin-policies", "", "check objects against every built in rule that needs no configuration, at this severity. One of warn or block")
+}
+
+// objectPolicyFromFlags builds the policy the flags ask for. It has no
+// rules if no policy flags were passed.
+func objectPolicyFromFlags(cmd *cobra.Command) (*objectPolicy, error) {
+	p := &objectPolicy{}
+
+	builtin, err := cmd.Flags().GetString("builtin-policies")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of builtin-policies flag, got err: %s", err)
+	}
+	if builtin != "" {
+		for _, name := range []string{"no-latest-tag", "require-resources", "no-privileged", "no-host-path"} {
+			if err := p.add(policyRuleConfig{Name: name, Severity: severity(builtin)}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	paths, err := cmd.Flags().GetStringSlice("policy")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of policy flag, got err: %s", err)
+	}
+	for _, path := range paths {
+		if err := p.load(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// load adds the rules in a policy file.
+func (p *objectPolicy) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file: %s, got err: %s", path, err)
+	}
+
+	file := policyFile{}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("failed to parse policy file: %s, got err: %w", path, err)
+	}
+
+	for _, config := range file.Rules {
+		if err := p.add(config); err != nil {
+			return fmt.Errorf("invalid rule in policy file %s, got err: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// add adds a rule to the policy.
+func (p *objectPolicy) add(config policyRuleConfig) error {
+	if config.Name == "" {
+		return fmt.Errorf("rules must have a name")
+	}
+	switch config.Severity {
+	case severityWarn, severityBlock:
+	default:
+		return fmt.Errorf("invalid severity for rule %s, must be one of warn or block, got: %q", config.Name, config.Severity)
+	}
+
+	var check policyCheck
+	var err error
+	if config.Expression != "" {
+		check, err = newCELPolicy(config)
+	} else if build, ok := builtinPolicies[config.Name]; ok {
+		check, err = build(config)
+	} else {
+		err = fmt.Errorf("unknown rule %s, pass an expression for custom rules", config.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	rule := policyRule{name: config.Name, severity: config.Severity, check: check}
+	if len(config.Kinds) > 0 {
+		rule.kinds = map[string]bool{}
+		for _, kind := range config.Kinds {
+			rule.kinds[kind] = true
+		}
+	}
+	p.rules = append(p.rules, rule)
+
+	return nil
+}
+
+// checkObjectPolicy checks every object against the policy, reporting each
+// violation. Only violations of blocking rules are an error.
+func checkObjectPolicy(p *objectPolicy, objects []manifestObject) error {
+	if p == nil || len(p.rules) == 0 {
+		return nil
+	}
+
+	blocked := 0
+	for _, o := range objects {
+		isBlocked := false
+		for _, rule := range p.rules {
+			if rule.kinds != nil && !rule.kinds[o.obj.GetKind()] {
+				continue
+			}
+
+			violations, err := rule.check(o.obj)
+			if err != nil {
+				// A rule that can't be checked could be hiding a
+				// violation, so it counts as one.
+				violations = []violation{{message: err.Error()}}
+			}
+
+			prefix := ""
+			if rule.severity == severityWarn {
+				prefix = "Warning: "
+			}
+			for _, v := range violations {
+				fmt.Fprintf(os.Stderr, "%s%s: %s: %s: %s\n", prefix, o.source.locate(o.index, v.path), describeObject(o.obj), rule.name, v.message)
+			}
+			if len(violations) > 0 && rule.severity == severityBlock {
+				isBlocked = true
+			}
+		}
+		if isBlocked {
+			blocked++
+		}
+	}
+
+	if blocked > 0 {
+		return fmt.Errorf("%d object(s) violate blocking policy rules", blocked)
+	}
+
+	return nil
+}
+
+// newCELPolicy builds a custom rule from a CEL expression.
+func newCELPolicy(config policyRuleConfig) (policyCheck, error) {
+	expression, err := compileCEL(config.Expression)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(obj *unstructured.Unstructured) ([]violation, error) {
+		failures, err := expression.failures(obj)
+		if err != nil {
+			return nil, err
+		}
+		if len(failures) > 0 && config.Message != "" {
+			return []violation{{message: config.Message}}, nil
+		}
+
+		violations := make([]violation, 0, len(failures))
+		for _, failure := range failures {
+			violations = append(violations, violation{message: failure})
+		}
+		return violations, nil
+	}, nil
+}
+
+// containerAt is a container inside an object.
+type containerAt struct {
+	path      fieldPath
+	container map[string]interface{}
+}
+
+// objectContainers returns every container in an object's pod specs.
+func objectContainers(obj *unstructured.Unstructured) []containerAt {
+	containers := []containerAt{}
+	for _, specPath := range podSpecPaths(obj.GetKind()) {
+		spec := childMap(obj.Object, specPath...)
+		if spec == nil {
+			continue
+		}
+		for _, field := range []string{"initContainers", "containers", "ephemeralContainers"} {
+			list, _ := spec[field].([]interface{})
+			for i, item := range list {
+				if container, ok := item.(map[string]interface{}); ok {
+					containers = append(containers, containerAt{path: toFieldPath(specPath).child(field).child(i), container: container})
+				}
+			}
+		}
+	}
+
+	return containers
+}
+
+// podSpecPathsByKind are the paths to the pod specs inside the kinds that
+// have them. Unlike podTemplatePaths a CronJob's job template isn't one, only
+// the pod template inside it.
+var podSpecPathsByKind = map[string][][]string{
+	"Pod":                   {{"spec"}},
+	"Deployment":            {{"spec", "template", "spec"}},
+	"ReplicaSet":            {{"spec", "template", "spec"}},
+	"StatefulSet":           {{"spec", "template", "spec"}},
+	"DaemonSet":             {{"spec", "template", "spec"}},
+	"Job":                   {{"spec", "template", "spec"}},
+	"ReplicationController": {{"spec", "template", "spec"}},
+	"PodTemplate":           {{"template", "spec"}},
+	"CronJob":               {{"spec", "jobTemplate", "spec", "template", "spec"}},
+}
+
+// podSpecPaths returns the paths to the pod specs in objects of kind.
+func podSpecPaths(kind string) [][]string {
+	return podSpecPathsByKind[kind]
+}
+
+// toFieldPath converts a path of field names to a fieldPath.
+func toFieldPath(path []string) fieldPath {
+	p := make(fieldPath, 0, len(path))
+	for _, elem := range path {
+		p = append(p, elem)
+	}
+
+	return p
+}
+
+// containerName names a container for messages.
+func containerName(c containerAt) string {
+	name, _ := c.container["name"].(string)
+	return name
+}
+
+// checkNoLatestTag flags images using the latest tag, or no tag, unless
+// they're pinned to a digest.
+func checkNoLatestTag(obj *unstructured.Unstructured) ([]violation, error) {
+	violations := []violation{}
+	for _, c := range objectContainers(obj) {
+		image, _ := c.container["image"].(string)
+		ref, err := parseImage(image)
+		if err != nil {
+			violations = append(violations, violation{path: c.path.child("image"), message: err.Error()})
+			continue
+		}
+		if ref.digest == "" && ref.tag == defaultTag {
+			violations = append(violations, violation{
+				path:    c.path.child("image"),
+				message: fmt.Sprintf("container %s uses the latest tag of %s, pin a version or digest", containerName(c), image),
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+// newRequireResources builds a rule requiring containers to set resource
+// requests and limits.
+func newRequireResources(config policyRuleConfig) (policyCheck, error) {
+	resources := config.Resources
+	if len(resources) == 0 {
+		resources = defaultResources
+	}
+	for _, resource := range resources {
+		parts := strings.SplitN(resource, ".", 2)
+		if len(parts) != 2 || (parts[0] != "requests" && parts[0] != "limits") {
+			return nil, fmt.Errorf("resources must be requests.<name> or limits.<name>, got: %s", resource)
+		}
+	}
+
+	return func(obj *unstructured.Unstructured) ([]violation, error) {
+		violations := []violation{}
+		for _, c := range objectContainers(obj) {
+			missing := []string{}
+			for _, resource := range resources {
+				parts := strings.SplitN(resource, ".", 2)
+				if _, ok := childMap(c.container, "resources", parts[0])[parts[1]]; !ok {
+					missing = append(missing, resource)
+				}
+			}
+			if len(missing) > 0 {
+				violations = append(violations, violation{
+					path:    c.path.child("resources"),
+					message: fmt.Sprintf("container %s doesn't set %s", containerName(c), strings.Join(missing, ", ")),
+				})
+			}
+		}
+		return violations, nil
+	}, nil
+}
+
+// checkNoPrivileged flags privileged containers.
+func checkNoPrivileged(obj *unstructured.Unstructured) ([]violation, error) {
+	violations := []violation{}
+	for _, c := range objectContainers(obj) {
+		if privileged, _ := childMap(c.container, "securityContext")["privileged"].(bool); privileged {
+			violations = append(violations, violation{
+				path:    c.path.child("securityContext").child("privileged"),
+				message: fmt.Sprintf("container %s is privileged", containerName(c)),
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+// checkNoHostPath flags pods mounting directories from their node.
+func checkNoHostPath(obj *unstructured.Unstructured) ([]violation, error) {
+	violations := []violation{}
+	for _, specPath := range podSpecPaths(obj.GetKind()) {
+		volumes, _ := childMap(obj.Object, specPath...)["volumes"].([]interface{})
+		for i, item := range volumes {
+			volume, _ := item.(map[string]interface{})
+			if _, ok := volume["hostPath"]; ok {
+				violations = append(violations, violation{
+					path:    toFieldPath(specPath).child("volumes").child(i).child("hostPath"),
+					message: fmt.Sprintf("volume %s mounts a hostPath", volume["name"]),
+				})
+			}
+		}
+	}
+
+	return violations, nil
+}
+
+// newRequiredLabels builds a rule requiring objects to have labels.
+func newRequiredLabels(config policyRuleConfig) (policyCheck, error) {
+	if len(config.Labels) == 0 {
+		return nil, fmt.Errorf("required-labels needs labels to require")
+	}
+	labels := append([]string{}, config.Labels...)
+	sort.Strings(labels)
+
+	return func(obj *unstructured.Unstructured) ([]violation, error) {
+		missing := []string{}
+		for _, label := range labels {
+			if _, ok := obj.GetLabels()[label]; !ok {
+				missing = append(missing, label)
+			}
+		}
+		if len(missing) == 0 {
+			return nil, nil
+		}
+		return []violation{{
+			path:    fieldPath{"metadata"},
+			message: fmt.Sprintf("missing required label(s) %s", strings.Join(missing, ", ")),
+		}}, nil
+	}, nil
+}
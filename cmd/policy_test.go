@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var unsafeDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: busybox
+  namespace: sre-test
+  labels:
+    team: sre
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: busybox
+  template:
+    metadata:
+      labels:
+        app: busybox
+    spec:
+      containers:
+      - name: busybox
+        image: busybox
+        securityContext:
+          privileged: true
+        resources:
+          requests:
+            cpu: 100m
+            memory: 64Mi
+      - name: pinned
+        image: busybox@sha256:abc
+        resources:
+          requests:
+            cpu: 100m
+            memory: 64Mi
+          limits:
+            cpu: 100m
+            memory: 64Mi
+      volumes:
+      - name: docker
+        hostPath:
+          path: /var/run/docker.sock
+`
+
+func TestBuiltinPolicies(t *testing.T) {
+	manifests, err := decodeManifests([]inputFile{{source: "deployment.yaml", contents: []byte(unsafeDeployment)}})
+	require.NoError(t, err, "failed to decode deployment")
+	obj := manifests[0].obj
+
+	cases := []struct {
+		Name     string
+		Config   policyRuleConfig
+		Expected []violation
+		Err      string
+	}{
+		{
+			Name:   "no-latest-tag",
+			Config: policyRuleConfig{Name: "no-latest-tag"},
+			Expected: []violation{{
+				path:    fieldPath{"spec", "template", "spec", "containers", 0, "image"},
+				message: "container busybox uses the latest tag of busybox, pin a version or digest",
+			}},
+		},
+		{
+			Name:   "require-resources",
+			Config: policyRuleConfig{Name: "require-resources"},
+			Expected: []violation{{
+				path:    fieldPath{"spec", "template", "spec", "containers", 0, "resources"},
+				message: "container busybox doesn't set limits.cpu, limits.memory",
+			}},
+		},
+		{
+			Name:   "require-resources with configured resources",
+			Config: policyRuleConfig{Name: "require-resources", Resources: []string{"requests.memory"}},
+		},
+		{
+			Name:   "invalid resources",
+			Config: policyRuleConfig{Name: "require-resources", Resources: []string{"memory"}},
+			Err:    "resources must be requests.<name> or limits.<name>, got: memory",
+		},
+		{
+			Name:   "no-privileged",
+			Config: policyRuleConfig{Name: "no-privileged"},
+			Expected: []violation{{
+				path:    fieldPath{"spec", "template", "spec", "containers", 0, "securityContext", "privileged"},
+				message: "container busybox is privileged",
+			}},
+		},
+		{
+			Name:   "no-host-path",
+			Config: policyRuleConfig{Name: "no-host-path"},
+			Expected: []violation{{
+				path:    fieldPath{"spec", "template", "spec", "volumes", 0, "hostPath"},
+				message: "volume docker mounts a hostPath",
+			}},
+		},
+		{
+			Name:   "required-labels",
+			Config: policyRuleConfig{Name: "required-labels", Labels: []string{"team", "app.kubernetes.io/name", "release"}},
+			Expected: []violation{{
+				path:    fieldPath{"metadata"},
+				message: "missing required label(s) app.kubernetes.io/name, release",
+			}},
+		},
+		{
+			Name:   "required-labels without labels",
+			Config: policyRuleConfig{Name: "required-labels"},
+			Err:    "required-labels needs labels to require",
+		},
+		{
+			Name:   "custom rule returning a bool",
+			Config: policyRuleConfig{Name: "replicas", Expression: "object.spec.replicas >= 2", Message: "run at least two replicas"},
+			Expected: []violation{{
+				message: "run at least two replicas",
+			}},
+		},
+		{
+			Name: "custom rule returning messages",
+			Config: policyRuleConfig{
+				Name:       "memory-limits",
+				Expression: `object.spec.template.spec.containers.filter(c, !has(c.resources.limits)).map(c, c.name + " has no limits")`,
+			},
+			Expected: []violation{{message: "busybox has no limits"}},
+		},
+		{
+			Name:   "custom rule that doesn't compile",
+			Config: policyRuleConfig{Name: "broken", Expression: "object.spec.replicas >="},
+			Err:    "failed to compile",
+		},
+	}
+
+	for _, tt := range cases {
+		tt.Config.Severity = severityBlock
+		p := &objectPolicy{}
+		err := p.add(tt.Config)
+		if tt.Err != "" {
+			require.Error(t, err, "test: %s", tt.Name)
+			require.Contains(t, err.Error(), tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+
+		violations, err := p.rules[0].check(obj)
+		require.NoError(t, err, "test: %s", tt.Name)
+		if len(tt.Expected) == 0 {
+			require.Empty(t, violations, "test: %s", tt.Name)
+			continue
+		}
+		require.Equal(t, tt.Expected, violations, "test: %s", tt.Name)
+	}
+}
+
+func TestCheckObjectPolicy(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"warn.yaml": `
+rules:
+- name: no-latest-tag
+  severity: warn
+- name: required-labels
+  severity: warn
+  labels: [team]
+`,
+		"block.yaml": `
+rules:
+- name: no-host-path
+  severity: block
+  kinds: [Deployment]
+`,
+		"pods-only.yaml": `
+rules:
+- name: no-host-path
+  severity: block
+  kinds: [Pod]
+`,
+		"invalid.yaml": `
+rules:
+- name: no-host-path
+  severity: error
+`,
+		"unknown.yaml": `
+rules:
+- name: no-root
+  severity: warn
+`,
+	})
+
+	manifests, err := decodeManifests([]inputFile{{source: "deployment.yaml", contents: []byte(unsafeDeployment)}})
+	require.NoError(t, err, "failed to decode deployment")
+
+	cases := []struct {
+		Name  string
+		Files []string
+		Err   string
+	}{
+		{
+			Name:  "warnings don't block",
+			Files: []string{"warn.yaml"},
+		},
+		{
+			Name:  "blocking violations",
+			Files: []string{"warn.yaml", "block.yaml"},
+			Err:   "1 object(s) violate blocking policy rules",
+		},
+		{
+			Name:  "rules only check their kinds",
+			Files: []string{"pods-only.yaml"},
+		},
+		{
+			Name:  "invalid severity",
+			Files: []string{"invalid.yaml"},
+			Err:   `invalid rule in policy file ` + filepath.Join(dir, "invalid.yaml") + `, got err: invalid severity for rule no-host-path, must be one of warn or block, got: "error"`,
+		},
+		{
+			Name:  "unknown rule",
+			Files: []string{"unknown.yaml"},
+			Err:   `invalid rule in policy file ` + filepath.Join(dir, "unknown.yaml") + `, got err: unknown rule no-root, pass an expression for custom rules`,
+		},
+	}
+
+	for _, tt := range cases {
+		p := &objectPolicy{}
+		var err error
+		for _, file := range tt.Files {
+			if err = p.load(filepath.Join(dir, file)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = checkObjectPolicy(p, manifests)
+		}
+
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+	}
+}
+
+var unsafeCronJob = `
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: busybox
+  namespace: sre-test
+spec:
+  schedule: "*/5 * * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          restartPolicy: Never
+          containers:
+          - name: busybox
+            image: busybox:1.34
+            securityContext:
+              privileged: true
+          volumes:
+          - name: docker
+            hostPath:
+              path: /var/run/docker.sock
+`
+
+func TestCronJobPolicies(t *testing.T) {
+	manifests, err := decodeManifests([]inputFile{{source: "cronjob.yaml", contents: []byte(unsafeCronJob)}})
+	require.NoError(t, err, "failed to decode CronJob")
+	obj := manifests[0].obj
+
+	// Only the pod template is a pod spec, not the job template around it.
+	require.Equal(t, [][]string{{"spec", "jobTemplate", "spec", "template", "spec"}}, podSpecPaths("CronJob"))
+
+	cases := []struct {
+		Name     string
+		Expected []violation
+	}{
+		{
+			Name: "no-privileged",
+			Expected: []violation{{
+				path:    fieldPath{"spec", "jobTemplate", "spec", "template", "spec", "containers", 0, "securityContext", "privileged"},
+				message: "container busybox is privileged",
+			}},
+		},
+		{
+			Name: "no-host-path",
+			Expected: []violation{{
+				path:    fieldPath{"spec", "jobTemplate", "spec", "template", "spec", "volumes", 0, "hostPath"},
+				message: "volume docker mounts a hostPath",
+			}},
+		},
+		{
+			Name: "no-latest-tag",
+		},
+	}
+
+	for _, tt := range cases {
+		p := &objectPolicy{}
+		require.NoError(t, p.add(policyRuleConfig{Name: tt.Name, Severity: severityBlock}), "test: %s", tt.Name)
+
+		violations, err := p.rules[0].check(obj)
+		require.NoError(t, err, "test: %s", tt.Name)
+		if len(tt.Expected) == 0 {
+			require.Empty(t, violations, "test: %s", tt.Name)
+			continue
+		}
+		require.Equal(t, tt.Expected, violations, "test: %s", tt.Name)
+	}
+}
@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/rest"
+)
+
+// protectedTarget is a kubeconfig context or API server that changes are
+// guarded against, read from the protected list in the config file:
+//
+//	protected:
+//	- context: prod-eu
+//	  name: prod-eu-1
+//	  window:
+//	    days: [Mon, Tue, Wed, Thu]
+//	    start: "09:00"
+//	    end: "16:00"
+//	    timezone: Europe/London
+//	  branches: [main]
+//	- server: https://prod.example.com:6443
+type protectedTarget struct {
+	// Context and Server match the kubeconfig context or API server
+	// URL being used. Either is enough to match.
+	Context string `mapstructure:"context"`
+	Server  string `mapstructure:"server"`
+	// Name is what has to be typed to confirm changes. It defaults to
+	// the context's cluster name.
+	Name string `mapstructure:"name"`
+	// Window restricts changes to certain times.
+	Window *changeWindow `mapstructure:"window"`
+	// Branches restricts changes to being made from these git
+	// branches.
+	Branches []string `mapstructure:"branches"`
+}
+
+// changeWindow is when changes are allowed, e.g. 09:00 to 16:00 Monday to
+// Thursday.
+type changeWindow struct {
+	Days     []string `mapstructure:"days"`
+	Start    string   `mapstructure:"start"`
+	End      string   `mapstructure:"end"`
+	Timezone string   `mapstructure:"timezone"`
+}
+
+// clusterTarget is the context and API server commands are about to talk
+// to.
+type clusterTarget struct {
+	context string
+	cluster string
+	server  string
+	// user is the context's kubeconfig user.
+	user string
+}
+
+// addProtectionFlags adds the flags that confirm changes to protected
+// clusters to flags.
+func addProtectionFlags(flags *pflag.FlagSet) {
+	flags.String("confirm-cluster", "", "the name of the protected cluster being changed, to confirm changes to it without being asked")
+}
+
+// protectedTargetsFromConfig reads the protected list from the config file.
+func protectedTargetsFromConfig(v *viper.Viper) ([]protectedTarget, error) {
+	targets := []protectedTarget{}
+	if err := v.UnmarshalKey("protected", &targets); err != nil {
+		return nil, fmt.Errorf("failed to read protected from config, got err: %w", err)
+	}
+
+	for i, target := range targets {
+		if target.Context == "" && target.Server == "" {
+			return nil, fmt.Errorf("protected target %d needs a context or server", i)
+		}
+		if target.Window != nil {
+			if _, err := target.Window.allows(time.Now()); err != nil {
+				return nil, fmt.Errorf("invalid window for protected target %d, got err: %w", i, err)
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+// currentTarget returns the context and API server config talks to.
+func currentTarget(config *rest.Config) (clusterTarget, error) {
+	target := clusterTarget{server: config.Host}
+
+	kubeconfigPath := os.Getenv("KUBECONFIG")
+	if kubeconfigPath == "" {
+		return target, nil
+	}
+
+	raw, err := kubeconfigLoader(kubeconfigPath).RawConfig()
+	if err != nil {
+		return target, fmt.Errorf("failed to read kubeconfig from file: %s, got err: %s", kubeconfigPath, err)
+	}
+	target.context = raw.CurrentContext
+	if kubeContext != "" {
+		target.context = kubeContext
+	}
+	if context, ok := raw.Contexts[target.context]; ok {
+		target.cluster = context.Cluster
+		target.user = context.AuthInfo
+	}
+
+	return target, nil
+}
+
+// matches reports whether t is protected by p.
+func (p protectedTarget) matches(t clusterTarget) bool {
+	switch {
+	case p.Context != "" && p.Context == t.context:
+		return true
+	case p.Server != "" && strings.TrimSuffix(p.Server, "/") == strings.TrimSuffix(t.server, "/"):
+		return true
+	default:
+		return false
+	}
+}
+
+// allows reports whether changes may be made at now. A window whose end is
+// before its start, e.g. 22:00 to 02:00, runs past midnight, and belongs to
+// the day it starts on.
+func (w changeWindow) allows(now time.Time) (bool, error) {
+	location := time.Local
+	if w.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(w.Timezone); err != nil {
+			return false, fmt.Errorf("invalid timezone %q, got err: %w", w.Timezone, err)
+		}
+	}
+	now = now.In(location)
+
+	start, end := 0, 24*60
+	if w.Start != "" {
+		var err error
+		if start, err = windowMinutes(w.Start); err != nil {
+			return false, fmt.Errorf("invalid start %q, expected HH:MM", w.Start)
+		}
+	}
+	if w.End != "" {
+		var err error
+		if end, err = windowMinutes(w.End); err != nil {
+			return false, fmt.Errorf("invalid end %q, expected HH:MM", w.End)
+		}
+	}
+
+	minutes := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	allowed := minutes >= start && minutes < end
+	if start > end {
+		allowed = minutes >= start || minutes < end
+		// After midnight we're in the window that started yesterday.
+		if minutes < end {
+			day = now.AddDate(0, 0, -1).Weekday()
+		}
+	}
+
+	if len(w.Days) > 0 {
+		onDay := false
+		for _, d := range w.Days {
+			if len(d) < 3 {
+				return false, fmt.Errorf("invalid day %q, expected one like Mon or Monday", d)
+			}
+			if strings.EqualFold(d[:3], day.String()[:3]) {
+				onDay = true
+			}
+		}
+		if !onDay {
+			return false, nil
+		}
+	}
+
+	return allowed, nil
+}
+
+// windowMinutes returns the minutes since midnight of a time of day like
+// 09:30. 24:00 is the end of the day.
+func windowMinutes(clock string) (int, error) {
+	if clock == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// String describes the window, e.g. "Mon, Tue 09:00-16:00 Europe/London".
+func (w changeWindow) String() string {
+	start, end, zone := w.Start, w.End, w.Timezone
+	if start == "" {
+		start = "00:00"
+	}
+	if end == "" {
+		end = "24:00"
+	}
+	if zone == "" {
+		zone = "local time"
+	}
+
+	days := "every day"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ", ")
+	}
+
+	return fmt.Sprintf("%s %s-%s %s", days, start, end, zone)
+}
+
+// protection guards changes to a protected cluster.
+type protection struct {
+	// name is what has to be typed to confirm changes.
+	name string
+}
+
+// checkProtection returns the protection for the cluster config talks to,
+// or nil if it isn't protected. Protected clusters must be chosen with
+// --context, and changed within their window and from their branches.
+// files are the input files, whose git checkout is checked for the branch.
+func checkProtection(cmd *cobra.Command, v *viper.Viper, config *rest.Config, files []inputFile, now time.Time) (*protection, error) {
+	targets, err := protectedTargetsFromConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := currentTarget(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range targets {
+		if !target.matches(current) {
+			continue
+		}
+
+		p := &protection{name: target.Name}
+		if p.name == "" {
+			p.name = current.cluster
+		}
+		if p.name == "" {
+			p.name = current.server
+		}
+
+		if !cmd.Flags().Changed("context") {
+			return nil, fmt.Errorf("%s is a protected cluster, pass --context explicitly to change it", p.name)
+		}
+
+		if target.Window != nil {
+			allowed, err := target.Window.allows(now)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				return nil, fmt.Errorf("%s is a protected cluster that can only be changed %s", p.name, target.Window)
+			}
+		}
+
+		if len(target.Branches) > 0 {
+			branch, err := git(checkoutDir(files), "rev-parse", "--abbrev-ref", "HEAD")
+			if err != nil {
+				return nil, fmt.Errorf("%s is a protected cluster that can only be changed from the %s branch(es), failed to get the current branch, got err: %w", p.name, strings.Join(target.Branches, ", "), err)
+			}
+			if !containsString(target.Branches, branch) {
+				return nil, fmt.Errorf("%s is a protected cluster that can only be changed from the %s branch(es), not %s", p.name, strings.Join(target.Branches, ", "), branch)
+			}
+		}
+
+		return p, nil
+	}
+
+	return nil, nil
+}
+
+// checkoutDir returns the directory of the first input file, or the working
+// directory if they were all read from stdin.
+func checkoutDir(files []inputFile) string {
+	for _, file := range files {
+		if file.source != stdinSource {
+			return filepath.Dir(file.source)
+		}
+	}
+
+	return "."
+}
+
+// confirm has the cluster's name typed to confirm changes to it, or passed
+// with --confirm-cluster. When the objects are read from stdin the name is
+// read from the terminal directly.
+func (p *protection) confirm(cmd *cobra.Command, readsStdin bool, out io.Writer) error {
+	confirmed, err := cmd.Flags().GetString("confirm-cluster")
+	if err != nil {
+		return fmt.Errorf("could not get value of confirm-cluster flag, got err: %s", err)
+	}
+
+	if confirmed == "" {
+		in := confirmationInput(readsStdin)
+		if in == nil {
+			return fmt.Errorf("%s is a protected cluster, pass --confirm-cluster %s to change it without a terminal", p.name, p.name)
+		}
+		if in != os.Stdin {
+			defer in.Close()
+		}
+
+		fmt.Fprintf(out, "\n%s is a protected cluster. Type its name to confirm: ", p.name)
+		answer, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read answer, got err: %w", err)
+		}
+		confirmed = strings.TrimSpace(answer)
+	}
+
+	if confirmed != p.name {
+		return fmt.Errorf("%q doesn't match the protected cluster's name %s, not changing it", confirmed, p.name)
+	}
+
+	return nil
+}
+
+// containsString reports whether values contains s.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
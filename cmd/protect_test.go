@@ -0,0 +1,317 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+// protectionConfig returns the config file contents as viper would read
+// them.
+func protectionConfig(t *testing.T, contents string) *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(contents)), "failed to read config")
+
+	return v
+}
+
+// protectionCommand returns a command with the flags checkProtection reads,
+// with --context passed if context isn't empty.
+func protectionCommand(t *testing.T, context string) *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.Flags().String("context", "", "")
+	addProtectionFlags(cmd.Flags())
+	if context != "" {
+		require.NoError(t, cmd.Flags().Set("context", context), "failed to set context flag")
+	}
+
+	return cmd
+}
+
+func TestProtectedTargetsFromConfig(t *testing.T) {
+	targets, err := protectedTargetsFromConfig(protectionConfig(t, `
+protected:
+- context: prod
+  name: prod-eu-1
+  window:
+    days: [Mon, Tuesday]
+    start: "09:00"
+    end: "16:00"
+    timezone: Europe/London
+  branches: [main]
+- server: https://prod.example.com:6443
+`))
+	require.NoError(t, err, "failed to read protected targets")
+	require.Equal(t, []protectedTarget{
+		{
+			Context:  "prod",
+			Name:     "prod-eu-1",
+			Window:   &changeWindow{Days: []string{"Mon", "Tuesday"}, Start: "09:00", End: "16:00", Timezone: "Europe/London"},
+			Branches: []string{"main"},
+		},
+		{Server: "https://prod.example.com:6443"},
+	}, targets)
+
+	targets, err = protectedTargetsFromConfig(viper.New())
+	require.NoError(t, err, "failed to read missing protected targets")
+	require.Empty(t, targets)
+
+	cases := []struct {
+		Name   string
+		Config string
+		Err    string
+	}{
+		{
+			Name:   "no context or server",
+			Config: "protected:\n- name: prod\n",
+			Err:    "protected target 0 needs a context or server",
+		},
+		{
+			Name:   "invalid start",
+			Config: "protected:\n- context: prod\n  window:\n    start: 9am\n",
+			Err:    `invalid window for protected target 0, got err: invalid start "9am", expected HH:MM`,
+		},
+		{
+			Name:   "invalid day",
+			Config: "protected:\n- context: prod\n  window:\n    days: [M]\n",
+			Err:    `invalid window for protected target 0, got err: invalid day "M", expected one like Mon or Monday`,
+		},
+	}
+
+	for _, tt := range cases {
+		_, err := protectedTargetsFromConfig(protectionConfig(t, tt.Config))
+		require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+	}
+}
+
+func TestChangeWindow(t *testing.T) {
+	window := changeWindow{Days: []string{"Mon", "tuesday"}, Start: "09:00", End: "16:00", Timezone: "UTC"}
+	require.Equal(t, "Mon, tuesday 09:00-16:00 UTC", window.String())
+
+	cases := []struct {
+		Name    string
+		Window  changeWindow
+		Time    time.Time
+		Allowed bool
+	}{
+		{
+			Name:    "inside",
+			Window:  window,
+			Time:    time.Date(2021, time.August, 2, 9, 0, 0, 0, time.UTC),
+			Allowed: true,
+		},
+		{
+			Name:   "after",
+			Window: window,
+			Time:   time.Date(2021, time.August, 3, 16, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:   "wrong day",
+			Window: window,
+			Time:   time.Date(2021, time.August, 4, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:    "converted to the window's timezone",
+			Window:  changeWindow{Start: "09:00", End: "16:00", Timezone: "America/New_York"},
+			Time:    time.Date(2021, time.August, 2, 14, 0, 0, 0, time.UTC),
+			Allowed: true,
+		},
+		{
+			Name:    "days only",
+			Window:  changeWindow{Days: []string{"Sat"}},
+			Time:    time.Date(2021, time.August, 7, 23, 59, 0, 0, time.UTC),
+			Allowed: true,
+		},
+		{
+			Name:    "ending at 24:00",
+			Window:  changeWindow{Start: "18:00", End: "24:00", Timezone: "UTC"},
+			Time:    time.Date(2021, time.August, 2, 23, 59, 0, 0, time.UTC),
+			Allowed: true,
+		},
+		{
+			Name:   "before a window ending at 24:00",
+			Window: changeWindow{Start: "18:00", End: "24:00", Timezone: "UTC"},
+			Time:   time.Date(2021, time.August, 2, 17, 59, 0, 0, time.UTC),
+		},
+		{
+			Name:    "overnight before midnight",
+			Window:  changeWindow{Start: "22:00", End: "02:00", Timezone: "UTC"},
+			Time:    time.Date(2021, time.August, 2, 23, 0, 0, 0, time.UTC),
+			Allowed: true,
+		},
+		{
+			Name:    "overnight after midnight",
+			Window:  changeWindow{Start: "22:00", End: "02:00", Timezone: "UTC"},
+			Time:    time.Date(2021, time.August, 3, 1, 59, 0, 0, time.UTC),
+			Allowed: true,
+		},
+		{
+			Name:   "outside an overnight window",
+			Window: changeWindow{Start: "22:00", End: "02:00", Timezone: "UTC"},
+			Time:   time.Date(2021, time.August, 3, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:    "overnight belongs to the day it starts",
+			Window:  changeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00", Timezone: "UTC"},
+			Time:    time.Date(2021, time.August, 7, 1, 0, 0, 0, time.UTC),
+			Allowed: true,
+		},
+		{
+			Name:   "overnight on the wrong day",
+			Window: changeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00", Timezone: "UTC"},
+			Time:   time.Date(2021, time.August, 6, 1, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range cases {
+		allowed, err := tt.Window.allows(tt.Time)
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Allowed, allowed, "test: %s", tt.Name)
+	}
+}
+
+func TestInvalidChangeWindow(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Window changeWindow
+		Err    string
+	}{
+		{
+			Name:   "start past the end of the day",
+			Window: changeWindow{Start: "24:30"},
+			Err:    `invalid start "24:30", expected HH:MM`,
+		},
+		{
+			Name:   "end that isn't a time",
+			Window: changeWindow{End: "5pm"},
+			Err:    `invalid end "5pm", expected HH:MM`,
+		},
+		{
+			Name:   "short day",
+			Window: changeWindow{Days: []string{"M"}},
+			Err:    `invalid day "M", expected one like Mon or Monday`,
+		},
+	}
+
+	for _, tt := range cases {
+		_, err := tt.Window.allows(time.Now())
+		require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+	}
+}
+
+func TestCheckProtection(t *testing.T) {
+	startFakeAPIServer(t)
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+
+	// Monday lunchtime.
+	now := time.Date(2021, time.August, 2, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		Name    string
+		Config  string
+		Context string
+		Want    string
+		Err     string
+	}{
+		{
+			Name:   "unprotected",
+			Config: "protected:\n- context: prod\n",
+		},
+		{
+			Name:   "context without --context",
+			Config: "protected:\n- context: fake\n",
+			Err:    "fake is a protected cluster, pass --context explicitly to change it",
+		},
+		{
+			Name:    "context",
+			Config:  "protected:\n- context: fake\n",
+			Context: "fake",
+			Want:    "fake",
+		},
+		{
+			Name:    "server",
+			Config:  fmt.Sprintf("protected:\n- server: %s/\n  name: prod-eu-1\n", config.Host),
+			Context: "fake",
+			Want:    "prod-eu-1",
+		},
+		{
+			Name:    "inside window",
+			Config:  "protected:\n- context: fake\n  window:\n    days: [Mon]\n    timezone: UTC\n",
+			Context: "fake",
+			Want:    "fake",
+		},
+		{
+			Name:    "outside window",
+			Config:  "protected:\n- context: fake\n  window:\n    start: \"14:00\"\n    end: \"16:00\"\n    timezone: UTC\n",
+			Context: "fake",
+			Err:     "fake is a protected cluster that can only be changed every day 14:00-16:00 UTC",
+		},
+	}
+
+	for _, tt := range cases {
+		p, err := checkProtection(protectionCommand(t, tt.Context), protectionConfig(t, tt.Config), config, nil, now)
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+		if tt.Want == "" {
+			require.Nil(t, p, "test: %s", tt.Name)
+			continue
+		}
+		require.Equal(t, tt.Want, p.name, "test: %s", tt.Name)
+	}
+}
+
+func TestCheckProtectionBranches(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	startFakeAPIServer(t)
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"pod.yaml": onePod})
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"checkout", "--quiet", "-b", "feature"},
+		{"add", "pod.yaml"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "Add pod"},
+	} {
+		_, err := git(dir, args...)
+		require.NoError(t, err, "failed to run git %v", args)
+	}
+	files := []inputFile{{source: filepath.Join(dir, "pod.yaml")}}
+
+	_, err = checkProtection(protectionCommand(t, "fake"), protectionConfig(t, "protected:\n- context: fake\n  branches: [main]\n"), config, files, time.Now())
+	require.EqualError(t, err, "fake is a protected cluster that can only be changed from the main branch(es), not feature")
+
+	p, err := checkProtection(protectionCommand(t, "fake"), protectionConfig(t, "protected:\n- context: fake\n  branches: [main, feature]\n"), config, files, time.Now())
+	require.NoError(t, err, "expected the feature branch to be allowed")
+	require.Equal(t, "fake", p.name)
+}
+
+func TestProtectionConfirm(t *testing.T) {
+	p := &protection{name: "prod-eu-1"}
+
+	cmd := protectionCommand(t, "prod")
+	require.NoError(t, cmd.Flags().Set("confirm-cluster", "prod-eu-1"), "failed to set confirm-cluster flag")
+	require.NoError(t, p.confirm(cmd, false, &bytes.Buffer{}), "expected the right name to confirm")
+
+	cmd = protectionCommand(t, "prod")
+	require.NoError(t, cmd.Flags().Set("confirm-cluster", "prod-us-1"), "failed to set confirm-cluster flag")
+	err := p.confirm(cmd, false, &bytes.Buffer{})
+	require.EqualError(t, err, `"prod-us-1" doesn't match the protected cluster's name prod-eu-1, not changing it`, "expected the wrong name to cancel")
+}
@@ -0,0 +1,491 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultReconcileInterval time.Duration = time.Minute
+	// serviceAccountNamespace holds the namespace of the pod we're running
+	// in, if any.
+	serviceAccountNamespace string = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// reconcileCmd represents the reconcile command
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Continuously apply configuration from files, directories or git checkouts",
+	Long: `Reconcile runs until it's stopped, applying the resources in its sources every
+interval and pruning those that have been removed from them since, making it
+a small GitOps agent that can run in the cluster it manages.
+
+Sources are files or directories, which are searched recursively for .yaml,
+.yml and .json files. Directories that are git checkouts are pulled before
+each reconcile. The objects applied are recorded in a ConfigMap so pruning
+works across restarts.
+
+Metrics are served on /metrics and health on /healthz. Several replicas can
+run at once, only the one holding the leader election Lease reconciles.
+
+Examples:
+	# Reconcile a git checkout every minute.
+	kubecuttle reconcile --source /srv/manifests --interval 1m
+`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options, err := reconcileOptionsFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		policy, err := retryPolicyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		cacheDir, err := cacheDirFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		ttl, err := discoveryTTLFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		config, err := buildConfig()
+		if err != nil {
+			return fmt.Errorf("failed to build config, got err: %w", err)
+		}
+
+		client, err := typedClientInit(config)
+		if err != nil {
+			return err
+		}
+
+		dynamicClient, err := dynamicClientInit(config)
+		if err != nil {
+			return fmt.Errorf("failed to build clients: %w", err)
+		}
+
+		discoveryClient, mapper, err := buildCachedDiscovery(config, cacheDir, ttl)
+		if err != nil {
+			return err
+		}
+
+		r := &reconciler{
+			options:   options,
+			dynamic:   dynamicClient,
+			mapper:    mapper,
+			applier:   newManifestApplier(dynamicClient, mapper, discoveryClient, policy),
+			inventory: inventory{client: client.CoreV1(), namespace: options.namespace, name: options.name + "-inventory"},
+			policy:    policy,
+			metrics:   newReconcileMetrics(options.interval),
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if options.statusAddr != "" {
+			server := &http.Server{Addr: options.statusAddr, Handler: newStatusMux(r.metrics)}
+			go func() {
+				if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Printf("status server failed: %s", err)
+					stop()
+				}
+			}()
+			defer server.Close()
+		}
+
+		if !options.leaderElect {
+			r.metrics.setLeader(true)
+			r.run(ctx)
+			return nil
+		}
+
+		return runWithLeaderElection(ctx, client, options.namespace, options.name, r)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reconcileCmd)
+
+	reconcileCmd.PersistentFlags().StringSlice("source", nil, "files or directories, optionally git checkouts, to read configuration from")
+	reconcileCmd.PersistentFlags().Duration("interval", defaultReconcileInterval, "time between reconciles")
+	reconcileCmd.PersistentFlags().Bool("prune", true, "delete objects that were applied before but have since been removed from the sources")
+	reconcileCmd.PersistentFlags().Bool("git-pull", true, "pull sources that are git checkouts before each reconcile")
+	reconcileCmd.PersistentFlags().String("name", fieldManager, "name of the inventory ConfigMap and leader election Lease, for running several reconcilers in one namespace")
+	reconcileCmd.PersistentFlags().String("namespace", "", "namespace of the inventory ConfigMap and leader election Lease. Defaults to the pod's namespace or default")
+	reconcileCmd.PersistentFlags().Bool("leader-elect", true, "only reconcile while holding a Lease, so several replicas can run safely")
+	reconcileCmd.PersistentFlags().String("status-addr", ":8080", "address to serve /metrics and /healthz on. Pass an empty value to disable")
+	reconcileCmd.PersistentFlags().Duration("timeout", defaultObjectTimeout, "time allowed to apply each object, including retries. Zero means no limit")
+	reconcileCmd.PersistentFlags().Duration("request-timeout", defaultTimeout, "time allowed for a single request to the API server")
+	addTemplateFlags(reconcileCmd.PersistentFlags())
+	addTransformFlags(reconcileCmd.PersistentFlags())
+	addImageFlags(reconcileCmd.PersistentFlags())
+	addPolicyFlags(reconcileCmd.PersistentFlags())
+}
+
+// reconcileOptions configures the reconcile loop.
+type reconcileOptions struct {
+	sources     []string
+	interval    time.Duration
+	prune       bool
+	pull        bool
+	name        string
+	namespace   string
+	leaderElect bool
+	statusAddr  string
+	// templates renders the sources before they're decoded.
+	templates *templateOptions
+	// transforms changes every object before it's applied.
+	transforms *transformOptions
+	// images changes the images of every container before they're
+	// applied.
+	images *imageOptions
+	// rules are checked before anything is applied.
+	rules *objectPolicy
+}
+
+// reconcileOptionsFromFlags reads the reconcile command's flags.
+func reconcileOptionsFromFlags(cmd *cobra.Command) (reconcileOptions, error) {
+	options := reconcileOptions{}
+	flags := cmd.Flags()
+
+	var err error
+	if options.sources, err = flags.GetStringSlice("source"); err != nil {
+		return options, fmt.Errorf("could not get value of source flag, got err: %s", err)
+	}
+	if len(options.sources) == 0 {
+		return options, fmt.Errorf("no source passed")
+	}
+	if options.interval, err = flags.GetDuration("interval"); err != nil {
+		return options, fmt.Errorf("could not get value of interval flag, got err: %s", err)
+	}
+	if options.interval <= 0 {
+		return options, fmt.Errorf("interval must be positive, got: %s", options.interval)
+	}
+	if options.prune, err = flags.GetBool("prune"); err != nil {
+		return options, fmt.Errorf("could not get value of prune flag, got err: %s", err)
+	}
+	if options.pull, err = flags.GetBool("git-pull"); err != nil {
+		return options, fmt.Errorf("could not get value of git-pull flag, got err: %s", err)
+	}
+	if options.name, err = flags.GetString("name"); err != nil {
+		return options, fmt.Errorf("could not get value of name flag, got err: %s", err)
+	}
+	if options.namespace, err = flags.GetString("namespace"); err != nil {
+		return options, fmt.Errorf("could not get value of namespace flag, got err: %s", err)
+	}
+	if options.namespace == "" {
+		options.namespace = podNamespace()
+	}
+	if options.leaderElect, err = flags.GetBool("leader-elect"); err != nil {
+		return options, fmt.Errorf("could not get value of leader-elect flag, got err: %s", err)
+	}
+	if options.statusAddr, err = flags.GetString("status-addr"); err != nil {
+		return options, fmt.Errorf("could not get value of status-addr flag, got err: %s", err)
+	}
+	if options.templates, err = templateOptionsFromFlags(cmd); err != nil {
+		return options, err
+	}
+	if options.transforms, err = transformOptionsFromFlags(cmd); err != nil {
+		return options, err
+	}
+	if options.images, err = imageOptionsFromFlags(cmd); err != nil {
+		return options, err
+	}
+	if options.rules, err = objectPolicyFromFlags(cmd); err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+// podNamespace returns the namespace of the pod we're running in, or
+// default outside of a pod.
+func podNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if data, err := ioutil.ReadFile(serviceAccountNamespace); err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	}
+
+	return metav1.NamespaceDefault
+}
+
+// reconciler applies the configuration in its sources and prunes objects
+// removed from them.
+type reconciler struct {
+	options   reconcileOptions
+	dynamic   dynamic.Interface
+	mapper    meta.RESTMapper
+	applier   *manifestApplier
+	inventory inventory
+	policy    retryPolicy
+	metrics   *reconcileMetrics
+}
+
+// run reconciles every interval until ctx is done.
+func (r *reconciler) run(ctx context.Context) {
+	for {
+		start := time.Now()
+		result, err := r.reconcile(ctx)
+		result.duration = time.Since(start)
+		r.metrics.record(result, err, time.Now())
+
+		summary := fmt.Sprintf("%d applied, %d failed, %d pruned in %s", result.applied, result.failed, result.pruned, result.duration.Round(time.Millisecond))
+		if result.revision != "" {
+			summary = fmt.Sprintf("revision %s: %s", result.revision, summary)
+		}
+		if err != nil {
+			log.Printf("reconcile failed, %s, got err: %s", summary, err)
+		} else {
+			log.Printf("reconciled %s", summary)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.options.interval):
+		}
+	}
+}
+
+// reconcile applies every object in the sources once, then prunes objects
+// applied by an earlier reconcile that are no longer in them. A failure to
+// apply one object doesn't stop the rest being applied.
+func (r *reconciler) reconcile(ctx context.Context) (reconcileResult, error) {
+	result := reconcileResult{}
+
+	files, revisions, err := readSources(r.options.sources, r.options.pull)
+	if err != nil {
+		return result, err
+	}
+	result.revision = strings.Join(revisions, ",")
+
+	files, err = r.options.templates.render(files)
+	if err != nil {
+		return result, err
+	}
+
+	// Nothing is applied or pruned unless every source decodes, a
+	// half written file mustn't prune everything in it.
+	manifests, err := decodeManifests(files)
+	if err != nil {
+		return result, fmt.Errorf("failed to decode objects, got err: %w", err)
+	}
+	r.options.transforms.transform(manifests)
+	if err := r.options.images.rewrite(manifests); err != nil {
+		return result, err
+	}
+
+	// Like decoding, a blocking policy violation stops the whole
+	// reconcile rather than pruning the objects that broke it.
+	if err := checkObjectPolicy(r.options.rules, manifests); err != nil {
+		return result, err
+	}
+
+	previous, err := r.inventory.load(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	errs := []error{}
+	current := make([]objectRef, 0, len(manifests))
+	for _, manifest := range manifests {
+		current = append(current, refFor(manifest.obj))
+
+		if _, err := r.applier.apply(manifest); err != nil {
+			result.failed++
+			errs = append(errs, fmt.Errorf("%s: %w", describeObject(manifest.obj), err))
+			continue
+		}
+		result.applied++
+	}
+
+	// Keep track of objects that couldn't be pruned so that we try
+	// again next time.
+	remaining := current
+	if r.options.prune {
+		pruned, failed, err := r.prune(pruneCandidates(previous, current))
+		result.pruned = pruned
+		remaining = append(remaining, failed...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		remaining = append(remaining, pruneCandidates(previous, current)...)
+	}
+
+	if err := r.inventory.save(ctx, remaining); err != nil {
+		errs = append(errs, err)
+	}
+
+	return result, utilerrors.NewAggregate(errs)
+}
+
+// prune deletes the objects in refs, most dependent first. Objects that no
+// longer carry kubecuttle's field manager were adopted by someone else and
+// are left alone. It returns how many objects were deleted and those that
+// couldn't be.
+func (r *reconciler) prune(refs []objectRef) (int, []objectRef, error) {
+	return pruneObjects(r.dynamic, r.mapper, r.policy, refs, func(obj *unstructured.Unstructured, adopted bool) {
+		if adopted {
+			log.Printf("not pruning %s, it was adopted by another field manager", describeObject(obj))
+			return
+		}
+		log.Printf("pruned %s", describeObject(obj))
+	})
+}
+
+// pruneObjects deletes the objects in refs, most dependent first, calling
+// report for each one deleted. Objects that are already gone are skipped,
+// and those whose managedFields no longer list kubecuttle's field manager
+// were adopted by someone else, so they're reported as such and left alone.
+// It returns how many objects were deleted and those that couldn't be.
+func pruneObjects(dynamicClient dynamic.Interface, mapper meta.RESTMapper, policy retryPolicy, refs []objectRef, report func(obj *unstructured.Unstructured, adopted bool)) (int, []objectRef, error) {
+	manifests := make([]manifestObject, 0, len(refs))
+	for _, ref := range refs {
+		gvk := ref.gvk()
+		manifests = append(manifests, manifestObject{obj: ref.object(), gvk: &gvk})
+	}
+
+	count := 0
+	failed := []objectRef{}
+	errs := []error{}
+	options := deleteOptions{propagation: metav1.DeletePropagationBackground, ignoreNotFound: true}
+	for _, manifest := range sortForDelete(manifests) {
+		obj := manifest.obj
+		mapping, err := getResourceMapping(mapper, manifest.gvk)
+		if meta.IsNoMatchError(err) {
+			// The kind, and so the object, no longer exists.
+			continue
+		}
+		if err != nil {
+			failed = append(failed, refFor(obj))
+			errs = append(errs, fmt.Errorf("failed to get gvr for %s, got err: %w", describeObject(obj), err))
+			continue
+		}
+
+		dr := getRESTMapping(dynamicClient, mapping.Scope.Name(), obj.GetNamespace(), mapping.Resource)
+
+		var live *unstructured.Unstructured
+		err = policy.do(func(ctx context.Context) error {
+			var err error
+			live, err = dr.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			return err
+		})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			failed = append(failed, refFor(obj))
+			errs = append(errs, fmt.Errorf("failed to get %s, got err: %w", describeObject(obj), err))
+			continue
+		}
+		if !managedBy(live, fieldManager) {
+			report(obj, true)
+			continue
+		}
+
+		deleted, err := deleteObject(dr, obj, options, policy)
+		if err != nil {
+			failed = append(failed, refFor(obj))
+			errs = append(errs, fmt.Errorf("failed to prune %s, got err: %w", describeObject(obj), err))
+			continue
+		}
+		if deleted {
+			count++
+			report(obj, false)
+		}
+	}
+
+	return count, failed, utilerrors.NewAggregate(errs)
+}
+
+// managedBy reports whether manager owns any of obj's fields.
+func managedBy(obj *unstructured.Unstructured, manager string) bool {
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Manager == manager {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runWithLeaderElection runs r while holding the Lease called name, until
+// ctx is done. Losing the Lease is an error so that the process restarts
+// and waits its turn again.
+func runWithLeaderElection(ctx context.Context, client kubernetes.Interface, namespace, name string, r *reconciler) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname, got err: %w", err)
+	}
+	identity := hostname + "_" + string(uuid.NewUUID())
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            name,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("acquired lease %s/%s as %s", namespace, name, identity)
+				r.metrics.setLeader(true)
+				r.run(ctx)
+			},
+			OnStoppedLeading: func() {
+				r.metrics.setLeader(false)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Printf("waiting for lease %s/%s held by %s", namespace, name, leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up leader election, got err: %w", err)
+	}
+
+	elector.Run(ctx)
+	if ctx.Err() == nil {
+		return fmt.Errorf("lost lease %s/%s", namespace, name)
+	}
+
+	return nil
+}
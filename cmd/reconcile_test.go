@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// writeFiles creates files, relative to dir, with the given contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755), "failed to create directory")
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0o644), "failed to write %s", name)
+	}
+}
+
+func TestReadSources(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"b.yaml":            onePod,
+		"a/pods.yml":        twoPods,
+		"a/notes.txt":       "not a manifest",
+		".hidden/pod.yaml":  onePod,
+		"c.json":            `{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "sre-test"}}`,
+		"single/extra.yaml": onePod,
+	})
+
+	files, revisions, err := readSources([]string{dir, filepath.Join(dir, "single", "extra.yaml")}, false)
+	require.NoError(t, err, "failed to read sources")
+	require.Empty(t, revisions, "expected no git revisions")
+
+	sources := []string{}
+	for _, f := range files {
+		rel, err := filepath.Rel(dir, f.source)
+		require.NoError(t, err)
+		sources = append(sources, rel)
+	}
+	require.Equal(t, []string{"a/pods.yml", "b.yaml", "c.json", "single/extra.yaml", "single/extra.yaml"}, sources)
+
+	_, _, err = readSources([]string{filepath.Join(dir, "missing")}, false)
+	require.Error(t, err, "expected missing source to fail")
+}
+
+func TestReadGitSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"pod.yaml": onePod})
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "pod.yaml"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "Add pod"},
+	} {
+		_, err := git(dir, args...)
+		require.NoError(t, err, "failed to run git %v", args)
+	}
+	head, err := git(dir, "rev-parse", "HEAD")
+	require.NoError(t, err, "failed to get HEAD")
+
+	files, revisions, err := readSources([]string{dir}, false)
+	require.NoError(t, err, "failed to read git source")
+	require.Len(t, files, 1)
+	require.Equal(t, []string{head}, revisions)
+
+	// There's no upstream to pull from.
+	_, _, err = readSources([]string{dir}, true)
+	require.Error(t, err, "expected pull without an upstream to fail")
+}
+
+func TestPruneCandidates(t *testing.T) {
+	previous := []objectRef{
+		{Version: "v1", Kind: "Pod", Namespace: "sre-test", Name: "busybox-sleep"},
+		{Version: "v1", Kind: "Pod", Namespace: "sre-test", Name: "busybox-sleep-less"},
+		{Group: "policy", Version: "v1beta1", Kind: "PodDisruptionBudget", Namespace: "sre-test", Name: "busybox"},
+	}
+	current := []objectRef{
+		{Version: "v1", Kind: "Pod", Namespace: "sre-test", Name: "busybox-sleep"},
+		// Changing the API version doesn't make it a different object.
+		{Group: "policy", Version: "v1", Kind: "PodDisruptionBudget", Namespace: "sre-test", Name: "busybox"},
+	}
+
+	require.Equal(t, []objectRef{previous[1]}, pruneCandidates(previous, current))
+	require.Empty(t, pruneCandidates(nil, current))
+}
+
+func TestPruneObjectsLeavesAdopted(t *testing.T) {
+	server := startFakeAPIServer(t)
+	config, err := buildConfig()
+	require.NoError(t, err, "failed to build config")
+	dynamicClient, err := dynamicClientInit(config)
+	require.NoError(t, err, "failed to build dynamic client")
+	discoveryClient, mapper, err := buildCachedDiscovery(config, "", 0)
+	require.NoError(t, err, "failed to build discovery")
+	policy := defaultRetryPolicy()
+
+	manifests, err := decodeManifests([]inputFile{{source: "test.yaml", contents: []byte(onePod + "---" + configMapB)}})
+	require.NoError(t, err, "failed to decode objects")
+	applier := newManifestApplier(dynamicClient, mapper, discoveryClient, policy)
+	for _, manifest := range manifests {
+		_, err := applier.apply(manifest)
+		require.NoError(t, err, "failed to apply %s", describeObject(manifest.obj))
+	}
+
+	// Someone else takes over the ConfigMap.
+	adopted := manifests[1].obj.DeepCopy()
+	require.NoError(t, unstructured.SetNestedField(adopted.Object, "theirs", "data", "key"))
+	data, err := adopted.MarshalJSON()
+	require.NoError(t, err, "failed to encode ConfigMap")
+	force := true
+	_, err = dynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).Namespace("sre-test").
+		Patch(context.Background(), "b", types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: "other", Force: &force})
+	require.NoError(t, err, "failed to adopt ConfigMap")
+
+	reports := map[string]bool{}
+	count, failed, err := pruneObjects(dynamicClient, mapper, policy, []objectRef{refFor(manifests[0].obj), refFor(manifests[1].obj)}, func(obj *unstructured.Unstructured, adopted bool) {
+		reports[describeObject(obj)] = adopted
+	})
+	require.NoError(t, err, "failed to prune")
+	require.Empty(t, failed)
+	require.Equal(t, 1, count)
+	require.Equal(t, map[string]bool{"Pod sre-test/busybox-sleep": false, "ConfigMap sre-test/b": true}, reports)
+	require.Nil(t, server.get("pods", "sre-test", "busybox-sleep"), "expected the pod to be pruned")
+	require.NotNil(t, server.get("configmaps", "sre-test", "b"), "expected the adopted ConfigMap to be left alone")
+}
+
+func TestInventory(t *testing.T) {
+	ctx := context.Background()
+	inv := inventory{client: fake.NewSimpleClientset().CoreV1(), namespace: "sre-test", name: "kubecuttle-inventory"}
+
+	refs, err := inv.load(ctx)
+	require.NoError(t, err, "failed to load missing inventory")
+	require.Empty(t, refs)
+
+	saved := []objectRef{
+		{Version: "v1", Kind: "Pod", Namespace: "sre-test", Name: "b"},
+		{Version: "v1", Kind: "Namespace", Name: "sre-test"},
+		{Version: "v1", Kind: "Pod", Namespace: "sre-test", Name: "a"},
+	}
+	require.NoError(t, inv.save(ctx, saved), "failed to create inventory")
+	require.NoError(t, inv.save(ctx, saved[1:]), "failed to update inventory")
+
+	refs, err = inv.load(ctx)
+	require.NoError(t, err, "failed to load inventory")
+	require.Equal(t, []objectRef{saved[1], saved[2]}, refs)
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	m := newReconcileMetrics(time.Minute)
+	start := m.started
+	m.setLeader(true)
+
+	server := httptest.NewServer(newStatusMux(m))
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err, "failed to get %s", path)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err, "failed to read %s", path)
+		return resp.StatusCode, string(body)
+	}
+
+	m.record(reconcileResult{revision: "abc123", applied: 3, pruned: 1, duration: 1500 * time.Millisecond}, nil, start)
+	m.record(reconcileResult{applied: 2, failed: 1}, errors.New("boom"), start.Add(time.Minute))
+
+	status, body := get("/metrics")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "kubecuttle_reconcile_total{result=\"success\"} 1\n")
+	require.Contains(t, body, "kubecuttle_reconcile_total{result=\"failure\"} 1\n")
+	require.Contains(t, body, "kubecuttle_reconcile_objects{outcome=\"failed\"} 1\n")
+	require.Contains(t, body, "kubecuttle_reconcile_pruned_total 1\n")
+	require.Contains(t, body, "kubecuttle_leader 1\n")
+
+	status, _ = get("/healthz")
+	require.Equal(t, http.StatusOK, status, "expected a recent success to be healthy")
+
+	// Failing for longer than a few intervals is unhealthy, unless
+	// another replica is the leader.
+	later := start.Add(time.Hour)
+	require.EqualError(t, m.healthy(later), "no successful reconcile since "+start.Format(time.RFC3339)+", last error: boom")
+	m.setLeader(false)
+	require.NoError(t, m.healthy(later))
+}
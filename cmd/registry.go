@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// dockerHubRegistry is where Docker Hub's registry API is served.
+	dockerHubRegistry string = "registry-1.docker.io"
+	// dockerHubConfigKey is the key Docker Hub credentials are stored
+	// under in docker's config.
+	dockerHubConfigKey string = "https://index.docker.io/v1/"
+)
+
+// manifestMediaTypes are the manifest formats we accept. Indexes come first
+// so multi-arch images resolve to the digest of the index rather than one
+// platform's manifest.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// registryResolver resolves image tags to digests using the registry HTTP
+// API, authenticating with the credentials docker login stores.
+type registryResolver struct {
+	client *http.Client
+	// credentials are base64 encoded user:password pairs by registry.
+	credentials map[string]string
+	// plainHTTP reports whether a registry is spoken to without TLS.
+	plainHTTP func(domain string) bool
+
+	mu sync.Mutex
+	// digests caches resolved images, so each is only resolved once.
+	digests map[string]string
+}
+
+// newRegistryResolver returns a resolver using the credentials in docker's
+// config file. Only registries on localhost are spoken to without TLS.
+func newRegistryResolver() *registryResolver {
+	return &registryResolver{
+		client:      &http.Client{Timeout: defaultTimeout},
+		credentials: dockerCredentials(),
+		plainHTTP:   isLocalRegistry,
+		digests:     map[string]string{},
+	}
+}
+
+// isLocalRegistry reports whether domain is on this machine.
+func isLocalRegistry(domain string) bool {
+	host := domain
+	if i := strings.LastIndex(domain, ":"); i >= 0 {
+		host = domain[:i]
+	}
+
+	return host == "localhost" || host == "127.0.0.1" || host == "[::1]"
+}
+
+// dockerCredentials reads the credentials stored by docker login. Credential
+// helpers aren't supported, registries using them are accessed anonymously.
+func dockerCredentials() map[string]string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil
+	}
+
+	config := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil
+	}
+
+	credentials := map[string]string{}
+	for registry, auth := range config.Auths {
+		if auth.Auth == "" {
+			continue
+		}
+		if registry == dockerHubConfigKey {
+			registry = dockerHubDomain
+		}
+		// Keys may be URLs rather than bare hosts.
+		registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+		credentials[strings.TrimSuffix(registry, "/")] = auth.Auth
+	}
+
+	return credentials
+}
+
+// resolve returns the digest ref's tag points at.
+func (r *registryResolver) resolve(ref imageReference) (string, error) {
+	key := ref.name() + ":" + ref.tag
+	r.mu.Lock()
+	digest, ok := r.digests[key]
+	r.mu.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	digest, err := r.fetchDigest(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve digest of %s, got err: %w", key, err)
+	}
+
+	r.mu.Lock()
+	r.digests[key] = digest
+	r.mu.Unlock()
+
+	return digest, nil
+}
+
+// fetchDigest asks the registry for the digest of ref's manifest. HEAD is
+// tried first, as Docker Hub doesn't count it against pull limits, falling
+// back to hashing the manifest if the registry doesn't return a digest.
+func (r *registryResolver) fetchDigest(ref imageReference) (string, error) {
+	host := ref.domain
+	if host == dockerHubDomain {
+		host = dockerHubRegistry
+	}
+	scheme := "https"
+	if r.plainHTTP(ref.domain) {
+		scheme = "http"
+	}
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, ref.repository, ref.tag)
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		resp, err := r.do(method, manifestURL, ref)
+		if err != nil {
+			return "", err
+		}
+
+		digest := resp.Header.Get("Docker-Content-Digest")
+		if digest == "" && method == http.MethodGet {
+			hash := sha256.New()
+			if _, err := io.Copy(hash, resp.Body); err != nil {
+				resp.Body.Close()
+				return "", fmt.Errorf("failed to read manifest, got err: %w", err)
+			}
+			digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+		}
+		resp.Body.Close()
+
+		if digest != "" {
+			return digest, nil
+		}
+	}
+
+	return "", fmt.Errorf("registry did not return a digest")
+}
+
+// do sends a request for one of ref's manifests, authenticating if the
+// registry asks us to.
+func (r *registryResolver) do(method, manifestURL string, ref imageReference) (*http.Response, error) {
+	send := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequest(method, manifestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return r.client.Do(req)
+	}
+
+	resp, err := send("")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		authorization, err := r.authorize(challenge, ref)
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = send(authorization); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %s", method, manifestURL, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// authorize answers a registry's WWW-Authenticate challenge, returning the
+// Authorization header to retry with. Bearer challenges are answered by
+// fetching a pull token, anonymously unless we have credentials.
+func (r *registryResolver) authorize(challenge string, ref imageReference) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	credentials := r.credentials[ref.domain]
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if credentials == "" {
+			return "", fmt.Errorf("registry %s requires credentials, run docker login", ref.domain)
+		}
+		return "Basic " + credentials, nil
+
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return "", fmt.Errorf("registry %s sent an invalid challenge: %s", ref.domain, challenge)
+		}
+		query := realm.Query()
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		query.Set("scope", "repository:"+ref.repository+":pull")
+		realm.RawQuery = query.Encode()
+
+		req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if credentials != "" {
+			req.Header.Set("Authorization", "Basic "+credentials)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("failed to get token from %s, got err: %w", realm.Host, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("failed to get token from %s, got: %s", realm.Host, resp.Status)
+		}
+
+		token := struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return "", fmt.Errorf("failed to decode token from %s, got err: %w", realm.Host, err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+
+		return "Bearer " + token.Token, nil
+
+	default:
+		return "", fmt.Errorf("registry %s asked for unsupported authentication: %s", ref.domain, challenge)
+	}
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+// into its scheme and parameters.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return parts[0], params
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	defaultObjectTimeout time.Duration = time.Minute
+	defaultRetries       int           = 5
+)
+
+// retryPolicy controls how requests to the API server are retried when they
+// fail with an error that is likely to go away on its own.
+type retryPolicy struct {
+	// requestTimeout bounds each individual request to the API server.
+	requestTimeout time.Duration
+	// timeout bounds all attempts made for a single object, including the
+	// time spent backing off between them. Zero means no overall limit.
+	timeout time.Duration
+	// retries is the maximum number of retries after the first attempt.
+	retries int
+	// backoff describes the delay between attempts.
+	backoff wait.Backoff
+}
+
+// defaultRetryPolicy returns the retry policy used when no flags are passed.
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{
+		requestTimeout: defaultTimeout,
+		timeout:        defaultObjectTimeout,
+		retries:        defaultRetries,
+		backoff: wait.Backoff{
+			Duration: 500 * time.Millisecond,
+			Factor:   2,
+			Jitter:   0.1,
+			Cap:      30 * time.Second,
+		},
+	}
+}
+
+// do calls fn until it succeeds, fails with an error that is not transient
+// or the policy is exhausted. Each call to fn is given a context bounded by
+// the policy's request timeout.
+func (p retryPolicy) do(fn func(ctx context.Context) error) error {
+	return p.doContext(context.Background(), fn)
+}
+
+// doContext is do, giving up early if ctx is cancelled. It's the Retry
+// option of the apply library.
+func (p retryPolicy) doContext(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	backoff := p.backoff
+	for attempt := 1; ; attempt++ {
+		err := p.attempt(ctx, fn)
+		if err == nil {
+			return nil
+		}
+
+		if !isTransientError(err) {
+			return err
+		}
+		if attempt > p.retries {
+			return fmt.Errorf("giving up after %d attempts, got err: %w", attempt, err)
+		}
+
+		// Honour the server's Retry-After if it asks us to wait for
+		// longer than we otherwise would.
+		delay := backoff.Step()
+		if after, ok := retryAfter(err); ok && after > delay {
+			delay = after
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("giving up after %d attempts, timeout of %s exceeded, got err: %w", attempt, p.timeout, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("giving up after %d attempts, got err: %w", attempt, err)
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt makes a single call to fn bounded by the request timeout.
+func (p retryPolicy) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.requestTimeout)
+		defer cancel()
+	}
+
+	return fn(ctx)
+}
+
+// isTransientError reports whether a request that failed with err is worth
+// retrying. Throttling, server errors, refused connections, etcd leader
+// elections and resourceVersion conflicts all usually resolve themselves
+// given a little time.
+func isTransientError(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case apierrors.IsTooManyRequests(err),
+		apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsServiceUnavailable(err),
+		apierrors.IsInternalError(err):
+		return true
+	case apierrors.IsConflict(err):
+		// A field manager conflict from Server Side Apply will fail
+		// the same way every time, only conflicts on the object's
+		// resourceVersion are worth retrying.
+		return !apierrors.HasStatusCause(err, metav1.CauseTypeFieldManagerConflict)
+	case utilnet.IsConnectionRefused(err), utilnet.IsConnectionReset(err):
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		// The request timed out on our side.
+		return true
+	case isEtcdLeaderChange(err):
+		return true
+	}
+
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		code := status.Status().Code
+		return code >= 500 && code != 501
+	}
+
+	return false
+}
+
+// isEtcdLeaderChange reports whether err was caused by etcd electing a new
+// leader while the API server was talking to it.
+func isEtcdLeaderChange(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "etcdserver: leader changed") ||
+		strings.Contains(msg, "etcdserver: no leader")
+}
+
+// retryAfter returns how long the server asked us to wait before retrying,
+// taken from the Retry-After header of its response.
+func retryAfter(err error) (time.Duration, bool) {
+	seconds, ok := apierrors.SuggestsClientDelay(err)
+	if !ok || seconds <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
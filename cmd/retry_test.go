@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var podsResource = schema.GroupResource{Resource: "pods"}
+
+func TestIsTransientError(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Err       error
+		Transient bool
+	}{
+		{
+			"too many requests",
+			apierrors.NewTooManyRequests("slow down", 1),
+			true,
+		},
+		{
+			"internal error",
+			apierrors.NewInternalError(fmt.Errorf("boom")),
+			true,
+		},
+		{
+			"service unavailable",
+			apierrors.NewServiceUnavailable("unavailable"),
+			true,
+		},
+		{
+			"bad gateway",
+			apierrors.NewGenericServerResponse(502, "PATCH", podsResource, "busybox", "", 0, true),
+			true,
+		},
+		{
+			"etcd leader changed",
+			fmt.Errorf("rpc error: code = Unavailable desc = etcdserver: leader changed"),
+			true,
+		},
+		{
+			"connection refused",
+			&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			true,
+		},
+		{
+			"resourceVersion conflict",
+			apierrors.NewConflict(podsResource, "busybox", fmt.Errorf("the object has been modified")),
+			true,
+		},
+		{
+			"field manager conflict",
+			apierrors.NewApplyConflict([]metav1.StatusCause{{
+				Type:    metav1.CauseTypeFieldManagerConflict,
+				Message: `conflict with "kubectl"`,
+				Field:   ".spec.replicas",
+			}}, "Apply failed with 1 conflict"),
+			false,
+		},
+		{
+			"invalid",
+			apierrors.NewBadRequest("bad"),
+			false,
+		},
+		{
+			"not found",
+			apierrors.NewNotFound(podsResource, "busybox"),
+			false,
+		},
+	}
+
+	for _, tt := range cases {
+		require.Equal(t, tt.Transient, isTransientError(tt.Err), "test: %s", tt.Name)
+	}
+}
+
+func testRetryPolicy() retryPolicy {
+	return retryPolicy{
+		requestTimeout: time.Second,
+		timeout:        5 * time.Second,
+		retries:        3,
+		backoff: wait.Backoff{
+			Duration: time.Millisecond,
+			Factor:   2,
+		},
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	// Transient errors are retried until the call succeeds.
+	calls := 0
+	err := testRetryPolicy().do(func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return apierrors.NewTooManyRequests("slow down", 0)
+		}
+		return nil
+	})
+	require.NoError(t, err, "expected call to succeed after retries")
+	require.Equal(t, 3, calls)
+
+	// Permanent errors are returned straight away.
+	calls = 0
+	err = testRetryPolicy().do(func(ctx context.Context) error {
+		calls++
+		return apierrors.NewBadRequest("bad")
+	})
+	require.Error(t, err, "expected permanent error to be returned")
+	require.Equal(t, 1, calls)
+
+	// Retries are bounded.
+	calls = 0
+	err = testRetryPolicy().do(func(ctx context.Context) error {
+		calls++
+		return apierrors.NewInternalError(fmt.Errorf("boom"))
+	})
+	require.Error(t, err, "expected error once retries are exhausted")
+	require.True(t, apierrors.IsInternalError(err), "expected original error to be wrapped")
+	require.Equal(t, 4, calls)
+
+	// A Retry-After that would take us past the timeout gives up early.
+	policy := testRetryPolicy()
+	policy.timeout = 100 * time.Millisecond
+	calls = 0
+	err = policy.do(func(ctx context.Context) error {
+		calls++
+		return apierrors.NewTooManyRequests("slow down", 10)
+	})
+	require.Error(t, err, "expected error when Retry-After exceeds the timeout")
+	require.Equal(t, 1, calls)
+
+	// Each attempt is bounded by the request timeout.
+	policy = testRetryPolicy()
+	policy.requestTimeout = 10 * time.Millisecond
+	policy.retries = 0
+	err = policy.do(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// rollbackCmd represents the rollback command
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Re-apply a previous revision of a release",
+	Long: `Rollback re-applies the objects recorded in a previous revision of a release
+and prunes those that were only applied by later revisions, then records the
+result as a new revision. See kubecuttle history for the revisions there are.
+
+Examples:
+	# Go back to revision 3 of what's been applied to the sre-test namespace.
+	kubecuttle rollback --to-revision 3 --release-namespace sre-test
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		n, err := cmd.Flags().GetInt("to-revision")
+		if err != nil {
+			return fmt.Errorf("could not get value of to-revision flag, got err: %s", err)
+		}
+		if n <= 0 {
+			return fmt.Errorf("pass the revision to roll back to with --to-revision")
+		}
+
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			return fmt.Errorf("could not get value of yes flag, got err: %s", err)
+		}
+
+		policy, err := retryPolicyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		cacheDir, err := cacheDirFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		ttl, err := discoveryTTLFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		config, err := buildConfig()
+		if err != nil {
+			return fmt.Errorf("failed to build config, got err: %w", err)
+		}
+
+		protected, err := checkProtection(cmd, viper.GetViper(), config, nil, time.Now())
+		if err != nil {
+			return err
+		}
+
+		client, err := typedClientInit(config)
+		if err != nil {
+			return err
+		}
+
+		dynamicClient, err := dynamicClientInit(config)
+		if err != nil {
+			return fmt.Errorf("failed to build clients: %w", err)
+		}
+
+		discoveryClient, mapper, err := buildCachedDiscovery(config, cacheDir, ttl)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		history, err := revisionHistoryFromFlags(cmd, client.CoreV1(), nil, true)
+		if err != nil {
+			return err
+		}
+		target, err := history.get(ctx, n)
+		if err != nil {
+			return err
+		}
+		manifests, err := decodeManifests([]inputFile{{source: fmt.Sprintf("revision %d", n), contents: target.manifests}})
+		if err != nil {
+			return fmt.Errorf("failed to decode revision %d, got err: %w", n, err)
+		}
+
+		// Take the same lock apply would for these objects.
+		lock, err := applyLockFromFlags(cmd, client.CoordinationV1(), manifests)
+		if err != nil {
+			return err
+		}
+		if lock != nil {
+			if err := lock.acquire(ctx); err != nil {
+				return err
+			}
+			defer func() {
+				if err := lock.release(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}()
+		}
+
+		revisions, err := history.list(ctx)
+		if err != nil {
+			return err
+		}
+		prune := rollbackPrunes(revisions, target)
+
+		// Show what going back will change, including what's pruned.
+		p, err := planManifests(dynamicClient, mapper, discoveryClient, manifests, policy)
+		if err != nil {
+			return err
+		}
+		p.addPrunes(prune)
+		fmt.Printf("Rolling back %s to revision %d:\n", history.release, n)
+		printPlan(os.Stdout, p)
+		switch {
+		case protected != nil:
+			if err := protected.confirm(cmd, false, os.Stdout); err != nil {
+				return err
+			}
+		case !yes:
+			if in := confirmationInput(false); in != nil {
+				ok, err := confirm(in, os.Stdout, p.changeCount())
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return errApplyCancelled
+				}
+			}
+		}
+
+		audit, err := auditLogFromFlags(cmd, config, dynamicClient, client.CoreV1())
+		if err != nil {
+			return err
+		}
+		defer audit.close()
+
+		r, err := rollbackTo(ctx, history, target, manifests, prune, p, newManifestApplier(dynamicClient, mapper, discoveryClient, policy), dynamicClient, mapper, policy, lock, audit, os.Stdout)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nRecorded revision %d of %s in namespace %s\n", r.Number, history.release, history.namespace)
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+
+	rollbackCmd.PersistentFlags().Int("to-revision", 0, "the revision to roll back to")
+	rollbackCmd.PersistentFlags().Duration("timeout", defaultObjectTimeout, "time allowed to apply or prune each object, including retries. Zero means no limit")
+	rollbackCmd.PersistentFlags().Duration("request-timeout", defaultTimeout, "time allowed for a single request to the API server")
+	rollbackCmd.PersistentFlags().Bool("yes", false, "roll back without asking to confirm. Only asked at a terminal")
+	addHistoryFlags(rollbackCmd.PersistentFlags(), true)
+	addLockFlags(rollbackCmd.PersistentFlags())
+	addProtectionFlags(rollbackCmd.PersistentFlags())
+	addAuditFlags(rollbackCmd.PersistentFlags())
+}
+
+// rollbackPrunes returns the objects applied by revisions after target that
+// aren't in it.
+func rollbackPrunes(revisions []revision, target revision) []objectRef {
+	newer := []objectRef{}
+	seen := map[string]bool{}
+	for _, r := range revisions {
+		if r.Number <= target.Number {
+			continue
+		}
+		for _, ref := range r.Objects {
+			if !seen[ref.key()] {
+				seen[ref.key()] = true
+				newer = append(newer, ref)
+			}
+		}
+	}
+
+	return pruneCandidates(newer, target.Objects)
+}
+
+// rollbackTo applies target's manifests, prunes the objects in prune and
+// records the result as a new revision of history. Objects are applied with
+// applier and pruned with dynamicClient. Every change is recorded in audit,
+// with its diff hash from p, and it stops if lock is lost.
+func rollbackTo(ctx context.Context, history revisionHistory, target revision, manifests []manifestObject, prune []objectRef, p plan, applier *manifestApplier, dynamicClient dynamic.Interface, mapper meta.RESTMapper, policy retryPolicy, lock *applyLock, audit *auditLog, out io.Writer) (revision, error) {
+	for _, manifest := range manifests {
+		obj, err := applyAndRecord(applier, manifest, lock, audit, p.hash(manifest.obj))
+		if err != nil {
+			return revision{}, err
+		}
+		fmt.Fprintf(out, "%s applied\n", describeObject(obj))
+	}
+
+	if err := lock.err(); err != nil {
+		return revision{}, err
+	}
+	var auditErr error
+	_, _, err := pruneObjects(dynamicClient, mapper, policy, prune, func(obj *unstructured.Unstructured, adopted bool) {
+		if adopted {
+			fmt.Fprintf(out, "%s not pruned, it was adopted by another field manager\n", describeObject(obj))
+			return
+		}
+		fmt.Fprintf(out, "%s pruned\n", describeObject(obj))
+		if err := audit.record(obj, nil, auditPruned, "", nil); err != nil && auditErr == nil {
+			auditErr = err
+		}
+	})
+	if err != nil {
+		return revision{}, err
+	}
+	if auditErr != nil {
+		return revision{}, auditErr
+	}
+
+	// The rollback is recorded as the revision it went back to, made
+	// by us.
+	r := revision{Time: time.Now().UTC(), User: currentUser(), GitSHA: target.GitSHA, RollbackTo: target.Number}
+
+	return history.record(ctx, r, manifests)
+}
@@ -26,6 +26,9 @@ import (
 
 var cfgFile string
 
+// kubeContext is the kubeconfig context passed with --context.
+var kubeContext string
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "kubecuttle",
@@ -55,6 +58,9 @@ func init() {
 	// will be global for your application.
 
 	//rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.kubecuttle.yaml)")
+	rootCmd.PersistentFlags().StringVar(&kubeContext, "context", "", "the kubeconfig context to use instead of the current context")
+	rootCmd.PersistentFlags().String("cache-dir", defaultCacheDir(), "directory to cache API server data such as OpenAPI schemas in. Pass an empty value to disable caching")
+	rootCmd.PersistentFlags().Duration("discovery-ttl", defaultDiscoveryTTL, "how long cached discovery data is used before it's fetched from the API server again")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
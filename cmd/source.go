@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// sourceMap records where each document in an input file starts so that
+// problems found with an object can be reported against the line of the
+// file that caused them.
+type sourceMap struct {
+	source    string
+	documents []sourceDocument
+}
+
+// sourceDocument is a single document within an input file.
+type sourceDocument struct {
+	// line is the line of the file the document starts on.
+	line int
+	// node is the parsed document, it is nil if it could not be parsed.
+	node *yamlv3.Node
+}
+
+// newSourceMap splits contents into documents the same way decodeInput
+// does, so the nth document in the map is the nth object decodeInput
+// returns.
+func newSourceMap(source string, contents []byte) *sourceMap {
+	m := &sourceMap{source: source}
+
+	trimmed := bytes.TrimLeft(contents, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		m.documents = splitJSONDocuments(contents)
+	} else {
+		m.documents = splitYAMLDocuments(contents)
+	}
+
+	return m
+}
+
+// splitYAMLDocuments splits a YAML stream on document separators. It mirrors
+// the behaviour of the YAMLReader used by decodeInput.
+func splitYAMLDocuments(contents []byte) []sourceDocument {
+	documents := []sourceDocument{}
+	lines := bytes.Split(contents, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		// A trailing newline doesn't start another line.
+		lines = lines[:len(lines)-1]
+	}
+
+	var buffer bytes.Buffer
+	start := 1
+	flush := func() {
+		documents = append(documents, sourceDocument{
+			line: start,
+			node: parseSourceNode(buffer.Bytes()),
+		})
+		buffer.Reset()
+	}
+
+	for i, line := range lines {
+		if bytes.HasPrefix(line, []byte("---")) && buffer.Len() != 0 {
+			flush()
+			continue
+		}
+		if buffer.Len() == 0 {
+			start = i + 1
+		}
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+	if buffer.Len() != 0 {
+		flush()
+	}
+
+	return documents
+}
+
+// splitJSONDocuments splits a stream of JSON objects.
+func splitJSONDocuments(contents []byte) []sourceDocument {
+	documents := []sourceDocument{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+
+	for {
+		raw := json.RawMessage{}
+		if err := decoder.Decode(&raw); err != nil {
+			// Either we've reached the end of the stream or the
+			// input is invalid, in which case decodeInput will
+			// report the error.
+			return documents
+		}
+
+		start := int(decoder.InputOffset()) - len(raw)
+		documents = append(documents, sourceDocument{
+			line: bytes.Count(contents[:start], []byte("\n")) + 1,
+			node: parseSourceNode(raw),
+		})
+	}
+}
+
+// parseSourceNode parses a document into a YAML node tree, which records
+// the line each value is on.
+func parseSourceNode(data []byte) *yamlv3.Node {
+	node := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal(data, node); err != nil {
+		return nil
+	}
+
+	return node
+}
+
+// locate returns a file:line reference for the field at path in the
+// document at index. When the field itself doesn't exist, as with a missing
+// required field, the closest parent that does is used.
+func (m *sourceMap) locate(index int, path fieldPath) string {
+	if m == nil {
+		return ""
+	}
+	if index < 0 || index >= len(m.documents) {
+		return m.source
+	}
+
+	doc := m.documents[index]
+	return fmt.Sprintf("%s:%d", m.source, doc.line+findLine(doc.node, path)-1)
+}
+
+// findLine walks a YAML node tree along path and returns the line, relative
+// to the start of the document, of the deepest field found. For map keys
+// the line of the key is used as that's where a reader would look.
+func findLine(node *yamlv3.Node, path fieldPath) int {
+	if node == nil || node.Kind == 0 {
+		return 1
+	}
+	if node.Kind == yamlv3.DocumentNode {
+		if len(node.Content) == 0 {
+			return 1
+		}
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, elem := range path {
+		key, value := childNode(node, elem)
+		if value == nil {
+			break
+		}
+		line, node = key.Line, value
+	}
+
+	return line
+}
+
+// childNode returns the nodes for a map key or list index within node. For
+// list items the key is the item itself.
+func childNode(node *yamlv3.Node, elem interface{}) (*yamlv3.Node, *yamlv3.Node) {
+	switch e := elem.(type) {
+	case string:
+		if node.Kind != yamlv3.MappingNode {
+			return nil, nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == e {
+				return node.Content[i], node.Content[i+1]
+			}
+		}
+	case int:
+		if node.Kind != yamlv3.SequenceNode || e < 0 || e >= len(node.Content) {
+			return nil, nil
+		}
+		return node.Content[e], node.Content[e]
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// readSources reads every manifest in paths, each of which is a file or a
+// directory. Directories are searched recursively for .yaml, .yml and .json
+// files. If pull is set, directories that are git work trees are fast
+// forwarded first. It returns the files read and the git revision of each
+// work tree.
+func readSources(paths []string, pull bool) ([]inputFile, []string, error) {
+	files := []inputFile{}
+	revisions := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read source %s, got err: %w", path, err)
+		}
+
+		if !info.IsDir() {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read file: %s, got err: %s", path, err)
+			}
+			files = append(files, inputFile{source: path, contents: contents})
+			continue
+		}
+
+		if isGitWorkTree(path) {
+			if pull {
+				if err := gitPull(path); err != nil {
+					return nil, nil, err
+				}
+			}
+			revision, err := gitRevision(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			revisions = append(revisions, revision)
+		}
+
+		manifests, err := manifestFiles(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, manifest := range manifests {
+			contents, err := ioutil.ReadFile(manifest)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read file: %s, got err: %s", manifest, err)
+			}
+			files = append(files, inputFile{source: manifest, contents: contents})
+		}
+	}
+
+	return files, revisions, nil
+}
+
+// manifestFiles returns the manifests under dir in lexical order. Hidden
+// files and directories, such as .git, are skipped.
+func manifestFiles(dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list manifests in %s, got err: %w", dir, err)
+	}
+
+	return files, nil
+}
+
+// isGitWorkTree reports whether dir is the top of a git work tree.
+func isGitWorkTree(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// gitPull fast forwards the git work tree in dir to its upstream.
+func gitPull(dir string) error {
+	if _, err := git(dir, "pull", "--ff-only", "--quiet"); err != nil {
+		return fmt.Errorf("failed to pull %s, got err: %w", dir, err)
+	}
+
+	return nil
+}
+
+// gitRevision returns the commit checked out in dir.
+func gitRevision(dir string) (string, error) {
+	revision, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to get revision of %s, got err: %w", dir, err)
+	}
+
+	return revision, nil
+}
+
+// git runs a git command in dir and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,362 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// variableName matches the names of variables that can be substituted.
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// variableReference matches ${VAR} and ${VAR:-default}. $${ escapes a
+// reference so that it's left alone.
+var variableReference = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// templateOptions configures how input files are rendered before they're
+// decoded.
+type templateOptions struct {
+	// substitute replaces ${VAR} references with the values of variables.
+	substitute bool
+	// goTemplate renders files as Go templates.
+	goTemplate bool
+	// vars are the variables passed with --var and --vars-file. They take
+	// precedence over the environment.
+	vars map[string]string
+	// lookupEnv reads the environment.
+	lookupEnv func(key string) (string, bool)
+}
+
+// addTemplateFlags adds the flags that control rendering input files to
+// flags.
+func addTemplateFlags(flags *pflag.FlagSet) {
+	flags.Bool("envsubst", false, "replace ${VAR} and ${VAR:-default} in input files with variables from the environment, --var and --vars-file")
+	flags.StringArray("var", nil, "set a variable for substitution and templates, as name=value. Implies --envsubst")
+	flags.StringSlice("vars-file", nil, "read variables for substitution and templates from these YAML files of names to values. Implies --envsubst")
+	flags.Bool("template", false, "render input files as Go templates, with variables as {{ .name }}")
+}
+
+// templateOptionsFromFlags reads the templating flags. Variables passed with
+// --var override those from --vars-file, and later vars files override
+// earlier ones.
+func templateOptionsFromFlags(cmd *cobra.Command) (*templateOptions, error) {
+	options := &templateOptions{vars: map[string]string{}, lookupEnv: os.LookupEnv}
+	flags := cmd.Flags()
+
+	var err error
+	if options.substitute, err = flags.GetBool("envsubst"); err != nil {
+		return nil, fmt.Errorf("could not get value of envsubst flag, got err: %s", err)
+	}
+	if options.goTemplate, err = flags.GetBool("template"); err != nil {
+		return nil, fmt.Errorf("could not get value of template flag, got err: %s", err)
+	}
+
+	varsFiles, err := flags.GetStringSlice("vars-file")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of vars-file flag, got err: %s", err)
+	}
+	for _, path := range varsFiles {
+		vars, err := readVarsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range vars {
+			options.vars[name] = value
+		}
+	}
+
+	vars, err := flags.GetStringArray("var")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of var flag, got err: %s", err)
+	}
+	for _, v := range vars {
+		name, value, err := parseVar(v)
+		if err != nil {
+			return nil, err
+		}
+		options.vars[name] = value
+	}
+
+	// Passing variables only makes sense if they're substituted.
+	if len(varsFiles) > 0 || len(vars) > 0 {
+		options.substitute = true
+	}
+
+	return options, nil
+}
+
+// parseVar parses a name=value variable.
+func parseVar(v string) (string, string, error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("variables must be passed as name=value, got: %s", v)
+	}
+	if !variableName.MatchString(parts[0]) {
+		return "", "", fmt.Errorf("invalid variable name: %q", parts[0])
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// readVarsFile reads a YAML or JSON file mapping variable names to values.
+// Values must be scalars, they're converted to strings.
+func readVarsFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vars file: %s, got err: %s", path, err)
+	}
+
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse vars file: %s, got err: %w", path, err)
+	}
+
+	vars := map[string]string{}
+	for name, value := range raw {
+		if !variableName.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name in %s: %q", path, name)
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("variable %s in %s must be a string, number or bool", name, path)
+		case nil:
+			vars[name] = ""
+		default:
+			vars[name] = fmt.Sprint(value)
+		}
+	}
+
+	return vars, nil
+}
+
+// lookup returns the value of a variable, preferring those passed on the
+// command line to the environment.
+func (o *templateOptions) lookup(name string) (string, bool) {
+	if value, ok := o.vars[name]; ok {
+		return value, true
+	}
+
+	return o.lookupEnv(name)
+}
+
+// render substitutes variables in, and then renders as templates, each of
+// files as configured. Files are returned unchanged if neither is enabled.
+// Line numbers in later messages refer to the rendered files.
+func (o *templateOptions) render(files []inputFile) ([]inputFile, error) {
+	if o == nil || (!o.substitute && !o.goTemplate) {
+		return files, nil
+	}
+
+	rendered := make([]inputFile, 0, len(files))
+	for _, file := range files {
+		contents := file.contents
+
+		var err error
+		if o.substitute {
+			if contents, err = o.substituteVars(file.source, contents); err != nil {
+				return nil, err
+			}
+		}
+		if o.goTemplate {
+			if contents, err = o.executeTemplate(file.source, contents); err != nil {
+				return nil, err
+			}
+		}
+
+		rendered = append(rendered, inputFile{source: file.source, contents: contents})
+	}
+
+	return rendered, nil
+}
+
+// substituteVars replaces ${VAR} and ${VAR:-default} in contents. As in
+// the shell, the default is used when the variable is unset or empty. Any
+// reference to a variable that isn't set is an error, every one of them is
+// reported.
+func (o *templateOptions) substituteVars(source string, contents []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	unresolved := []string{}
+	last := 0
+	for _, match := range variableReference.FindAllSubmatchIndex(contents, -1) {
+		start, end := match[0], match[1]
+		out.Write(contents[last:start])
+		last = end
+
+		// $${VAR} is written out as ${VAR}.
+		if contents[start+1] == '$' {
+			out.Write(contents[start+1 : end])
+			continue
+		}
+
+		reference := string(contents[match[2]:match[3]])
+		name, fallback, hasDefault := reference, "", false
+		if i := strings.Index(reference, ":-"); i >= 0 {
+			name, fallback, hasDefault = reference[:i], reference[i+2:], true
+		}
+
+		line := bytes.Count(contents[:start], []byte("\n")) + 1
+		if !variableName.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable reference ${%s} in %s on line %d", reference, source, line)
+		}
+
+		value, ok := o.lookup(name)
+		switch {
+		case hasDefault && value == "":
+			value = fallback
+		case !ok:
+			unresolved = append(unresolved, fmt.Sprintf("%s (line %d)", name, line))
+		}
+		out.WriteString(value)
+	}
+	out.Write(contents[last:])
+
+	if len(unresolved) > 0 {
+		return nil, fmt.Errorf("unresolved variables in %s: %s, set them in the environment or pass them with --var", source, strings.Join(unresolved, ", "))
+	}
+
+	return out.Bytes(), nil
+}
+
+// executeTemplate renders contents as a Go template. Variables are the
+// template's data, referring to one that isn't set is an error.
+func (o *templateOptions) executeTemplate(source string, contents []byte) ([]byte, error) {
+	tmpl, err := template.New(source).Option("missingkey=error").Funcs(o.templateFuncs()).Parse(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template, got err: %w", err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := tmpl.Execute(out, o.vars); err != nil {
+		return nil, fmt.Errorf("failed to render template, got err: %w", err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// templateFuncs returns the functions available to templates. They follow
+// the names and argument order of the sprig library's, so that values can be
+// piped into them.
+func (o *templateOptions) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// env returns an environment variable, failing if it's not set.
+		// Use ${NAME:-default} for optional ones.
+		"env": func(name string) (string, error) {
+			value, ok := o.lookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			return value, nil
+		},
+		"default": func(fallback interface{}, value interface{}) interface{} {
+			if isEmptyValue(value) {
+				return fallback
+			}
+			return value
+		},
+		"required": func(message string, value interface{}) (interface{}, error) {
+			if isEmptyValue(value) {
+				return nil, fmt.Errorf("%s", message)
+			}
+			return value, nil
+		},
+		"quote": func(value interface{}) string {
+			return fmt.Sprintf("%q", fmt.Sprint(value))
+		},
+		"squote": func(value interface{}) string {
+			return "'" + fmt.Sprint(value) + "'"
+		},
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, values interface{}) string {
+			return strings.Join(toStrings(values), sep)
+		},
+		"indent": func(spaces int, s string) string {
+			return indent(spaces, s)
+		},
+		"nindent": func(spaces int, s string) string {
+			return "\n" + indent(spaces, s)
+		},
+		"toYaml": func(value interface{}) (string, error) {
+			data, err := yaml.Marshal(value)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSuffix(string(data), "\n"), nil
+		},
+		"toJson": func(value interface{}) (string, error) {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return "", err
+			}
+			return string(data), nil
+		},
+		"b64enc": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"b64dec": func(s string) (string, error) {
+			data, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return "", err
+			}
+			return string(data), nil
+		},
+	}
+}
+
+// isEmptyValue reports whether value is nil or its type's zero value, or an
+// empty collection.
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// toStrings formats each element of a slice or array as a string.
+func toStrings(values interface{}) []string {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return []string{fmt.Sprint(values)}
+	}
+
+	strs := make([]string, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		strs = append(strs, fmt.Sprint(v.Index(i).Interface()))
+	}
+
+	return strs
+}
+
+// indent prefixes every line of s with spaces.
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
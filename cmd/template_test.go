@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEnv looks variables up in env instead of the environment.
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+var templatedPod = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-sleep
+  namespace: ${NAMESPACE:-sre-test}
+spec:
+  containers:
+  - name: busybox
+    image: busybox:${TAG}
+    command: ["sh", "-c", "echo $${HOME}"]
+`
+
+func TestSubstituteVars(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Contents string
+		Vars     map[string]string
+		Env      map[string]string
+		Expected string
+		Err      string
+	}{
+		{
+			Name:     "variables from the environment",
+			Contents: "image: busybox:${TAG}",
+			Env:      map[string]string{"TAG": "1.34"},
+			Expected: "image: busybox:1.34",
+		},
+		{
+			Name:     "variables passed override the environment",
+			Contents: "image: busybox:${TAG}",
+			Vars:     map[string]string{"TAG": "1.35"},
+			Env:      map[string]string{"TAG": "1.34"},
+			Expected: "image: busybox:1.35",
+		},
+		{
+			Name:     "defaults are used for unset and empty variables",
+			Contents: "replicas: ${REPLICAS:-2}\nnamespace: ${NAMESPACE:-sre-test}",
+			Env:      map[string]string{"NAMESPACE": ""},
+			Expected: "replicas: 2\nnamespace: sre-test",
+		},
+		{
+			Name:     "set but empty variables without a default are empty",
+			Contents: "value: '${EMPTY}'",
+			Env:      map[string]string{"EMPTY": ""},
+			Expected: "value: ''",
+		},
+		{
+			Name:     "escaped references are left alone",
+			Contents: "command: echo $${HOME} $HOME",
+			Expected: "command: echo ${HOME} $HOME",
+		},
+		{
+			Name:     "every unresolved variable is reported",
+			Contents: "image: busybox:${TAG}\nreplicas: ${REPLICAS}\n",
+			Err:      "unresolved variables in pod.yaml: TAG (line 1), REPLICAS (line 2), set them in the environment or pass them with --var",
+		},
+		{
+			Name:     "invalid references fail",
+			Contents: "\nimage: ${TAG-1}",
+			Err:      "invalid variable reference ${TAG-1} in pod.yaml on line 2",
+		},
+	}
+
+	for _, tt := range cases {
+		options := &templateOptions{substitute: true, vars: tt.Vars, lookupEnv: fakeEnv(tt.Env)}
+		out, err := options.substituteVars("pod.yaml", []byte(tt.Contents))
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Expected, string(out), "test: %s", tt.Name)
+	}
+}
+
+func TestExecuteTemplate(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Contents string
+		Vars     map[string]string
+		Env      map[string]string
+		Expected string
+		Err      string
+	}{
+		{
+			Name:     "variables are the template's data",
+			Contents: "replicas: {{ .replicas }}\nimage: {{ .image | quote }}",
+			Vars:     map[string]string{"replicas": "3", "image": "busybox:1.34"},
+			Expected: "replicas: 3\nimage: \"busybox:1.34\"",
+		},
+		{
+			Name:     "helpers",
+			Contents: `{{ .env | upper }} {{ .missing | default "x" }} {{ env "HOME" }} {{ splitList "," "a,b" | join "-" }} {{ "hi" | b64enc }}`,
+			Vars:     map[string]string{"env": "prod", "missing": ""},
+			Env:      map[string]string{"HOME": "/root"},
+			Expected: "PROD x /root a-b aGk=",
+		},
+		{
+			Name:     "indenting",
+			Contents: "labels:{{ .labels | nindent 2 }}",
+			Vars:     map[string]string{"labels": "a: b\nc: d"},
+			Expected: "labels:\n  a: b\n  c: d",
+		},
+		{
+			Name:     "unset variables fail",
+			Contents: "replicas: {{ .replicas }}",
+			Vars:     map[string]string{},
+			Err:      `failed to render template, got err: template: pod.yaml:1:13: executing "pod.yaml" at <.replicas>: map has no entry for key "replicas"`,
+		},
+		{
+			Name:     "unset environment variables fail",
+			Contents: `{{ env "TAG" }}`,
+			Err:      `failed to render template, got err: template: pod.yaml:1:3: executing "pod.yaml" at <env "TAG">: error calling env: environment variable TAG is not set`,
+		},
+		{
+			Name:     "required values fail when empty",
+			Contents: `{{ .tag | required "tag is required" }}`,
+			Vars:     map[string]string{"tag": ""},
+			Err:      `failed to render template, got err: template: pod.yaml:1:10: executing "pod.yaml" at <required "tag is required">: error calling required: tag is required`,
+		},
+	}
+
+	for _, tt := range cases {
+		options := &templateOptions{goTemplate: true, vars: tt.Vars, lookupEnv: fakeEnv(tt.Env)}
+		out, err := options.executeTemplate("pod.yaml", []byte(tt.Contents))
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Expected, string(out), "test: %s", tt.Name)
+	}
+}
+
+func TestTemplateOptionsFromFlags(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"base.yaml":  "TAG: \"1.33\"\nNAMESPACE: sre-test\nREPLICAS: 2\n",
+		"prod.yaml":  "TAG: \"1.34\"\n",
+		"bad.yaml":   "TAG:\n  nested: value\n",
+		"pod.yaml":   templatedPod,
+		"plain.yaml": onePod,
+	})
+
+	parse := func(args ...string) (*templateOptions, error) {
+		cmd := &cobra.Command{}
+		addTemplateFlags(cmd.Flags())
+		require.NoError(t, cmd.ParseFlags(args), "failed to parse flags")
+		return templateOptionsFromFlags(cmd)
+	}
+
+	options, err := parse()
+	require.NoError(t, err)
+	require.False(t, options.substitute, "expected substitution to be off by default")
+	files := []inputFile{{source: "plain.yaml", contents: []byte(onePod)}}
+	rendered, err := options.render(files)
+	require.NoError(t, err)
+	require.Equal(t, files, rendered)
+
+	options, err = parse(
+		"--vars-file", filepath.Join(dir, "base.yaml"),
+		"--vars-file", filepath.Join(dir, "prod.yaml"),
+		"--var", "NAMESPACE=sre-prod",
+	)
+	require.NoError(t, err)
+	require.True(t, options.substitute, "expected passing variables to turn on substitution")
+	require.Equal(t, map[string]string{"TAG": "1.34", "NAMESPACE": "sre-prod", "REPLICAS": "2"}, options.vars)
+
+	rendered, err = options.render([]inputFile{{source: "pod.yaml", contents: []byte(templatedPod)}})
+	require.NoError(t, err, "failed to render pod")
+	manifests, err := decodeManifests(rendered)
+	require.NoError(t, err, "failed to decode rendered pod")
+	require.Equal(t, "sre-prod", manifests[0].obj.GetNamespace())
+	require.Contains(t, string(rendered[0].contents), "image: busybox:1.34\n")
+	require.Contains(t, string(rendered[0].contents), `"echo ${HOME}"`)
+
+	_, err = parse("--var", "TAG")
+	require.EqualError(t, err, "variables must be passed as name=value, got: TAG")
+	_, err = parse("--vars-file", filepath.Join(dir, "bad.yaml"))
+	require.Error(t, err, "expected nested values to fail")
+}
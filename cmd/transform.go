@@ -0,0 +1,366 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// podTemplatePaths are the paths to the pod templates inside the kinds that
+// have them.
+var podTemplatePaths = map[string][][]string{
+	"Deployment":            {{"spec", "template"}},
+	"ReplicaSet":            {{"spec", "template"}},
+	"StatefulSet":           {{"spec", "template"}},
+	"DaemonSet":             {{"spec", "template"}},
+	"Job":                   {{"spec", "template"}},
+	"ReplicationController": {{"spec", "template"}},
+	"PodTemplate":           {{"template"}},
+	// A CronJob's job template is labelled as well as its pod template,
+	// so the Jobs it creates are too.
+	"CronJob": {{"spec", "jobTemplate"}, {"spec", "jobTemplate", "spec", "template"}},
+}
+
+// unprefixedKinds are kinds whose names can't take a prefix, they're
+// dictated by what they define.
+var unprefixedKinds = map[string]bool{
+	"Namespace":                true,
+	"CustomResourceDefinition": true,
+	"APIService":               true,
+}
+
+// transformOptions are changes made to every object before it's sent.
+type transformOptions struct {
+	labels      map[string]string
+	annotations map[string]string
+	namePrefix  string
+}
+
+// addTransformFlags adds the flags that change every object to flags.
+func addTransformFlags(flags *pflag.FlagSet) {
+	flags.StringArray("add-label", nil, "add a label, as key=value, to every object and the pod templates inside them. Replaces existing values")
+	flags.StringArray("add-annotation", nil, "add an annotation, as key=value, to every object and the pod templates inside them. Replaces existing values")
+	flags.String("name-prefix", "", "prefix the name of every object, and the references to them from other objects in the input")
+}
+
+// transformOptionsFromFlags reads the transform flags.
+func transformOptionsFromFlags(cmd *cobra.Command) (*transformOptions, error) {
+	options := &transformOptions{labels: map[string]string{}, annotations: map[string]string{}}
+	flags := cmd.Flags()
+
+	labels, err := flags.GetStringArray("add-label")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of add-label flag, got err: %s", err)
+	}
+	for _, label := range labels {
+		key, value, err := parseKeyValue("label", label)
+		if err != nil {
+			return nil, err
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid value for label %s: %s", key, strings.Join(errs, ", "))
+		}
+		options.labels[key] = value
+	}
+
+	annotations, err := flags.GetStringArray("add-annotation")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of add-annotation flag, got err: %s", err)
+	}
+	for _, annotation := range annotations {
+		key, value, err := parseKeyValue("annotation", annotation)
+		if err != nil {
+			return nil, err
+		}
+		options.annotations[key] = value
+	}
+
+	if options.namePrefix, err = flags.GetString("name-prefix"); err != nil {
+		return nil, fmt.Errorf("could not get value of name-prefix flag, got err: %s", err)
+	}
+
+	return options, nil
+}
+
+// parseKeyValue parses a key=value label or annotation.
+func parseKeyValue(what, v string) (string, string, error) {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("%ss must be passed as key=value, got: %s", what, v)
+	}
+	if errs := validation.IsQualifiedName(parts[0]); len(errs) > 0 {
+		return "", "", fmt.Errorf("invalid %s key %q: %s", what, parts[0], strings.Join(errs, ", "))
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// transformManifests reads the transform flags and makes their changes to
+// manifests.
+func transformManifests(cmd *cobra.Command, manifests []manifestObject) error {
+	options, err := transformOptionsFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+
+	options.transform(manifests)
+	return nil
+}
+
+// transform makes the changes to every object in manifests, in place.
+// Selectors are left alone, they're immutable in most workloads so adding
+// to them would stop the objects being updated.
+func (t *transformOptions) transform(manifests []manifestObject) {
+	if t == nil {
+		return
+	}
+
+	// Only references to objects in the input are renamed, anything else
+	// already exists under its own name.
+	renamed := map[string]bool{}
+	if t.namePrefix != "" {
+		for _, m := range manifests {
+			if !unprefixedKinds[m.obj.GetKind()] {
+				renamed[referenceKey(m.obj.GetKind(), m.obj.GetNamespace(), m.obj.GetName())] = true
+			}
+		}
+	}
+
+	for _, m := range manifests {
+		obj := m.obj.Object
+		metadata := childMap(obj, "metadata")
+		addStrings(metadata, "labels", t.labels)
+		addStrings(metadata, "annotations", t.annotations)
+
+		for _, path := range podTemplatePaths[m.obj.GetKind()] {
+			if len(t.labels) == 0 && len(t.annotations) == 0 {
+				break
+			}
+			template := childMap(obj, path...)
+			if template == nil {
+				continue
+			}
+			templateMetadata := childMap(template, "metadata")
+			if templateMetadata == nil {
+				templateMetadata = map[string]interface{}{}
+				template["metadata"] = templateMetadata
+			}
+			addStrings(templateMetadata, "labels", t.labels)
+			addStrings(templateMetadata, "annotations", t.annotations)
+		}
+
+		if t.namePrefix == "" {
+			continue
+		}
+		if !unprefixedKinds[m.obj.GetKind()] {
+			m.obj.SetName(t.namePrefix + m.obj.GetName())
+		}
+		for _, spec := range podSpecs(m.obj.GetKind(), obj) {
+			t.prefixReferences(spec, m.obj.GetNamespace(), renamed)
+		}
+		t.prefixObjectReferences(m.obj.GetKind(), obj, m.obj.GetNamespace(), renamed)
+	}
+}
+
+// prefixName prefixes the name at field in ref if it's that of an object of
+// kind in namespace that's in renamed.
+func (t *transformOptions) prefixName(kind, namespace string, ref map[string]interface{}, field string, renamed map[string]bool) {
+	name, ok := ref[field].(string)
+	if ok && renamed[referenceKey(kind, namespace, name)] {
+		ref[field] = t.namePrefix + name
+	}
+}
+
+// prefixObjectReferences prefixes the names of the objects in renamed that
+// an object of kind refers to outside of its pod specs: the Services and
+// Secrets of an Ingress, the roles and ServiceAccounts of a binding, the
+// Service of a StatefulSet and the target of a HorizontalPodAutoscaler.
+// PodDisruptionBudgets pick their pods by label, not name, so still match
+// them after renaming.
+func (t *transformOptions) prefixObjectReferences(kind string, obj map[string]interface{}, namespace string, renamed map[string]bool) {
+	switch kind {
+	case "Ingress":
+		spec := childMap(obj, "spec")
+		if spec == nil {
+			return
+		}
+		backends := []map[string]interface{}{}
+		// defaultBackend was called backend before networking.k8s.io/v1.
+		for _, field := range []string{"defaultBackend", "backend"} {
+			if backend := childMap(spec, field); backend != nil {
+				backends = append(backends, backend)
+			}
+		}
+		for _, rule := range childMaps(spec, "rules") {
+			for _, path := range childMaps(rule, "http", "paths") {
+				if backend := childMap(path, "backend"); backend != nil {
+					backends = append(backends, backend)
+				}
+			}
+		}
+		for _, backend := range backends {
+			if service := childMap(backend, "service"); service != nil {
+				t.prefixName("Service", namespace, service, "name", renamed)
+			}
+			t.prefixName("Service", namespace, backend, "serviceName", renamed)
+		}
+		for _, tls := range childMaps(spec, "tls") {
+			t.prefixName("Secret", namespace, tls, "secretName", renamed)
+		}
+	case "RoleBinding", "ClusterRoleBinding":
+		if roleRef := childMap(obj, "roleRef"); roleRef != nil {
+			// Roles are in the binding's namespace, ClusterRoles in
+			// none.
+			roleKind, _ := roleRef["kind"].(string)
+			roleNamespace := namespace
+			if roleKind == "ClusterRole" {
+				roleNamespace = ""
+			}
+			t.prefixName(roleKind, roleNamespace, roleRef, "name", renamed)
+		}
+		for _, subject := range childMaps(obj, "subjects") {
+			if subject["kind"] != "ServiceAccount" {
+				continue
+			}
+			subjectNamespace, ok := subject["namespace"].(string)
+			if !ok {
+				subjectNamespace = namespace
+			}
+			t.prefixName("ServiceAccount", subjectNamespace, subject, "name", renamed)
+		}
+	case "StatefulSet":
+		if spec := childMap(obj, "spec"); spec != nil {
+			t.prefixName("Service", namespace, spec, "serviceName", renamed)
+		}
+	case "HorizontalPodAutoscaler":
+		if target := childMap(obj, "spec", "scaleTargetRef"); target != nil {
+			targetKind, _ := target["kind"].(string)
+			t.prefixName(targetKind, namespace, target, "name", renamed)
+		}
+	}
+}
+
+// prefixReferences prefixes the names of the ConfigMaps, Secrets,
+// ServiceAccounts and PersistentVolumeClaims in renamed that spec refers to.
+func (t *transformOptions) prefixReferences(spec map[string]interface{}, namespace string, renamed map[string]bool) {
+	prefix := func(kind string, ref map[string]interface{}, field string) {
+		t.prefixName(kind, namespace, ref, field, renamed)
+	}
+
+	prefix("ServiceAccount", spec, "serviceAccountName")
+	for _, secret := range childMaps(spec, "imagePullSecrets") {
+		prefix("Secret", secret, "name")
+	}
+
+	for _, volume := range childMaps(spec, "volumes") {
+		if ref := childMap(volume, "configMap"); ref != nil {
+			prefix("ConfigMap", ref, "name")
+		}
+		if ref := childMap(volume, "secret"); ref != nil {
+			prefix("Secret", ref, "secretName")
+		}
+		if ref := childMap(volume, "persistentVolumeClaim"); ref != nil {
+			prefix("PersistentVolumeClaim", ref, "claimName")
+		}
+		for _, source := range childMaps(volume, "projected", "sources") {
+			if ref := childMap(source, "configMap"); ref != nil {
+				prefix("ConfigMap", ref, "name")
+			}
+			if ref := childMap(source, "secret"); ref != nil {
+				prefix("Secret", ref, "name")
+			}
+		}
+	}
+
+	containers := append(childMaps(spec, "initContainers"), childMaps(spec, "containers")...)
+	for _, container := range containers {
+		for _, envFrom := range childMaps(container, "envFrom") {
+			if ref := childMap(envFrom, "configMapRef"); ref != nil {
+				prefix("ConfigMap", ref, "name")
+			}
+			if ref := childMap(envFrom, "secretRef"); ref != nil {
+				prefix("Secret", ref, "name")
+			}
+		}
+		for _, env := range childMaps(container, "env") {
+			if ref := childMap(env, "valueFrom", "configMapKeyRef"); ref != nil {
+				prefix("ConfigMap", ref, "name")
+			}
+			if ref := childMap(env, "valueFrom", "secretKeyRef"); ref != nil {
+				prefix("Secret", ref, "name")
+			}
+		}
+	}
+}
+
+// podSpecs returns the pod specs in an object of kind.
+func podSpecs(kind string, obj map[string]interface{}) []map[string]interface{} {
+	specs := []map[string]interface{}{}
+	for _, path := range podSpecPaths(kind) {
+		if spec := childMap(obj, path...); spec != nil {
+			specs = append(specs, spec)
+		}
+	}
+
+	return specs
+}
+
+// referenceKey identifies an object that can be referred to by name.
+func referenceKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// childMap returns the map at path in obj, or nil if there isn't one. Unlike
+// unstructured.NestedMap it isn't a copy, so changes to it change obj.
+func childMap(obj map[string]interface{}, path ...string) map[string]interface{} {
+	for _, field := range path {
+		next, ok := obj[field].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		obj = next
+	}
+
+	return obj
+}
+
+// childMaps returns the maps in the list at path in obj.
+func childMaps(obj map[string]interface{}, path ...string) []map[string]interface{} {
+	parent := childMap(obj, path[:len(path)-1]...)
+	if parent == nil {
+		return nil
+	}
+	list, ok := parent[path[len(path)-1]].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	maps := []map[string]interface{}{}
+	for _, item := range list {
+		if m, ok := item.(map[string]interface{}); ok {
+			maps = append(maps, m)
+		}
+	}
+
+	return maps
+}
+
+// addStrings sets values in the string map at field in metadata, creating it
+// if needed.
+func addStrings(metadata map[string]interface{}, field string, values map[string]string) {
+	if metadata == nil || len(values) == 0 {
+		return
+	}
+
+	existing, ok := metadata[field].(map[string]interface{})
+	if !ok {
+		existing = map[string]interface{}{}
+		metadata[field] = existing
+	}
+	for key, value := range values {
+		existing[key] = value
+	}
+}
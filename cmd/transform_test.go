@@ -0,0 +1,453 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+var transformInput = `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: sre-test
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: sre-test
+  labels:
+    team: old
+data:
+  key: value
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: busybox
+  namespace: sre-test
+spec:
+  selector:
+    matchLabels:
+      app: busybox
+  template:
+    metadata:
+      labels:
+        app: busybox
+    spec:
+      serviceAccountName: default
+      containers:
+      - name: busybox
+        image: busybox
+        envFrom:
+        - configMapRef:
+            name: settings
+        env:
+        - name: PASSWORD
+          valueFrom:
+            secretKeyRef:
+              name: external
+              key: password
+      volumes:
+      - name: settings
+        configMap:
+          name: settings
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: nightly
+  namespace: sre-test
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          restartPolicy: Never
+          containers:
+          - name: busybox
+            image: busybox
+`
+
+var transformedInput = `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: sre-test
+  labels:
+    team: sre
+  annotations:
+    git-sha: abc123
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prod-settings
+  namespace: sre-test
+  labels:
+    team: sre
+  annotations:
+    git-sha: abc123
+data:
+  key: value
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: prod-busybox
+  namespace: sre-test
+  labels:
+    team: sre
+  annotations:
+    git-sha: abc123
+spec:
+  selector:
+    matchLabels:
+      app: busybox
+  template:
+    metadata:
+      labels:
+        app: busybox
+        team: sre
+      annotations:
+        git-sha: abc123
+    spec:
+      serviceAccountName: default
+      containers:
+      - name: busybox
+        image: busybox
+        envFrom:
+        - configMapRef:
+            name: prod-settings
+        env:
+        - name: PASSWORD
+          valueFrom:
+            secretKeyRef:
+              name: external
+              key: password
+      volumes:
+      - name: settings
+        configMap:
+          name: prod-settings
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: prod-nightly
+  namespace: sre-test
+  labels:
+    team: sre
+  annotations:
+    git-sha: abc123
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    metadata:
+      labels:
+        team: sre
+      annotations:
+        git-sha: abc123
+    spec:
+      template:
+        metadata:
+          labels:
+            team: sre
+          annotations:
+            git-sha: abc123
+        spec:
+          restartPolicy: Never
+          containers:
+          - name: busybox
+            image: busybox
+`
+
+func TestTransform(t *testing.T) {
+	manifests, err := decodeManifests([]inputFile{{source: "input.yaml", contents: []byte(transformInput)}})
+	require.NoError(t, err, "failed to decode input")
+	expected, err := decodeManifests([]inputFile{{source: "expected.yaml", contents: []byte(transformedInput)}})
+	require.NoError(t, err, "failed to decode expected objects")
+
+	options := &transformOptions{
+		labels:      map[string]string{"team": "sre"},
+		annotations: map[string]string{"git-sha": "abc123"},
+		namePrefix:  "prod-",
+	}
+	options.transform(manifests)
+
+	require.Len(t, manifests, len(expected))
+	for i := range expected {
+		want, err := yaml.Marshal(expected[i].obj.Object)
+		require.NoError(t, err)
+		got, err := yaml.Marshal(manifests[i].obj.Object)
+		require.NoError(t, err)
+		require.Equal(t, string(want), string(got), "object %d", i)
+	}
+}
+
+func TestTransformOptionsFromFlags(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Args     []string
+		Expected *transformOptions
+		Err      string
+	}{
+		{
+			Name:     "no flags",
+			Expected: &transformOptions{labels: map[string]string{}, annotations: map[string]string{}},
+		},
+		{
+			Name: "every flag",
+			Args: []string{"--add-label", "team=sre", "--add-label", "release=2021.09", "--add-annotation", "example.com/note=a=b", "--name-prefix", "prod-"},
+			Expected: &transformOptions{
+				labels:      map[string]string{"team": "sre", "release": "2021.09"},
+				annotations: map[string]string{"example.com/note": "a=b"},
+				namePrefix:  "prod-",
+			},
+		},
+		{
+			Name: "missing value",
+			Args: []string{"--add-label", "team"},
+			Err:  "labels must be passed as key=value, got: team",
+		},
+		{
+			Name: "invalid label value",
+			Args: []string{"--add-label", "team=not valid"},
+			Err:  "invalid value for label team: a valid label must be an empty string or consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character (e.g. 'MyValue',  or 'my_value',  or '12345', regex used for validation is '(([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9])?')",
+		},
+	}
+
+	for _, tt := range cases {
+		cmd := &cobra.Command{}
+		addTransformFlags(cmd.Flags())
+		require.NoError(t, cmd.ParseFlags(tt.Args), "test: %s", tt.Name)
+
+		options, err := transformOptionsFromFlags(cmd)
+		if tt.Err != "" {
+			require.EqualError(t, err, tt.Err, "test: %s", tt.Name)
+			continue
+		}
+		require.NoError(t, err, "test: %s", tt.Name)
+		require.Equal(t, tt.Expected, options, "test: %s", tt.Name)
+	}
+}
+
+var prefixInput = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: sre-test
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: web
+  namespace: sre-test
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: reader
+  namespace: sre-test
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: web-reader
+  namespace: sre-test
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: reader
+subjects:
+- kind: ServiceAccount
+  name: web
+- kind: ServiceAccount
+  name: web
+  namespace: kube-system
+- kind: User
+  name: web
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: web-view
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: view
+subjects:
+- kind: ServiceAccount
+  name: web
+  namespace: sre-test
+---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  defaultBackend:
+    service:
+      name: web
+      port:
+        number: 80
+  rules:
+  - http:
+      paths:
+      - path: /
+        pathType: Prefix
+        backend:
+          service:
+            name: web
+            port:
+              number: 80
+      - path: /other
+        pathType: Prefix
+        backend:
+          service:
+            name: other
+            port:
+              number: 80
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  serviceName: web
+---
+apiVersion: autoscaling/v2beta2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+  namespace: sre-test
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: StatefulSet
+    name: web
+`
+
+var prefixedInput = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: prod-web
+  namespace: sre-test
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: prod-web
+  namespace: sre-test
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: prod-reader
+  namespace: sre-test
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: prod-web-reader
+  namespace: sre-test
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: prod-reader
+subjects:
+- kind: ServiceAccount
+  name: prod-web
+- kind: ServiceAccount
+  name: web
+  namespace: kube-system
+- kind: User
+  name: web
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: prod-web-view
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: view
+subjects:
+- kind: ServiceAccount
+  name: prod-web
+  namespace: sre-test
+---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: prod-web
+  namespace: sre-test
+spec:
+  defaultBackend:
+    service:
+      name: prod-web
+      port:
+        number: 80
+  rules:
+  - http:
+      paths:
+      - path: /
+        pathType: Prefix
+        backend:
+          service:
+            name: prod-web
+            port:
+              number: 80
+      - path: /other
+        pathType: Prefix
+        backend:
+          service:
+            name: other
+            port:
+              number: 80
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: prod-web
+  namespace: sre-test
+spec:
+  serviceName: prod-web
+---
+apiVersion: autoscaling/v2beta2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: prod-web
+  namespace: sre-test
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: StatefulSet
+    name: prod-web
+`
+
+func TestPrefixObjectReferences(t *testing.T) {
+	manifests, err := decodeManifests([]inputFile{{source: "input.yaml", contents: []byte(prefixInput)}})
+	require.NoError(t, err, "failed to decode input")
+	expected, err := decodeManifests([]inputFile{{source: "expected.yaml", contents: []byte(prefixedInput)}})
+	require.NoError(t, err, "failed to decode expected objects")
+
+	options := &transformOptions{namePrefix: "prod-"}
+	options.transform(manifests)
+
+	require.Len(t, manifests, len(expected))
+	for i := range expected {
+		want, err := yaml.Marshal(expected[i].obj.Object)
+		require.NoError(t, err)
+		got, err := yaml.Marshal(manifests[i].obj.Object)
+		require.NoError(t, err)
+		require.Equal(t, string(want), string(got), "object %d", i)
+	}
+}
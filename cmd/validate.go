@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate configuration files without talking to a cluster",
+	Long: `Validate decodes the resources passed to it and validates them against their
+OpenAPI schemas without talking to an API server, making it suitable for
+pre-commit hooks and CI jobs without cluster access.
+
+Schemas are looked up, in order, in files passed with --openapi-file,
+CustomResourceDefinitions passed with --crd or found in the input, schemas
+cached by a previous apply against the cluster KUBECONFIG points at, and
+finally the schemas bundled with kubecuttle for built in kinds.
+
+Examples:
+	# Validate several manifests at once.
+	kubecuttle validate -f deploy.yaml -f service.yaml
+
+	# Validate custom resources against the CRDs that define them.
+	kubecuttle validate -f widget.yaml --crd ./crds/
+
+	# Check every pod sets a security context.
+	kubecuttle validate -f pods.yaml --assert 'object.kind != "Pod" || has(object.spec.securityContext)'
+
+	# Check the manifests still work after upgrading to Kubernetes v1.25.
+	kubecuttle validate -f cronjob.yaml --target-version v1.25
+`,
+	// Problems are reported as they're found, the usage message would
+	// only bury them.
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		files, err := readInputFiles(cmd)
+		if err != nil {
+			return err
+		}
+
+		manifests, err := decodeManifests(files)
+		if err != nil {
+			return fmt.Errorf("failed to decode objects, got err: %w", err)
+		}
+		if err := transformManifests(cmd, manifests); err != nil {
+			return err
+		}
+
+		target, err := targetVersionFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+		if target != nil {
+			if err := checkDeprecations(manifests, target); err != nil {
+				return err
+			}
+		}
+
+		schemas, err := offlineSchemaSource(cmd, manifests)
+		if err != nil {
+			return err
+		}
+
+		if err := validateObjects(newValidator(schemas), manifests, validationStrict); err != nil {
+			return err
+		}
+
+		rules, err := objectPolicyFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+		if err := checkObjectPolicy(rules, manifests); err != nil {
+			return err
+		}
+
+		assertions, err := assertionsFromFlags(cmd)
+		if err != nil {
+			return err
+		}
+		if err := checkAssertions(assertions, manifests); err != nil {
+			return err
+		}
+
+		fmt.Printf("%d object(s) valid\n", len(manifests))
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+
+	validateCmd.PersistentFlags().StringSliceP("file", "f", nil, "pass a file path or pass - to validate yaml configuration from STDIN")
+	validateCmd.PersistentFlags().StringSlice("openapi-file", nil, "read OpenAPI v3 documents from these files or directories")
+	validateCmd.PersistentFlags().StringSlice("crd", nil, "read schemas for custom resources from CustomResourceDefinitions in these files or directories")
+	validateCmd.PersistentFlags().String("target-version", "", "also check for APIs deprecated or removed in this Kubernetes version, e.g. v1.25")
+	addTemplateFlags(validateCmd.PersistentFlags())
+	addTransformFlags(validateCmd.PersistentFlags())
+	addPolicyFlags(validateCmd.PersistentFlags())
+	addAssertFlags(validateCmd.PersistentFlags())
+}
+
+// offlineSchemaSource returns every source of schemas that doesn't need an
+// API server, most specific first.
+func offlineSchemaSource(cmd *cobra.Command, manifests []manifestObject) (schemaSource, error) {
+	sources := layeredSchemaSource{}
+
+	openAPIFiles, err := cmd.Flags().GetStringSlice("openapi-file")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of openapi-file flag, got err: %s", err)
+	}
+	if len(openAPIFiles) > 0 {
+		files, err := loadOpenAPIFiles(openAPIFiles)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, files)
+	}
+
+	crdFiles, err := cmd.Flags().GetStringSlice("crd")
+	if err != nil {
+		return nil, fmt.Errorf("could not get value of crd flag, got err: %s", err)
+	}
+	if len(crdFiles) > 0 {
+		crds, err := loadCRDFiles(crdFiles)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, crds)
+	}
+
+	crds, err := crdSchemaSourceFromManifests(manifests)
+	if err != nil {
+		return nil, err
+	}
+	sources = append(sources, crds)
+
+	cached, err := cachedSchemaSource(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		sources = append(sources, cached)
+	}
+
+	return append(sources, bundledSchemaSource()), nil
+}
+
+// cachedSchemaSource returns the OpenAPI documents cached by a previous
+// apply against the cluster KUBECONFIG points at. It returns nil if there's
+// no cluster configured or nothing has been cached.
+func cachedSchemaSource(cmd *cobra.Command) (schemaSource, error) {
+	cacheDir, err := cacheDirFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if cacheDir == "" {
+		return nil, nil
+	}
+
+	config, err := buildConfig()
+	if err != nil {
+		// Without a kubeconfig we can't know which cluster's cache to
+		// use.
+		return nil, nil
+	}
+
+	dir := openAPICacheDir(cacheDir, config.Host)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, nil
+	}
+
+	cached, err := loadOpenAPIFiles([]string{dir})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached OpenAPI documents, got err: %w", err)
+	}
+
+	return cached, nil
+}
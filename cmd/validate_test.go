@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var deploymentWrongReplicas = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+  namespace: sre-test
+spec:
+  replicas: three
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      labels:
+        app: nginx
+    spec:
+      containers:
+      - name: nginx
+        image: nginx
+        ports:
+        - containerPort: "80"
+        resources:
+          limits:
+            cpu: 500m
+            memory: 1
+`
+
+var widgetCRD = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            required:
+            - size
+            properties:
+              size:
+                type: integer
+              colour:
+                type: string
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: my-widget
+  namespace: sre-test
+spec:
+  colour: blue
+  shape: round
+`
+
+// validateOffline validates input against the CRDs in it and the bundled
+// schemas, the same way the validate command does.
+func validateOffline(t *testing.T, input string) []string {
+	manifests, err := decodeManifests([]inputFile{{source: "input.yaml", contents: []byte(input)}})
+	require.NoError(t, err, "failed to decode objects")
+
+	crds, err := crdSchemaSourceFromManifests(manifests)
+	require.NoError(t, err, "failed to read CRDs")
+	v := newValidator(layeredSchemaSource{crds, bundledSchemaSource()})
+
+	problems := []string{}
+	for _, manifest := range manifests {
+		errs, found, err := v.validate(manifest.obj, *manifest.gvk)
+		require.NoError(t, err, "failed to validate object")
+		if !found {
+			// CustomResourceDefinitions themselves have no bundled
+			// schema.
+			require.True(t, isCRD(*manifest.gvk), "expected a schema for %s", manifest.gvk)
+			continue
+		}
+
+		for _, fieldErr := range errs {
+			problems = append(problems, manifest.source.locate(manifest.index, fieldErr.Path)+": "+fieldErr.Error())
+		}
+	}
+
+	return problems
+}
+
+func TestValidateOffline(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Input    string
+		Problems []string
+	}{
+		{
+			"valid pods",
+			twoPods,
+			[]string{},
+		},
+		{
+			"valid pod updates",
+			onePodInvalidSpecUpdate,
+			[]string{},
+		},
+		{
+			"unknown field",
+			incorrectSpec,
+			[]string{`input.yaml:14: unknown field ".should"`},
+		},
+		{
+			"wrong types",
+			deploymentWrongReplicas,
+			[]string{
+				`input.yaml:8: invalid type ".spec.replicas": expected integer, got string`,
+				`input.yaml:21: invalid type ".spec.template.spec.containers[0].ports[0].containerPort": expected integer, got string`,
+			},
+		},
+		{
+			"custom resource",
+			widgetCRD,
+			[]string{
+				`input.yaml:35: missing required field ".spec.size"`,
+				`input.yaml:37: unknown field ".spec.shape"`,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		require.Equal(t, tt.Problems, validateOffline(t, tt.Input), "test: %s", tt.Name)
+	}
+}
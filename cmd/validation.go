@@ -0,0 +1,420 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// validationMode controls what happens when an object fails validation.
+type validationMode string
+
+const (
+	// validationStrict reports problems and refuses to apply anything.
+	validationStrict validationMode = "strict"
+	// validationWarn reports problems but applies anyway.
+	validationWarn validationMode = "warn"
+	// validationIgnore skips validation altogether.
+	validationIgnore validationMode = "ignore"
+)
+
+// parseValidationMode parses the value of the validate flag. true and false
+// are accepted for familiarity with kubectl.
+func parseValidationMode(value string) (validationMode, error) {
+	switch strings.ToLower(value) {
+	case "strict", "true":
+		return validationStrict, nil
+	case "warn":
+		return validationWarn, nil
+	case "ignore", "false":
+		return validationIgnore, nil
+	}
+
+	return "", fmt.Errorf("invalid value for validate: %q, expected one of strict, warn or ignore", value)
+}
+
+// validateObjects validates every object and prints any problems found
+// against the file and line that caused them. In strict mode an error is
+// returned if any object is invalid.
+func validateObjects(v *validator, objects []manifestObject, mode validationMode) error {
+	invalid := 0
+	for _, object := range objects {
+		errs, found, err := v.validate(object.obj, *object.gvk)
+		if errors.Is(err, errOpenAPIUnavailable) {
+			fmt.Fprintf(os.Stderr, "Warning: skipping validation, %s\n", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "Warning: no schema found for %s, skipping validation of %s\n", object.gvk, describeObject(object.obj))
+			continue
+		}
+
+		for _, fieldErr := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", object.source.locate(object.index, fieldErr.Path), describeObject(object.obj), fieldErr)
+		}
+		if len(errs) > 0 {
+			invalid++
+		}
+	}
+
+	if invalid > 0 && mode == validationStrict {
+		return fmt.Errorf("%d object(s) failed validation", invalid)
+	}
+
+	return nil
+}
+
+// describeObject names an object for messages, e.g. Pod sre-test/busybox.
+func describeObject(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%s %s", obj.GetKind(), obj.GetName())
+	}
+
+	return fmt.Sprintf("%s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
+
+// fieldPath identifies a field within an object. Each element is either a
+// map key (string) or a list index (int).
+type fieldPath []interface{}
+
+// child returns a copy of p with elem appended.
+func (p fieldPath) child(elem interface{}) fieldPath {
+	path := make(fieldPath, len(p), len(p)+1)
+	copy(path, p)
+	return append(path, elem)
+}
+
+// String renders the path the way kubectl explain does, e.g.
+// .spec.containers[0].image.
+func (p fieldPath) String() string {
+	if len(p) == 0 {
+		return "."
+	}
+
+	var b strings.Builder
+	for _, elem := range p {
+		switch e := elem.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", e)
+		default:
+			fmt.Fprintf(&b, ".%s", e)
+		}
+	}
+
+	return b.String()
+}
+
+// fieldErrorType categorises a validation failure.
+type fieldErrorType string
+
+const (
+	fieldErrorUnknownField     fieldErrorType = "unknown field"
+	fieldErrorInvalidType      fieldErrorType = "invalid type"
+	fieldErrorRequired         fieldErrorType = "missing required field"
+	fieldErrorUnsupportedValue fieldErrorType = "unsupported value"
+)
+
+// fieldError describes a single problem found while validating an object.
+type fieldError struct {
+	Type   fieldErrorType
+	Path   fieldPath
+	Detail string
+}
+
+// Error implements error.
+func (e fieldError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("%s %q", e.Type, e.Path)
+	}
+
+	return fmt.Sprintf("%s %q: %s", e.Type, e.Path, e.Detail)
+}
+
+// validator validates decoded objects against their OpenAPI schemas.
+type validator struct {
+	source schemaSource
+}
+
+// newValidator returns a validator that looks schemas up in source.
+func newValidator(source schemaSource) *validator {
+	return &validator{source: source}
+}
+
+// validate checks obj against the schema for gvk. It returns every problem
+// found, and reports false if no schema for the kind could be found.
+func (v *validator) validate(obj *unstructured.Unstructured, gvk schema.GroupVersionKind) ([]fieldError, bool, error) {
+	definition, schemas, err := v.source.schemaFor(gvk)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get schema for %s, got err: %w", gvk, err)
+	}
+	if definition == nil {
+		return nil, false, nil
+	}
+
+	w := &schemaWalker{schemas: schemas}
+	w.walk(definition, obj.Object, fieldPath{})
+
+	return w.errs, true, nil
+}
+
+// schemaWalker walks a value alongside its schema collecting errors.
+type schemaWalker struct {
+	schemas *openAPISchemas
+	errs    []fieldError
+}
+
+// walk validates value, found at path, against s.
+func (w *schemaWalker) walk(s *openAPISchema, value interface{}, path fieldPath) {
+	s = w.resolve(s)
+	if s == nil || value == nil {
+		// Kubernetes treats null as unset, which is always allowed.
+		return
+	}
+
+	// allOf is used by Kubernetes to attach a description or default to
+	// a $ref, the value must match all of them.
+	for _, sub := range s.AllOf {
+		w.walk(sub, value, path)
+	}
+
+	if s.IntOrString {
+		switch value.(type) {
+		case string, int64, float64:
+		default:
+			w.typeError(path, "integer or string", value)
+		}
+		return
+	}
+
+	if len(s.AnyOf) > 0 && !w.matchesAny(s.AnyOf, value, path) {
+		return
+	}
+	if len(s.OneOf) > 0 && !w.matchesAny(s.OneOf, value, path) {
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		w.walkObject(s, value, path)
+	case "array":
+		w.walkArray(s, value, path)
+	case "string":
+		if _, ok := value.(string); !ok {
+			w.typeError(path, "string", value)
+			return
+		}
+	case "integer":
+		if !isInteger(value) {
+			w.typeError(path, "integer", value)
+			return
+		}
+	case "number":
+		switch value.(type) {
+		case int64, float64:
+		default:
+			w.typeError(path, "number", value)
+			return
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			w.typeError(path, "boolean", value)
+			return
+		}
+	case "":
+		// Objects without a type but with properties are objects.
+		if len(s.Properties) > 0 || s.AdditionalProperties != nil {
+			w.walkObject(s, value, path)
+		}
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		w.errs = append(w.errs, fieldError{
+			Type:   fieldErrorUnsupportedValue,
+			Path:   path,
+			Detail: fmt.Sprintf("%v is not one of %s", value, formatEnum(s.Enum)),
+		})
+	}
+}
+
+// walkObject validates a map against an object schema.
+func (w *schemaWalker) walkObject(s *openAPISchema, value interface{}, path fieldPath) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		w.typeError(path, "object", value)
+		return
+	}
+
+	for _, name := range s.Required {
+		if _, ok := fields[name]; !ok {
+			w.errs = append(w.errs, fieldError{Type: fieldErrorRequired, Path: path.child(name)})
+		}
+	}
+
+	// Walk the fields in a stable order so errors are reported in the
+	// same order every time.
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fieldValue := fields[name]
+		if property, ok := s.Properties[name]; ok {
+			w.walk(property, fieldValue, path.child(name))
+			continue
+		}
+
+		switch {
+		case s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil:
+			w.walk(s.AdditionalProperties.Schema, fieldValue, path.child(name))
+		case s.AdditionalProperties != nil && s.AdditionalProperties.Allows:
+		case s.PreserveUnknownFields:
+		case s.EmbeddedResource && isEmbeddedResourceField(name):
+		case len(s.Properties) == 0 && s.AdditionalProperties == nil:
+			// A bare object schema accepts anything.
+		default:
+			w.errs = append(w.errs, fieldError{Type: fieldErrorUnknownField, Path: path.child(name)})
+		}
+	}
+}
+
+// walkArray validates a list against an array schema.
+func (w *schemaWalker) walkArray(s *openAPISchema, value interface{}, path fieldPath) {
+	items, ok := value.([]interface{})
+	if !ok {
+		w.typeError(path, "array", value)
+		return
+	}
+	if s.Items == nil {
+		return
+	}
+
+	for i, item := range items {
+		w.walk(s.Items, item, path.child(i))
+	}
+}
+
+// matchesAny reports whether value is valid against at least one of
+// schemas. If none match the errors from the first are kept.
+func (w *schemaWalker) matchesAny(schemas []*openAPISchema, value interface{}, path fieldPath) bool {
+	var first []fieldError
+	for i, s := range schemas {
+		sub := &schemaWalker{schemas: w.schemas}
+		sub.walk(s, value, path)
+		if len(sub.errs) == 0 {
+			return true
+		}
+		if i == 0 {
+			first = sub.errs
+		}
+	}
+
+	w.errs = append(w.errs, first...)
+	return false
+}
+
+// resolve follows $refs, including the allOf wrapping Kubernetes uses to
+// decorate a single $ref, until it reaches a concrete schema.
+func (w *schemaWalker) resolve(s *openAPISchema) *openAPISchema {
+	for depth := 0; s != nil && depth < 32; depth++ {
+		switch {
+		case s.Ref != "":
+			resolved, ok := w.schemas.resolve(s.Ref)
+			if !ok {
+				return nil
+			}
+			s = resolved
+		case len(s.AllOf) == 1 && s.Type == "" && len(s.Properties) == 0:
+			s = s.AllOf[0]
+		default:
+			return s
+		}
+	}
+
+	return s
+}
+
+// typeError records a value with the wrong type.
+func (w *schemaWalker) typeError(path fieldPath, expected string, value interface{}) {
+	w.errs = append(w.errs, fieldError{
+		Type:   fieldErrorInvalidType,
+		Path:   path,
+		Detail: fmt.Sprintf("expected %s, got %s", expected, jsonTypeOf(value)),
+	})
+}
+
+// isEmbeddedResourceField reports whether name is implicitly allowed on an
+// embedded resource.
+func isEmbeddedResourceField(name string) bool {
+	switch name {
+	case "apiVersion", "kind", "metadata":
+		return true
+	}
+
+	return false
+}
+
+// isInteger reports whether value is a whole number.
+func isInteger(value interface{}) bool {
+	switch v := value.(type) {
+	case int64:
+		return true
+	case float64:
+		return v == math.Trunc(v)
+	}
+
+	return false
+}
+
+// inEnum reports whether value is one of enum.
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if fmt.Sprint(allowed) == fmt.Sprint(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatEnum renders the allowed values of an enum.
+func formatEnum(enum []interface{}) string {
+	values := make([]string, 0, len(enum))
+	for _, v := range enum {
+		values = append(values, fmt.Sprintf("%q", fmt.Sprint(v)))
+	}
+
+	return "[" + strings.Join(values, ", ") + "]"
+}
+
+// jsonTypeOf names the JSON type of a decoded value.
+func jsonTypeOf(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "number"
+	case nil:
+		return "null"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	serializerYaml "k8s.io/apimachinery/pkg/runtime/serializer/yaml"
+)
+
+// podOpenAPIDocument is a cut down version of the api/v1 OpenAPI v3
+// document served by the API server.
+var podOpenAPIDocument = `
+components:
+  schemas:
+    io.k8s.api.core.v1.Pod:
+      type: object
+      properties:
+        apiVersion:
+          type: string
+        kind:
+          type: string
+        metadata:
+          allOf:
+          - $ref: '#/components/schemas/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta'
+          default: {}
+        spec:
+          allOf:
+          - $ref: '#/components/schemas/io.k8s.api.core.v1.PodSpec'
+      x-kubernetes-group-version-kind:
+      - group: ""
+        kind: Pod
+        version: v1
+    io.k8s.api.core.v1.PodSpec:
+      type: object
+      required:
+      - containers
+      properties:
+        containers:
+          type: array
+          items:
+            allOf:
+            - $ref: '#/components/schemas/io.k8s.api.core.v1.Container'
+        restartPolicy:
+          type: string
+          enum:
+          - Always
+          - OnFailure
+          - Never
+    io.k8s.api.core.v1.Container:
+      type: object
+      required:
+      - name
+      properties:
+        name:
+          type: string
+        image:
+          type: string
+        args:
+          type: array
+          items:
+            type: string
+        env:
+          type: array
+          items:
+            type: object
+            properties:
+              name:
+                type: string
+              value:
+                type: string
+    io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta:
+      type: object
+      properties:
+        name:
+          type: string
+        namespace:
+          type: string
+        labels:
+          type: object
+          additionalProperties:
+            type: string
+`
+
+var wrongTypes = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-types
+  namespace: sre-test
+  labels:
+    replicas: 3
+spec:
+  restartPolicy: Sometimes
+  containers:
+  - image: busybox
+    args: sleep
+`
+
+// validateInput decodes input and validates every object in it against
+// podOpenAPIDocument, returning the problems found as they'd be printed.
+func validateInput(t *testing.T, input string) []string {
+	doc, err := parseOpenAPIDocument([]byte(podOpenAPIDocument))
+	require.NoError(t, err, "failed to parse OpenAPI document")
+	schemas := newOpenAPISchemas()
+	schemas.addDocument(doc)
+	v := newValidator(&staticSchemaSource{schemas: schemas})
+
+	objects, err := decodeInput([]byte(input))
+	require.NoError(t, err, "failed to decode objects")
+	sources := newSourceMap("pod.yaml", []byte(input))
+
+	decodingSerializer := serializerYaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
+	problems := []string{}
+	for i, object := range objects {
+		obj := &unstructured.Unstructured{}
+		_, gvk, err := decodeRawObjects(decodingSerializer, object.Raw, obj)
+		require.NoError(t, err, "failed to decode raw objects")
+
+		errs, found, err := v.validate(obj, *gvk)
+		require.NoError(t, err, "failed to validate object")
+		require.True(t, found, "expected a schema for %s", gvk)
+
+		for _, fieldErr := range errs {
+			problems = append(problems, sources.locate(i, fieldErr.Path)+": "+fieldErr.Error())
+		}
+	}
+
+	return problems
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Input    string
+		Problems []string
+	}{
+		{
+			"valid pods",
+			twoPods,
+			[]string{},
+		},
+		{
+			"unknown field",
+			incorrectSpec,
+			[]string{`pod.yaml:14: unknown field ".should"`},
+		},
+		{
+			"schema valid but immutable update",
+			onePodInvalidSpecUpdate,
+			[]string{},
+		},
+		{
+			"wrong types and missing fields",
+			wrongTypes,
+			[]string{
+				`pod.yaml:8: invalid type ".metadata.labels.replicas": expected string, got integer`,
+				`pod.yaml:12: missing required field ".spec.containers[0].name"`,
+				`pod.yaml:13: invalid type ".spec.containers[0].args": expected array, got string`,
+				`pod.yaml:10: unsupported value ".spec.restartPolicy": Sometimes is not one of ["Always", "OnFailure", "Never"]`,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		require.Equal(t, tt.Problems, validateInput(t, tt.Input), "test: %s", tt.Name)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	sources := newSourceMap("pods.yaml", []byte(twoPods))
+	require.Len(t, sources.documents, 2)
+	require.Equal(t, "pods.yaml:5", sources.locate(0, fieldPath{"metadata", "name"}))
+	require.Equal(t, "pods.yaml:18", sources.locate(1, fieldPath{"metadata", "name"}))
+	require.Equal(t, "pods.yaml:23", sources.locate(1, fieldPath{"spec", "containers", 0, "image"}))
+
+	// Missing fields are reported against their closest parent.
+	require.Equal(t, "pods.yaml:22", sources.locate(1, fieldPath{"spec", "containers", 0, "ports"}))
+
+	json := `{"apiVersion": "v1", "kind": "Pod"}
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+    "name": "busybox"
+  }
+}`
+	sources = newSourceMap("pods.json", []byte(json))
+	require.Len(t, sources.documents, 2)
+	require.Equal(t, "pods.json:6", sources.locate(1, fieldPath{"metadata", "name"}))
+}
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultDebounce is how long input files must stop changing for before
+// they're re-applied in watch mode. Editors often write a file in several
+// steps.
+const defaultDebounce time.Duration = 200 * time.Millisecond
+
+// watchAndApply re-applies objects from files whenever their documents
+// change, until ctx is done. manifests are the objects already applied.
+// The objects in changed files are loaded with load and passed through
+// prepare, then applied one at a time with apply, and a line is written to
+// out for each.
+func watchAndApply(ctx context.Context, files []inputFile, manifests []manifestObject, debounce time.Duration, load func([]string) ([]manifestObject, error), prepare func([]manifestObject) error, apply func(manifestObject) error, out io.Writer) error {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.source)
+	}
+
+	applied, err := hashManifests(manifests)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%s watching %d file(s) for changes\n", time.Now().Format(watchTimeFormat), len(paths))
+	return watchFiles(ctx, paths, debounce, func(changed []string) {
+		reapplyChanged(changed, applied, load, prepare, apply, out)
+	})
+}
+
+// watchTimeFormat is the format of the timestamps that start each line of
+// output in watch mode.
+const watchTimeFormat string = "15:04:05"
+
+// reapplyChanged loads the objects in paths with load and applies those
+// that differ from what was last applied, as recorded in applied, which is
+// updated.
+func reapplyChanged(paths []string, applied map[string]string, load func([]string) ([]manifestObject, error), prepare func([]manifestObject) error, apply func(manifestObject) error, out io.Writer) {
+	now := func() string {
+		return time.Now().Format(watchTimeFormat)
+	}
+
+	manifests, err := load(paths)
+	if err != nil {
+		fmt.Fprintf(out, "%s %s\n", now(), err)
+		return
+	}
+
+	changed := []manifestObject{}
+	hashes := map[string]string{}
+	for _, manifest := range manifests {
+		key := refFor(manifest.obj).key()
+		hash, err := hashObject(manifest)
+		if err != nil {
+			fmt.Fprintf(out, "%s %s: %s\n", now(), describeObject(manifest.obj), err)
+			continue
+		}
+		if applied[key] != hash {
+			changed = append(changed, manifest)
+			hashes[key] = hash
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	if err := prepare(changed); err != nil {
+		fmt.Fprintf(out, "%s %s\n", now(), err)
+		return
+	}
+
+	for _, manifest := range changed {
+		if err := apply(manifest); err != nil {
+			fmt.Fprintf(out, "%s %s failed: %s\n", now(), describeObject(manifest.obj), err)
+			continue
+		}
+		fmt.Fprintf(out, "%s %s applied\n", now(), describeObject(manifest.obj))
+		key := refFor(manifest.obj).key()
+		applied[key] = hashes[key]
+	}
+}
+
+// hashManifests returns the hash of each object in manifests, keyed by its
+// identity.
+func hashManifests(manifests []manifestObject) (map[string]string, error) {
+	hashes := map[string]string{}
+	for _, manifest := range manifests {
+		hash, err := hashObject(manifest)
+		if err != nil {
+			return nil, err
+		}
+		hashes[refFor(manifest.obj).key()] = hash
+	}
+
+	return hashes, nil
+}
+
+// hashObject returns a hash of an object's contents. Formatting and
+// comments in the document don't affect it.
+func hashObject(manifest manifestObject) (string, error) {
+	data, err := json.Marshal(manifest.obj.Object)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash object, got err: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// watchFiles calls onChange with the paths that changed once no more
+// changes have been seen for debounce, until ctx is done. The directories
+// holding paths are watched rather than the files themselves, as many
+// editors save by replacing the file.
+func watchFiles(ctx context.Context, paths []string, debounce time.Duration, onChange func(changed []string)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch files, got err: %w", err)
+	}
+	defer watcher.Close()
+
+	// Map the paths events are reported for back to the paths we were
+	// passed, so that messages use the names the user gave.
+	watched := map[string]string{}
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("failed to watch %s, got err: %w", path, err)
+		}
+		watched[abs] = path
+
+		dir := filepath.Dir(abs)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s, got err: %w", dir, err)
+		}
+		dirs[dir] = true
+	}
+
+	pending := map[string]bool{}
+	timer := time.NewTimer(debounce)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	var fire <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			path, ok := watched[filepath.Clean(event.Name)]
+			if !ok || event.Op == fsnotify.Chmod {
+				continue
+			}
+			pending[path] = true
+
+			// Restart the debounce timer, draining it if it fired
+			// before we got round to reading it.
+			if !timer.Stop() && fire != nil {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(debounce)
+			fire = timer.C
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return fmt.Errorf("failed to watch files, got err: %w", err)
+
+		case <-fire:
+			fire = nil
+			changed := make([]string, 0, len(pending))
+			for path := range pending {
+				changed = append(changed, path)
+			}
+			sort.Strings(changed)
+			pending = map[string]bool{}
+
+			onChange(changed)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReapplyChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pods.yaml")
+	writeFiles(t, dir, map[string]string{"pods.yaml": twoPods})
+
+	manifests, err := decodeManifests([]inputFile{{source: path, contents: []byte(twoPods)}})
+	require.NoError(t, err, "failed to decode pods")
+	applied, err := hashManifests(manifests)
+	require.NoError(t, err, "failed to hash pods")
+
+	load := func(paths []string) ([]manifestObject, error) {
+		files, err := readPaths(paths)
+		if err != nil {
+			return nil, err
+		}
+		manifests, err := decodeManifests(files)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode objects, got err: %w", err)
+		}
+		return manifests, nil
+	}
+	prepare := func([]manifestObject) error { return nil }
+	names := []string{}
+	failing := ""
+	apply := func(m manifestObject) error {
+		names = append(names, m.obj.GetName())
+		if m.obj.GetName() == failing {
+			return errors.New("boom")
+		}
+		return nil
+	}
+
+	cases := []struct {
+		Name     string
+		Contents string
+		Failing  string
+		Applied  []string
+		Output   string
+	}{
+		{
+			Name:     "unchanged documents are skipped",
+			Contents: twoPods + "\n# a comment\n",
+			Applied:  []string{},
+		},
+		{
+			Name:     "only the changed document is applied",
+			Contents: strings.Replace(twoPods, "busybox-sleep-less", "busybox-sleep-more", 1),
+			Applied:  []string{"busybox-sleep-more"},
+			Output:   "Pod sre-test/busybox-sleep-more applied",
+		},
+		{
+			Name:     "failed objects are reported",
+			Contents: strings.Replace(twoPods, "busybox-sleep-less", "busybox-sleep-again", 1),
+			Failing:  "busybox-sleep-again",
+			Applied:  []string{"busybox-sleep-again"},
+			Output:   "Pod sre-test/busybox-sleep-again failed: boom",
+		},
+		{
+			Name:     "failed objects are applied again",
+			Contents: strings.Replace(twoPods, "busybox-sleep-less", "busybox-sleep-again", 1),
+			Applied:  []string{"busybox-sleep-again"},
+			Output:   "Pod sre-test/busybox-sleep-again applied",
+		},
+		{
+			Name:     "decode errors are reported",
+			Contents: "kind: [",
+			Applied:  []string{},
+			Output:   "failed to decode objects",
+		},
+	}
+
+	for _, tt := range cases {
+		writeFiles(t, dir, map[string]string{"pods.yaml": tt.Contents})
+		names = []string{}
+		failing = tt.Failing
+		out := &bytes.Buffer{}
+
+		reapplyChanged([]string{path}, applied, load, prepare, apply, out)
+		require.Equal(t, tt.Applied, names, "test: %s", tt.Name)
+		require.Contains(t, out.String(), tt.Output, "test: %s", tt.Name)
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pod.yaml")
+	writeFiles(t, dir, map[string]string{"pod.yaml": onePod, "other.yaml": onePod})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changes := make(chan []string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- watchFiles(ctx, []string{path}, 50*time.Millisecond, func(changed []string) {
+			select {
+			case changes <- changed:
+			default:
+			}
+		})
+	}()
+
+	// Keep writing until the watcher has started and seen a change. Files
+	// that aren't watched are ignored.
+	var changed []string
+	for changed == nil {
+		writeFiles(t, dir, map[string]string{"other.yaml": twoPods, "pod.yaml": twoPods})
+		select {
+		case changed = <-changes:
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for a change")
+		}
+	}
+	require.Equal(t, []string{path}, changed)
+
+	cancel()
+	require.NoError(t, <-done, "expected the watcher to stop cleanly")
+}
@@ -3,9 +3,17 @@ module github.com/avestuk/kubecuttle
 go 1.16
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/google/cel-go v0.12.6
 	github.com/spf13/cobra v1.2.1
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.8.1
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/term v0.0.0-20210220032956-6a3ed077a48d
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+	k8s.io/api v0.22.0
 	k8s.io/apimachinery v0.22.0
 	k8s.io/client-go v0.22.0
+	sigs.k8s.io/structured-merge-diff/v4 v4.1.2
+	sigs.k8s.io/yaml v1.2.0
 )
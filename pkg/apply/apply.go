@@ -0,0 +1,299 @@
+// Package apply server side applies Kubernetes objects. It's the apply
+// pipeline behind kubecuttle apply, usable from other Go programs:
+//
+//	applier, err := apply.NewForConfig(config, apply.Options{
+//		FieldManager: "deployer",
+//		Concurrency:  4,
+//		Printer:      apply.NewTextPrinter(os.Stdout),
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	report, err := applier.ApplyReader(ctx, manifests)
+package apply
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+const (
+	// DefaultFieldManager is the field manager objects are applied as
+	// when Options doesn't name one.
+	DefaultFieldManager = "kubecuttle"
+	// DefaultTimeout bounds each request when Options doesn't set a
+	// Retry func.
+	DefaultTimeout = 10 * time.Second
+)
+
+// Options configure an Applier. The zero value applies objects one at a
+// time as DefaultFieldManager, without printing anything.
+type Options struct {
+	// FieldManager is who the applied fields are owned by.
+	FieldManager string
+	// DryRun sends every request as a dry run, so the server validates
+	// and defaults objects without persisting them.
+	DryRun bool
+	// Force takes ownership of fields other managers own rather than
+	// failing with a conflict.
+	Force bool
+	// Concurrency is how many objects are applied at once. Anything
+	// below one applies them one at a time.
+	Concurrency int
+	// Printer is sent every event as it happens.
+	Printer Printer
+	// Retry calls fn until it succeeds or gives up, passing it the
+	// context each request should use. The default makes a single
+	// attempt bounded by DefaultTimeout.
+	Retry func(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// Applier server side applies objects.
+type Applier struct {
+	client  dynamic.Interface
+	mapper  meta.RESTMapper
+	options Options
+}
+
+// New returns an Applier that sends objects with client, finding their
+// resources with mapper.
+func New(client dynamic.Interface, mapper meta.RESTMapper, options Options) *Applier {
+	if options.FieldManager == "" {
+		options.FieldManager = DefaultFieldManager
+	}
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+	if options.Retry == nil {
+		options.Retry = once
+	}
+
+	return &Applier{client: client, mapper: mapper, options: options}
+}
+
+// NewForConfig returns an Applier for the cluster config points at.
+func NewForConfig(config *rest.Config, options Options) (*Applier, error) {
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dynamic client, got err: %w", err)
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build discovery client, got err: %w", err)
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
+	return New(client, mapper, options), nil
+}
+
+// once calls fn a single time, bounded by DefaultTimeout.
+func once(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+
+	return fn(ctx)
+}
+
+// Result is the outcome of applying one object.
+type Result struct {
+	// Object is the object that was sent.
+	Object *unstructured.Unstructured
+	// Applied is the object the server returned, nil if applying failed.
+	Applied *unstructured.Unstructured
+	// Err is why the object couldn't be applied.
+	Err error
+}
+
+// Report is the outcome of applying a set of objects.
+type Report struct {
+	// Results has one entry per object, in the order they were passed.
+	Results []Result
+	// Events is every event sent while applying, in the order they
+	// happened.
+	Events []Event
+}
+
+// Failed returns the results of objects that couldn't be applied.
+func (r *Report) Failed() []Result {
+	failed := []Result{}
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+
+	return failed
+}
+
+// MappingError is returned when an object's kind isn't served by the
+// cluster.
+type MappingError struct {
+	Object *unstructured.Unstructured
+	Err    error
+}
+
+func (e *MappingError) Error() string {
+	return fmt.Sprintf("failed to get gvr for %s, got err: %s", Describe(e.Object), e.Err)
+}
+
+func (e *MappingError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyReader decodes the YAML or JSON objects in r and applies them.
+func (a *Applier) ApplyReader(ctx context.Context, r io.Reader) (*Report, error) {
+	objects, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.Apply(ctx, objects)
+}
+
+// Apply applies objects, returning the outcome of each. Consecutive objects
+// of the same kind are applied concurrently, up to the Applier's
+// concurrency, but each kind waits for the one before it to finish so that
+// objects can depend on those earlier in the list, such as a Namespace
+// before what's in it. An error is returned if any object fails; the rest
+// are still applied.
+func (a *Applier) Apply(ctx context.Context, objects []*unstructured.Unstructured) (*Report, error) {
+	report := &Report{Results: make([]Result, len(objects))}
+	var mu sync.Mutex
+	emit := func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.Events = append(report.Events, event)
+		if a.options.Printer != nil {
+			a.options.Printer.PrintEvent(event)
+		}
+	}
+
+	for start := 0; start < len(objects); {
+		end := start + 1
+		for end < len(objects) && objects[end].GroupVersionKind().GroupKind() == objects[start].GroupVersionKind().GroupKind() {
+			end++
+		}
+
+		a.applyWave(ctx, objects, start, end, report.Results, emit)
+		start = end
+	}
+
+	if failed := report.Failed(); len(failed) > 0 {
+		return report, fmt.Errorf("failed to apply %d of %d object(s)", len(failed), len(objects))
+	}
+
+	return report, nil
+}
+
+// applyWave applies objects[start:end] concurrently, storing their
+// results in results.
+func (a *Applier) applyWave(ctx context.Context, objects []*unstructured.Unstructured, start, end int, results []Result, emit func(Event)) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, a.options.Concurrency)
+	for i := start; i < end; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			obj := objects[i]
+			emit(newEvent(EventApplying, obj, nil))
+			applied, err := a.ApplyObject(ctx, obj)
+			if err != nil {
+				emit(newEvent(EventFailed, obj, err))
+			} else {
+				emit(newEvent(EventApplied, applied, nil))
+			}
+			results[i] = Result{Object: obj, Applied: applied, Err: err}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// ApplyObject server side applies a single object, returning what the
+// server made of it. No events are sent.
+func (a *Applier) ApplyObject(ctx context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Find the resource mapping for the GVK of the object. A resource
+	// type is uniquely identified by a Group, Version, Resource tuple
+	// where a kind is identified by a Group, Version, Kind tuple.
+	gvk := obj.GroupVersionKind()
+	mapping, err := a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		// The kind may have been added since the mapper last
+		// looked, by a CRD applied earlier for instance.
+		if resettable, ok := a.mapper.(interface{ Reset() }); ok {
+			resettable.Reset()
+			mapping, err = a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		}
+	}
+	if err != nil {
+		return nil, &MappingError{Object: obj, Err: err}
+	}
+
+	// As some objects are not namespaced (e.g. PVs) a namespace may not
+	// be required.
+	var dr dynamic.ResourceInterface = a.client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		dr = a.client.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+	}
+
+	// The API server works on JSON. All JSON is valid YAML but not
+	// all YAML is valid JSON.
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal json to runtime obj, got err: %w", err)
+	}
+
+	options := metav1.PatchOptions{FieldManager: a.options.FieldManager}
+	if a.options.DryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+	if a.options.Force {
+		force := true
+		options.Force = &force
+	}
+
+	var applied *unstructured.Unstructured
+	err = a.options.Retry(ctx, func(ctx context.Context) error {
+		var err error
+		applied, err = dr.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, options)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply obj, got err: %w", err)
+	}
+
+	return applied, nil
+}
+
+// Describe returns the kind, namespace and name of obj, e.g.
+// "Pod sre-test/busybox".
+func Describe(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%s %s", obj.GetKind(), obj.GetName())
+	}
+
+	return fmt.Sprintf("%s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
@@ -0,0 +1,224 @@
+package apply
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+var namespaceAndPods = `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: sre-test
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-sleep
+  namespace: sre-test
+spec:
+  containers:
+  - name: busybox
+    image: busybox
+---
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: invalid
+  namespace: sre-test
+spec:
+  containers:
+  - name: busybox
+    image: busybox
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: busybox-sleep-less
+  namespace: sre-test
+spec:
+  containers:
+  - name: busybox
+    image: busybox
+`
+
+// patchRequest is a request received by fakeAPIServer.
+type patchRequest struct {
+	path  string
+	query map[string][]string
+}
+
+// fakeAPIServer answers apply patches by echoing the object sent back,
+// rejecting objects named invalid. It records each request and how many
+// were in flight at once.
+type fakeAPIServer struct {
+	mu          sync.Mutex
+	requests    []patchRequest
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, patchRequest{path: r.URL.Path, query: r.URL.Query()})
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+
+	// Give concurrent requests a chance to overlap.
+	time.Sleep(10 * time.Millisecond)
+
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	if strings.HasSuffix(r.URL.Path, "/invalid") {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonInvalid,
+			Message:  "Pod \"invalid\" is invalid",
+			Code:     http.StatusUnprocessableEntity,
+		})
+		return
+	}
+	w.Write(body)
+}
+
+// newTestApplier returns an Applier that sends objects to server.
+func newTestApplier(t *testing.T, server *fakeAPIServer, options Options) *Applier {
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+
+	client, err := dynamic.NewForConfig(&rest.Config{Host: srv.URL})
+	require.NoError(t, err, "failed to build dynamic client")
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, meta.RESTScopeNamespace)
+
+	return New(client, mapper, options)
+}
+
+func TestDecode(t *testing.T) {
+	objects, err := Decode(strings.NewReader(namespaceAndPods))
+	require.NoError(t, err, "failed to decode objects")
+	require.Len(t, objects, 4, "expected the empty document to be skipped")
+	require.Equal(t, "Namespace sre-test", Describe(objects[0]))
+	require.Equal(t, "Pod sre-test/busybox-sleep-less", Describe(objects[3]))
+
+	_, err = Decode(strings.NewReader("apiVersion: v1\nmetadata:\n  name: no-kind\n"))
+	require.Error(t, err, "expected objects without a kind to fail")
+}
+
+func TestApply(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Options     Options
+		Query       map[string][]string
+		MaxInFlight int
+	}{
+		{
+			Name:        "defaults",
+			Query:       map[string][]string{"fieldManager": {"kubecuttle"}},
+			MaxInFlight: 1,
+		},
+		{
+			Name:        "dry run",
+			Options:     Options{FieldManager: "deployer", DryRun: true},
+			Query:       map[string][]string{"fieldManager": {"deployer"}, "dryRun": {"All"}},
+			MaxInFlight: 1,
+		},
+		{
+			Name:        "force and concurrency",
+			Options:     Options{Force: true, Concurrency: 3},
+			Query:       map[string][]string{"fieldManager": {"kubecuttle"}, "force": {"true"}},
+			MaxInFlight: 3,
+		},
+	}
+
+	for _, tt := range cases {
+		server := &fakeAPIServer{}
+		out := &bytes.Buffer{}
+		tt.Options.Printer = NewTextPrinter(out)
+		applier := newTestApplier(t, server, tt.Options)
+
+		report, err := applier.ApplyReader(context.Background(), strings.NewReader(namespaceAndPods))
+		require.EqualError(t, err, "failed to apply 1 of 4 object(s)", "test: %s", tt.Name)
+
+		// Results are in the order objects were passed.
+		require.Len(t, report.Results, 4, "test: %s", tt.Name)
+		for i, name := range []string{"sre-test", "busybox-sleep", "invalid", "busybox-sleep-less"} {
+			result := report.Results[i]
+			require.Equal(t, name, result.Object.GetName(), "test: %s", tt.Name)
+			if name == "invalid" {
+				require.Error(t, result.Err, "test: %s", tt.Name)
+				require.Contains(t, result.Err.Error(), `Pod "invalid" is invalid`, "test: %s", tt.Name)
+				require.Nil(t, result.Applied, "test: %s", tt.Name)
+				continue
+			}
+			require.NoError(t, result.Err, "test: %s", tt.Name)
+			require.Equal(t, name, result.Applied.GetName(), "test: %s", tt.Name)
+		}
+		require.Len(t, report.Failed(), 1, "test: %s", tt.Name)
+
+		// The Namespace is applied before any of the Pods in it.
+		require.Equal(t, "/api/v1/namespaces/sre-test", server.requests[0].path, "test: %s", tt.Name)
+		for _, request := range server.requests {
+			require.Equal(t, tt.Query, request.query, "test: %s", tt.Name)
+		}
+		require.Equal(t, tt.MaxInFlight, server.maxInFlight, "test: %s", tt.Name)
+
+		// Every object is reported as applying, then applied or failed.
+		require.Len(t, report.Events, 8, "test: %s", tt.Name)
+		require.Equal(t, EventApplying, report.Events[0].Type, "test: %s", tt.Name)
+		require.Equal(t, EventApplied, report.Events[1].Type, "test: %s", tt.Name)
+		require.Contains(t, out.String(), "Namespace sre-test applied\n", "test: %s", tt.Name)
+		require.Contains(t, out.String(), "Pod sre-test/busybox-sleep applied\n", "test: %s", tt.Name)
+		require.Contains(t, out.String(), "Pod sre-test/invalid failed: failed to apply obj", "test: %s", tt.Name)
+	}
+}
+
+func TestApplyObject(t *testing.T) {
+	applier := newTestApplier(t, &fakeAPIServer{}, Options{})
+
+	objects, err := Decode(strings.NewReader(`
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: unknown
+`))
+	require.NoError(t, err, "failed to decode widget")
+
+	_, err = applier.ApplyObject(context.Background(), objects[0])
+	mappingErr := &MappingError{}
+	require.ErrorAs(t, err, &mappingErr, "expected a MappingError for an unknown kind")
+	require.Contains(t, err.Error(), "failed to get gvr for Widget unknown", "expected the object in the error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = applier.ApplyObject(ctx, objects[0])
+	require.ErrorIs(t, err, context.Canceled, "expected cancelled contexts to stop applying")
+}
@@ -0,0 +1,36 @@
+package apply
+
+import (
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Decode reads the YAML or JSON objects in r. YAML documents are separated
+// by ---, empty documents are skipped.
+func Decode(r io.Reader) ([]*unstructured.Unstructured, error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	objects := []*unstructured.Unstructured{}
+
+	for i := 0; ; i++ {
+		raw := runtime.RawExtension{}
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return objects, nil
+			}
+			return nil, fmt.Errorf("failed to decode object %d, got err: %w", i, err)
+		}
+		if len(raw.Raw) == 0 || string(raw.Raw) == "null" {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		if _, _, err := unstructured.UnstructuredJSONScheme.Decode(raw.Raw, nil, obj); err != nil {
+			return nil, fmt.Errorf("failed to decode object %d, got err: %w", i, err)
+		}
+		objects = append(objects, obj)
+	}
+}
@@ -0,0 +1,70 @@
+package apply
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// EventType is what happened to an object.
+type EventType string
+
+const (
+	// EventApplying is sent before an object is sent to the server.
+	EventApplying EventType = "Applying"
+	// EventApplied is sent once the server accepts an object.
+	EventApplied EventType = "Applied"
+	// EventFailed is sent when an object can't be applied.
+	EventFailed EventType = "Failed"
+)
+
+// Event reports progress applying an object.
+type Event struct {
+	Type EventType
+	// Object is the object sent, or what the server returned once
+	// applied.
+	Object *unstructured.Unstructured
+	// Err is why the object failed to apply.
+	Err  error
+	Time time.Time
+}
+
+func newEvent(eventType EventType, obj *unstructured.Unstructured, err error) Event {
+	return Event{Type: eventType, Object: obj, Err: err, Time: time.Now()}
+}
+
+// Printer is sent events as objects are applied. Events are sent one at a
+// time, even when objects are applied concurrently.
+type Printer interface {
+	PrintEvent(event Event)
+}
+
+// PrinterFunc lets a func be used as a Printer.
+type PrinterFunc func(event Event)
+
+// PrintEvent calls f(event).
+func (f PrinterFunc) PrintEvent(event Event) {
+	f(event)
+}
+
+// textPrinter writes a line for each object applied or failed.
+type textPrinter struct {
+	out io.Writer
+}
+
+// NewTextPrinter returns a Printer that writes a line to out as each object
+// is applied or fails, e.g. "Pod sre-test/busybox applied".
+func NewTextPrinter(out io.Writer) Printer {
+	return &textPrinter{out: out}
+}
+
+func (p *textPrinter) PrintEvent(event Event) {
+	switch event.Type {
+	case EventApplied:
+		fmt.Fprintf(p.out, "%s applied\n", Describe(event.Object))
+	case EventFailed:
+		fmt.Fprintf(p.out, "%s failed: %s\n", Describe(event.Object), event.Err)
+	}
+}